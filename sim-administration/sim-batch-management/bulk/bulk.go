@@ -0,0 +1,441 @@
+// Package bulk runs an operation over a list of SIM profiles with
+// bounded concurrency, collecting the outcome for each profile
+// instead of giving up on the first failure.
+package bulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/metrics"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultConcurrency is the number of items processed in parallel
+// unless told otherwise.  If we get too many we run out of file
+// descriptors, and we don't seem to get much speedup after hundred
+// or so.
+const DefaultConcurrency = 160
+
+// DefaultProgressInterval is the time between progress reports
+// unless told otherwise.
+const DefaultProgressInterval = 10 * time.Second
+
+// Exit codes reflecting the outcome of a bulk operation.
+const (
+	ExitOK             = 0
+	ExitFailure        = 1
+	ExitPartialFailure = 2
+	ExitInterrupted    = 130
+)
+
+var (
+	itemsTotal = metrics.NewCounter("sbm_bulk_items_total",
+		"Items handled by bulk operations, by operation and outcome.",
+		"operation", "outcome")
+
+	itemDuration = metrics.NewHistogram("sbm_bulk_item_duration_seconds",
+		"Time taken to process single items in bulk operations.",
+		nil, "operation")
+)
+
+// Outcome is the outcome of processing a single item.
+type Outcome int
+
+// The possible outcomes.  Items are not attempted if the operation is
+// interrupted before they are dispatched.
+const (
+	Succeeded Outcome = iota
+	Failed
+	Skipped
+	NotAttempted
+)
+
+func (outcome Outcome) String() string {
+	switch outcome {
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	case Skipped:
+		return "skipped"
+	case NotAttempted:
+		return "not attempted"
+	}
+	return fmt.Sprintf("outcome(%d)", int(outcome))
+}
+
+// label returns the outcome as used in metrics.
+func (outcome Outcome) label() string {
+	return strings.Replace(outcome.String(), " ", "_", -1)
+}
+
+// ErrSkip is returned by a task to mark an item as skipped, e.g.
+// because there is nothing to do for it.  Wrap it to give a reason.
+var ErrSkip = errors.New("skipped")
+
+// Skip returns an error marking an item as skipped for the given reason.
+func Skip(reason string) error {
+	return &skipError{reason: reason}
+}
+
+type skipError struct {
+	reason string
+}
+
+func (err *skipError) Error() string {
+	return fmt.Sprintf("skipped: %s", err.reason)
+}
+
+func isSkip(err error) bool {
+	if err == ErrSkip {
+		return true
+	}
+	_, ok := err.(*skipError)
+	return ok
+}
+
+// Task processes the item with the given index, returning a line of
+// output (without a trailing newline), or "" for none.  Tasks are run
+// concurrently, and must synchronize access to shared state themselves.
+type Task func(index int) (string, error)
+
+// Options tweak how a bulk operation is run.  The zero value is
+// usable.
+type Options struct {
+	// Name of the operation, used in metrics.
+	Name string
+
+	// Max number of tasks running at the same time.  Zero means
+	// DefaultConcurrency.
+	Concurrency int
+
+	// Where the output lines are written, in the order of the items,
+	// whatever order the tasks finish in.  Nil means nowhere.
+	Output io.Writer
+
+	// Where progress reports, and the errors of failed items, are
+	// logged.  Errors are logged with the item as the ICCID.  Nil
+	// means nowhere.
+	Progress *logging.Logger
+
+	// Time between progress reports.  Zero means
+	// DefaultProgressInterval.
+	ProgressInterval time.Duration
+
+	// Called with the result of every item as soon as it has been
+	// processed, e.g. to persist it.  Calls are serialized.  Nil
+	// means nothing is called.
+	OnResult func(result Result)
+
+	// Called before each item is processed, blocking for as long as
+	// processing should be paused, e.g. while the system the items
+	// are sent to is down.  An error means the item is not attempted.
+	// Nil means never pause.
+	Pause func(ctx context.Context) error
+
+	// Called when an item fails.  If it returns true, the item is
+	// processed again, after pausing, rather than failed.  Only use it
+	// for errors that guarantee nothing was done, e.g. requests that
+	// were refused without being sent.  Nil means never requeue.
+	Requeue func(err error) bool
+}
+
+// Result is the outcome of processing a single item.
+type Result struct {
+	Index   int
+	Item    string
+	Outcome Outcome
+	Output  string
+	Err     error
+}
+
+// Summary is the outcome of a bulk operation.
+type Summary struct {
+	Results      []Result
+	Succeeded    int
+	Failed       int
+	Skipped      int
+	NotAttempted int
+	Elapsed      time.Duration
+}
+
+// String returns a one line summary.
+func (summary *Summary) String() string {
+	return fmt.Sprintf("%d items: %d succeeded, %d failed, %d skipped, %d not attempted, in %v",
+		len(summary.Results), summary.Succeeded, summary.Failed, summary.Skipped, summary.NotAttempted,
+		summary.Elapsed.Round(time.Millisecond))
+}
+
+// Items returns the names of the items with the given outcomes, in
+// the order they were given.
+func (summary *Summary) Items(outcomes ...Outcome) []string {
+	var items []string
+	for _, result := range summary.Results {
+		for _, outcome := range outcomes {
+			if result.Outcome == outcome {
+				items = append(items, result.Item)
+				break
+			}
+		}
+	}
+	return items
+}
+
+// ExitCode returns the exit code reflecting the outcome: ExitOK if
+// nothing failed, ExitInterrupted if something wasn't attempted,
+// ExitFailure if nothing succeeded, ExitPartialFailure otherwise.
+func (summary *Summary) ExitCode() int {
+	switch {
+	case summary.NotAttempted > 0:
+		return ExitInterrupted
+	case summary.Failed == 0:
+		return ExitOK
+	case summary.Succeeded == 0:
+		return ExitFailure
+	default:
+		return ExitPartialFailure
+	}
+}
+
+// Err returns nil if the operation was a success, otherwise an
+// *Error carrying the summary.
+func (summary *Summary) Err() error {
+	if summary.ExitCode() == ExitOK {
+		return nil
+	}
+	return &Error{Summary: summary}
+}
+
+// Error is returned when a bulk operation was interrupted, or some
+// of its items failed.
+type Error struct {
+	Summary *Summary
+}
+
+func (err *Error) Error() string {
+	if err.Summary.NotAttempted > 0 {
+		return fmt.Sprintf("interrupted: %s", err.Summary)
+	}
+	return fmt.Sprintf("%d of %d items failed: %s", err.Summary.Failed, len(err.Summary.Results), err.Summary)
+}
+
+// ExitCode returns the exit code reflecting the outcome.
+func (err *Error) ExitCode() int {
+	return err.Summary.ExitCode()
+}
+
+// Run runs the task for every one of the named items, at most
+// options.Concurrency at a time.  When the context is cancelled, no
+// more tasks are started, but the ones running are allowed to finish.
+// A task that panics fails its item rather than the program.
+func Run(ctx context.Context, items []string, task Task, options Options) *Summary {
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	interval := options.ProgressInterval
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+
+	started := time.Now()
+	results := make([]Result, len(items))
+	for i, item := range items {
+		results[i] = Result{Index: i, Item: item, Outcome: NotAttempted}
+	}
+
+	var mutex sync.Mutex
+	done := make([]bool, len(items))
+	nextToWrite := 0
+	finished := 0
+	counts := make(map[Outcome]int)
+
+	// finish records the outcome of an item, and writes all output
+	// that no longer has to wait for earlier items.
+	finish := func(result Result) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		results[result.Index] = result
+		done[result.Index] = true
+		counts[result.Outcome]++
+		if result.Outcome != NotAttempted {
+			finished++
+			itemsTotal.Inc(options.Name, result.Outcome.label())
+		}
+		if result.Outcome == Failed && options.Progress != nil {
+			options.Progress.With(logging.FieldIccid, result.Item, logging.FieldError, result.Err).Errorf("Item failed")
+		}
+		if options.OnResult != nil && result.Outcome != NotAttempted {
+			options.OnResult(result)
+		}
+		for nextToWrite < len(items) && done[nextToWrite] {
+			if output := results[nextToWrite].Output; output != "" && options.Output != nil {
+				fmt.Fprintln(options.Output, output)
+			}
+			nextToWrite++
+		}
+	}
+
+	stopProgress := make(chan struct{})
+	progressStopped := make(chan struct{})
+	go func() {
+		defer close(progressStopped)
+		if options.Progress == nil {
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mutex.Lock()
+				report := progress(finished, len(items), counts[Failed], time.Since(started))
+				mutex.Unlock()
+				options.Progress.Infof("%s", report)
+			case <-stopProgress:
+				return
+			}
+		}
+	}()
+
+	sem := make(chan struct{}, concurrency)
+	var waitgroup sync.WaitGroup
+	notAttempted := 0
+	for i := range items {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			notAttempted = len(items) - i
+			break
+		}
+
+		waitgroup.Add(1)
+		go func(i int) {
+			defer waitgroup.Done()
+			defer func() { <-sem }()
+			finish(process(ctx, task, i, items[i], options))
+		}(i)
+	}
+	waitgroup.Wait()
+	close(stopProgress)
+	<-progressStopped
+
+	// Items never dispatched don't hold up the output of the ones that
+	// were, so flush what is left.
+	mutex.Lock()
+	for ; nextToWrite < len(items); nextToWrite++ {
+		if output := results[nextToWrite].Output; done[nextToWrite] && output != "" && options.Output != nil {
+			fmt.Fprintln(options.Output, output)
+		}
+	}
+	mutex.Unlock()
+
+	notAttempted += counts[NotAttempted]
+	if notAttempted > 0 {
+		itemsTotal.Add(float64(notAttempted), options.Name, NotAttempted.label())
+	}
+
+	summary := &Summary{
+		Results:      results,
+		Succeeded:    counts[Succeeded],
+		Failed:       counts[Failed],
+		Skipped:      counts[Skipped],
+		NotAttempted: notAttempted,
+		Elapsed:      time.Since(started),
+	}
+	if options.Progress != nil {
+		options.Progress.Infof("%s", summary)
+	}
+	return summary
+}
+
+// process runs the task for an item, pausing first if told to, and
+// again whenever it fails in a way that means it should be requeued.
+func process(ctx context.Context, task Task, index int, item string, options Options) Result {
+	for {
+		if options.Pause != nil {
+			if err := options.Pause(ctx); err != nil {
+				return Result{Index: index, Item: item, Outcome: NotAttempted, Err: err}
+			}
+		}
+		started := time.Now()
+		result := runTask(task, index, item)
+		itemDuration.ObserveDuration(started, options.Name)
+		if result.Outcome != Failed || options.Requeue == nil || !options.Requeue(result.Err) {
+			return result
+		}
+		if ctx.Err() != nil {
+			return Result{Index: index, Item: item, Outcome: NotAttempted, Err: result.Err}
+		}
+	}
+}
+
+// runTask runs a task, turning errors and panics into outcomes.
+func runTask(task Task, index int, item string) (result Result) {
+	result = Result{Index: index, Item: item}
+	defer func() {
+		if r := recover(); r != nil {
+			result.Outcome = Failed
+			result.Output = ""
+			result.Err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	output, err := task(index)
+	result.Output = output
+	result.Err = err
+	switch {
+	case err == nil:
+		result.Outcome = Succeeded
+	case isSkip(err):
+		result.Outcome = Skipped
+	default:
+		result.Outcome = Failed
+	}
+	return result
+}
+
+// progress returns a progress report with an estimate of the
+// remaining time.
+func progress(finished int, total int, failed int, elapsed time.Duration) string {
+	report := fmt.Sprintf("Progress: %d of %d items done (%d%%), %d failed", finished, total, percent(finished, total), failed)
+	if finished > 0 && finished < total {
+		eta := time.Duration(float64(elapsed) / float64(finished) * float64(total-finished))
+		report += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+	}
+	return report
+}
+
+func percent(part int, total int) int {
+	if total == 0 {
+		return 100
+	}
+	return part * 100 / total
+}
+
+// RunIccids runs the function for every ICCID in the list, as Run does.
+func RunIccids(ctx context.Context, iccids []string, fn func(iccid string) (string, error), options Options) *Summary {
+	return Run(ctx, iccids, func(i int) (string, error) {
+		return fn(iccids[i])
+	}, options)
+}
+
+// RunSimEntries runs the function for every SIM entry in the list,
+// as Run does.  Items are named by ICCID.
+func RunSimEntries(ctx context.Context, entries []model.SimEntry, fn func(entry model.SimEntry) (string, error), options Options) *Summary {
+	iccids := make([]string, len(entries))
+	for i, entry := range entries {
+		iccids[i] = entry.Iccid
+	}
+	return Run(ctx, iccids, func(i int) (string, error) {
+		return fn(entries[i])
+	}, options)
+}
@@ -0,0 +1,202 @@
+package bulk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
+	"gotest.tools/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func items(n int) []string {
+	result := make([]string, n)
+	for i := range result {
+		result[i] = fmt.Sprintf("item-%03d", i)
+	}
+	return result
+}
+
+func TestOutputIsInItemOrder(t *testing.T) {
+	names := items(50)
+	output := new(bytes.Buffer)
+
+	// Later items finish first.
+	summary := Run(context.Background(), names, func(i int) (string, error) {
+		time.Sleep(time.Duration(50-i) * 100 * time.Microsecond)
+		return names[i], nil
+	}, Options{Concurrency: 10, Output: output})
+
+	assert.Equal(t, strings.Join(names, "\n")+"\n", output.String())
+	assert.Equal(t, 50, summary.Succeeded)
+	assert.Equal(t, ExitOK, summary.ExitCode())
+	assert.NilError(t, summary.Err())
+}
+
+func TestConcurrencyIsBounded(t *testing.T) {
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	Run(context.Background(), items(40), func(i int) (string, error) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		time.Sleep(2 * time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return "", nil
+	}, Options{Concurrency: 4})
+	assert.Equal(t, 4, maxRunning)
+}
+
+func TestFailuresAreCollectedPerItem(t *testing.T) {
+	names := items(10)
+	progress := new(bytes.Buffer)
+	summary := Run(context.Background(), names, func(i int) (string, error) {
+		switch {
+		case i == 3:
+			return "", fmt.Errorf("no such profile")
+		case i == 5:
+			panic("oops")
+		case i%2 == 0:
+			return "", Skip("already activated")
+		}
+		return names[i], nil
+	}, Options{Progress: logging.New(progress, logging.LevelInfo, logging.FormatLogfmt)})
+
+	assert.Equal(t, 3, summary.Succeeded)
+	assert.Equal(t, 2, summary.Failed)
+	assert.Equal(t, 5, summary.Skipped)
+	assert.DeepEqual(t, []string{"item-003", "item-005"}, summary.Items(Failed))
+	assert.Equal(t, ExitPartialFailure, summary.ExitCode())
+	assert.Assert(t, strings.Contains(progress.String(), `level=error msg="Item failed" iccid=item-003 error="no such profile"`))
+	assert.Assert(t, strings.Contains(progress.String(), `level=error msg="Item failed" iccid=item-005 error="panic: oops"`))
+
+	err, ok := summary.Err().(*Error)
+	assert.Assert(t, ok)
+	assert.Equal(t, ExitPartialFailure, err.ExitCode())
+
+	allFailed := Run(context.Background(), names, func(i int) (string, error) {
+		return "", fmt.Errorf("down")
+	}, Options{})
+	assert.Equal(t, ExitFailure, allFailed.ExitCode())
+}
+
+func TestNothingIsStartedAfterCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	names := items(100)
+	output := new(bytes.Buffer)
+	summary := Run(ctx, names, func(i int) (string, error) {
+		if i == 9 {
+			cancel()
+		}
+		return names[i], nil
+	}, Options{Concurrency: 1, Output: output})
+
+	assert.Equal(t, 10, summary.Succeeded)
+	assert.Equal(t, 90, summary.NotAttempted)
+	assert.Equal(t, ExitInterrupted, summary.ExitCode())
+	assert.Equal(t, "item-010", summary.Items(NotAttempted)[0])
+	assert.Equal(t, 10, strings.Count(output.String(), "\n"))
+}
+
+func TestProgressReportsEstimateRemainingTime(t *testing.T) {
+	assert.Equal(t, "Progress: 25 of 100 items done (25%), 1 failed, ETA 30s", progress(25, 100, 1, 10*time.Second))
+	assert.Equal(t, "Progress: 100 of 100 items done (100%), 0 failed", progress(100, 100, 0, 10*time.Second))
+}
+
+func TestEveryResultIsReportedAsItCompletes(t *testing.T) {
+	names := items(20)
+	skippedBefore := itemsTotal.Value("reporting-test", "skipped")
+	succeededBefore := itemsTotal.Value("reporting-test", "succeeded")
+	reported := make(map[string]Outcome)
+	summary := Run(context.Background(), names, func(i int) (string, error) {
+		if i%5 == 0 {
+			return "", Skip("nothing to do")
+		}
+		return "", nil
+	}, Options{Name: "reporting-test", Concurrency: 4, OnResult: func(result Result) {
+		// Calls are serialized, so no locking is needed.
+		reported[result.Item] = result.Outcome
+	}})
+
+	assert.Equal(t, 20, len(reported))
+	assert.Equal(t, Skipped, reported["item-005"])
+	assert.Equal(t, Succeeded, reported["item-006"])
+	assert.Equal(t, 4, summary.Skipped)
+	assert.Equal(t, 4.0, itemsTotal.Value("reporting-test", "skipped")-skippedBefore)
+	assert.Equal(t, 16.0, itemsTotal.Value("reporting-test", "succeeded")-succeededBefore)
+}
+
+func TestItemsAreRequeuedWhilePaused(t *testing.T) {
+	errRefused := fmt.Errorf("refused, not sent")
+	var mutex sync.Mutex
+	down := true
+	resumed := make(chan struct{})
+	attempts := make(map[int]int)
+
+	summary := Run(context.Background(), items(10), func(i int) (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts[i]++
+		if down {
+			return "", errRefused
+		}
+		return "", nil
+	}, Options{
+		Concurrency: 3,
+		Pause: func(ctx context.Context) error {
+			mutex.Lock()
+			paused := down && len(attempts) > 0
+			mutex.Unlock()
+			if paused {
+				<-resumed
+			}
+			return ctx.Err()
+		},
+		Requeue: func(err error) bool {
+			if err != errRefused {
+				return false
+			}
+			// The system comes back after the first refusal.
+			mutex.Lock()
+			defer mutex.Unlock()
+			if down {
+				down = false
+				close(resumed)
+			}
+			return true
+		},
+	})
+
+	assert.Equal(t, 10, summary.Succeeded)
+	assert.Equal(t, ExitOK, summary.ExitCode())
+	total := 0
+	for _, n := range attempts {
+		total += n
+	}
+	assert.Assert(t, total > 10, "nothing was requeued")
+}
+
+func TestPausedItemsAreNotAttemptedWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	summary := Run(ctx, items(5), func(i int) (string, error) {
+		return "", nil
+	}, Options{
+		Concurrency: 5,
+		Pause: func(ctx context.Context) error {
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+	assert.Equal(t, 0, summary.Succeeded)
+	assert.Equal(t, 5, summary.NotAttempted)
+	assert.Equal(t, ExitInterrupted, summary.ExitCode())
+}
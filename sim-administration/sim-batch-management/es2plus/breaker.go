@@ -0,0 +1,319 @@
+package es2plus
+
+import (
+	"context"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/metrics"
+	"sync"
+	"time"
+)
+
+///
+///  Failing fast when an SM-DP+ is down
+///
+
+// BreakerPolicy describes when a circuit breaker opens, and for how long.
+type BreakerPolicy struct {
+	// The breaker opens when at least this fraction (0.0 - 1.0) of
+	// the last Window requests failed, provided at least MinRequests
+	// requests have been made.
+	FailureRatio float64
+	Window       int
+	MinRequests  int
+
+	// Time the breaker stays open, failing requests without sending
+	// them, before letting HalfOpenProbes requests through to see if
+	// the SM-DP+ is back.
+	OpenDuration   time.Duration
+	HalfOpenProbes int
+}
+
+// DefaultBreakerPolicy returns the circuit breaker policy used unless
+// told otherwise.
+func DefaultBreakerPolicy() BreakerPolicy {
+	return BreakerPolicy{
+		FailureRatio:   0.5,
+		Window:         20,
+		MinRequests:    10,
+		OpenDuration:   30 * time.Second,
+		HalfOpenProbes: 1,
+	}
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (state breakerState) String() string {
+	switch state {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("state(%d)", int(state))
+}
+
+// What a request that was let through by a breaker came to.  Requests
+// abandoned by the caller, e.g. because the program is interrupted,
+// say nothing about the health of the SM-DP+.
+type breakerResult int
+
+const (
+	breakerSuccess breakerResult = iota
+	breakerFailure
+	breakerIgnored
+)
+
+var breakerTransitionsTotal = metrics.NewCounter("sbm_es2plus_circuit_breaker_transitions_total",
+	"Circuit breaker state changes, by vendor and the state changed to.",
+	"vendor", "state")
+
+// CircuitOpenError is returned, without anything being sent, for
+// requests to an SM-DP+ whose circuit breaker is open.
+type CircuitOpenError struct {
+	Vendor string
+	Until  time.Time
+}
+
+func (err *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for vendor '%s' is open until %s, request not sent", err.Vendor, err.Until.Format(time.RFC3339))
+}
+
+// IsCircuitOpen is true if the error is a request refused by an open
+// circuit breaker.  Nothing was sent to the SM-DP+ in that case, so
+// the request can safely be made again when the breaker closes.
+func IsCircuitOpen(err error) bool {
+	_, ok := err.(*CircuitOpenError)
+	return ok
+}
+
+// CircuitBreaker keeps track of the requests failing for transient
+// reasons (as defined by IsRetryable) to an SM-DP+, and fails requests
+// fast while too many of them do.  A single breaker should be shared
+// by all clients talking to the same SM-DP+.  A nil breaker lets
+// everything through.
+type CircuitBreaker struct {
+	mutex  sync.Mutex
+	vendor string
+	policy BreakerPolicy
+	state  breakerState
+
+	// The outcomes of the most recent requests, a ring buffer.
+	outcomes []bool
+	next     int
+	count    int
+	failures int
+
+	openedAt time.Time
+	probes   int
+
+	// Closed, and replaced, whenever the state changes.
+	changed chan struct{}
+}
+
+// NewCircuitBreaker creates a closed circuit breaker for the vendor's
+// SM-DP+.  Zero values in the policy are replaced by the defaults.
+func NewCircuitBreaker(vendor string, policy BreakerPolicy) *CircuitBreaker {
+	defaults := DefaultBreakerPolicy()
+	if policy.FailureRatio <= 0 || policy.FailureRatio > 1 {
+		policy.FailureRatio = defaults.FailureRatio
+	}
+	if policy.Window <= 0 {
+		policy.Window = defaults.Window
+	}
+	if policy.MinRequests <= 0 {
+		policy.MinRequests = defaults.MinRequests
+	}
+	if policy.MinRequests > policy.Window {
+		policy.MinRequests = policy.Window
+	}
+	if policy.OpenDuration <= 0 {
+		policy.OpenDuration = defaults.OpenDuration
+	}
+	if policy.HalfOpenProbes <= 0 {
+		policy.HalfOpenProbes = defaults.HalfOpenProbes
+	}
+	return &CircuitBreaker{
+		vendor:   vendor,
+		policy:   policy,
+		outcomes: make([]bool, policy.Window),
+		changed:  make(chan struct{}),
+	}
+}
+
+// allow returns a *CircuitOpenError if a request may not be sent,
+// otherwise a function to call with the result of the request.
+func (breaker *CircuitBreaker) allow() (func(result breakerResult), error) {
+	if breaker == nil {
+		return func(breakerResult) {}, nil
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	switch breaker.state {
+	case breakerOpen:
+		until := breaker.openedAt.Add(breaker.policy.OpenDuration)
+		if time.Now().Before(until) {
+			return nil, &CircuitOpenError{Vendor: breaker.vendor, Until: until}
+		}
+		breaker.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if breaker.probes >= breaker.policy.HalfOpenProbes {
+			// Probes are in flight, so we'll know soon.
+			return nil, &CircuitOpenError{Vendor: breaker.vendor, Until: time.Now()}
+		}
+		breaker.probes++
+		return breaker.probeDone, nil
+	}
+	return breaker.requestDone, nil
+}
+
+// requestDone records the result of a request made while the breaker
+// was closed, opening it if too many requests failed.
+func (breaker *CircuitBreaker) requestDone(result breakerResult) {
+	if result == breakerIgnored {
+		return
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	// Requests that were in flight when the breaker opened are
+	// not counted.
+	if breaker.state != breakerClosed {
+		return
+	}
+
+	failed := result == breakerFailure
+	if breaker.count == len(breaker.outcomes) {
+		if breaker.outcomes[breaker.next] {
+			breaker.failures--
+		}
+	} else {
+		breaker.count++
+	}
+	breaker.outcomes[breaker.next] = failed
+	breaker.next = (breaker.next + 1) % len(breaker.outcomes)
+	if failed {
+		breaker.failures++
+	}
+
+	if breaker.count >= breaker.policy.MinRequests &&
+		float64(breaker.failures) >= breaker.policy.FailureRatio*float64(breaker.count) {
+		breaker.logger().Warnf("Circuit breaker opened, %d of the last %d requests failed.  Not sending requests for %v.",
+			breaker.failures, breaker.count, breaker.policy.OpenDuration)
+		breaker.open()
+	}
+}
+
+// probeDone records the result of a request made while the breaker
+// was half-open, closing it if the request succeeded.
+func (breaker *CircuitBreaker) probeDone(result breakerResult) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.probes--
+	if breaker.state != breakerHalfOpen {
+		return
+	}
+
+	switch result {
+	case breakerSuccess:
+		breaker.logger().Infof("Circuit breaker closed, the SM-DP+ is responding again.")
+		breaker.count, breaker.next, breaker.failures = 0, 0, 0
+		breaker.setState(breakerClosed)
+	case breakerFailure:
+		breaker.logger().Warnf("Circuit breaker opened again, the SM-DP+ is still failing.  Not sending requests for %v.",
+			breaker.policy.OpenDuration)
+		breaker.open()
+	case breakerIgnored:
+		// Let someone else probe.
+		breaker.signal()
+	}
+}
+
+func (breaker *CircuitBreaker) logger() *logging.Logger {
+	return logging.With(logging.FieldVendor, breaker.vendor)
+}
+
+func (breaker *CircuitBreaker) open() {
+	breaker.openedAt = time.Now()
+	breaker.setState(breakerOpen)
+}
+
+func (breaker *CircuitBreaker) setState(state breakerState) {
+	breaker.state = state
+	breakerTransitionsTotal.Inc(breaker.vendor, state.String())
+	breaker.signal()
+}
+
+// signal wakes up everybody waiting for the breaker.
+func (breaker *CircuitBreaker) signal() {
+	close(breaker.changed)
+	breaker.changed = make(chan struct{})
+}
+
+// Wait blocks while the breaker would refuse requests, returning when
+// one would be let through, or when the context is done.  Bulk
+// operations use it to pause while an SM-DP+ is down, rather than
+// failing all the remaining items.
+func (breaker *CircuitBreaker) Wait(ctx context.Context) error {
+	if breaker == nil {
+		return ctx.Err()
+	}
+	for {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		breaker.mutex.Lock()
+		switch breaker.state {
+		case breakerClosed:
+			breaker.mutex.Unlock()
+			return ctx.Err()
+		case breakerOpen:
+			remaining := time.Until(breaker.openedAt.Add(breaker.policy.OpenDuration))
+			if remaining <= 0 {
+				breaker.mutex.Unlock()
+				return ctx.Err()
+			}
+			timer = time.NewTimer(remaining)
+			timeout = timer.C
+		case breakerHalfOpen:
+			if breaker.probes < breaker.policy.HalfOpenProbes {
+				breaker.mutex.Unlock()
+				return ctx.Err()
+			}
+		}
+		changed := breaker.changed
+		breaker.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// State returns the current state of the breaker: "closed", "open" or
+// "half-open".
+func (breaker *CircuitBreaker) State() string {
+	if breaker == nil {
+		return breakerClosed.String()
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return breaker.state.String()
+}
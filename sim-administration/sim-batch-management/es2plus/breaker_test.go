@@ -0,0 +1,98 @@
+package es2plus
+
+import (
+	"context"
+	"gotest.tools/assert"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensFailsFastAndCloses(t *testing.T) {
+	var mutex sync.Mutex
+	healthy := false
+	requests := 0
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		ok := healthy
+		mutex.Unlock()
+		if !ok {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		writeResponse(w, http.StatusOK, DownloadOrderResponse{Header: successHeader(), Iccid: "8947000000000000001"})
+	})
+	breaker := NewCircuitBreaker("Durian", BreakerPolicy{
+		FailureRatio: 0.5,
+		Window:       4,
+		MinRequests:  4,
+		OpenDuration: 100 * time.Millisecond,
+	})
+	client, server := newTestClient(t, handler, WithRetryPolicy(NoRetries), WithCircuitBreaker(breaker))
+	defer server.Close()
+
+	for i := 0; i < 4; i++ {
+		_, err := client.DownloadOrder("8947000000000000001", OrderParameters{})
+		assert.Assert(t, err != nil && !IsCircuitOpen(err), "unexpected error %v", err)
+	}
+	assert.Equal(t, "open", breaker.State())
+
+	// While open, nothing is sent.
+	_, err := client.DownloadOrder("8947000000000000001", OrderParameters{})
+	assert.Assert(t, IsCircuitOpen(err), "expected circuit open error, got %v", err)
+	assert.Equal(t, 4, requests)
+
+	// A probe failing opens it again.
+	assert.NilError(t, breaker.Wait(context.Background()))
+	_, err = client.DownloadOrder("8947000000000000001", OrderParameters{})
+	assert.Assert(t, err != nil && !IsCircuitOpen(err), "unexpected error %v", err)
+	assert.Equal(t, "open", breaker.State())
+	assert.Equal(t, 5, requests)
+
+	// A probe succeeding closes it.
+	mutex.Lock()
+	healthy = true
+	mutex.Unlock()
+	started := time.Now()
+	assert.NilError(t, breaker.Wait(context.Background()))
+	assert.Assert(t, time.Since(started) > 50*time.Millisecond, "didn't wait for the breaker")
+	_, err = client.DownloadOrder("8947000000000000001", OrderParameters{})
+	assert.NilError(t, err)
+	assert.Equal(t, "closed", breaker.State())
+}
+
+func TestCircuitBreakerIgnoresBusinessErrors(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, http.StatusOK, DownloadOrderResponse{Header: ResponseHeader{FunctionExecutionStatus: FunctionExecutionStatus{
+			FunctionExecutionStatusType: StatusFailed,
+			StatusCodeData: StatusCodeData{
+				SubjectCode: SubjectProfileIccid,
+				ReasonCode:  ReasonUnknown,
+				Message:     "No such profile",
+			},
+		}}})
+	})
+	breaker := NewCircuitBreaker("Durian", BreakerPolicy{FailureRatio: 0.5, Window: 2, MinRequests: 2})
+	client, server := newTestClient(t, handler, WithRetryPolicy(NoRetries), WithCircuitBreaker(breaker))
+	defer server.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := client.DownloadOrder("8947000000000000001", OrderParameters{})
+		assert.Assert(t, err != nil && !IsCircuitOpen(err), "unexpected error %v", err)
+	}
+	assert.Equal(t, "closed", breaker.State())
+}
+
+func TestWaitingForCircuitBreakerCanBeCancelled(t *testing.T) {
+	breaker := NewCircuitBreaker("Durian", BreakerPolicy{OpenDuration: time.Hour})
+	breaker.mutex.Lock()
+	breaker.open()
+	breaker.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, breaker.Wait(ctx))
+}
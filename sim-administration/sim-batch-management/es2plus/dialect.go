@@ -0,0 +1,182 @@
+package es2plus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+///
+///  Talking to SM-DP+s that don't quite agree on the protocol
+///
+
+// DefaultProtocolVersion is the SGP.22 version we claim to speak
+// unless told otherwise.
+const DefaultProtocolVersion = "2.0.0"
+
+var protocolVersionRegexp = regexp.MustCompile(`^2\.[0-9]+\.[0-9]+$`)
+
+// ValidateProtocolVersion checks that a version is an SGP.22 v2
+// version, such as "2.2.0".
+func ValidateProtocolVersion(version string) error {
+	if !protocolVersionRegexp.MatchString(version) {
+		return fmt.Errorf("not a supported ES2+ protocol version: '%s'.  Must be 2.x.y, e.g. 2.2.0", version)
+	}
+	return nil
+}
+
+// AdminProtocolHeader returns the X-Admin-Protocol header value for
+// a protocol version.
+func AdminProtocolHeader(version string) string {
+	return "gsma/rsp/v" + version
+}
+
+// Dialect maps the field names of ES2+ payloads, as defined by SGP.22
+// and used in the JSON tags of this package, to the names a particular
+// SM-DP+ uses, and lists the optional fields it doesn't understand.
+// Renames apply to fields at any depth, in both requests and responses.
+type Dialect struct {
+	Fields map[string]string `json:"fields,omitempty"`
+	Omit   []string          `json:"omit,omitempty"`
+}
+
+// The built-in dialects.  DialectDefault is what this client has
+// always spoken, which is SGP.22 but for the name of the status
+// timestamp in getProfileStatus responses.
+const (
+	DialectDefault = "default"
+	DialectSgp22   = "sgp22"
+)
+
+var builtinDialects = map[string]*Dialect{
+	DialectDefault: {Fields: map[string]string{"statusLastUpdateTimestamp": "status_last_update_timestamp"}},
+	DialectSgp22:   {},
+}
+
+// ParseDialect returns the dialect described by a specification: The
+// name of a built-in dialect, or a dialect as a JSON object, e.g.
+//
+//	{"fields": {"matchingId": "matchingID"}, "omit": ["smdsAddress"]}
+//
+// The empty specification is the default dialect.
+func ParseDialect(spec string) (*Dialect, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		spec = DialectDefault
+	}
+	if dialect, found := builtinDialects[spec]; found {
+		return dialect, nil
+	}
+	if !strings.HasPrefix(spec, "{") {
+		names := make([]string, 0, len(builtinDialects))
+		for name := range builtinDialects {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown ES2+ dialect '%s', must be a JSON object or one of %v", spec, names)
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(spec))
+	decoder.DisallowUnknownFields()
+	dialect := new(Dialect)
+	if err := decoder.Decode(dialect); err != nil {
+		return nil, fmt.Errorf("couldn't parse ES2+ dialect '%s': %s", spec, err)
+	}
+	seen := make(map[string]string)
+	for field, name := range dialect.Fields {
+		if field == "" || name == "" {
+			return nil, fmt.Errorf("ES2+ dialect can't rename '%s' to '%s'", field, name)
+		}
+		if other, found := seen[name]; found {
+			return nil, fmt.Errorf("ES2+ dialect renames both '%s' and '%s' to '%s'", other, field, name)
+		}
+		seen[name] = field
+	}
+	return dialect, nil
+}
+
+func (dialect *Dialect) isIdentity() bool {
+	return dialect == nil || (len(dialect.Fields) == 0 && len(dialect.Omit) == 0)
+}
+
+// secretFields returns the names of the fields whose values are never
+// logged or recorded, in payloads translated to the dialect: the SGP.22
+// names, and what the dialect renames them to.
+func (dialect *Dialect) secretFields() map[string]bool {
+	if dialect.isIdentity() {
+		return secretFields
+	}
+	fields := make(map[string]bool, 2*len(secretFields))
+	for field := range secretFields {
+		fields[field] = true
+		if name, found := dialect.Fields[field]; found {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// encode translates a serialized request to the dialect.
+func (dialect *Dialect) encode(payload []byte) ([]byte, error) {
+	if dialect.isIdentity() {
+		return payload, nil
+	}
+	omit := make(map[string]bool)
+	for _, field := range dialect.Omit {
+		omit[field] = true
+	}
+	return translate(payload, dialect.Fields, omit)
+}
+
+// decode translates a serialized response from the dialect.  Fields
+// already having the SGP.22 names are left alone.
+func (dialect *Dialect) decode(body []byte) ([]byte, error) {
+	if dialect.isIdentity() {
+		return body, nil
+	}
+	names := make(map[string]string)
+	for field, name := range dialect.Fields {
+		names[name] = field
+	}
+	return translate(body, names, nil)
+}
+
+// translate renames and omits fields of JSON objects, at any depth.
+func translate(payload []byte, names map[string]string, omit map[string]bool) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	result := new(bytes.Buffer)
+	if err := json.NewEncoder(result).Encode(translateValue(value, names, omit)); err != nil {
+		return nil, err
+	}
+	return result.Bytes(), nil
+}
+
+func translateValue(value interface{}, names map[string]string, omit map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, field := range v {
+			if omit[key] {
+				continue
+			}
+			if name, found := names[key]; found {
+				key = name
+			}
+			result[key] = translateValue(field, names, omit)
+		}
+		return result
+	case []interface{}:
+		for i := range v {
+			v[i] = translateValue(v[i], names, omit)
+		}
+	}
+	return value
+}
@@ -0,0 +1,72 @@
+package es2plus
+
+import (
+	"encoding/json"
+	"fmt"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestRequestsAndResponsesAreTranslatedByTheDialect(t *testing.T) {
+	var protocolHeader string
+	var request map[string]interface{}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protocolHeader = r.Header.Get("X-Admin-Protocol")
+		body, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &request)
+
+		w.Header().Set("X-Admin-Protocol", "gsma/rsp/v2.2.0")
+		fmt.Fprint(w, `{"header": {"functionExecutionStatus": {"status": "Executed-Success"}},
+		                "iccid": "8947000000000000001", "matchingID": "ABC-123", "smdpAddress": "smdp.example.com"}`)
+	})
+
+	dialect, err := ParseDialect(`{"fields": {"matchingId": "matchingID", "releaseFlag": "release"}, "omit": ["smdsAddress"]}`)
+	assert.NilError(t, err)
+	client, server := newTestClient(t, handler, WithRetryPolicy(NoRetries), WithProtocolVersion("2.2.0"), WithDialect(dialect))
+	defer server.Close()
+
+	result, err := client.ConfirmOrder("8947000000000000001", OrderParameters{MatchingID: "ABC-123", SmdsAddress: "smds.example.com"})
+	assert.NilError(t, err)
+	assert.Equal(t, "gsma/rsp/v2.2.0", protocolHeader)
+	assert.Equal(t, "ABC-123", request["matchingID"])
+	assert.Equal(t, true, request["release"])
+	_, found := request["smdsAddress"]
+	assert.Assert(t, !found, "omitted field was sent")
+	assert.Assert(t, request["header"].(map[string]interface{})["functionCallIdentifier"] != "")
+
+	assert.Equal(t, "ABC-123", result.MatchingID)
+	assert.Equal(t, "smdp.example.com", result.SmdpAddress)
+}
+
+func TestDefaultDialectReadsBothStatusTimestampNames(t *testing.T) {
+	dialect, err := ParseDialect("")
+	assert.NilError(t, err)
+
+	for _, body := range []string{
+		`{"profileStatusList": [{"iccid": "1", "status_last_update_timestamp": "2019-12-01T10:11:12Z"}]}`,
+		`{"profileStatusList": [{"iccid": "1", "statusLastUpdateTimestamp": "2019-12-01T10:11:12Z"}]}`,
+	} {
+		decoded, err := dialect.decode([]byte(body))
+		assert.NilError(t, err)
+		response := new(es2ProfileStatusResponse)
+		assert.NilError(t, json.Unmarshal(decoded, response))
+		assert.Equal(t, "2019-12-01T10:11:12Z", response.ProfileStatusList[0].StatusLastUpdateTimestamp)
+	}
+}
+
+func TestDialectsAndProtocolVersionsAreValidated(t *testing.T) {
+	_, err := ParseDialect(DialectSgp22)
+	assert.NilError(t, err)
+	_, err = ParseDialect("gsma")
+	assert.ErrorContains(t, err, "unknown ES2+ dialect 'gsma'")
+	_, err = ParseDialect(`{"renames": {}}`)
+	assert.ErrorContains(t, err, "unknown field")
+	_, err = ParseDialect(`{"fields": {"eid": "id", "iccid": "id"}}`)
+	assert.ErrorContains(t, err, "to 'id'")
+
+	assert.NilError(t, ValidateProtocolVersion("2.2.0"))
+	assert.ErrorContains(t, ValidateProtocolVersion("3.0.0"), "not a supported ES2+ protocol version")
+}
@@ -0,0 +1,211 @@
+package es2plus
+
+import (
+	"context"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/metrics"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+///
+///  Failing over between the SM-DP+ sites of a vendor
+///
+
+// DefaultFailBackAfter is the time an endpoint that failed is avoided
+// unless told otherwise.
+const DefaultFailBackAfter = 10 * time.Minute
+
+// Endpoint is an address ES2+ requests to a vendor can be sent to,
+// together with its health.
+type Endpoint struct {
+	Hostport string
+
+	// When the endpoint last failed, and how.  A zero FailedAt means
+	// it hasn't failed since it last responded.
+	FailedAt  time.Time
+	LastError string
+}
+
+// EndpointStatus is an endpoint, whether it is currently considered
+// healthy, and whether requests are currently sent to it.
+type EndpointStatus struct {
+	Endpoint
+	Healthy bool
+	Active  bool
+}
+
+var endpointFailoversTotal = metrics.NewCounter("sbm_es2plus_endpoint_failovers_total",
+	"Times an SM-DP+ endpoint was marked as failed, by vendor and endpoint.",
+	"vendor", "endpoint")
+
+// EndpointSet is the ordered list of endpoints of a vendor.  Requests
+// go to the first healthy endpoint.  An endpoint is unhealthy for
+// the fail back time after a request to it failed with a connection
+// error or a 5xx response, then it gets another chance.  A single set
+// should be shared by all clients talking to the same vendor.
+type EndpointSet struct {
+	mutex         sync.Mutex
+	vendor        string
+	endpoints     []Endpoint
+	failBackAfter time.Duration
+	onChange      func(endpoint Endpoint)
+	now           func() time.Time
+}
+
+// NewEndpointSet creates a set of endpoints, in order of preference.
+// onChange, if not nil, is called whenever an endpoint fails or
+// recovers, so that its health can be remembered.  A failBackAfter
+// less than or equal to zero is replaced by DefaultFailBackAfter.
+func NewEndpointSet(vendor string, endpoints []Endpoint, failBackAfter time.Duration, onChange func(endpoint Endpoint)) *EndpointSet {
+	if failBackAfter <= 0 {
+		failBackAfter = DefaultFailBackAfter
+	}
+	return &EndpointSet{
+		vendor:        vendor,
+		endpoints:     append([]Endpoint(nil), endpoints...),
+		failBackAfter: failBackAfter,
+		onChange:      onChange,
+		now:           time.Now,
+	}
+}
+
+func (set *EndpointSet) healthy(endpoint Endpoint, now time.Time) bool {
+	return endpoint.FailedAt.IsZero() || now.Sub(endpoint.FailedAt) >= set.failBackAfter
+}
+
+// active returns the index of the endpoint requests go to: the first
+// healthy one, or if none are, the one that failed longest ago.
+func (set *EndpointSet) active(now time.Time) int {
+	leastRecentlyFailed := 0
+	for i, endpoint := range set.endpoints {
+		if set.healthy(endpoint, now) {
+			return i
+		}
+		if endpoint.FailedAt.Before(set.endpoints[leastRecentlyFailed].FailedAt) {
+			leastRecentlyFailed = i
+		}
+	}
+	return leastRecentlyFailed
+}
+
+// Active returns the address requests are currently sent to, or the
+// empty string if there are no endpoints in the set.
+func (set *EndpointSet) Active() string {
+	if set == nil {
+		return ""
+	}
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	if len(set.endpoints) == 0 {
+		return ""
+	}
+	return set.endpoints[set.active(set.now())].Hostport
+}
+
+// Status returns all the endpoints, in order of preference.
+func (set *EndpointSet) Status() []EndpointStatus {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	now := set.now()
+	active := set.active(now)
+	result := make([]EndpointStatus, len(set.endpoints))
+	for i, endpoint := range set.endpoints {
+		result[i] = EndpointStatus{
+			Endpoint: endpoint,
+			Healthy:  set.healthy(endpoint, now),
+			Active:   i == active,
+		}
+	}
+	return result
+}
+
+// done records the outcome of a request sent to an endpoint.  The
+// change, if any, is passed on to onChange after the set is unlocked,
+// since remembering it may take a while.
+func (set *EndpointSet) done(ctx context.Context, hostport string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	var endpoint *Endpoint
+	if isEndpointFailure(err) {
+		endpoint = set.failed(hostport, err)
+	} else {
+		endpoint = set.responded(hostport)
+	}
+	if endpoint != nil && set.onChange != nil {
+		set.onChange(*endpoint)
+	}
+}
+
+// failed marks an endpoint as failed, returning a copy of it, or nil
+// if it isn't in the set.
+func (set *EndpointSet) failed(hostport string, err error) *Endpoint {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	i := set.indexOf(hostport)
+	if i < 0 {
+		return nil
+	}
+	now := set.now()
+	wasActive := set.active(now) == i
+	set.endpoints[i].FailedAt = now
+	set.endpoints[i].LastError = err.Error()
+	endpointFailoversTotal.Inc(set.vendor, hostport)
+
+	logger := logging.With(logging.FieldVendor, set.vendor, logging.FieldError, err)
+	if next := set.endpoints[set.active(now)].Hostport; wasActive && next != hostport {
+		logger.Warnf("SM-DP+ endpoint %s failed, failing over to %s for %v", hostport, next, set.failBackAfter)
+	} else {
+		logger.Warnf("SM-DP+ endpoint %s failed", hostport)
+	}
+	endpoint := set.endpoints[i]
+	return &endpoint
+}
+
+// responded marks an endpoint that had failed as healthy, returning a
+// copy of it, or nil if nothing changed.
+func (set *EndpointSet) responded(hostport string) *Endpoint {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	i := set.indexOf(hostport)
+	if i < 0 || set.endpoints[i].FailedAt.IsZero() {
+		return nil
+	}
+	set.endpoints[i].FailedAt = time.Time{}
+	set.endpoints[i].LastError = ""
+	logging.With(logging.FieldVendor, set.vendor).Infof("SM-DP+ endpoint %s is responding again", hostport)
+	endpoint := set.endpoints[i]
+	return &endpoint
+}
+
+func (set *EndpointSet) indexOf(hostport string) int {
+	for i, endpoint := range set.endpoints {
+		if endpoint.Hostport == hostport {
+			return i
+		}
+	}
+	return -1
+}
+
+// isEndpointFailure is true if an error says the SM-DP+ site can't be
+// reached or is broken, as opposed to the request being refused or
+// throttled, so another site should be tried.
+func isEndpointFailure(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *Error:
+		return e.HTTPStatusCode >= 500
+	case *url.Error:
+		err = e.Err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
@@ -0,0 +1,151 @@
+package es2plus
+
+import (
+	"context"
+	"crypto/tls"
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequestsFailOverAndFailBack(t *testing.T) {
+	var mutex sync.Mutex
+	primaryDown := true
+	var served []string
+
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			served = append(served, name)
+			down := name == "primary" && primaryDown
+			mutex.Unlock()
+			if down {
+				http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+				return
+			}
+			writeResponse(w, http.StatusOK, es2ProfileStatusResponse{
+				Header:            successHeader(),
+				ProfileStatusList: []ProfileStatus{{Iccid: "8947000000000000001", State: string(ProfileStateReleased)}},
+			})
+		}))
+	}
+	primary := newServer("primary")
+	defer primary.Close()
+	dr := newServer("dr")
+	defer dr.Close()
+	primaryAddress := strings.TrimPrefix(primary.URL, "https://")
+	drAddress := strings.TrimPrefix(dr.URL, "https://")
+
+	var changes []Endpoint
+	endpoints := NewEndpointSet("Durian", []Endpoint{{Hostport: primaryAddress}, {Hostport: drAddress}}, time.Hour, func(endpoint Endpoint) {
+		changes = append(changes, endpoint)
+	})
+	now := time.Now()
+	endpoints.now = func() time.Time { return now }
+
+	client, server := newTestClient(t, http.NotFoundHandler(),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 1}),
+		WithEndpoints(endpoints),
+		WithHTTPClient(&http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}))
+	defer server.Close()
+
+	// The primary fails, the retry goes to the DR site.  Only idempotent
+	// functions are retried after a 503.
+	_, err := client.GetStatus("8947000000000000001")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"primary", "dr"}, served)
+	assert.Equal(t, drAddress, endpoints.Active())
+	assert.Equal(t, 1, len(changes))
+	assert.Equal(t, primaryAddress, changes[0].Hostport)
+	assert.Assert(t, strings.Contains(changes[0].LastError, "503"), changes[0].LastError)
+
+	// Until it's time to fail back, the DR site is used.
+	_, err = client.GetStatus("8947000000000000001")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"primary", "dr", "dr"}, served)
+	status := endpoints.Status()
+	assert.Assert(t, !status[0].Healthy && !status[0].Active)
+	assert.Assert(t, status[1].Healthy && status[1].Active)
+
+	// Then the primary gets another chance, and is healthy again once
+	// it responds.
+	mutex.Lock()
+	primaryDown = false
+	mutex.Unlock()
+	now = now.Add(time.Hour)
+	assert.Equal(t, primaryAddress, endpoints.Active())
+	_, err = client.GetStatus("8947000000000000001")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"primary", "dr", "dr", "primary"}, served)
+	assert.Equal(t, 2, len(changes))
+	assert.Assert(t, changes[1].FailedAt.IsZero())
+}
+
+func TestRefusedRequestsDontFailOver(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	})
+	client, server := newTestClient(t, handler, WithRetryPolicy(NoRetries))
+	defer server.Close()
+	endpoints := NewEndpointSet("Durian", []Endpoint{{Hostport: client.hostport}, {Hostport: "localhost:1"}}, 0, nil)
+	client.endpoints = endpoints
+
+	_, err := client.DownloadOrder("8947000000000000001", OrderParameters{})
+	assert.Assert(t, err != nil)
+	assert.Equal(t, client.hostport, endpoints.Active())
+}
+
+func TestHangingEndpointsAreFailedOverFromAndCountedByTheBreaker(t *testing.T) {
+	hanging := make(chan struct{})
+	newServer := func(hang bool) *httptest.Server {
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hang {
+				<-hanging
+				return
+			}
+			writeResponse(w, http.StatusOK, es2ProfileStatusResponse{
+				Header:            successHeader(),
+				ProfileStatusList: []ProfileStatus{{Iccid: "8947000000000000001", State: string(ProfileStateReleased)}},
+			})
+		}))
+	}
+	primary := newServer(true)
+	defer primary.Close()
+	dr := newServer(false)
+	defer dr.Close()
+	primaryAddress := strings.TrimPrefix(primary.URL, "https://")
+	drAddress := strings.TrimPrefix(dr.URL, "https://")
+	// Let the primary's handler return before the server is closed.
+	defer close(hanging)
+
+	var changes []Endpoint
+	endpoints := NewEndpointSet("Durian", []Endpoint{{Hostport: primaryAddress}, {Hostport: drAddress}}, time.Hour, func(endpoint Endpoint) {
+		changes = append(changes, endpoint)
+	})
+	breaker := NewCircuitBreaker("Durian", BreakerPolicy{Window: 10, MinRequests: 10})
+
+	client, server := newTestClient(t, http.NotFoundHandler(),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 1}),
+		WithAttemptTimeout(100*time.Millisecond),
+		WithCircuitBreaker(breaker),
+		WithEndpoints(endpoints),
+		WithHTTPClient(&http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}))
+	defer server.Close()
+
+	// The primary never answers, so the attempt times out, and the
+	// retry goes to the DR site, well within the invocation's timeout.
+	_, err := client.GetStatusContext(context.Background(), "8947000000000000001")
+	assert.NilError(t, err)
+	assert.Equal(t, drAddress, endpoints.Active())
+	assert.Equal(t, 1, len(changes))
+	assert.Assert(t, strings.Contains(changes[0].LastError, "no response from "+primaryAddress), changes[0].LastError)
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	assert.Equal(t, 2, breaker.count)
+	assert.Equal(t, 1, breaker.failures)
+}
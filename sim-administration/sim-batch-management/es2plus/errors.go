@@ -0,0 +1,231 @@
+package es2plus
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+///
+///  Errors returned from ES2+ invocations
+///
+
+// Function execution status values as defined by SGP.22.
+const (
+	StatusExecutedSuccess     = "Executed-Success"
+	StatusExecutedWithWarning = "Executed-WithWarning"
+	StatusFailed              = "Failed"
+	StatusExpired             = "Expired"
+)
+
+// Subject codes from the SGP.22 subject code table that we care about.
+const (
+	SubjectFunctionRequester = "1.1"
+	SubjectFunction          = "1.2"
+	SubjectEid               = "8.1.1"
+	SubjectProfile           = "8.2"
+	SubjectProfileIccid      = "8.2.1"
+	SubjectProfileType       = "8.2.5"
+	SubjectMatchingID        = "8.2.6"
+	SubjectConfirmationCode  = "8.2.7"
+	SubjectSmdpAddress       = "8.8.1"
+	SubjectSmds              = "8.9"
+)
+
+// Reason codes from the SGP.22 reason code table that we care about.
+const (
+	ReasonUnknownAccess               = "1.1"
+	ReasonNotAllowed                  = "1.2"
+	ReasonUnsupportedFunction         = "1.3"
+	ReasonInvalid                     = "2.1"
+	ReasonMandatoryElementMissing     = "2.2"
+	ReasonConditionalElementMissing   = "2.3"
+	ReasonConditionsOfUseNotSatisfied = "3.1"
+	ReasonAlreadyInUse                = "3.3"
+	ReasonInvalidTransition           = "3.5"
+	ReasonUnavailable                 = "3.7"
+	ReasonRefused                     = "3.8"
+	ReasonUnknown                     = "3.9"
+	ReasonInvalidAssociation          = "3.10"
+	ReasonExecutionError              = "4.2"
+	ReasonInaccessible                = "5.1"
+	ReasonTimeout                     = "5.2"
+	ReasonVerificationFailed          = "6.1"
+	ReasonExpired                     = "6.3"
+	ReasonMaxRetriesExceeded          = "6.4"
+)
+
+var subjectCodeDescriptions = map[string]string{
+	SubjectFunctionRequester: "Function requester",
+	SubjectFunction:          "Function",
+	SubjectEid:               "EID",
+	SubjectProfile:           "Profile",
+	SubjectProfileIccid:      "Profile ICCID",
+	SubjectProfileType:       "Profile type",
+	SubjectMatchingID:        "Matching ID",
+	SubjectConfirmationCode:  "Confirmation code",
+	SubjectSmdpAddress:       "SM-DP+ address",
+	SubjectSmds:              "SM-DS",
+}
+
+var reasonCodeDescriptions = map[string]string{
+	ReasonUnknownAccess:               "Access error: unknown (authentication failure)",
+	ReasonNotAllowed:                  "Access error: not allowed (authorisation failure)",
+	ReasonUnsupportedFunction:         "Access error: unsupported function",
+	ReasonInvalid:                     "Format error: invalid",
+	ReasonMandatoryElementMissing:     "Format error: mandatory element missing",
+	ReasonConditionalElementMissing:   "Format error: conditional element missing",
+	ReasonConditionsOfUseNotSatisfied: "Conditions of use not satisfied",
+	ReasonAlreadyInUse:                "Already in use",
+	ReasonInvalidTransition:           "Invalid transition",
+	ReasonUnavailable:                 "Unavailable",
+	ReasonRefused:                     "Refused",
+	ReasonUnknown:                     "Unknown",
+	ReasonInvalidAssociation:          "Invalid association",
+	ReasonExecutionError:              "Processing error: execution error",
+	ReasonInaccessible:                "Transport error: inaccessible",
+	ReasonTimeout:                     "Transport error: timeout",
+	ReasonVerificationFailed:          "Security error: verification failed",
+	ReasonExpired:                     "Security error: expired",
+	ReasonMaxRetriesExceeded:          "Security error: maximum number of retries exceeded",
+}
+
+// Error is returned from every ES2+ invocation that doesn't succeed,
+// either because the SM-DP+ reported a function execution status other
+// than success, or because the HTTP response itself was unacceptable.
+type Error struct {
+	// The ES2+ function that was invoked, e.g. "downloadOrder".
+	Function string
+
+	// HTTP status code of the response, zero if the response
+	// was never received.
+	HTTPStatusCode int
+
+	// Function execution status and status code data, as reported
+	// by the SM-DP+.  Empty if the SM-DP+ didn't report any.
+	Status            string
+	SubjectCode       string
+	ReasonCode        string
+	SubjectIdentifier string
+	Message           string
+}
+
+func newErrorFromStatus(function string, httpStatusCode int, status FunctionExecutionStatus) *Error {
+	return &Error{
+		Function:          function,
+		HTTPStatusCode:    httpStatusCode,
+		Status:            status.FunctionExecutionStatusType,
+		SubjectCode:       status.StatusCodeData.SubjectCode,
+		ReasonCode:        status.StatusCodeData.ReasonCode,
+		SubjectIdentifier: status.StatusCodeData.SubjectIdentifier,
+		Message:           status.StatusCodeData.Message,
+	}
+}
+
+func (e *Error) Error() string {
+	var parts []string
+	if e.Status != "" {
+		parts = append(parts, fmt.Sprintf("status='%s'", e.Status))
+	} else if e.HTTPStatusCode != 0 {
+		parts = append(parts, fmt.Sprintf("http status=%d", e.HTTPStatusCode))
+	}
+	if e.SubjectCode != "" || e.ReasonCode != "" {
+		parts = append(parts, fmt.Sprintf("subject=%s (%s), reason=%s (%s)",
+			e.SubjectCode, e.SubjectDescription(), e.ReasonCode, e.ReasonDescription()))
+	}
+	if e.SubjectIdentifier != "" {
+		parts = append(parts, fmt.Sprintf("subjectIdentifier='%s'", e.SubjectIdentifier))
+	}
+	if e.Message != "" {
+		parts = append(parts, fmt.Sprintf("message='%s'", e.Message))
+	}
+	return fmt.Sprintf("es2+ %s failed: %s", e.Function, strings.Join(parts, ", "))
+}
+
+// SubjectDescription returns a human readable description of the subject code.
+func (e *Error) SubjectDescription() string {
+	if description, found := subjectCodeDescriptions[e.SubjectCode]; found {
+		return description
+	}
+	return "unknown subject"
+}
+
+// ReasonDescription returns a human readable description of the reason code.
+func (e *Error) ReasonDescription() string {
+	if description, found := reasonCodeDescriptions[e.ReasonCode]; found {
+		return description
+	}
+	return "unknown reason"
+}
+
+// IsProfileNotFound is true if the SM-DP+ doesn't know about the profile.
+func (e *Error) IsProfileNotFound() bool {
+	return e.SubjectCode == SubjectProfileIccid && e.ReasonCode == ReasonUnknown
+}
+
+// IsInvalidState is true if the operation was refused because the
+// profile was not in a state where it could be applied.
+func (e *Error) IsInvalidState() bool {
+	switch e.ReasonCode {
+	case ReasonInvalidTransition, ReasonAlreadyInUse, ReasonUnavailable, ReasonConditionsOfUseNotSatisfied:
+		return true
+	}
+	return false
+}
+
+// IsAuthFailure is true if we weren't authenticated or authorised
+// to perform the operation.
+func (e *Error) IsAuthFailure() bool {
+	if e.HTTPStatusCode == 401 || e.HTTPStatusCode == 403 {
+		return true
+	}
+	return e.ReasonCode == ReasonUnknownAccess || e.ReasonCode == ReasonNotAllowed
+}
+
+// AttemptTimeoutError is returned when a single request to an SM-DP+
+// endpoint isn't answered within the client's attempt timeout.  Being a
+// net.Error, it is retryable, fails the endpoint over, and counts as a
+// failure with the circuit breaker.
+type AttemptTimeoutError struct {
+	Hostport string
+	After    time.Duration
+}
+
+func (e *AttemptTimeoutError) Error() string {
+	return fmt.Sprintf("no response from %s within %v", e.Hostport, e.After)
+}
+
+// Timeout is true, as for other net.Errors caused by timeouts.
+func (e *AttemptTimeoutError) Timeout() bool { return true }
+
+// Temporary is true, as for other net.Errors caused by timeouts.
+func (e *AttemptTimeoutError) Temporary() bool { return true }
+
+// StatusesError is returned from GetStatuses when some of the
+// getProfileStatus requests failed.  The statuses returned by the others
+// are returned along with it.
+type StatusesError struct {
+	// The ICCIDs asked for by the requests that failed, and why, one
+	// per request.
+	Failed []FailedStatusRequest
+}
+
+// FailedStatusRequest is a getProfileStatus request that failed.
+type FailedStatusRequest struct {
+	Iccids []string
+	Err    error
+}
+
+func (e *StatusesError) Error() string {
+	iccids := 0
+	for _, failed := range e.Failed {
+		iccids += len(failed.Iccids)
+	}
+	return fmt.Sprintf("%d getProfileStatus requests for %d ICCIDs failed, the first with: %s", len(e.Failed), iccids, e.Failed[0].Err)
+}
+
+// isSuccess is true if a function execution status indicates that the
+// function was executed.
+func isSuccess(status string) bool {
+	return status == StatusExecutedSuccess || status == StatusExecutedWithWarning
+}
@@ -2,25 +2,46 @@ package es2plus
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
-	"log"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 
 // Client is an external interface for ES2+ client
 type Client interface {
 	GetStatus(iccid string) (*ProfileStatus, error)
-	RecoverProfile(iccid string, targetState string) (*RecoverProfileResponse, error)
-	CancelOrder(iccid string, targetState string) (*CancelOrderResponse, error)
-	DownloadOrder(iccid string) (*DownloadOrderResponse, error)
-	ConfirmOrder(iccid string) (*ConfirmOrderResponse, error)
-	ActivateIccid(iccid string) (*ProfileStatus, error)
+	GetStatuses(iccids []string) (map[string]*ProfileStatus, []string, error)
+	RecoverProfile(iccid string, targetState RecoverProfileTarget) (*RecoverProfileResponse, error)
+	CancelOrder(iccid string, targetState CancelOrderTarget) (*CancelOrderResponse, error)
+	ReleaseProfile(iccid string) (*ReleaseProfileResponse, error)
+	DownloadOrder(iccid string, params OrderParameters) (*DownloadOrderResponse, error)
+	ConfirmOrder(iccid string, params OrderParameters) (*ConfirmOrderResponse, error)
+	ActivateIccid(iccid string, params OrderParameters) (*ProfileStatus, error)
+
+	GetStatusContext(ctx context.Context, iccid string) (*ProfileStatus, error)
+	GetStatusesContext(ctx context.Context, iccids []string) (map[string]*ProfileStatus, []string, error)
+	RecoverProfileContext(ctx context.Context, iccid string, targetState RecoverProfileTarget) (*RecoverProfileResponse, error)
+	CancelOrderContext(ctx context.Context, iccid string, targetState CancelOrderTarget) (*CancelOrderResponse, error)
+	ReleaseProfileContext(ctx context.Context, iccid string) (*ReleaseProfileResponse, error)
+	DownloadOrderContext(ctx context.Context, iccid string, params OrderParameters) (*DownloadOrderResponse, error)
+	ConfirmOrderContext(ctx context.Context, iccid string, params OrderParameters) (*ConfirmOrderResponse, error)
+	ActivateIccidContext(ctx context.Context, iccid string, params OrderParameters) (*ProfileStatus, error)
+	Activate(ctx context.Context, iccid string, params OrderParameters) (*Activation, error)
+
 	RequesterID() string
+	RetryCount() int64
 }
 
 ///
@@ -53,7 +74,7 @@ type FunctionExecutionStatus struct {
 
 // ResponseHeader is part of the generic response header in es2+ reponses.
 type ResponseHeader struct {
-	FunctionExecutionStatus FunctionExecutionStatus `json:"FunctionExecutionStatus"`
+	FunctionExecutionStatus FunctionExecutionStatus `json:"functionExecutionStatus"`
 }
 
 //
@@ -80,7 +101,7 @@ type es2ProfileStatusResponse struct {
 // ProfileStatus holds the "profile status" part of a ProfileStatusResponse
 // - response returned from an es2+ request.
 type ProfileStatus struct {
-	StatusLastUpdateTimestamp string `json:"status_last_update_timestamp"`
+	StatusLastUpdateTimestamp string `json:"statusLastUpdateTimestamp"`
 	ACToken                   string `json:"acToken"`
 	State                     string `json:"state"`
 	Eid                       string `json:"eid"`
@@ -118,12 +139,51 @@ type CancelOrderResponse struct {
 }
 
 
+// OrderParameters are the optional parameters of the downloadOrder
+// and confirmOrder invocations.  The zero value gives the SM-DP+
+// free hands, and releases the profile when confirming the order.
+type OrderParameters struct {
+	// EID of the eUICC the profile is bound to.
+	Eid string
+
+	// Profile type to allocate a profile of, when downloadOrder is
+	// invoked without an ICCID.
+	ProfileType string
+
+	// Matching ID to use in the activation code.  If empty, the SM-DP+
+	// generates one.
+	MatchingID string
+
+	// Confirmation code the end user has to enter when downloading
+	// the profile.
+	ConfirmationCode string
+
+	// Address of the SM-DS the SM-DP+ should register an event at.
+	SmdsAddress string
+
+	// NoRelease stages the order:  The profile is left in the
+	// CONFIRMED state, and can't be downloaded until released
+	// by releaseProfile.
+	NoRelease bool
+}
+
+// ReleaseProfileRequest the payload of the releaseProfile request.
+type ReleaseProfileRequest struct {
+	Header Header `json:"header"`
+	Iccid  string `json:"iccid"`
+}
+
+// ReleaseProfileResponse the payload of the releaseProfile request response.
+type ReleaseProfileResponse struct {
+	Header ResponseHeader `json:"header"`
+}
+
 // DownloadOrderRequest The payload of a downloadOrder request.
 type DownloadOrderRequest struct {
 	Header      Header `json:"header"`
 	Iccid       string        `json:"iccid"`
 	Eid         string        `json:"eid,omitempty"`
-	Profiletype string        `json:"profiletype,omitempty"`
+	Profiletype string        `json:"profileType,omitempty"`
 }
 
 
@@ -146,7 +206,7 @@ type ConfirmOrderRequest struct {
 	Eid              string        `json:"eid,omitempty"`
 	MatchingID       string        `json:"matchingId,omitempty"`
 	ConfirmationCode string        `json:"confirmationCode,omitempty"`
-	SmdpAddress      string        `json:"smdpAddress,omitempty"`
+	SmdsAddress      string        `json:"smdsAddress,omitempty"`
 	ReleaseFlag      bool          `json:"releaseFlag"`
 }
 
@@ -166,42 +226,241 @@ type ConfirmOrderResponse struct {
 //
 
 
+// DefaultMaxIccidsPerRequest is the number of ICCIDs packed into a single
+// getProfileStatus request unless the client is told otherwise.
+const DefaultMaxIccidsPerRequest = 50
+
+// DefaultTimeout is the time an ES2+ invocation, including retries, is
+// allowed to take when the context it is invoked with has no deadline.
+const DefaultTimeout = 60 * time.Second
+
+// DefaultAttemptTimeout is the time a single request to the SM-DP+ is
+// allowed to take unless the client is told otherwise.  It is shorter
+// than DefaultTimeout, so that an endpoint that doesn't respond is given
+// up on, and failed over from, while there is time left to retry.
+const DefaultAttemptTimeout = 20 * time.Second
+
+// Time allowed for connecting to the SM-DP+, and for the TLS handshake.
+const (
+	dialTimeout         = 10 * time.Second
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// maxConcurrentStatusRequests limits the number of getProfileStatus requests
+// a single GetStatuses invocation will have in flight at the same time.
+const maxConcurrentStatusRequests = 8
+
 // ClientState struct representing the state of a ES2+ client.
 type ClientState struct {
-	httpClient  *http.Client
-	hostport    string
-	requesterID string
-	logPayload  bool
-	logHeaders  bool
+	httpClient          *http.Client
+	hostport            string
+	requesterID         string
+	logPayload          bool
+	logHeaders          bool
+	maxIccidsPerRequest int
+	vendor              string
+	retryPolicy         RetryPolicy
+	retryCount          int64
+	defaultTimeout      time.Duration
+	attemptTimeout      time.Duration
+	serverTrust         ServerTrust
+	recorder            *TrafficRecorder
+	rateLimiter         *RateLimiter
+	breaker             *CircuitBreaker
+	endpoints           *EndpointSet
+	protocolVersion     string
+	dialect             *Dialect
+	observer            ProfileObserver
+}
+
+// ClientOption is used to tweak the behaviour of a client when
+// it is created.
+type ClientOption func(client *ClientState)
+
+// WithMaxIccidsPerRequest sets the maximum number of ICCIDs the client will
+// put in a single getProfileStatus request.  Values less than one are ignored.
+func WithMaxIccidsPerRequest(maxIccidsPerRequest int) ClientOption {
+	return func(client *ClientState) {
+		if maxIccidsPerRequest > 0 {
+			client.maxIccidsPerRequest = maxIccidsPerRequest
+		}
+	}
+}
+
+// WithVendor sets the name of the profile vendor the client talks to,
+// used when logging.
+func WithVendor(vendor string) ClientOption {
+	return func(client *ClientState) {
+		client.vendor = vendor
+	}
+}
+
+// WithRetryPolicy sets the policy used to retry failed invocations.
+func WithRetryPolicy(policy RetryPolicy) ClientOption {
+	return func(client *ClientState) {
+		client.retryPolicy = policy
+	}
+}
+
+// WithDefaultTimeout sets the time an invocation is allowed to take when
+// the context it is invoked with has no deadline.  Values less than or
+// equal to zero are ignored.
+func WithDefaultTimeout(timeout time.Duration) ClientOption {
+	return func(client *ClientState) {
+		if timeout > 0 {
+			client.defaultTimeout = timeout
+		}
+	}
+}
+
+// WithHTTPClient makes the client use a preconfigured http client instead
+// of one built from the certificate and key files.  Mostly useful
+// for testing.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(client *ClientState) {
+		client.httpClient = httpClient
+	}
+}
+
+// WithPayloadLogging makes the client log the payloads of all
+// requests and responses, with secrets redacted.
+func WithPayloadLogging(logPayload bool) ClientOption {
+	return func(client *ClientState) {
+		client.logPayload = logPayload
+	}
+}
+
+// WithHeaderLogging makes the client log the HTTP headers of all
+// requests and responses, with secrets redacted.
+func WithHeaderLogging(logHeaders bool) ClientOption {
+	return func(client *ClientState) {
+		client.logHeaders = logHeaders
+	}
+}
+
+// WithTrafficRecorder makes the client record every request it sends,
+// and the response to it, in a traffic log.
+func WithTrafficRecorder(recorder *TrafficRecorder) ClientOption {
+	return func(client *ClientState) {
+		client.recorder = recorder
+	}
+}
+
+// WithRateLimiter makes the client wait for the limiter before
+// sending each request, including retries.  Clients talking to the
+// same SM-DP+ should share a limiter.
+func WithRateLimiter(limiter *RateLimiter) ClientOption {
+	return func(client *ClientState) {
+		client.rateLimiter = limiter
+	}
+}
+
+// WithServerTrust sets how the certificate presented by the SM-DP+
+// is verified.  Without it, the system trust store is used.
+func WithServerTrust(trust ServerTrust) ClientOption {
+	return func(client *ClientState) {
+		client.serverTrust = trust
+	}
+}
+
+// WithCircuitBreaker makes the client fail requests fast while the
+// breaker is open.  The breaker should be shared by all clients
+// talking to the same SM-DP+.
+func WithCircuitBreaker(breaker *CircuitBreaker) ClientOption {
+	return func(client *ClientState) {
+		client.breaker = breaker
+	}
+}
+
+// WithEndpoints makes the client send requests to the active endpoint
+// of the set, rather than to the host and port it was created with,
+// failing over to the next endpoint when one fails.
+func WithEndpoints(endpoints *EndpointSet) ClientOption {
+	return func(client *ClientState) {
+		client.endpoints = endpoints
+	}
+}
+
+// WithProtocolVersion sets the SGP.22 version the client claims to
+// speak in the X-Admin-Protocol header, e.g. "2.2.0".
+func WithProtocolVersion(version string) ClientOption {
+	return func(client *ClientState) {
+		client.protocolVersion = version
+	}
+}
+
+// WithDialect makes the client translate requests to, and responses
+// from, the field names used by the SM-DP+.
+func WithDialect(dialect *Dialect) ClientOption {
+	return func(client *ClientState) {
+		client.dialect = dialect
+	}
 }
 
+// WithAttemptTimeout sets the time a single request to the SM-DP+ is
+// allowed to take, see AttemptTimeoutError.  Values less than or equal
+// to zero are ignored.
+func WithAttemptTimeout(timeout time.Duration) ClientOption {
+	return func(client *ClientState) {
+		if timeout > 0 {
+			client.attemptTimeout = timeout
+		}
+	}
+}
+
+// WithProfileObserver makes the client tell the observer about the
+// states of the profiles it invokes functions on.
+func WithProfileObserver(observer ProfileObserver) ClientOption {
+	return func(client *ClientState) {
+		client.observer = observer
+	}
+}
 
 // NewClient create a new es2+ client instance
-func NewClient(certFilePath string, keyFilePath string, hostport string, requesterID string) *ClientState {
-	return &ClientState{
-		httpClient:  newHTTPClient(certFilePath, keyFilePath),
-		hostport:    hostport,
-		requesterID: requesterID,
-		logPayload:  false,
-		logHeaders:  false,
+func NewClient(certFilePath string, keyFilePath string, hostport string, requesterID string, options ...ClientOption) *ClientState {
+	client := &ClientState{
+		hostport:            hostport,
+		requesterID:         requesterID,
+		logPayload:          false,
+		logHeaders:          false,
+		maxIccidsPerRequest: DefaultMaxIccidsPerRequest,
+		retryPolicy:         DefaultRetryPolicy(),
+		defaultTimeout:      DefaultTimeout,
+		attemptTimeout:      DefaultAttemptTimeout,
+		protocolVersion:     DefaultProtocolVersion,
+		dialect:             builtinDialects[DialectDefault],
+	}
+	for _, option := range options {
+		option(client)
+	}
+	if client.httpClient == nil {
+		client.httpClient = newHTTPClient(certFilePath, keyFilePath, client.serverTrust, client.vendor, client.attemptTimeout)
 	}
+	return client
 }
 
-func newHTTPClient(certFilePath string, keyFilePath string) *http.Client {
+func newHTTPClient(certFilePath string, keyFilePath string, trust ServerTrust, vendor string, attemptTimeout time.Duration) *http.Client {
 	cert, err := tls.LoadX509KeyPair(
 		certFilePath,
 		keyFilePath)
 	if err != nil {
-		log.Fatalf("server: loadkeys: %s", err)
+		logging.With(logging.FieldVendor, vendor).Fatalf("Couldn't load ES2+ client certificate and key: %s", err)
 	}
 
-	// TODO: The certificate used to sign the other end of the TLS connection
-	//       is privately signed, and at this time we don't require the full
-	//       certificate chain to  be available.
-	config := tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
+	config, err := newTLSConfig(trust, vendor)
+	if err != nil {
+		logging.With(logging.FieldVendor, vendor).Fatalf("Couldn't configure TLS: %s", err)
+	}
+	config.Certificates = []tls.Certificate{cert}
 	client := &http.Client{
 		Transport: &http.Transport{
-			TLSClientConfig: &config,
+			DialContext: (&net.Dialer{
+				Timeout:   dialTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:       config,
+			TLSHandshakeTimeout:   tlsHandshakeTimeout,
+			ResponseHeaderTimeout: attemptTimeout,
 		},
 	}
 	return client
@@ -224,22 +483,57 @@ func formatRequest(r *http.Request) string {
 	request = append(request, url)
 	// Add the host
 	request = append(request, fmt.Sprintf("Host: %v", r.Host))
-	// Loop through headers
-	for name, headers := range r.Header {
+	// Loop through headers, hiding secrets
+	request = append(request, formatHeaders(r.Header)...)
+
+	// The payload is logged separately, if at all.
+	// Return the request as a string
+	return strings.Join(request, "\n")
+}
+
+// formatResponse returns the status line and headers of a response.
+func formatResponse(r *http.Response) string {
+	response := []string{fmt.Sprintf("%v %v", r.Proto, r.Status)}
+	response = append(response, formatHeaders(r.Header)...)
+	return strings.Join(response, "\n")
+}
+
+func formatHeaders(headers http.Header) []string {
+	var result []string
+	for name, values := range redactHeaders(headers) {
 		name = strings.ToLower(name)
-		for _, h := range headers {
-			request = append(request, fmt.Sprintf("%v: %v", name, h))
+		for _, h := range values {
+			result = append(result, fmt.Sprintf("%v: %v", name, h))
 		}
 	}
+	sort.Strings(result)
+	return result
+}
 
-	// If this is a POST, add post data
-	if r.Method == "POST" {
-		r.ParseForm()
-		request = append(request, "\n")
-		request = append(request, r.Form.Encode())
+// requestLogger returns the logger for messages about a request,
+// identified by the ICCID and function call identifier in its payload.
+func (client *ClientState) requestLogger(es2plusCommand string, payload []byte) *logging.Logger {
+	keyvals := []interface{}{logging.FieldVendor, client.vendor, logging.FieldFunction, es2plusCommand}
+	if iccid := iccidOf(payload); iccid != "" {
+		keyvals = append(keyvals, logging.FieldIccid, iccid)
 	}
-	// Return the request as a string
-	return strings.Join(request, "\n")
+	return logging.With(append(keyvals, logging.FieldFunctionCallIdentifier, functionCallIdentifierOf(payload))...)
+}
+
+// iccidOf digs the ICCID, if any, out of a serialized request.
+func iccidOf(payload []byte) string {
+	request := new(struct {
+		Iccid string `json:"iccid"`
+	})
+	if err := json.Unmarshal(payload, request); err != nil {
+		return ""
+	}
+	return request.Iccid
+}
+
+// es2plusPath returns the URL path of an ES2+ command.
+func es2plusPath(es2plusCommand string) string {
+	return fmt.Sprintf("/gsma/rsp2/es2plus/%s", es2plusCommand)
 }
 
 func newUUID() (string, error) {
@@ -260,47 +554,245 @@ func newHeader(client Client) (*Header, error) {
 	return &Header{FunctionCallIdentifier: functionCallIdentifier, FunctionrequesterIDentifier: client.RequesterID()}, nil
 }
 
+// The prefix of the X-Admin-Protocol header we require the SM-DP+ to
+// respond with.
+const adminProtocolPrefix = "gsma/rsp/v2."
+
 // execute is an internal function that will package a payload
 // by json serializing it, then execute an ES2+ command
-// and unmarshal the result into the result object.
+// and unmarshal the result into the result object.  If the
+// response isn't a successfully executed ES2+ function, an *Error
+// is returned.
+//
+// Invocations failing for transient reasons are retried according
+// to the client's retry policy, as far as re-sending them is safe, see
+// mayRetry.  The very same payload is re-sent,
+// so the SM-DP+ sees the same functionCallIdentifier and can recognize
+// the re-send as such.  If the context has no deadline, the client's
+// default timeout is applied to the invocation as a whole.
 func (client *ClientState) execute(
+	ctx context.Context,
 	es2plusCommand string,
-	payload interface{}, result interface{}) error {
+	payload interface{}, result interface{}) (err error) {
+
+	defer func(started time.Time) {
+		client.observeCall(es2plusCommand, started, err)
+	}(time.Now())
+
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline && client.defaultTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.defaultTimeout)
+		defer cancel()
+	}
 
 	// Serialize payload as json.
 	jsonStrB := new(bytes.Buffer)
-	err := json.NewEncoder(jsonStrB).Encode(payload)
+	err = json.NewEncoder(jsonStrB).Encode(payload)
 
 	if err != nil {
 		return err
 	}
 
+	logger := client.requestLogger(es2plusCommand, jsonStrB.Bytes())
+	wirePayload, err := client.dialect.encode(jsonStrB.Bytes())
+	if err != nil {
+		return err
+	}
 	if client.logPayload {
-		log.Print("Payload ->", jsonStrB.String())
+		logger.Debugf("Request payload -> %s", client.redact(wirePayload))
+	}
+
+	policy := client.retryPolicy
+	policy.Budget.recordCall()
+	for attempt := 1; ; attempt++ {
+		err = client.executeOnce(ctx, es2plusCommand, wirePayload, result, attempt)
+		if err == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil || !mayRetry(es2plusCommand, err) {
+			return err
+		}
+		if !policy.Budget.tryWithdraw() {
+			logger.With(logging.FieldError, err).Warnf("Not retrying %s, retry budget exhausted", es2plusCommand)
+			return err
+		}
+
+		backoff := policy.backoff(attempt)
+		atomic.AddInt64(&client.retryCount, 1)
+		retriesTotal.Inc(es2plusCommand, client.vendor)
+		logger.With(logging.FieldError, err).Warnf("Retrying %s in %v (attempt %d of %d)",
+			es2plusCommand, backoff, attempt+1, policy.MaxAttempts)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// executeOnce sends a serialized payload to the SM-DP+ and
+// interprets the response, recording the exchange if the client
+// has a traffic recorder.
+func (client *ClientState) executeOnce(ctx context.Context, es2plusCommand string, payload []byte, result interface{}, attempt int) (err error) {
+
+	done, err := client.breaker.allow()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		switch {
+		case ctx.Err() != nil:
+			done(breakerIgnored)
+		case IsRetryable(err):
+			done(breakerFailure)
+		default:
+			done(breakerSuccess)
+		}
+	}()
+
+	hostport := client.hostport
+	if active := client.endpoints.Active(); active != "" {
+		hostport = active
+		defer func() {
+			client.endpoints.done(ctx, hostport, err)
+		}()
+	}
+
+	// Give up on an attempt the SM-DP+ doesn't answer in time.  Unlike
+	// the invocation's own context expiring, that counts against the
+	// endpoint and the breaker.
+	attemptCtx := ctx
+	if client.attemptTimeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, client.attemptTimeout)
+		defer cancel()
 	}
 
-	url := fmt.Sprintf("https://%s/gsma/rsp2/es2plus/%s", client.hostport, es2plusCommand)
-	req, err := http.NewRequest("POST", url, jsonStrB)
+	url := fmt.Sprintf("https://%s%s", hostport, es2plusPath(es2plusCommand))
+	req, err := http.NewRequestWithContext(attemptCtx, "POST", url, bytes.NewReader(payload))
 	if err != nil {
 		return err
 	}
-	req.Header.Set("X-Admin-Protocol", "gsma/rsp/v2.0.0")
+	protocolVersion := client.protocolVersion
+	if protocolVersion == "" {
+		protocolVersion = DefaultProtocolVersion
+	}
+	req.Header.Set("X-Admin-Protocol", AdminProtocolHeader(protocolVersion))
 	req.Header.Set("Content-Type", "application/json")
 
+	logger := client.requestLogger(es2plusCommand, payload)
 	if client.logHeaders {
-		log.Printf("Request -> %s\n", formatRequest(req))
+		logger.Debugf("Request -> %s", formatRequest(req))
+	}
+
+	release, err := client.rateLimiter.acquire(ctx)
+	if err != nil {
+		return err
 	}
 
+	started := time.Now()
+	defer requestDuration.ObserveDuration(started, es2plusCommand, client.vendor)
 	resp, err := client.httpClient.Do(req)
 	if err != nil {
+		release()
+		err = client.attemptError(ctx, attemptCtx, hostport, err)
+		client.record(es2plusCommand, attempt, req, payload, nil, nil, err, started)
 		return err
 	}
 	defer resp.Body.Close()
 
-	// TODO Should check response headers here!
-	// (in particular X-admin-protocol) and fail if not OK.
+	body, err := ioutil.ReadAll(resp.Body)
+	release()
+	if err != nil {
+		err = client.attemptError(ctx, attemptCtx, hostport, err)
+		client.record(es2plusCommand, attempt, req, payload, resp, nil, err, started)
+		return err
+	}
+
+	if client.logHeaders {
+		logger.Debugf("Response <- %s", formatResponse(resp))
+	}
+	if client.logPayload {
+		logger.Debugf("Response payload <- %s", client.redact(body))
+	}
 
-	return json.NewDecoder(resp.Body).Decode(&result)
+	// Bodies that aren't JSON are left for interpretResponse to
+	// complain about.
+	canonicalBody := body
+	if decoded, decodeErr := client.dialect.decode(body); decodeErr == nil {
+		canonicalBody = decoded
+	}
+	err = interpretResponse(es2plusCommand, resp, canonicalBody, result)
+	client.record(es2plusCommand, attempt, req, payload, resp, body, err, started)
+	return err
+}
+
+// redact returns a payload, as sent to or received from the SM-DP+,
+// with the values of secret fields replaced.
+func (client *ClientState) redact(payload []byte) []byte {
+	return redactPayload(payload, client.dialect.secretFields())
+}
+
+// attemptError returns an *AttemptTimeoutError if an attempt failed
+// because it ran out of time while the invocation as a whole didn't,
+// otherwise the error as it is.
+func (client *ClientState) attemptError(ctx context.Context, attemptCtx context.Context, hostport string, err error) error {
+	if ctx.Err() == nil && attemptCtx.Err() == context.DeadlineExceeded {
+		return &AttemptTimeoutError{Hostport: hostport, After: client.attemptTimeout}
+	}
+	return err
+}
+
+// interpretResponse unmarshals a successful response into the result
+// object, or returns an *Error describing why it isn't successful.
+func interpretResponse(es2plusCommand string, resp *http.Response, body []byte, result interface{}) error {
+
+	// Whatever the HTTP status, the body may contain a function execution
+	// status explaining what went wrong, so try to find one.
+	header := new(struct {
+		Header ResponseHeader `json:"header"`
+	})
+	headerErr := json.Unmarshal(body, header)
+	executionStatus := header.Header.FunctionExecutionStatus
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if headerErr == nil && executionStatus.FunctionExecutionStatusType != "" {
+			return newErrorFromStatus(es2plusCommand, resp.StatusCode, executionStatus)
+		}
+		return &Error{
+			Function:       es2plusCommand,
+			HTTPStatusCode: resp.StatusCode,
+			Message:        truncate(strings.TrimSpace(string(body)), 200),
+		}
+	}
+
+	if !strings.HasPrefix(resp.Header.Get("X-Admin-Protocol"), adminProtocolPrefix) {
+		return &Error{
+			Function:       es2plusCommand,
+			HTTPStatusCode: resp.StatusCode,
+			Message:        fmt.Sprintf("missing or unsupported X-Admin-Protocol response header '%s'", resp.Header.Get("X-Admin-Protocol")),
+		}
+	}
+
+	if headerErr != nil {
+		return &Error{
+			Function:       es2plusCommand,
+			HTTPStatusCode: resp.StatusCode,
+			Message:        fmt.Sprintf("couldn't parse response: %s", headerErr),
+		}
+	}
+
+	if !isSuccess(executionStatus.FunctionExecutionStatusType) {
+		return newErrorFromStatus(es2plusCommand, resp.StatusCode, executionStatus)
+	}
+
+	return json.Unmarshal(body, result)
+}
+
+// truncate returns at most the first maxLen bytes of s.
+func truncate(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	return s[:maxLen] + "..."
 }
 
 ///
@@ -310,34 +802,185 @@ func (client *ClientState) execute(
 
 // GetStatus  will return the status of a profile with a specific ICCID.
 func (client *ClientState) GetStatus(iccid string) (*ProfileStatus, error) {
+	return client.GetStatusContext(context.Background(), iccid)
+}
+
+// GetStatusContext is like GetStatus, but takes a context controlling
+// deadlines and cancellation.
+func (client *ClientState) GetStatusContext(ctx context.Context, iccid string) (*ProfileStatus, error) {
+	result, err := client.getProfileStatusList(ctx, []string{iccid})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result) == 0 {
+		return nil, nil
+	} else if len(result) == 1 {
+		return &result[0], nil
+	} else {
+		return nil, fmt.Errorf("GetStatus returned more than one profile")
+	}
+}
+
+// GetStatuses will return the statuses of the profiles with the ICCIDs
+// in the parameter list, keyed by ICCID.  The ICCIDs are packed into
+// as few getProfileStatus requests as the client's maximum number of
+// ICCIDs per request allows.   ICCIDs the SM-DP+ didn't return a status
+// for, or says it doesn't know, are returned in the second return value,
+// in the order they were given.  If some of the requests fail, the
+// statuses returned by the others are returned along with a
+// *StatusesError telling which ICCIDs weren't looked up.
+func (client *ClientState) GetStatuses(iccids []string) (map[string]*ProfileStatus, []string, error) {
+	return client.GetStatusesContext(context.Background(), iccids)
+}
+
+// GetStatusesContext is like GetStatuses, but takes a context controlling
+// deadlines and cancellation.
+func (client *ClientState) GetStatusesContext(ctx context.Context, iccids []string) (map[string]*ProfileStatus, []string, error) {
+
+	// Don't ask for the same ICCID twice.
+	var unique []string
+	seen := make(map[string]bool, len(iccids))
+	for _, iccid := range iccids {
+		if !seen[iccid] {
+			seen[iccid] = true
+			unique = append(unique, iccid)
+		}
+	}
+
+	var chunks [][]string
+	for start := 0; start < len(unique); start += client.maxIccidsPerRequest {
+		end := start + client.maxIccidsPerRequest
+		if end > len(unique) {
+			end = len(unique)
+		}
+		chunks = append(chunks, unique[start:end])
+	}
+
+	statuses := make(map[string]*ProfileStatus, len(unique))
+	var failed []FailedStatusRequest
+	var mutex = &sync.Mutex{}
+	var waitgroup sync.WaitGroup
+
+	sem := make(chan bool, maxConcurrentStatusRequests)
+	for i, chunk := range chunks {
+		sem <- true
+		if err := ctx.Err(); err != nil {
+			<-sem
+			for _, notSent := range chunks[i:] {
+				failed = append(failed, FailedStatusRequest{Iccids: notSent, Err: err})
+			}
+			break
+		}
+		waitgroup.Add(1)
+		go func(chunk []string) {
+			defer func() { <-sem }()
+			defer waitgroup.Done()
+
+			result, chunkFailures := client.getProfileStatusChunk(ctx, chunk)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			for i := range result {
+				// Only keep the statuses we asked for.
+				if seen[result[i].Iccid] {
+					statuses[result[i].Iccid] = &result[i]
+				}
+			}
+			failed = append(failed, chunkFailures...)
+		}(chunk)
+	}
+	waitgroup.Wait()
+
+	notLookedUp := make(map[string]bool)
+	for _, f := range failed {
+		for _, iccid := range f.Iccids {
+			notLookedUp[iccid] = true
+		}
+	}
+	var missing []string
+	for _, iccid := range unique {
+		if _, found := statuses[iccid]; !found && !notLookedUp[iccid] {
+			missing = append(missing, iccid)
+		}
+	}
+	if len(failed) > 0 {
+		return statuses, missing, &StatusesError{Failed: failed}
+	}
+	return statuses, missing, nil
+}
+
+// getProfileStatusChunk asks for the statuses of a chunk of ICCIDs.  An
+// SM-DP+ may refuse the whole request if it doesn't know one of the
+// ICCIDs, so they are then asked for one at a time, to tell the unknown
+// ICCIDs from the others.  Unknown ICCIDs are neither returned nor
+// reported as failed.
+func (client *ClientState) getProfileStatusChunk(ctx context.Context, chunk []string) ([]ProfileStatus, []FailedStatusRequest) {
+	result, err := client.getProfileStatusList(ctx, chunk)
+	if err == nil {
+		return result, nil
+	}
+	es2Err, ok := err.(*Error)
+	switch {
+	case !ok || !es2Err.IsProfileNotFound():
+		return nil, []FailedStatusRequest{{Iccids: chunk, Err: err}}
+	case len(chunk) == 1:
+		return nil, nil
+	}
+
+	var failed []FailedStatusRequest
+	for _, iccid := range chunk {
+		single, singleFailed := client.getProfileStatusChunk(ctx, []string{iccid})
+		result = append(result, single...)
+		failed = append(failed, singleFailed...)
+	}
+	return result, failed
+}
+
+// getProfileStatusList executes a single getProfileStatus request
+// for all of the ICCIDs in the parameter list.
+func (client *ClientState) getProfileStatusList(ctx context.Context, iccids []string) ([]ProfileStatus, error) {
 	result := new(es2ProfileStatusResponse)
 	es2plusCommand := "getProfileStatus"
 	header, err := newHeader(client)
 	if err != nil {
 		return nil, err
 	}
+	iccidList := make([]ICCID, len(iccids))
+	for i, iccid := range iccids {
+		iccidList[i] = ICCID{Iccid: iccid}
+	}
 	payload := &GetProfileStatusRequest{
 		Header:    *header,
-		IccidList: []ICCID{ICCID{Iccid: iccid}},
+		IccidList: iccidList,
 	}
-	if err = client.execute(es2plusCommand, payload, result); err != nil {
+	if err = client.execute(ctx, es2plusCommand, payload, result); err != nil {
 		return nil, err
 	}
-
-	if len(result.ProfileStatusList) == 0 {
-		return nil, nil
-	} else if len(result.ProfileStatusList) == 1 {
-		return &result.ProfileStatusList[0], nil
-	} else {
-		return nil, fmt.Errorf("GetStatus returned more than one profile")
-	}
+	client.observeStatuses(result.ProfileStatusList)
+	return result.ProfileStatusList, nil
 }
 
 // RecoverProfile will recover the state of the profile with a particular ICCID,
-// by setting it to the target state.
-func (client *ClientState) RecoverProfile(iccid string, targetState string) (*RecoverProfileResponse, error) {
+// by setting it to the target state.  The transition is checked against the
+// current state of the profile before anything is sent.
+func (client *ClientState) RecoverProfile(iccid string, targetState RecoverProfileTarget) (*RecoverProfileResponse, error) {
+	return client.RecoverProfileContext(context.Background(), iccid, targetState)
+}
+
+// RecoverProfileContext is like RecoverProfile, but takes a context controlling
+// deadlines and cancellation.
+func (client *ClientState) RecoverProfileContext(ctx context.Context, iccid string, targetState RecoverProfileTarget) (*RecoverProfileResponse, error) {
 	result := new(RecoverProfileResponse)
 	es2plusCommand := "recoverProfile"
+	targetState, err := ParseRecoverProfileTarget(string(targetState))
+	if err != nil {
+		return nil, err
+	}
+	sources := recoverProfileSources[targetState]
+	if err := client.checkTransition(ctx, es2plusCommand, iccid, ProfileState(targetState), sources); err != nil {
+		return nil, err
+	}
 	header, err := newHeader(client)
 	if err != nil {
 		return nil, err
@@ -345,16 +988,33 @@ func (client *ClientState) RecoverProfile(iccid string, targetState string) (*Re
 	payload := &RecoverProfileRequest{
 		Header:        *header,
 		Iccid:         iccid,
-		ProfileStatus: targetState,
+		ProfileStatus: string(targetState),
 	}
-	return result,  client.execute(es2plusCommand, payload, result)
+	if err = client.execute(ctx, es2plusCommand, payload, result); err != nil {
+		return nil, err
+	}
+	client.observeStateChange(iccid, ProfileState(targetState), "")
+	return result, nil
 }
 
 // CancelOrder will cancel an order by setting  the state of the profile with a particular ICCID,
-// the target state.
-func (client *ClientState) CancelOrder(iccid string, targetState string) (*CancelOrderResponse, error) {
+// the target state.  The profile's current state is checked before anything is sent.
+func (client *ClientState) CancelOrder(iccid string, targetState CancelOrderTarget) (*CancelOrderResponse, error) {
+	return client.CancelOrderContext(context.Background(), iccid, targetState)
+}
+
+// CancelOrderContext is like CancelOrder, but takes a context controlling
+// deadlines and cancellation.
+func (client *ClientState) CancelOrderContext(ctx context.Context, iccid string, targetState CancelOrderTarget) (*CancelOrderResponse, error) {
 	result := new(CancelOrderResponse)
 	es2plusCommand := "cancelOrder"
+	targetState, err := ParseCancelOrderTarget(string(targetState))
+	if err != nil {
+		return nil, err
+	}
+	if err := client.checkTransition(ctx, es2plusCommand, iccid, ProfileState(targetState), cancelOrderSources); err != nil {
+		return nil, err
+	}
 	header, err := newHeader(client)
 	if err != nil {
 		return nil, err
@@ -362,14 +1022,54 @@ func (client *ClientState) CancelOrder(iccid string, targetState string) (*Cance
 	payload := &CancelOrderRequest{
 		Header:                      *header,
 		Iccid:                       iccid,
-		FinalProfileStatusIndicator: targetState,
+		FinalProfileStatusIndicator: string(targetState),
+	}
+	if err = client.execute(ctx, es2plusCommand, payload, result); err != nil {
+		return nil, err
 	}
-	return result,  client.execute(es2plusCommand, payload, result)
+	client.observeStateChange(iccid, ProfileState(targetState), "")
+	return result, nil
+}
+
+// ReleaseProfile will make a profile whose order was confirmed without
+// the release flag available for download.  The profile's current state
+// is checked before anything is sent.
+func (client *ClientState) ReleaseProfile(iccid string) (*ReleaseProfileResponse, error) {
+	return client.ReleaseProfileContext(context.Background(), iccid)
+}
+
+// ReleaseProfileContext is like ReleaseProfile, but takes a context controlling
+// deadlines and cancellation.
+func (client *ClientState) ReleaseProfileContext(ctx context.Context, iccid string) (*ReleaseProfileResponse, error) {
+	result := new(ReleaseProfileResponse)
+	es2plusCommand := "releaseProfile"
+	if err := client.checkTransition(ctx, es2plusCommand, iccid, ProfileStateReleased, releaseProfileSources); err != nil {
+		return nil, err
+	}
+	header, err := newHeader(client)
+	if err != nil {
+		return nil, err
+	}
+	payload := &ReleaseProfileRequest{
+		Header: *header,
+		Iccid:  iccid,
+	}
+	if err = client.execute(ctx, es2plusCommand, payload, result); err != nil {
+		return nil, err
+	}
+	client.observeStateChange(iccid, ProfileStateReleased, "")
+	return result, nil
 }
 
 // DownloadOrder will prepare the profile to be downloaded (first of two steps, the
 // ConfirmDownload is also necessary).
-func (client *ClientState) DownloadOrder(iccid string) (*DownloadOrderResponse, error) {
+func (client *ClientState) DownloadOrder(iccid string, params OrderParameters) (*DownloadOrderResponse, error) {
+	return client.DownloadOrderContext(context.Background(), iccid, params)
+}
+
+// DownloadOrderContext is like DownloadOrder, but takes a context controlling
+// deadlines and cancellation.
+func (client *ClientState) DownloadOrderContext(ctx context.Context, iccid string, params OrderParameters) (*DownloadOrderResponse, error) {
 	result := new(DownloadOrderResponse)
 	es2plusCommand := "downloadOrder"
 	header, err := newHeader(client)
@@ -379,23 +1079,36 @@ func (client *ClientState) DownloadOrder(iccid string) (*DownloadOrderResponse,
 	payload := &DownloadOrderRequest{
 		Header:      *header,
 		Iccid:       iccid,
-		Eid:         "",
-		Profiletype: "",
+		Eid:         params.Eid,
+		Profiletype: params.ProfileType,
 	}
-	if err =  client.execute(es2plusCommand, payload, result); err != nil {
+	if err =  client.execute(ctx, es2plusCommand, payload, result); err != nil {
 		return nil, err
 	}
 
-	executionStatus := result.Header.FunctionExecutionStatus.FunctionExecutionStatusType
-	if executionStatus == "Executed-Success" {
-		return result, nil
+	// The SM-DP+ picks a profile if no ICCID was given, and links it
+	// to the eUICC if an EID was.
+	state := ProfileStateAllocated
+	if params.Eid != "" {
+		state = ProfileStateLinked
 	}
-	return result, fmt.Errorf("ExecutionStatus was: ''%s'", executionStatus)
+	allocated := result.Iccid
+	if allocated == "" {
+		allocated = iccid
+	}
+	client.observeStateChange(allocated, state, params.Eid)
+	return result, nil
 }
 
 // ConfirmOrder will execute the second of the two steps that are necessary to prepare a profile for
 // to be downloaded.
-func (client *ClientState) ConfirmOrder(iccid string) (*ConfirmOrderResponse, error) {
+func (client *ClientState) ConfirmOrder(iccid string, params OrderParameters) (*ConfirmOrderResponse, error) {
+	return client.ConfirmOrderContext(context.Background(), iccid, params)
+}
+
+// ConfirmOrderContext is like ConfirmOrder, but takes a context controlling
+// deadlines and cancellation.
+func (client *ClientState) ConfirmOrderContext(ctx context.Context, iccid string, params OrderParameters) (*ConfirmOrderResponse, error) {
 	result := new(ConfirmOrderResponse)
 	es2plusCommand := "confirmOrder"
 	header, err := newHeader(client)
@@ -405,22 +1118,26 @@ func (client *ClientState) ConfirmOrder(iccid string) (*ConfirmOrderResponse, er
 	payload := &ConfirmOrderRequest{
 		Header:           *header,
 		Iccid:            iccid,
-		Eid:              "",
-		ConfirmationCode: "",
-		MatchingID:       "",
-		SmdpAddress:      "",
-		ReleaseFlag:      true,
+		Eid:              params.Eid,
+		ConfirmationCode: params.ConfirmationCode,
+		MatchingID:       params.MatchingID,
+		SmdsAddress:      params.SmdsAddress,
+		ReleaseFlag:      !params.NoRelease,
 	}
 
-	if err =  client.execute(es2plusCommand, payload, result); err != nil {
+	if err =  client.execute(ctx, es2plusCommand, payload, result); err != nil {
 		return nil, err
 	}
 
-	executionStatus := result.Header.FunctionExecutionStatus.FunctionExecutionStatusType
-	if executionStatus != "Executed-Success" {
-		return result, fmt.Errorf("ExecutionStatus was: ''%s'", executionStatus)
+	state := ProfileStateReleased
+	if params.NoRelease {
+		state = ProfileStateConfirmed
 	}
-
+	eid := result.Eid
+	if eid == "" {
+		eid = params.Eid
+	}
+	client.observeStateChange(iccid, state, eid)
 	return result, nil
 }
 
@@ -428,33 +1145,80 @@ func (client *ClientState) ConfirmOrder(iccid string) (*ConfirmOrderResponse, er
 // ActivateIccid will take a profile to the state "READY" where it can be downloaded.
 // This function will if poll the current status of the profile, and if
 // necessary advance the state by executing the DownloadOrder and
-// ConfirmOrder functions.
-func (client *ClientState) ActivateIccid(iccid string) (*ProfileStatus, error) {
+// ConfirmOrder functions, passing on the order parameters.
+func (client *ClientState) ActivateIccid(iccid string, params OrderParameters) (*ProfileStatus, error) {
+	return client.ActivateIccidContext(context.Background(), iccid, params)
+}
 
-	result, err := client.GetStatus(iccid)
+// ActivateIccidContext is like ActivateIccid, but takes a context controlling
+// deadlines and cancellation.
+func (client *ClientState) ActivateIccidContext(ctx context.Context, iccid string, params OrderParameters) (*ProfileStatus, error) {
+	activation, err := client.Activate(ctx, iccid, params)
 	if err != nil {
 		return nil, err
 	}
+	return activation.Status, nil
+}
+
+// Activation tells what activating a profile did, as far as it got.
+type Activation struct {
+	// Status of the profile once activated.  Nil if activation failed.
+	Status *ProfileStatus
+
+	// Ordered is set if downloadOrder was invoked successfully.
+	Ordered bool
+
+	// Confirmed is the response to confirmOrder, if it was invoked
+	// successfully.
+	Confirmed *ConfirmOrderResponse
+}
+
+// Changed is true if the activation changed the state of the profile
+// on the SM-DP+, rather than finding it ready.
+func (activation *Activation) Changed() bool {
+	return activation.Ordered || activation.Confirmed != nil
+}
+
+// Activate is like ActivateIccidContext, but also tells which of the
+// steps were taken.  The activation is returned even if it fails, telling
+// how far it got.
+func (client *ClientState) Activate(ctx context.Context, iccid string, params OrderParameters) (*Activation, error) {
+	activation := &Activation{}
+
+	result, err := client.GetStatusContext(ctx, iccid)
+	if err != nil {
+		return activation, err
+	}
+	if result == nil {
+		return activation, fmt.Errorf("no status returned for iccid '%s'", iccid)
+	}
 
 	if result.ACToken == "" {
 
-		if result.State == "AVAILABLE" {
-			if _, err := client.DownloadOrder(iccid); err != nil {
-				return nil, err
+		if ProfileState(result.State) == ProfileStateAvailable {
+			if _, err := client.DownloadOrderContext(ctx, iccid, params); err != nil {
+				return activation, err
 			}
-			if result, err = client.GetStatus(iccid); err != nil {
-				return nil, err
+			activation.Ordered = true
+			if result, err = client.GetStatusContext(ctx, iccid); err != nil {
+				return activation, err
 			}
 		}
 
-		if result.State == "ALLOCATED" {
-			if _, err = client.ConfirmOrder(iccid); err != nil {
-				return nil, err
+		if ProfileState(result.State) == ProfileStateAllocated {
+			if activation.Confirmed, err = client.ConfirmOrderContext(ctx, iccid, params); err != nil {
+				return activation, err
 			}
 		}
 	}
-	result, err = client.GetStatus(iccid)
-	return result, err
+	activation.Status, err = client.GetStatusContext(ctx, iccid)
+	return activation, err
+}
+
+// RetryCount returns the number of times the client has retried
+// failed invocations.
+func (client *ClientState) RetryCount() int64 {
+	return atomic.LoadInt64(&client.retryCount)
 }
 
 // RequesterID TODO: This shouldn't have to be public, but how can it be avoided?
@@ -0,0 +1,203 @@
+package es2plus
+
+import (
+	"encoding/json"
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestClient returns a client talking to a TLS test server
+// serving the handler.
+func newTestClient(t *testing.T, handler http.Handler, options ...ClientOption) (*ClientState, *httptest.Server) {
+	server := httptest.NewTLSServer(handler)
+	client := &ClientState{
+		httpClient:          server.Client(),
+		hostport:            strings.TrimPrefix(server.URL, "https://"),
+		requesterID:         "test-requester",
+		maxIccidsPerRequest: DefaultMaxIccidsPerRequest,
+	}
+	for _, option := range options {
+		option(client)
+	}
+	return client, server
+}
+
+func successHeader() ResponseHeader {
+	return ResponseHeader{FunctionExecutionStatus: FunctionExecutionStatus{FunctionExecutionStatusType: StatusExecutedSuccess}}
+}
+
+func writeResponse(w http.ResponseWriter, httpStatus int, response interface{}) {
+	w.Header().Set("X-Admin-Protocol", "gsma/rsp/v2.1.0")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func TestGetStatusesChunksRequests(t *testing.T) {
+	var mutex sync.Mutex
+	var requestSizes []int
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := new(GetProfileStatusRequest)
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			t.Fatal(err)
+		}
+		mutex.Lock()
+		requestSizes = append(requestSizes, len(request.IccidList))
+		mutex.Unlock()
+
+		response := es2ProfileStatusResponse{Header: successHeader()}
+		for _, iccid := range request.IccidList {
+			// Pretend we've never heard of the last profile.
+			if iccid.Iccid != "8947000000000000069" {
+				response.ProfileStatusList = append(response.ProfileStatusList, ProfileStatus{Iccid: iccid.Iccid, State: "AVAILABLE"})
+			}
+		}
+		writeResponse(w, http.StatusOK, response)
+	})
+
+	client, server := newTestClient(t, handler, WithMaxIccidsPerRequest(3))
+	defer server.Close()
+
+	var iccids []string
+	for _, suffix := range []string{"01", "02", "03", "04", "05", "06", "07", "08", "08", "69"} {
+		iccids = append(iccids, "89470000000000000"+suffix)
+	}
+
+	statuses, missing, err := client.GetStatuses(iccids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nine unique ICCIDs, three per request.
+	assert.Equal(t, 3, len(requestSizes))
+	for _, size := range requestSizes {
+		assert.Equal(t, 3, size)
+	}
+
+	assert.Equal(t, 8, len(statuses))
+	assert.Equal(t, "AVAILABLE", statuses["8947000000000000001"].State)
+	assert.DeepEqual(t, []string{"8947000000000000069"}, missing)
+}
+
+func TestGetStatusesReturnsWhatItCould(t *testing.T) {
+	var mutex sync.Mutex
+	var requestSizes []int
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := new(GetProfileStatusRequest)
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			t.Fatal(err)
+		}
+		mutex.Lock()
+		requestSizes = append(requestSizes, len(request.IccidList))
+		mutex.Unlock()
+
+		response := es2ProfileStatusResponse{Header: successHeader()}
+		for _, iccid := range request.IccidList {
+			switch iccid.Iccid {
+			case "8947000000000000005":
+				// Refuse the whole request because of one unknown profile.
+				response.Header.FunctionExecutionStatus = FunctionExecutionStatus{
+					FunctionExecutionStatusType: StatusFailed,
+					StatusCodeData:              StatusCodeData{SubjectCode: SubjectProfileIccid, ReasonCode: ReasonUnknown},
+				}
+				response.ProfileStatusList = nil
+				writeResponse(w, http.StatusOK, response)
+				return
+			case "8947000000000000008":
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			response.ProfileStatusList = append(response.ProfileStatusList, ProfileStatus{Iccid: iccid.Iccid, State: "AVAILABLE"})
+		}
+		writeResponse(w, http.StatusOK, response)
+	})
+
+	client, server := newTestClient(t, handler, WithMaxIccidsPerRequest(3), WithRetryPolicy(NoRetries))
+	defer server.Close()
+
+	var iccids []string
+	for _, suffix := range []string{"01", "02", "03", "04", "05", "06", "07", "08", "09"} {
+		iccids = append(iccids, "89470000000000000"+suffix)
+	}
+
+	statuses, missing, err := client.GetStatuses(iccids)
+
+	// The chunk with the unknown profile is asked for again, one
+	// ICCID at a time.
+	assert.Equal(t, 6, len(requestSizes))
+	assert.Equal(t, 5, len(statuses))
+	assert.Equal(t, "AVAILABLE", statuses["8947000000000000006"].State)
+	assert.DeepEqual(t, []string{"8947000000000000005"}, missing)
+
+	statusesErr, ok := err.(*StatusesError)
+	assert.Assert(t, ok, "expected *StatusesError, got %v", err)
+	assert.Equal(t, 1, len(statusesErr.Failed))
+	assert.DeepEqual(t, []string{"8947000000000000007", "8947000000000000008", "8947000000000000009"}, statusesErr.Failed[0].Iccids)
+}
+
+func TestFailedExecutionStatusIsReturnedAsError(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == es2plusPath("getProfileStatus") {
+			writeResponse(w, http.StatusOK, es2ProfileStatusResponse{
+				Header:            successHeader(),
+				ProfileStatusList: []ProfileStatus{{Iccid: "8947000000000000001", State: "ALLOCATED"}},
+			})
+			return
+		}
+		writeResponse(w, http.StatusOK, CancelOrderResponse{
+			Header: ResponseHeader{FunctionExecutionStatus: FunctionExecutionStatus{
+				FunctionExecutionStatusType: StatusFailed,
+				StatusCodeData: StatusCodeData{
+					SubjectCode:       SubjectProfileIccid,
+					ReasonCode:        ReasonUnknown,
+					SubjectIdentifier: "8947000000000000001",
+					Message:           "No such profile",
+				},
+			}},
+		})
+	})
+	client, server := newTestClient(t, handler)
+	defer server.Close()
+
+	result, err := client.CancelOrder("8947000000000000001", "AVAILABLE")
+	assert.Assert(t, result == nil)
+	es2Err, ok := err.(*Error)
+	assert.Assert(t, ok, "expected *Error, got %v", err)
+	assert.Equal(t, "cancelOrder", es2Err.Function)
+	assert.Equal(t, "8947000000000000001", es2Err.SubjectIdentifier)
+	assert.Assert(t, es2Err.IsProfileNotFound())
+	assert.Assert(t, !es2Err.IsInvalidState())
+	assert.Assert(t, !es2Err.IsAuthFailure())
+}
+
+func TestUnacceptableHTTPResponsesAreReturnedAsErrors(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case es2plusPath("getProfileStatus"):
+			http.Error(w, "forbidden", http.StatusForbidden)
+		default:
+			// Successful, but without the X-Admin-Protocol header.
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(DownloadOrderResponse{Header: successHeader()})
+		}
+	})
+	client, server := newTestClient(t, handler)
+	defer server.Close()
+
+	_, err := client.GetStatus("8947000000000000001")
+	es2Err, ok := err.(*Error)
+	assert.Assert(t, ok, "expected *Error, got %v", err)
+	assert.Equal(t, http.StatusForbidden, es2Err.HTTPStatusCode)
+	assert.Assert(t, es2Err.IsAuthFailure())
+
+	_, err = client.DownloadOrder("8947000000000000001", OrderParameters{})
+	es2Err, ok = err.(*Error)
+	assert.Assert(t, ok, "expected *Error, got %v", err)
+	assert.Assert(t, strings.Contains(es2Err.Message, "X-Admin-Protocol"))
+}
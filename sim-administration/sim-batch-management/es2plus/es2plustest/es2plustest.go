@@ -0,0 +1,536 @@
+// Package es2plustest provides an in-process fake SM-DP+ implementing
+// the ES2+ functions used by the es2plus client, and the ES9+ functions
+// used by the lpa simulator, for use in tests.
+package es2plustest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/es2plus"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/lpa"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/store"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Profile states used by the fake SM-DP+.
+const (
+	StateAvailable   = "AVAILABLE"
+	StateAllocated   = "ALLOCATED"
+	StateConfirmed   = "CONFIRMED"
+	StateReleased    = "RELEASED"
+	StateDownloaded  = "DOWNLOADED"
+	StateInstalled   = "INSTALLED"
+	StateUnavailable = "UNAVAILABLE"
+)
+
+// Profile is the state of a single profile held by the fake SM-DP+.
+type Profile struct {
+	Iccid            string
+	State            string
+	Eid              string
+	ProfileType      string
+	MatchingID       string
+	ConfirmationCode string
+	ACToken          string
+}
+
+// Fault describes a misbehaviour to inject into the fake SM-DP+.  A
+// fault applies to invocations matching Function and Iccid (empty
+// values match anything).
+type Fault struct {
+	Function string
+	Iccid    string
+
+	// Delay the response.
+	Latency time.Duration
+
+	// Respond with this HTTP status code instead of processing
+	// the request.
+	HTTPStatus int
+
+	// Respond with a "Failed" function execution status carrying
+	// this status code data instead of processing the request.
+	StatusCodeData *es2plus.StatusCodeData
+
+	// Close the connection without responding.
+	DropConnection bool
+
+	// Number of times the fault is triggered before it is removed,
+	// zero means forever.
+	Times int
+}
+
+// Server is a fake SM-DP+ serving ES2+ and ES9+ over TLS.
+type Server struct {
+	*httptest.Server
+
+	SmdpAddress string
+
+	mutex        sync.Mutex
+	profiles     map[string]*Profile
+	faults       []*Fault
+	calls        map[string]int
+	transactions map[string]*transaction
+}
+
+// NewServer starts a new fake SM-DP+ without any profiles.  It must be
+// closed by the caller when no longer needed.
+func NewServer() *Server {
+	server := &Server{
+		SmdpAddress:  "smdp.example.com",
+		profiles:     make(map[string]*Profile),
+		calls:        make(map[string]int),
+		transactions: make(map[string]*transaction),
+	}
+
+	mux := http.NewServeMux()
+	for function, handler := range map[string]func([]byte) (interface{}, error){
+		"getProfileStatus": server.getProfileStatus,
+		"downloadOrder":    server.downloadOrder,
+		"confirmOrder":     server.confirmOrder,
+		"cancelOrder":      server.cancelOrder,
+		"recoverProfile":   server.recoverProfile,
+		"releaseProfile":   server.releaseProfile,
+	} {
+		mux.HandleFunc("/gsma/rsp2/es2plus/"+function, server.serve(function, handler))
+	}
+	for function, handler := range map[string]func([]byte) (interface{}, error){
+		lpa.StepInitiateAuthentication: server.initiateAuthentication,
+		lpa.StepAuthenticateClient:     server.authenticateClient,
+		lpa.StepGetBoundProfilePackage: server.getBoundProfilePackage,
+		lpa.StepHandleNotification:     server.handleNotification,
+	} {
+		mux.HandleFunc("/gsma/rsp2/es9plus/"+function, server.serve(function, handler))
+	}
+	server.Server = httptest.NewTLSServer(mux)
+	return server
+}
+
+// NewClient returns an es2plus client talking to the fake SM-DP+.  Retries
+// are disabled unless a retry policy is given as an option.
+func (server *Server) NewClient(options ...es2plus.ClientOption) *es2plus.ClientState {
+	options = append([]es2plus.ClientOption{
+		es2plus.WithHTTPClient(server.Client()),
+		es2plus.WithRetryPolicy(es2plus.NoRetries),
+	}, options...)
+	return es2plus.NewClient("", "", strings.TrimPrefix(server.URL, "https://"), "fake-requester", options...)
+}
+
+// AddProfile makes a profile known to the fake SM-DP+, in the
+// AVAILABLE state.
+func (server *Server) AddProfile(iccid string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.profiles[iccid] = &Profile{Iccid: iccid, State: StateAvailable}
+}
+
+// SeedFromBatch adds all the profiles in the named batch to the
+// fake SM-DP+.
+func (server *Server) SeedFromBatch(db store.Store, batchName string) error {
+	batch, err := db.GetBatchByName(batchName)
+	if err != nil {
+		return err
+	}
+	if batch == nil {
+		return fmt.Errorf("no batch found with name '%s'", batchName)
+	}
+	entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		server.AddProfile(entry.Iccid)
+	}
+	return nil
+}
+
+// Profile returns a copy of the current state of a profile, or nil
+// if the fake SM-DP+ doesn't know about it.
+func (server *Server) Profile(iccid string) *Profile {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	profile, found := server.profiles[iccid]
+	if !found {
+		return nil
+	}
+	result := *profile
+	return &result
+}
+
+// SimulateDownload moves a RELEASED profile to DOWNLOADED, as if
+// an LPA had downloaded it.
+func (server *Server) SimulateDownload(iccid string, eid string) error {
+	return server.transition(iccid, StateReleased, StateDownloaded, eid)
+}
+
+// SimulateInstall moves a DOWNLOADED profile to INSTALLED, as if
+// an eUICC had installed it.
+func (server *Server) SimulateInstall(iccid string) error {
+	return server.transition(iccid, StateDownloaded, StateInstalled, "")
+}
+
+func (server *Server) transition(iccid string, from string, to string, eid string) error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	profile, found := server.profiles[iccid]
+	if !found {
+		return fmt.Errorf("unknown profile '%s'", iccid)
+	}
+	if profile.State != from {
+		return fmt.Errorf("profile '%s' is in state %s, not %s", iccid, profile.State, from)
+	}
+	profile.State = to
+	if eid != "" {
+		profile.Eid = eid
+	}
+	return nil
+}
+
+// InjectFault adds a fault to the fake SM-DP+.
+func (server *Server) InjectFault(fault Fault) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.faults = append(server.faults, &fault)
+}
+
+// ClearFaults removes all injected faults.
+func (server *Server) ClearFaults() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.faults = nil
+}
+
+// Calls returns the number of times an ES2+ or ES9+ function has been
+// invoked, including invocations that were hit by faults.
+func (server *Server) Calls(function string) int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.calls[function]
+}
+
+///
+///  Request processing
+///
+
+// requestWithIccid picks out the parts of a request needed to
+// match faults against it.
+type requestWithIccid struct {
+	Iccid     string          `json:"iccid"`
+	IccidList []es2plus.ICCID `json:"iccidList"`
+}
+
+func (server *Server) serve(function string, handler func([]byte) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		parsed := new(requestWithIccid)
+		if err := json.Unmarshal(body, parsed); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		iccids := []string{parsed.Iccid}
+		for _, iccid := range parsed.IccidList {
+			iccids = append(iccids, iccid.Iccid)
+		}
+
+		fault := server.recordCall(function, iccids)
+		if fault != nil {
+			if fault.Latency > 0 {
+				time.Sleep(fault.Latency)
+			}
+			if fault.DropConnection {
+				dropConnection(w)
+				return
+			}
+			if fault.HTTPStatus != 0 {
+				http.Error(w, "injected fault", fault.HTTPStatus)
+				return
+			}
+			if fault.StatusCodeData != nil {
+				writeResponse(w, failed(*fault.StatusCodeData))
+				return
+			}
+		}
+
+		response, err := handler(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if response == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeResponse(w, response)
+	}
+}
+
+// recordCall counts an invocation and returns the first fault
+// matching it, if any.
+func (server *Server) recordCall(function string, iccids []string) *Fault {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.calls[function]++
+
+	for i, fault := range server.faults {
+		if fault.Function != "" && fault.Function != function {
+			continue
+		}
+		if fault.Iccid != "" && !contains(iccids, fault.Iccid) {
+			continue
+		}
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				server.faults = append(server.faults[:i], server.faults[i+1:]...)
+			}
+		}
+		return fault
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func dropConnection(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic("can't drop connection, response writer is not a hijacker")
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(err)
+	}
+	_ = conn.Close()
+}
+
+func writeResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("X-Admin-Protocol", "gsma/rsp/v2.0.0")
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func success() es2plus.ResponseHeader {
+	return es2plus.ResponseHeader{
+		FunctionExecutionStatus: es2plus.FunctionExecutionStatus{
+			FunctionExecutionStatusType: es2plus.StatusExecutedSuccess,
+		},
+	}
+}
+
+func failed(statusCodeData es2plus.StatusCodeData) interface{} {
+	return struct {
+		Header es2plus.ResponseHeader `json:"header"`
+	}{
+		Header: es2plus.ResponseHeader{
+			FunctionExecutionStatus: es2plus.FunctionExecutionStatus{
+				FunctionExecutionStatusType: es2plus.StatusFailed,
+				StatusCodeData:              statusCodeData,
+			},
+		},
+	}
+}
+
+func unknownProfile(iccid string) interface{} {
+	return failed(es2plus.StatusCodeData{
+		SubjectCode:       es2plus.SubjectProfileIccid,
+		ReasonCode:        es2plus.ReasonUnknown,
+		SubjectIdentifier: iccid,
+		Message:           "Unknown profile",
+	})
+}
+
+func invalidTransition(profile *Profile, function string) interface{} {
+	return failed(es2plus.StatusCodeData{
+		SubjectCode:       es2plus.SubjectProfileIccid,
+		ReasonCode:        es2plus.ReasonInvalidTransition,
+		SubjectIdentifier: profile.Iccid,
+		Message:           fmt.Sprintf("Can't %s profile in state %s", function, profile.State),
+	})
+}
+
+func (server *Server) getProfileStatus(body []byte) (interface{}, error) {
+	request := new(es2plus.GetProfileStatusRequest)
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	var statuses []es2plus.ProfileStatus
+	for _, iccid := range request.IccidList {
+		if profile, found := server.profiles[iccid.Iccid]; found {
+			statuses = append(statuses, es2plus.ProfileStatus{
+				Iccid:                     profile.Iccid,
+				State:                     profile.State,
+				Eid:                       profile.Eid,
+				ACToken:                   profile.ACToken,
+				StatusLastUpdateTimestamp: time.Now().UTC().Format(time.RFC3339),
+			})
+		}
+	}
+	return struct {
+		Header            es2plus.ResponseHeader  `json:"header"`
+		ProfileStatusList []es2plus.ProfileStatus `json:"profileStatusList"`
+	}{Header: success(), ProfileStatusList: statuses}, nil
+}
+
+func (server *Server) downloadOrder(body []byte) (interface{}, error) {
+	request := new(es2plus.DownloadOrderRequest)
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	profile, found := server.profiles[request.Iccid]
+	if !found {
+		return unknownProfile(request.Iccid), nil
+	}
+	if profile.State != StateAvailable {
+		return invalidTransition(profile, "downloadOrder"), nil
+	}
+	profile.State = StateAllocated
+	profile.Eid = request.Eid
+	profile.ProfileType = request.Profiletype
+	return es2plus.DownloadOrderResponse{Header: success(), Iccid: profile.Iccid}, nil
+}
+
+func (server *Server) confirmOrder(body []byte) (interface{}, error) {
+	request := new(es2plus.ConfirmOrderRequest)
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	profile, found := server.profiles[request.Iccid]
+	if !found {
+		return unknownProfile(request.Iccid), nil
+	}
+	if profile.State != StateAllocated {
+		return invalidTransition(profile, "confirmOrder"), nil
+	}
+
+	profile.MatchingID = request.MatchingID
+	if profile.MatchingID == "" {
+		profile.MatchingID = fmt.Sprintf("MATCH-%s", profile.Iccid)
+	}
+	profile.ConfirmationCode = request.ConfirmationCode
+	if request.Eid != "" {
+		profile.Eid = request.Eid
+	}
+	profile.ACToken = fmt.Sprintf("LPA:1$%s$%s", server.SmdpAddress, profile.MatchingID)
+	if request.ReleaseFlag {
+		profile.State = StateReleased
+	} else {
+		profile.State = StateConfirmed
+	}
+
+	return es2plus.ConfirmOrderResponse{
+		Header:      success(),
+		Iccid:       profile.Iccid,
+		Eid:         profile.Eid,
+		MatchingID:  profile.MatchingID,
+		SmdpAddress: server.SmdpAddress,
+	}, nil
+}
+
+func (server *Server) cancelOrder(body []byte) (interface{}, error) {
+	request := new(es2plus.CancelOrderRequest)
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	profile, found := server.profiles[request.Iccid]
+	if !found {
+		return unknownProfile(request.Iccid), nil
+	}
+	switch profile.State {
+	case StateAllocated, StateConfirmed, StateReleased:
+	default:
+		return invalidTransition(profile, "cancelOrder"), nil
+	}
+	switch request.FinalProfileStatusIndicator {
+	case StateAvailable, StateUnavailable:
+	default:
+		return failed(es2plus.StatusCodeData{
+			SubjectCode: es2plus.SubjectProfile,
+			ReasonCode:  es2plus.ReasonInvalid,
+			Message:     fmt.Sprintf("Invalid finalProfileStatusIndicator '%s'", request.FinalProfileStatusIndicator),
+		}), nil
+	}
+	profile.reset(request.FinalProfileStatusIndicator)
+	return es2plus.CancelOrderResponse{Header: success()}, nil
+}
+
+func (server *Server) recoverProfile(body []byte) (interface{}, error) {
+	request := new(es2plus.RecoverProfileRequest)
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	profile, found := server.profiles[request.Iccid]
+	if !found {
+		return unknownProfile(request.Iccid), nil
+	}
+	profile.reset(request.ProfileStatus)
+	return es2plus.RecoverProfileResponse{Header: success()}, nil
+}
+
+func (server *Server) releaseProfile(body []byte) (interface{}, error) {
+	request := new(es2plus.ReleaseProfileRequest)
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	profile, found := server.profiles[request.Iccid]
+	if !found {
+		return unknownProfile(request.Iccid), nil
+	}
+	if profile.State != StateConfirmed {
+		return invalidTransition(profile, "releaseProfile"), nil
+	}
+	profile.State = StateReleased
+	return es2plus.ReleaseProfileResponse{Header: success()}, nil
+}
+
+// reset puts a profile back into a state where it can be
+// ordered again (or not).
+func (profile *Profile) reset(state string) {
+	profile.State = state
+	if state == StateAvailable || state == StateUnavailable {
+		profile.Eid = ""
+		profile.MatchingID = ""
+		profile.ConfirmationCode = ""
+		profile.ACToken = ""
+	}
+}
@@ -0,0 +1,225 @@
+package es2plustest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/es2plus"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/lpa"
+)
+
+///
+///  ES9+, downloading RELEASED profiles to a simulated LPA
+///
+
+// SubjectTransactionID is the SGP.22 subject code of ES9+ transaction IDs.
+const SubjectTransactionID = "8.10.1"
+
+// transaction is an ongoing ES9+ download.
+type transaction struct {
+	id               string
+	euiccChallenge   string
+	serverChallenge  string
+	eid              string
+	euiccCertificate string
+	profile          *Profile
+}
+
+func randomHex(length int) string {
+	random := make([]byte, length)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(random)
+}
+
+func unknownTransaction(id string) interface{} {
+	return failed(es2plus.StatusCodeData{
+		SubjectCode:       SubjectTransactionID,
+		ReasonCode:        es2plus.ReasonUnknown,
+		SubjectIdentifier: id,
+		Message:           "Unknown transaction",
+	})
+}
+
+func verificationFailed(subjectCode string, err error) interface{} {
+	return failed(es2plus.StatusCodeData{
+		SubjectCode: subjectCode,
+		ReasonCode:  es2plus.ReasonVerificationFailed,
+		Message:     err.Error(),
+	})
+}
+
+func (server *Server) initiateAuthentication(body []byte) (interface{}, error) {
+	request := new(lpa.InitiateAuthenticationRequest)
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if request.SmdpAddress != server.SmdpAddress {
+		return failed(es2plus.StatusCodeData{
+			SubjectCode:       es2plus.SubjectSmdpAddress,
+			ReasonCode:        es2plus.ReasonInvalidAssociation,
+			SubjectIdentifier: request.SmdpAddress,
+			Message:           fmt.Sprintf("This is %s", server.SmdpAddress),
+		}), nil
+	}
+	t := &transaction{
+		id:              randomHex(16),
+		euiccChallenge:  request.EuiccChallenge,
+		serverChallenge: base64.StdEncoding.EncodeToString([]byte(randomHex(8))),
+	}
+	serverSigned1, err := lpa.Encode(&lpa.ServerSigned1{
+		TransactionID:   t.id,
+		EuiccChallenge:  t.euiccChallenge,
+		ServerAddress:   server.SmdpAddress,
+		ServerChallenge: t.serverChallenge,
+	})
+	if err != nil {
+		return nil, err
+	}
+	server.transactions[t.id] = t
+	return lpa.InitiateAuthenticationResponse{Header: success(), TransactionID: t.id, ServerSigned1: serverSigned1}, nil
+}
+
+func (server *Server) authenticateClient(body []byte) (interface{}, error) {
+	request := new(lpa.AuthenticateClientRequest)
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	t, found := server.transactions[request.TransactionID]
+	if !found {
+		return unknownTransaction(request.TransactionID), nil
+	}
+	if err := lpa.VerifySignature(request.EuiccCertificate, request.EuiccSigned1, request.EuiccSignature1); err != nil {
+		return verificationFailed(es2plus.SubjectEid, err), nil
+	}
+	signed := new(lpa.EuiccSigned1)
+	if err := lpa.Decode(request.EuiccSigned1, signed); err != nil {
+		return nil, err
+	}
+	if signed.TransactionID != t.id || signed.ServerChallenge != t.serverChallenge || signed.ServerAddress != server.SmdpAddress {
+		return verificationFailed(SubjectTransactionID, fmt.Errorf("euiccSigned1 doesn't match the transaction")), nil
+	}
+
+	var profile *Profile
+	for _, candidate := range server.profiles {
+		if candidate.MatchingID != "" && candidate.MatchingID == signed.MatchingID {
+			profile = candidate
+		}
+	}
+	if profile == nil {
+		return failed(es2plus.StatusCodeData{
+			SubjectCode:       es2plus.SubjectMatchingID,
+			ReasonCode:        es2plus.ReasonUnknown,
+			SubjectIdentifier: signed.MatchingID,
+			Message:           "Unknown matching ID",
+		}), nil
+	}
+	if profile.State != StateReleased {
+		return invalidTransition(profile, "download"), nil
+	}
+	if profile.Eid != "" && profile.Eid != signed.Eid {
+		return failed(es2plus.StatusCodeData{
+			SubjectCode:       es2plus.SubjectEid,
+			ReasonCode:        es2plus.ReasonRefused,
+			SubjectIdentifier: signed.Eid,
+			Message:           "Profile is reserved for another eUICC",
+		}), nil
+	}
+	t.eid = signed.Eid
+	t.euiccCertificate = request.EuiccCertificate
+	t.profile = profile
+
+	metadata, err := lpa.Encode(&lpa.ProfileMetadata{Iccid: profile.Iccid, ServiceProviderName: "Fake", ProfileName: profile.ProfileType})
+	if err != nil {
+		return nil, err
+	}
+	smdpSigned2, err := lpa.Encode(&lpa.SmdpSigned2{TransactionID: t.id, CcRequiredFlag: profile.ConfirmationCode != ""})
+	if err != nil {
+		return nil, err
+	}
+	return lpa.AuthenticateClientResponse{Header: success(), TransactionID: t.id, ProfileMetadata: metadata, SmdpSigned2: smdpSigned2}, nil
+}
+
+func (server *Server) getBoundProfilePackage(body []byte) (interface{}, error) {
+	request := new(lpa.GetBoundProfilePackageRequest)
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	t, found := server.transactions[request.TransactionID]
+	if !found || t.profile == nil {
+		return unknownTransaction(request.TransactionID), nil
+	}
+	if err := lpa.VerifySignature(t.euiccCertificate, request.EuiccSigned2, request.EuiccSignature2); err != nil {
+		return verificationFailed(es2plus.SubjectEid, err), nil
+	}
+	signed := new(lpa.EuiccSigned2)
+	if err := lpa.Decode(request.EuiccSigned2, signed); err != nil {
+		return nil, err
+	}
+	profile := t.profile
+	if profile.ConfirmationCode != "" && signed.HashCc != lpa.HashConfirmationCode(profile.ConfirmationCode, t.id) {
+		return failed(es2plus.StatusCodeData{
+			SubjectCode: es2plus.SubjectConfirmationCode,
+			ReasonCode:  es2plus.ReasonVerificationFailed,
+			Message:     "Wrong confirmation code",
+		}), nil
+	}
+	if profile.State != StateReleased {
+		return invalidTransition(profile, "download"), nil
+	}
+	profile.State = StateDownloaded
+	profile.Eid = t.eid
+
+	bpp, err := lpa.Encode(&lpa.BoundProfilePackage{
+		TransactionID:   t.id,
+		Iccid:           profile.Iccid,
+		ProfileElements: base64.StdEncoding.EncodeToString([]byte(profile.ProfileType)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lpa.GetBoundProfilePackageResponse{Header: success(), TransactionID: t.id, BoundProfilePackage: bpp}, nil
+}
+
+// handleNotification returns nothing, which is sent as 204 No Content.
+func (server *Server) handleNotification(body []byte) (interface{}, error) {
+	request := new(lpa.HandleNotificationRequest)
+	if err := json.Unmarshal(body, request); err != nil {
+		return nil, err
+	}
+	result := new(lpa.ProfileInstallationResult)
+	if err := lpa.Decode(request.ProfileInstallationResult, result); err != nil {
+		return nil, err
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	t, found := server.transactions[result.TransactionID]
+	if !found || t.profile == nil {
+		return nil, fmt.Errorf("unknown transaction '%s'", result.TransactionID)
+	}
+	if err := lpa.VerifySignature(t.euiccCertificate, request.ProfileInstallationResult, request.EuiccSignPIR); err != nil {
+		return nil, err
+	}
+	delete(server.transactions, t.id)
+	if result.FinalResult == lpa.InstallationSucceeded && t.profile.State == StateDownloaded {
+		t.profile.State = StateInstalled
+	}
+	return nil, nil
+}
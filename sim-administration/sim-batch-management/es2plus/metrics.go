@@ -0,0 +1,73 @@
+package es2plus
+
+import (
+	"context"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/metrics"
+	"time"
+)
+
+///
+///  Metrics on ES2+ invocations
+///
+
+var (
+	callsTotal = metrics.NewCounter("sbm_es2plus_calls_total",
+		"ES2+ invocations, including their retries, by function, vendor, outcome and reason code.",
+		"function", "vendor", "outcome", "reason_code")
+
+	callDuration = metrics.NewHistogram("sbm_es2plus_call_duration_seconds",
+		"Time taken by ES2+ invocations, including their retries.",
+		nil, "function", "vendor")
+
+	requestDuration = metrics.NewHistogram("sbm_es2plus_request_duration_seconds",
+		"Time taken by single ES2+ requests, from sending the request to receiving the whole response.",
+		nil, "function", "vendor")
+
+	retriesTotal = metrics.NewCounter("sbm_es2plus_retries_total",
+		"ES2+ requests re-sent after a transient failure.",
+		"function", "vendor")
+)
+
+// The outcomes of an invocation, as used in metrics.
+const (
+	outcomeSuccess     = "success"
+	outcomeFailed      = "failed"
+	outcomeHTTPError   = "http_error"
+	outcomeTimeout     = "timeout"
+	outcomeCanceled    = "canceled"
+	outcomeCircuitOpen = "circuit_open"
+	outcomeError       = "error"
+)
+
+// callOutcome classifies the error returned by an invocation, giving
+// the reason code reported by the SM-DP+, if any.
+func callOutcome(err error) (string, string) {
+	switch e := err.(type) {
+	case nil:
+		return outcomeSuccess, ""
+	case *Error:
+		if e.Status != "" {
+			return outcomeFailed, e.ReasonCode
+		}
+		return outcomeHTTPError, ""
+	case *CircuitOpenError:
+		return outcomeCircuitOpen, ""
+	}
+	if err == context.Canceled {
+		return outcomeCanceled, ""
+	}
+	if err == context.DeadlineExceeded {
+		return outcomeTimeout, ""
+	}
+	if timeout, ok := err.(interface{ Timeout() bool }); ok && timeout.Timeout() {
+		return outcomeTimeout, ""
+	}
+	return outcomeError, ""
+}
+
+// observeCall records the outcome and duration of an invocation.
+func (client *ClientState) observeCall(es2plusCommand string, started time.Time, err error) {
+	outcome, reasonCode := callOutcome(err)
+	callsTotal.Inc(es2plusCommand, client.vendor, outcome, reasonCode)
+	callDuration.ObserveDuration(started, es2plusCommand, client.vendor)
+}
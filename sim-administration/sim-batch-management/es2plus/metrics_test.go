@@ -0,0 +1,71 @@
+package es2plus
+
+import (
+	"context"
+	"encoding/json"
+	"gotest.tools/assert"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestInvocationsAreCountedByOutcomeAndReasonCode(t *testing.T) {
+	const vendor = "MetricsTestVendor"
+	var mutex sync.Mutex
+	attempts := 0
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := new(DownloadOrderRequest)
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			t.Fatal(err)
+		}
+		mutex.Lock()
+		attempts++
+		attempt := attempts
+		mutex.Unlock()
+
+		switch {
+		case attempt == 1:
+			http.Error(w, "try again later", http.StatusTooManyRequests)
+		case request.Iccid == "8947000000000000002":
+			writeResponse(w, http.StatusOK, DownloadOrderResponse{Header: ResponseHeader{FunctionExecutionStatus: FunctionExecutionStatus{
+				FunctionExecutionStatusType: StatusFailed,
+				StatusCodeData: StatusCodeData{
+					SubjectCode: SubjectProfileIccid,
+					ReasonCode:  ReasonInvalidTransition,
+					Message:     "Wrong state",
+				},
+			}}})
+		default:
+			writeResponse(w, http.StatusOK, DownloadOrderResponse{Header: successHeader(), Iccid: request.Iccid})
+		}
+	})
+	client, server := newTestClient(t, handler, WithVendor(vendor), WithRetryPolicy(fastRetries(3)))
+	defer server.Close()
+
+	// The metrics are global, so only look at what this test adds.
+	succeeded := callsTotal.Value("downloadOrder", vendor, outcomeSuccess, "")
+	failed := callsTotal.Value("downloadOrder", vendor, outcomeFailed, ReasonInvalidTransition)
+	retries := retriesTotal.Value("downloadOrder", vendor)
+	calls := callDuration.Count("downloadOrder", vendor)
+	requests := requestDuration.Count("downloadOrder", vendor)
+
+	if _, err := client.DownloadOrder("8947000000000000001", OrderParameters{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.DownloadOrder("8947000000000000002", OrderParameters{})
+	assert.Assert(t, err != nil)
+
+	assert.Equal(t, 1.0, callsTotal.Value("downloadOrder", vendor, outcomeSuccess, "")-succeeded)
+	assert.Equal(t, 1.0, callsTotal.Value("downloadOrder", vendor, outcomeFailed, ReasonInvalidTransition)-failed)
+	assert.Equal(t, 1.0, retriesTotal.Value("downloadOrder", vendor)-retries)
+	assert.Equal(t, uint64(2), callDuration.Count("downloadOrder", vendor)-calls)
+	assert.Equal(t, uint64(3), requestDuration.Count("downloadOrder", vendor)-requests)
+}
+
+func TestCanceledInvocationsAreNotCountedAsTimeouts(t *testing.T) {
+	outcome, _ := callOutcome(context.Canceled)
+	assert.Equal(t, outcomeCanceled, outcome)
+	outcome, _ = callOutcome(context.DeadlineExceeded)
+	assert.Equal(t, outcomeTimeout, outcome)
+}
@@ -0,0 +1,235 @@
+package es2plus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/fieldsyntaxchecks"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+///
+///  Receiving the handleDownloadProgressInfo notifications
+///  that the SM-DP+ pushes back to the operator.
+///
+
+// Notification point identifiers as defined by SGP.22.
+const (
+	NotificationPointEligibilityCheck = 1
+	NotificationPointConfirmationFail = 2
+	NotificationPointBppDownload      = 3
+	NotificationPointBppInstallation  = 4
+	NotificationPointProfileDeleted   = 5
+)
+
+const handleDownloadProgressInfoCommand = "handleDownloadProgressInfo"
+
+// Limits protecting the notification receiver, which is long running
+// and reachable from the internet, from clients that send too much or
+// take too long about it.  Notifications are well below a kilobyte.
+const (
+	maxNotificationSize           = 64 * 1024
+	notificationReadHeaderTimeout = 10 * time.Second
+	notificationReadTimeout       = 30 * time.Second
+	notificationWriteTimeout      = 30 * time.Second
+	notificationIdleTimeout       = 120 * time.Second
+)
+
+// NotificationPointStatus is the status of the procedure reported
+// at a particular notification point.
+type NotificationPointStatus struct {
+	Status         string          `json:"status"`
+	StatusCodeData *StatusCodeData `json:"statusCodeData,omitempty"`
+}
+
+// HandleDownloadProgressInfoRequest is the payload of the
+// handleDownloadProgressInfo request sent from the SM-DP+ to us.
+type HandleDownloadProgressInfoRequest struct {
+	Header                  Header                  `json:"header"`
+	Eid                     string                  `json:"eid,omitempty"`
+	Iccid                   string                  `json:"iccid"`
+	ProfileType             string                  `json:"profileType,omitempty"`
+	Timestamp               string                  `json:"timestamp"`
+	NotificationPointID     int                     `json:"notificationPointId"`
+	NotificationPointStatus NotificationPointStatus `json:"notificationPointStatus"`
+	ResultData              string                  `json:"resultData,omitempty"`
+}
+
+// HandleDownloadProgressInfoResponse is the payload returned to the SM-DP+
+// after a handleDownloadProgressInfo request.
+type HandleDownloadProgressInfoResponse struct {
+	Header ResponseHeader `json:"header"`
+}
+
+// ProfileState returns the state a notification says the profile has
+// reached:  DOWNLOADED when the bound profile package has been
+// downloaded, and INSTALLED when it has been installed.  Other
+// notifications, and failures, don't tell the state of the profile.
+func (n *HandleDownloadProgressInfoRequest) ProfileState() (ProfileState, bool) {
+	if !isSuccess(n.NotificationPointStatus.Status) {
+		return "", false
+	}
+	switch n.NotificationPointID {
+	case NotificationPointBppDownload:
+		return ProfileStateDownloaded, true
+	case NotificationPointBppInstallation:
+		return ProfileStateInstalled, true
+	}
+	return "", false
+}
+
+// DownloadProgressInfoHandler is called once for every syntactically valid
+// notification received.  A non-nil StatusCodeData return value is
+// reported back to the SM-DP+ as a failed function execution, a non-nil
+// error as an internal server error.
+type DownloadProgressInfoHandler func(notification *HandleDownloadProgressInfoRequest) (*StatusCodeData, error)
+
+// Status code data used when refusing notifications.  The codes are
+// taken from the subject/reason code tables in SGP.22.
+var (
+	statusCodeMissingIccid = StatusCodeData{SubjectCode: SubjectProfileIccid, ReasonCode: ReasonMandatoryElementMissing, Message: "Mandatory element missing: iccid"}
+	statusCodeInvalidIccid = StatusCodeData{SubjectCode: SubjectProfileIccid, ReasonCode: ReasonInvalid, Message: "Invalid ICCID"}
+
+	// StatusCodeUnknownIccid can be returned from a DownloadProgressInfoHandler when
+	// the notification refers to a profile we don't know about.
+	StatusCodeUnknownIccid = StatusCodeData{SubjectCode: SubjectProfileIccid, ReasonCode: ReasonUnknown, Message: "Unknown ICCID"}
+)
+
+// NewDownloadProgressInfoHandler returns an http.Handler implementing the
+// ES2+ handleDownloadProgressInfo endpoint.  Requests are validated before
+// they are passed on to the handler function.
+func NewDownloadProgressInfoHandler(handler DownloadProgressInfoHandler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(es2plusPath(handleDownloadProgressInfoCommand), func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !strings.HasPrefix(r.Header.Get("X-Admin-Protocol"), adminProtocolPrefix) {
+			http.Error(w, fmt.Sprintf("missing or unsupported X-Admin-Protocol header '%s'", r.Header.Get("X-Admin-Protocol")), http.StatusBadRequest)
+			return
+		}
+
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxNotificationSize))
+		if err != nil {
+			http.Error(w, "couldn't read request body", http.StatusBadRequest)
+			return
+		}
+
+		notification := new(HandleDownloadProgressInfoRequest)
+		if err := json.Unmarshal(body, notification); err != nil {
+			http.Error(w, fmt.Sprintf("couldn't parse request body: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		if statusCodeData := validateDownloadProgressInfo(notification); statusCodeData != nil {
+			notificationLogger(notification).Warnf("Refusing handleDownloadProgressInfo: %s", statusCodeData.Message)
+			writeNotificationResponse(w, statusCodeData)
+			return
+		}
+
+		statusCodeData, err := handler(notification)
+		if err != nil {
+			notificationLogger(notification).With(logging.FieldError, err).Errorf("Couldn't handle handleDownloadProgressInfo")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeNotificationResponse(w, statusCodeData)
+	})
+	return mux
+}
+
+// validateDownloadProgressInfo checks the mandatory fields of a
+// notification, returning the status code data to report back if
+// something is wrong, or nil if everything is fine.
+func validateDownloadProgressInfo(n *HandleDownloadProgressInfoRequest) *StatusCodeData {
+	if n.Header.FunctionrequesterIDentifier == "" {
+		return &StatusCodeData{SubjectCode: SubjectFunctionRequester, ReasonCode: ReasonMandatoryElementMissing, Message: "Mandatory element missing: functionRequesterIdentifier"}
+	}
+	if n.Header.FunctionCallIdentifier == "" {
+		return &StatusCodeData{SubjectCode: SubjectFunctionRequester, ReasonCode: ReasonMandatoryElementMissing, Message: "Mandatory element missing: functionCallIdentifier"}
+	}
+	if n.Iccid == "" {
+		return &statusCodeMissingIccid
+	}
+	if !fieldsyntaxchecks.IsICCID(n.Iccid) {
+		return &statusCodeInvalidIccid
+	}
+	if n.NotificationPointID <= 0 {
+		return &StatusCodeData{SubjectCode: SubjectFunction, ReasonCode: ReasonInvalid, Message: fmt.Sprintf("Invalid notificationPointId: %d", n.NotificationPointID)}
+	}
+	if n.NotificationPointStatus.Status == "" {
+		return &StatusCodeData{SubjectCode: SubjectFunction, ReasonCode: ReasonMandatoryElementMissing, Message: "Mandatory element missing: notificationPointStatus"}
+	}
+	if _, err := time.Parse(time.RFC3339, n.Timestamp); err != nil {
+		return &StatusCodeData{SubjectCode: SubjectFunction, ReasonCode: ReasonInvalid, Message: fmt.Sprintf("Invalid timestamp: '%s'", n.Timestamp)}
+	}
+	return nil
+}
+
+func writeNotificationResponse(w http.ResponseWriter, statusCodeData *StatusCodeData) {
+	response := HandleDownloadProgressInfoResponse{
+		Header: ResponseHeader{
+			FunctionExecutionStatus: FunctionExecutionStatus{
+				FunctionExecutionStatusType: StatusExecutedSuccess,
+			},
+		},
+	}
+	if statusCodeData != nil {
+		response.Header.FunctionExecutionStatus.FunctionExecutionStatusType = StatusFailed
+		response.Header.FunctionExecutionStatus.StatusCodeData = *statusCodeData
+	}
+
+	w.Header().Set("X-Admin-Protocol", AdminProtocolHeader(DefaultProtocolVersion))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logging.With(logging.FieldError, err).Errorf("Couldn't write handleDownloadProgressInfo response")
+	}
+}
+
+// notificationLogger returns the logger for messages about a notification.
+func notificationLogger(notification *HandleDownloadProgressInfoRequest) *logging.Logger {
+	return logging.With(logging.FieldIccid, notification.Iccid, logging.FieldFunctionCallIdentifier, notification.Header.FunctionCallIdentifier)
+}
+
+// ListenAndServeNotifications starts an HTTPS server on addr that receives
+// handleDownloadProgressInfo notifications.  The SM-DP+ must present a
+// client certificate signed by one of the CAs in clientCAFilePath
+// (mutual TLS).  The function blocks until the server fails.
+func ListenAndServeNotifications(addr string, certFilePath string, keyFilePath string, clientCAFilePath string, handler DownloadProgressInfoHandler) error {
+	caBytes, err := ioutil.ReadFile(clientCAFilePath)
+	if err != nil {
+		return fmt.Errorf("couldn't read client CA file '%s': %s", clientCAFilePath, err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caBytes) {
+		return fmt.Errorf("no certificates found in client CA file '%s'", clientCAFilePath)
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           NewDownloadProgressInfoHandler(handler),
+		ReadHeaderTimeout: notificationReadHeaderTimeout,
+		ReadTimeout:       notificationReadTimeout,
+		WriteTimeout:      notificationWriteTimeout,
+		IdleTimeout:       notificationIdleTimeout,
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  clientCAs,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	return server.ListenAndServeTLS(certFilePath, keyFilePath)
+}
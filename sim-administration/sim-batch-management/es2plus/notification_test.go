@@ -0,0 +1,135 @@
+package es2plus
+
+import (
+	"bytes"
+	"encoding/json"
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postNotification(t *testing.T, handler http.Handler, notification interface{}) (*httptest.ResponseRecorder, *HandleDownloadProgressInfoResponse) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", es2plusPath("handleDownloadProgressInfo"), bytes.NewReader(body))
+	req.Header.Set("X-Admin-Protocol", "gsma/rsp/v2.2.0")
+	req.Header.Set("Content-Type", "application/json")
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		return recorder, nil
+	}
+
+	response := new(HandleDownloadProgressInfoResponse)
+	if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+		t.Fatal(err)
+	}
+	return recorder, response
+}
+
+func validNotification() *HandleDownloadProgressInfoRequest {
+	return &HandleDownloadProgressInfoRequest{
+		Header:                  Header{FunctionrequesterIDentifier: "smdp", FunctionCallIdentifier: "call-1"},
+		Eid:                     "89049032123451234512345678901235",
+		Iccid:                   "8947000000000012141",
+		Timestamp:               "2019-11-29T10:12:13Z",
+		NotificationPointID:     NotificationPointBppInstallation,
+		NotificationPointStatus: NotificationPointStatus{Status: "Executed-Success"},
+	}
+}
+
+func TestDownloadProgressInfoIsPassedToHandler(t *testing.T) {
+	var received *HandleDownloadProgressInfoRequest
+	handler := NewDownloadProgressInfoHandler(func(n *HandleDownloadProgressInfoRequest) (*StatusCodeData, error) {
+		received = n
+		return nil, nil
+	})
+
+	_, response := postNotification(t, handler, validNotification())
+	assert.Equal(t, "Executed-Success", response.Header.FunctionExecutionStatus.FunctionExecutionStatusType)
+	assert.Assert(t, received != nil)
+	assert.Equal(t, "8947000000000012141", received.Iccid)
+	assert.Equal(t, NotificationPointBppInstallation, received.NotificationPointID)
+}
+
+func TestResponseHeaderUsesTheSgp22Names(t *testing.T) {
+	handler := NewDownloadProgressInfoHandler(func(n *HandleDownloadProgressInfoRequest) (*StatusCodeData, error) {
+		return nil, nil
+	})
+
+	// Go decodes JSON case insensitively, so look at the raw keys.
+	recorder, _ := postNotification(t, handler, validNotification())
+	var raw struct {
+		Header map[string]json.RawMessage `json:"header"`
+	}
+	assert.NilError(t, json.Unmarshal(recorder.Body.Bytes(), &raw))
+	_, found := raw.Header["functionExecutionStatus"]
+	assert.Assert(t, found, "no functionExecutionStatus in %s", recorder.Body.String())
+	assert.Equal(t, 1, len(raw.Header))
+}
+
+func TestOversizedNotificationsAreRefused(t *testing.T) {
+	handler := NewDownloadProgressInfoHandler(func(n *HandleDownloadProgressInfoRequest) (*StatusCodeData, error) {
+		t.Fatal("handler should not be invoked for oversized notifications")
+		return nil, nil
+	})
+
+	notification := validNotification()
+	notification.ResultData = strings.Repeat("A", maxNotificationSize)
+	recorder, _ := postNotification(t, handler, notification)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestInvalidDownloadProgressInfoIsRefused(t *testing.T) {
+	handler := NewDownloadProgressInfoHandler(func(n *HandleDownloadProgressInfoRequest) (*StatusCodeData, error) {
+		t.Fatal("handler should not be invoked for invalid notifications")
+		return nil, nil
+	})
+
+	notification := validNotification()
+	notification.Iccid = "not-an-iccid"
+	_, response := postNotification(t, handler, notification)
+	assert.Equal(t, "Failed", response.Header.FunctionExecutionStatus.FunctionExecutionStatusType)
+	assert.Equal(t, SubjectProfileIccid, response.Header.FunctionExecutionStatus.StatusCodeData.SubjectCode)
+
+	notification = validNotification()
+	notification.Timestamp = "yesterday"
+	_, response = postNotification(t, handler, notification)
+	assert.Equal(t, "Failed", response.Header.FunctionExecutionStatus.FunctionExecutionStatusType)
+
+	recorder, _ := postNotification(t, handler, "this is not a notification")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestUnknownIccidIsReportedBack(t *testing.T) {
+	handler := NewDownloadProgressInfoHandler(func(n *HandleDownloadProgressInfoRequest) (*StatusCodeData, error) {
+		return &StatusCodeUnknownIccid, nil
+	})
+
+	_, response := postNotification(t, handler, validNotification())
+	assert.Equal(t, "Failed", response.Header.FunctionExecutionStatus.FunctionExecutionStatusType)
+	assert.Equal(t, "3.9", response.Header.FunctionExecutionStatus.StatusCodeData.ReasonCode)
+}
+
+func TestNotificationsTellProfileState(t *testing.T) {
+	notification := func(point int, status string) *HandleDownloadProgressInfoRequest {
+		return &HandleDownloadProgressInfoRequest{NotificationPointID: point, NotificationPointStatus: NotificationPointStatus{Status: status}}
+	}
+
+	state, ok := notification(NotificationPointBppInstallation, StatusExecutedSuccess).ProfileState()
+	assert.Assert(t, ok)
+	assert.Equal(t, ProfileStateInstalled, state)
+	state, ok = notification(NotificationPointBppDownload, StatusExecutedSuccess).ProfileState()
+	assert.Assert(t, ok)
+	assert.Equal(t, ProfileStateDownloaded, state)
+
+	_, ok = notification(NotificationPointBppInstallation, StatusFailed).ProfileState()
+	assert.Assert(t, !ok)
+	_, ok = notification(NotificationPointEligibilityCheck, StatusExecutedSuccess).ProfileState()
+	assert.Assert(t, !ok)
+}
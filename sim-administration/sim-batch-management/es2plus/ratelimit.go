@@ -0,0 +1,158 @@
+package es2plus
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+///
+///  Limiting the rate of ES2+ requests sent to an SM-DP+
+///
+
+// RateLimiter limits the requests sent to an SM-DP+, both in number
+// of requests per second, using a token bucket, and in number of
+// requests in flight at the same time.  A single limiter should be
+// shared by all clients talking to the same SM-DP+.  A nil limiter
+// doesn't limit anything.
+type RateLimiter struct {
+	mutex             sync.Mutex
+	requestsPerSecond float64
+	burst             float64
+	tokens            float64
+	last              time.Time
+	inFlight          chan struct{}
+
+	// Statistics, the counters are updated atomically.
+	requests     int64
+	throttled    int64
+	firstRequest time.Time
+	lastResponse time.Time
+}
+
+// NewRateLimiter creates a limiter allowing requestsPerSecond requests
+// per second, and maxInFlight concurrent requests.  Zero (or less)
+// means no limit.
+func NewRateLimiter(requestsPerSecond float64, maxInFlight int) *RateLimiter {
+	limiter := &RateLimiter{requestsPerSecond: requestsPerSecond}
+	if requestsPerSecond > 0 {
+		// Allow bursts of up to one second's worth of requests,
+		// but never less than one.
+		limiter.burst = requestsPerSecond
+		if limiter.burst < 1 {
+			limiter.burst = 1
+		}
+		limiter.tokens = limiter.burst
+	}
+	if maxInFlight > 0 {
+		limiter.inFlight = make(chan struct{}, maxInFlight)
+	}
+	return limiter
+}
+
+// acquire waits until a request may be sent, and returns a function
+// to call when the response has been received.
+func (limiter *RateLimiter) acquire(ctx context.Context) (func(), error) {
+	if limiter == nil {
+		return func() {}, nil
+	}
+	atomic.AddInt64(&limiter.requests, 1)
+	started := time.Now()
+	defer func() {
+		atomic.AddInt64(&limiter.throttled, int64(time.Since(started)))
+	}()
+
+	limiter.mutex.Lock()
+	if limiter.firstRequest.IsZero() {
+		limiter.firstRequest = started
+	}
+	limiter.mutex.Unlock()
+
+	release := func() {
+		limiter.mutex.Lock()
+		limiter.lastResponse = time.Now()
+		limiter.mutex.Unlock()
+	}
+	if limiter.inFlight != nil {
+		select {
+		case limiter.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		release = func() {
+			<-limiter.inFlight
+			limiter.mutex.Lock()
+			limiter.lastResponse = time.Now()
+			limiter.mutex.Unlock()
+		}
+	}
+
+	if wait := limiter.reserve(); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+// reserve takes a token from the bucket, returning the time to wait
+// until the token is actually available.
+func (limiter *RateLimiter) reserve() time.Duration {
+	if limiter.requestsPerSecond <= 0 {
+		return 0
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	if !limiter.last.IsZero() {
+		limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.requestsPerSecond
+		if limiter.tokens > limiter.burst {
+			limiter.tokens = limiter.burst
+		}
+	}
+	limiter.last = now
+	limiter.tokens--
+	if limiter.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-limiter.tokens / limiter.requestsPerSecond * float64(time.Second))
+}
+
+// Requests returns the number of requests that have passed through
+// the limiter.
+func (limiter *RateLimiter) Requests() int64 {
+	if limiter == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&limiter.requests)
+}
+
+// Throughput returns the number of requests per second from the first
+// request to the last response that passed through the limiter.
+func (limiter *RateLimiter) Throughput() float64 {
+	if limiter == nil {
+		return 0
+	}
+	limiter.mutex.Lock()
+	elapsed := limiter.lastResponse.Sub(limiter.firstRequest)
+	limiter.mutex.Unlock()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(limiter.Requests()) / elapsed.Seconds()
+}
+
+// ThrottledTime returns the total time requests have spent waiting
+// for the limiter.  Since requests wait in parallel, this may be
+// longer than the time they have been running.
+func (limiter *RateLimiter) ThrottledTime() time.Duration {
+	if limiter == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&limiter.throttled))
+}
@@ -0,0 +1,79 @@
+package es2plus
+
+import (
+	"context"
+	"gotest.tools/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterLimitsRequestsPerSecond(t *testing.T) {
+	limiter := NewRateLimiter(200, 0)
+
+	// The first second's worth of requests go through at once, the
+	// next hundred have to wait for the bucket to refill.
+	started := time.Now()
+	for i := 0; i < 300; i++ {
+		release, err := limiter.acquire(context.Background())
+		assert.NilError(t, err)
+		release()
+	}
+	elapsed := time.Since(started)
+	assert.Assert(t, elapsed >= 400*time.Millisecond, "300 requests at 200/s took only %v", elapsed)
+	assert.Equal(t, int64(300), limiter.Requests())
+	assert.Assert(t, limiter.ThrottledTime() >= 400*time.Millisecond)
+	assert.Assert(t, limiter.Throughput() > 0)
+}
+
+func TestRateLimiterLimitsRequestsInFlight(t *testing.T) {
+	limiter := NewRateLimiter(0, 3)
+
+	var mutex sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := limiter.acquire(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mutex.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mutex.Lock()
+			inFlight--
+			mutex.Unlock()
+			release()
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, maxInFlight)
+}
+
+func TestRateLimiterGivesUpWhenCancelled(t *testing.T) {
+	limiter := NewRateLimiter(0, 1)
+	release, err := limiter.acquire(context.Background())
+	assert.NilError(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = limiter.acquire(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// A nil limiter doesn't limit anything.
+	var unlimited *RateLimiter
+	release, err = unlimited.acquire(context.Background())
+	assert.NilError(t, err)
+	release()
+}
@@ -0,0 +1,356 @@
+package es2plus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+///
+///  Recording ES2+ traffic, and replaying it offline
+///
+
+// TrafficRecord is a single ES2+ request and the response to it, as
+// written to a traffic log.  Secrets are redacted before the record
+// is written.
+type TrafficRecord struct {
+	Time                   time.Time           `json:"time"`
+	Vendor                 string              `json:"vendor,omitempty"`
+	Function               string              `json:"function"`
+	FunctionCallIdentifier string              `json:"functionCallIdentifier"`
+	Attempt                int                 `json:"attempt"`
+	URL                    string              `json:"url"`
+	RequestHeaders         map[string][]string `json:"requestHeaders,omitempty"`
+	Request                json.RawMessage     `json:"request,omitempty"`
+	HTTPStatusCode         int                 `json:"httpStatusCode,omitempty"`
+	ResponseHeaders        map[string][]string `json:"responseHeaders,omitempty"`
+	Response               json.RawMessage     `json:"response,omitempty"`
+	ResponseText           string              `json:"responseText,omitempty"`
+	Error                  string              `json:"error,omitempty"`
+	DurationMillis         int64               `json:"durationMillis"`
+}
+
+// Redacted is the value secrets are replaced with in traffic logs.
+const Redacted = "REDACTED"
+
+// HTTP headers whose values are never written to traffic logs.
+var secretHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+}
+
+// Payload fields whose values are never written to traffic logs.  The
+// activation code and the matching ID in it let anyone download the
+// profile.
+var secretFields = map[string]bool{
+	"confirmationCode": true,
+	"acToken":          true,
+	"matchingId":       true,
+}
+
+// redactHeaders returns a copy of the headers with secret values replaced.
+func redactHeaders(headers http.Header) map[string][]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	result := make(map[string][]string, len(headers))
+	for name, values := range headers {
+		if secretHeaders[strings.ToLower(name)] {
+			result[name] = []string{Redacted}
+		} else {
+			result[name] = append([]string(nil), values...)
+		}
+	}
+	return result
+}
+
+// redactPayload returns the JSON payload with the values of the given
+// secret fields replaced, at any depth.  Payloads that aren't JSON are
+// returned as they are.
+func redactPayload(payload []byte, fields map[string]bool) []byte {
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return payload
+	}
+	redacted, err := json.Marshal(redactValue(value, fields))
+	if err != nil {
+		return payload
+	}
+	return redacted
+}
+
+func redactValue(value interface{}, fields map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if fields[key] {
+				v[key] = Redacted
+			} else {
+				v[key] = redactValue(field, fields)
+			}
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = redactValue(element, fields)
+		}
+	}
+	return value
+}
+
+// redactLike replaces the values of the fields that are redacted in a
+// recorded value, at any depth, so that the two can be compared
+// whatever the secret fields are named on the wire.
+func redactLike(recorded interface{}, value interface{}) interface{} {
+	switch r := recorded.(type) {
+	case map[string]interface{}:
+		v, ok := value.(map[string]interface{})
+		if !ok {
+			return value
+		}
+		for key, field := range r {
+			if _, found := v[key]; !found {
+				continue
+			}
+			if field == Redacted {
+				v[key] = Redacted
+			} else {
+				v[key] = redactLike(field, v[key])
+			}
+		}
+	case []interface{}:
+		v, ok := value.([]interface{})
+		if !ok || len(v) != len(r) {
+			return value
+		}
+		for i := range r {
+			v[i] = redactLike(r[i], v[i])
+		}
+	}
+	return value
+}
+
+// functionCallIdentifierOf digs the function call identifier out of
+// a serialized request.
+func functionCallIdentifierOf(payload []byte) string {
+	request := new(struct {
+		Header Header `json:"header"`
+	})
+	if err := json.Unmarshal(payload, request); err != nil {
+		return ""
+	}
+	return request.Header.FunctionCallIdentifier
+}
+
+// TrafficRecorder appends the ES2+ traffic of one or more clients to a
+// JSONL file, one TrafficRecord per line.  It is safe for concurrent use.
+type TrafficRecorder struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// OpenTrafficRecorder opens a traffic log for appending, creating it
+// if it doesn't exist.
+func OpenTrafficRecorder(path string) (*TrafficRecorder, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open traffic log '%s': %s", path, err)
+	}
+	return &TrafficRecorder{file: file}, nil
+}
+
+// Record redacts and appends a record to the traffic log.  Only fields
+// with the SGP.22 names of secrets are redacted here, see
+// ClientState.record for payloads translated to a dialect.
+func (recorder *TrafficRecorder) Record(record *TrafficRecord) error {
+	if len(record.Request) > 0 {
+		record.Request = redactPayload(record.Request, secretFields)
+	}
+	if len(record.Response) > 0 {
+		record.Response = redactPayload(record.Response, secretFields)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	_, err = recorder.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the traffic log.
+func (recorder *TrafficRecorder) Close() error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	return recorder.file.Close()
+}
+
+// record writes an exchange with the SM-DP+ to the client's traffic
+// log, if it has one.  The payloads are as sent and received, so the
+// secrets are redacted under the names the client's dialect gives
+// them.  Failing to record is logged, but doesn't fail the invocation.
+func (client *ClientState) record(es2plusCommand string, attempt int, req *http.Request, payload []byte, resp *http.Response, body []byte, err error, started time.Time) {
+	if client.recorder == nil {
+		return
+	}
+	record := &TrafficRecord{
+		Time:                   started.UTC(),
+		Vendor:                 client.vendor,
+		Function:               es2plusCommand,
+		FunctionCallIdentifier: functionCallIdentifierOf(payload),
+		Attempt:                attempt,
+		URL:                    req.URL.String(),
+		RequestHeaders:         redactHeaders(req.Header),
+		Request:                json.RawMessage(client.redact(bytes.TrimSpace(payload))),
+		DurationMillis:         time.Since(started).Nanoseconds() / int64(time.Millisecond),
+	}
+	if resp != nil {
+		record.HTTPStatusCode = resp.StatusCode
+		record.ResponseHeaders = redactHeaders(resp.Header)
+	}
+	if trimmed := bytes.TrimSpace(body); json.Valid(trimmed) {
+		record.Response = json.RawMessage(client.redact(trimmed))
+	} else {
+		record.ResponseText = string(body)
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if recordErr := client.recorder.Record(record); recordErr != nil {
+		client.requestLogger(es2plusCommand, payload).With(logging.FieldError, recordErr).Errorf("Couldn't record %s", es2plusCommand)
+	}
+}
+
+// ReplayTransport is an http.RoundTripper serving ES2+ responses from
+// a traffic log instead of talking to an SM-DP+, so that a recorded
+// run can be reproduced offline.
+//
+// A request is answered by the first unused record with the same
+// function call identifier.  Since a new run generates new identifiers,
+// a request with an unknown identifier is answered by the first unused
+// record for the same function with the same payload, ignoring the
+// header and the values of the fields redacted in the record.  Records of transport failures are replayed as errors.
+// Secrets were redacted when recorded, and are replayed as REDACTED.
+type ReplayTransport struct {
+	mutex   sync.Mutex
+	records []*TrafficRecord
+	used    []bool
+}
+
+// OpenReplayTransport reads a traffic log written by a TrafficRecorder.
+func OpenReplayTransport(path string) (*ReplayTransport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open traffic log '%s': %s", path, err)
+	}
+	defer file.Close()
+
+	transport := &ReplayTransport{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		record := new(TrafficRecord)
+		if err := json.Unmarshal(line, record); err != nil {
+			return nil, fmt.Errorf("%s:%d: not a traffic record: %s", path, lineNo, err)
+		}
+		transport.records = append(transport.records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	transport.used = make([]bool, len(transport.records))
+	return transport, nil
+}
+
+// RoundTrip answers a request with a recorded response.
+func (transport *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var payload []byte
+	if req.Body != nil {
+		var err error
+		if payload, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+	}
+
+	function := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+	record := transport.take(function, functionCallIdentifierOf(payload), payload)
+	if record == nil {
+		return nil, fmt.Errorf("no recorded response to %s %s", function, string(bytes.TrimSpace(payload)))
+	}
+	if record.Error != "" && record.HTTPStatusCode == 0 {
+		return nil, fmt.Errorf("replayed: %s", record.Error)
+	}
+
+	body := []byte(record.Response)
+	if len(body) == 0 {
+		body = []byte(record.ResponseText)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", record.HTTPStatusCode, http.StatusText(record.HTTPStatusCode)),
+		StatusCode:    record.HTTPStatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header(record.ResponseHeaders),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// take returns the first unused record matching a request, and
+// marks it as used.
+func (transport *ReplayTransport) take(function string, functionCallIdentifier string, payload []byte) *TrafficRecord {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	match := func(matches func(record *TrafficRecord) bool) *TrafficRecord {
+		for i, record := range transport.records {
+			if !transport.used[i] && record.Function == function && matches(record) {
+				transport.used[i] = true
+				return record
+			}
+		}
+		return nil
+	}
+
+	if functionCallIdentifier != "" {
+		if record := match(func(record *TrafficRecord) bool { return record.FunctionCallIdentifier == functionCallIdentifier }); record != nil {
+			return record
+		}
+	}
+	return match(func(record *TrafficRecord) bool { return samePayload(record.Request, payload) })
+}
+
+// samePayload is true if a payload is the same as a recorded one,
+// ignoring the header identifying the individual invocation, and the
+// values of the fields redacted in the recorded payload.
+func samePayload(recorded []byte, payload []byte) bool {
+	var recordedValue, value interface{}
+	if json.Unmarshal(recorded, &recordedValue) != nil || json.Unmarshal(payload, &value) != nil {
+		return bytes.Equal(bytes.TrimSpace(recorded), bytes.TrimSpace(payload))
+	}
+	for _, v := range []interface{}{recordedValue, value} {
+		if object, ok := v.(map[string]interface{}); ok {
+			delete(object, "header")
+		}
+	}
+	return reflect.DeepEqual(recordedValue, redactLike(recordedValue, value))
+}
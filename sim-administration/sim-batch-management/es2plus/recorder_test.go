@@ -0,0 +1,150 @@
+package es2plus
+
+import (
+	"bufio"
+	"encoding/json"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTrafficIsRecordedAndReplayed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "es2plus-traffic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "traffic.jsonl")
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case es2plusPath("confirmOrder"):
+			writeResponse(w, http.StatusOK, ConfirmOrderResponse{
+				Header:     successHeader(),
+				Iccid:      "8947000000000000001",
+				MatchingID: "ABC-123",
+			})
+		default:
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+		}
+	})
+
+	recorder, err := OpenTrafficRecorder(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := newTestClient(t, handler, WithTrafficRecorder(recorder))
+	confirmed, err := client.ConfirmOrder("8947000000000000001", OrderParameters{MatchingID: "ABC-123", ConfirmationCode: "secret-4711"})
+	assert.NilError(t, err)
+	_, downloadErr := client.DownloadOrder("8947000000000000002", OrderParameters{})
+	assert.Assert(t, downloadErr != nil)
+	server.Close()
+	assert.NilError(t, recorder.Close())
+
+	// The log has one line per exchange, keyed by function call
+	// identifier, and without the confirmation code or matching ID.
+	logBytes, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, !strings.Contains(string(logBytes), "secret-4711"))
+	assert.Assert(t, !strings.Contains(string(logBytes), "ABC-123"))
+	var records []TrafficRecord
+	scanner := bufio.NewScanner(strings.NewReader(string(logBytes)))
+	for scanner.Scan() {
+		record := TrafficRecord{}
+		assert.NilError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "confirmOrder", records[0].Function)
+	assert.Assert(t, records[0].FunctionCallIdentifier != "")
+	assert.Assert(t, strings.Contains(string(records[0].Request), Redacted))
+	assert.Equal(t, http.StatusServiceUnavailable, records[1].HTTPStatusCode)
+
+	// Replaying gives the same results, without an SM-DP+.
+	replay, err := OpenReplayTransport(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayClient := NewClient("", "", "smdp.invalid", "test-requester",
+		WithHTTPClient(&http.Client{Transport: replay}),
+		WithRetryPolicy(NoRetries))
+
+	replayed, err := replayClient.ConfirmOrder("8947000000000000001", OrderParameters{MatchingID: "ABC-123", ConfirmationCode: "secret-4711"})
+	assert.NilError(t, err)
+	assert.Equal(t, "ABC-123", confirmed.MatchingID)
+	assert.Equal(t, Redacted, replayed.MatchingID)
+
+	_, err = replayClient.DownloadOrder("8947000000000000002", OrderParameters{})
+	assert.Equal(t, downloadErr.Error(), err.Error())
+
+	// Each record is only replayed once.
+	_, err = replayClient.DownloadOrder("8947000000000000002", OrderParameters{})
+	assert.Assert(t, err != nil && strings.Contains(err.Error(), "no recorded response"))
+}
+
+func TestActivationCodesAndMatchingIdsAreRedacted(t *testing.T) {
+	payload := []byte(`{"header": {"functionCallIdentifier": "42"},
+	    "profileStatusList": [{"iccid": "8947000000000000001", "state": "RELEASED", "acToken": "LPA:1$smdp.example.com$ABC-123"}],
+	    "matchingId": "ABC-123", "confirmationCode": "4711"}`)
+	result := string(redactPayload(payload, secretFields))
+	assert.Assert(t, !strings.Contains(result, "ABC-123"), result)
+	assert.Assert(t, !strings.Contains(result, "4711"), result)
+	assert.Assert(t, strings.Contains(result, "8947000000000000001"), result)
+	assert.Assert(t, strings.Contains(result, `"acToken":"REDACTED"`), result)
+}
+
+func TestSecretsAreRedactedUnderTheirDialectNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "es2plus-traffic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "traffic.jsonl")
+
+	dialect, err := ParseDialect(`{"fields": {"matchingId": "matchingID", "confirmationCode": "ccode"}}`)
+	assert.NilError(t, err)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Admin-Protocol", "gsma/rsp/v2.1.0")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"header": {"functionExecutionStatus": {"status": "Executed-Success"}}, "iccid": "8947000000000000001", "matchingID": "ABC-123"}`))
+	})
+
+	recorder, err := OpenTrafficRecorder(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := newTestClient(t, handler, WithDialect(dialect), WithTrafficRecorder(recorder))
+	confirmed, err := client.ConfirmOrder("8947000000000000001", OrderParameters{MatchingID: "ABC-123", ConfirmationCode: "secret-4711"})
+	assert.NilError(t, err)
+	assert.Equal(t, "ABC-123", confirmed.MatchingID)
+	server.Close()
+	assert.NilError(t, recorder.Close())
+
+	logBytes, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, !strings.Contains(string(logBytes), "secret-4711"), string(logBytes))
+	assert.Assert(t, !strings.Contains(string(logBytes), "ABC-123"), string(logBytes))
+	assert.Assert(t, strings.Contains(string(logBytes), `"ccode":"REDACTED"`), string(logBytes))
+
+	// The request is recognized although its secrets were redacted
+	// under the names of the dialect.
+	replay, err := OpenReplayTransport(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayClient := NewClient("", "", "smdp.invalid", "test-requester",
+		WithHTTPClient(&http.Client{Transport: replay}),
+		WithDialect(dialect),
+		WithRetryPolicy(NoRetries))
+	replayed, err := replayClient.ConfirmOrder("8947000000000000001", OrderParameters{MatchingID: "ABC-123", ConfirmationCode: "secret-4711"})
+	assert.NilError(t, err)
+	assert.Equal(t, Redacted, replayed.MatchingID)
+}
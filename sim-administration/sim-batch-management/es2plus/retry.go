@@ -0,0 +1,188 @@
+package es2plus
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+///
+///  Retrying ES2+ invocations that fail for transient reasons.
+///
+
+// RetryPolicy describes how, and how many times, a failed ES2+
+// invocation is retried.
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first one.  A value
+	// of one (or less) disables retries.
+	MaxAttempts int
+
+	// Backoff before the first retry, growing by Multiplier for each
+	// subsequent retry, but never beyond MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// Jitter is the fraction (0.0 - 1.0) of each backoff that is
+	// randomized, so that parallel workers don't retry in lockstep.
+	Jitter float64
+
+	// Budget, if non-nil, limits the total number of retries across
+	// all invocations made by a client.
+	Budget *RetryBudget
+}
+
+// DefaultRetryPolicy returns the retry policy used by clients unless
+// they are told otherwise.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     20 * time.Second,
+		Multiplier:     2.0,
+		Jitter:         0.5,
+		Budget:         NewRetryBudget(10, 0.2),
+	}
+}
+
+// NoRetries is a retry policy that never retries anything.
+var NoRetries = RetryPolicy{MaxAttempts: 1}
+
+// backoff returns the time to wait before the retry following
+// the attempt with the given (one-based) number.
+func (policy RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := policy.Multiplier
+	if multiplier < 1.0 {
+		multiplier = 1.0
+	}
+	backoff := float64(policy.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if policy.MaxBackoff > 0 && backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+	jitter := math.Max(0.0, math.Min(1.0, policy.Jitter))
+	backoff = backoff*(1.0-jitter) + rand.Float64()*backoff*jitter
+	return time.Duration(backoff)
+}
+
+// RetryBudget limits retries to a fraction of the total number of
+// invocations, with a minimum number of retries always allowed.  This
+// prevents a client from multiplying the load on an SM-DP+ that is
+// already in trouble.
+type RetryBudget struct {
+	mutex      sync.Mutex
+	minRetries int
+	ratio      float64
+	calls      int
+	retries    int
+}
+
+// NewRetryBudget creates a budget allowing minRetries retries, plus
+// ratio retries for every invocation made.
+func NewRetryBudget(minRetries int, ratio float64) *RetryBudget {
+	return &RetryBudget{minRetries: minRetries, ratio: ratio}
+}
+
+func (budget *RetryBudget) recordCall() {
+	if budget == nil {
+		return
+	}
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	budget.calls++
+}
+
+// tryWithdraw reserves a retry, returning false if the budget
+// is spent.
+func (budget *RetryBudget) tryWithdraw() bool {
+	if budget == nil {
+		return true
+	}
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	if float64(budget.retries) >= float64(budget.minRetries)+budget.ratio*float64(budget.calls) {
+		return false
+	}
+	budget.retries++
+	return true
+}
+
+// idempotentFunctions are the ES2+ functions that change nothing on the
+// SM-DP+, so that re-sending them is safe whatever became of an earlier
+// attempt.  The others, e.g. downloadOrder allocating a profile, may
+// already have been executed when a response is lost or an error is
+// returned.
+var idempotentFunctions = map[string]bool{
+	"getProfileStatus": true,
+}
+
+// mayRetry is true if an ES2+ function can be re-sent after failing
+// with an error:  Idempotent functions are retried on all transient
+// errors, the others only if the SM-DP+ can't have acted on the request.
+func mayRetry(es2plusCommand string, err error) bool {
+	if !IsRetryable(err) {
+		return false
+	}
+	return idempotentFunctions[es2plusCommand] || notProcessed(err)
+}
+
+// notProcessed is true if an error guarantees that the SM-DP+ didn't act
+// on a request:  The connection couldn't be made, or the SM-DP+ turned
+// the request away with HTTP 429.
+func notProcessed(err error) bool {
+	if es2Err, ok := err.(*Error); ok {
+		return es2Err.HTTPStatusCode == http.StatusTooManyRequests
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// IsRetryable is true if the error returned from an ES2+ invocation
+// is likely to be transient, so that re-sending the very same request
+// may succeed:  Transport level failures, HTTP 429 and 5xx responses, and
+// function execution statuses reporting expiry, transport errors or
+// an unavailable SM-DP+.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if es2Err, ok := err.(*Error); ok {
+		if es2Err.HTTPStatusCode == 429 || es2Err.HTTPStatusCode >= 500 {
+			return true
+		}
+		if es2Err.Status == StatusExpired {
+			return true
+		}
+		switch es2Err.ReasonCode {
+		case ReasonInaccessible, ReasonTimeout:
+			return true
+		}
+		return false
+	}
+
+	// The http client wraps everything in an url.Error, which itself
+	// is a net.Error, so look at what's inside.
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	// Connection resets, refused connections, timeouts, TLS handshake
+	// failures caused by the connection dropping etc. all surface
+	// as net.Errors.
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package es2plus
+
+import (
+	"context"
+	"encoding/json"
+	"gotest.tools/assert"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fastRetries(maxAttempts int) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		Multiplier:     2.0,
+		Jitter:         0.5,
+	}
+}
+
+func TestTransientFailuresAreRetriedWithSameFunctionCallIdentifier(t *testing.T) {
+	var mutex sync.Mutex
+	var callIdentifiers []string
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := new(DownloadOrderRequest)
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			t.Fatal(err)
+		}
+		mutex.Lock()
+		callIdentifiers = append(callIdentifiers, request.Header.FunctionCallIdentifier)
+		attempt := len(callIdentifiers)
+		mutex.Unlock()
+
+		if attempt < 3 {
+			http.Error(w, "try again later", http.StatusTooManyRequests)
+			return
+		}
+		writeResponse(w, http.StatusOK, DownloadOrderResponse{Header: successHeader(), Iccid: request.Iccid})
+	})
+	client, server := newTestClient(t, handler, WithRetryPolicy(fastRetries(5)))
+	defer server.Close()
+
+	result, err := client.DownloadOrder("8947000000000000001", OrderParameters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "8947000000000000001", result.Iccid)
+	assert.Equal(t, 3, len(callIdentifiers))
+	assert.Equal(t, callIdentifiers[0], callIdentifiers[1])
+	assert.Equal(t, callIdentifiers[0], callIdentifiers[2])
+	assert.Equal(t, int64(2), client.RetryCount())
+}
+
+func TestFatalFailuresAreNotRetried(t *testing.T) {
+	calls := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		writeResponse(w, http.StatusOK, ConfirmOrderResponse{
+			Header: ResponseHeader{FunctionExecutionStatus: FunctionExecutionStatus{
+				FunctionExecutionStatusType: StatusFailed,
+				StatusCodeData:              StatusCodeData{SubjectCode: SubjectProfileIccid, ReasonCode: ReasonInvalidTransition},
+			}},
+		})
+	})
+	client, server := newTestClient(t, handler, WithRetryPolicy(fastRetries(5)))
+	defer server.Close()
+
+	_, err := client.ConfirmOrder("8947000000000000001", OrderParameters{})
+	assert.Assert(t, err != nil)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, int64(0), client.RetryCount())
+}
+
+func TestFunctionsThatMayHaveBeenExecutedAreNotRetried(t *testing.T) {
+	calls := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	})
+	client, server := newTestClient(t, handler, WithRetryPolicy(fastRetries(5)))
+	defer server.Close()
+
+	_, err := client.DownloadOrder("8947000000000000001", OrderParameters{})
+	assert.Assert(t, IsRetryable(err))
+	assert.Equal(t, 1, calls)
+	_, err = client.ConfirmOrder("8947000000000000001", OrderParameters{})
+	assert.Assert(t, IsRetryable(err))
+	assert.Equal(t, 2, calls)
+
+	_, err = client.GetStatus("8947000000000000001")
+	assert.Assert(t, IsRetryable(err))
+	assert.Equal(t, 7, calls)
+}
+
+func TestRequestsThatCouldNotBeSentAreRetried(t *testing.T) {
+	// Nothing listens on the address of a closed server.
+	client, server := newTestClient(t, http.NotFoundHandler(), WithRetryPolicy(fastRetries(3)))
+	server.Close()
+
+	_, err := client.DownloadOrder("8947000000000000001", OrderParameters{})
+	assert.Assert(t, notProcessed(err), "%v", err)
+	assert.Equal(t, int64(2), client.RetryCount())
+}
+
+func TestRetryBudgetLimitsRetries(t *testing.T) {
+	calls := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "down", http.StatusBadGateway)
+	})
+	policy := fastRetries(10)
+	policy.Budget = NewRetryBudget(2, 0.0)
+	client, server := newTestClient(t, handler, WithRetryPolicy(policy))
+	defer server.Close()
+
+	_, err := client.GetStatus("8947000000000000001")
+	assert.Assert(t, IsRetryable(err))
+	assert.Equal(t, 3, calls)
+
+	_, err = client.GetStatus("8947000000000000001")
+	assert.Assert(t, err != nil)
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, int64(2), client.RetryCount())
+}
+
+func TestDefaultTimeoutAppliesToInvocationIncludingRetries(t *testing.T) {
+	calls := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	})
+	policy := fastRetries(1000)
+	policy.InitialBackoff = 20 * time.Millisecond
+	policy.MaxBackoff = 20 * time.Millisecond
+	client, server := newTestClient(t, handler, WithRetryPolicy(policy), WithDefaultTimeout(100*time.Millisecond))
+	defer server.Close()
+
+	start := time.Now()
+	_, err := client.GetStatus("8947000000000000001")
+	assert.Assert(t, err != nil)
+	assert.Assert(t, time.Since(start) < time.Second)
+	assert.Assert(t, calls < 1000)
+}
+
+func TestCancelledContextStopsInvocation(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("no request should be sent when the context is already cancelled")
+	})
+	client, server := newTestClient(t, handler, WithRetryPolicy(fastRetries(5)))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := client.DownloadOrderContext(ctx, "8947000000000000001", OrderParameters{})
+	assert.Assert(t, err != nil)
+	assert.Equal(t, int64(0), client.RetryCount())
+}
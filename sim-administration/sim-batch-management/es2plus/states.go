@@ -0,0 +1,165 @@
+package es2plus
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+///
+///  Profile states, and the transitions between them
+///
+
+// ProfileState is the state of a profile as reported by getProfileStatus.
+type ProfileState string
+
+// The profile states defined by SGP.22.
+const (
+	ProfileStateAvailable   ProfileState = "AVAILABLE"
+	ProfileStateAllocated   ProfileState = "ALLOCATED"
+	ProfileStateLinked      ProfileState = "LINKED"
+	ProfileStateConfirmed   ProfileState = "CONFIRMED"
+	ProfileStateReleased    ProfileState = "RELEASED"
+	ProfileStateDownloaded  ProfileState = "DOWNLOADED"
+	ProfileStateInstalled   ProfileState = "INSTALLED"
+	ProfileStateError       ProfileState = "ERROR"
+	ProfileStateUnavailable ProfileState = "UNAVAILABLE"
+)
+
+// CancelOrderTarget is a final state a profile can be left in by
+// cancelOrder.
+type CancelOrderTarget string
+
+// The legal cancelOrder final states.
+const (
+	CancelOrderToAvailable   CancelOrderTarget = "AVAILABLE"
+	CancelOrderToUnavailable CancelOrderTarget = "UNAVAILABLE"
+)
+
+// CancelOrderTargets are all the legal cancelOrder final states.
+var CancelOrderTargets = []CancelOrderTarget{CancelOrderToAvailable, CancelOrderToUnavailable}
+
+// RecoverProfileTarget is a state a profile can be put in by
+// recoverProfile.
+type RecoverProfileTarget string
+
+// The legal recoverProfile target states.
+const (
+	RecoverProfileToAvailable   RecoverProfileTarget = "AVAILABLE"
+	RecoverProfileToReleased    RecoverProfileTarget = "RELEASED"
+	RecoverProfileToUnavailable RecoverProfileTarget = "UNAVAILABLE"
+)
+
+// RecoverProfileTargets are all the legal recoverProfile target states.
+var RecoverProfileTargets = []RecoverProfileTarget{RecoverProfileToAvailable, RecoverProfileToReleased, RecoverProfileToUnavailable}
+
+// The states a profile must be in for an operation to be legal.
+var (
+	// An order can be cancelled until the profile has been downloaded.
+	cancelOrderSources = []ProfileState{ProfileStateAllocated, ProfileStateLinked, ProfileStateConfirmed, ProfileStateReleased}
+
+	// Only a confirmed, but unreleased, order can be released.
+	releaseProfileSources = []ProfileState{ProfileStateConfirmed}
+
+	// Recovery is for profiles whose download went wrong somewhere
+	// along the way.
+	recoverProfileSources = map[RecoverProfileTarget][]ProfileState{
+		RecoverProfileToAvailable:   {ProfileStateAllocated, ProfileStateLinked, ProfileStateConfirmed, ProfileStateReleased, ProfileStateDownloaded, ProfileStateError, ProfileStateUnavailable},
+		RecoverProfileToReleased:    {ProfileStateDownloaded, ProfileStateError},
+		RecoverProfileToUnavailable: {ProfileStateAvailable, ProfileStateAllocated, ProfileStateLinked, ProfileStateConfirmed, ProfileStateReleased, ProfileStateDownloaded, ProfileStateError},
+	}
+)
+
+// ParseCancelOrderTarget returns the cancelOrder final state with the
+// given name, which is case insensitive.
+func ParseCancelOrderTarget(s string) (CancelOrderTarget, error) {
+	for _, target := range CancelOrderTargets {
+		if strings.EqualFold(s, string(target)) {
+			return target, nil
+		}
+	}
+	return "", fmt.Errorf("illegal cancelOrder final state '%s', legal values are: %v", s, CancelOrderTargets)
+}
+
+// ParseRecoverProfileTarget returns the recoverProfile target state with
+// the given name, which is case insensitive.
+func ParseRecoverProfileTarget(s string) (RecoverProfileTarget, error) {
+	for _, target := range RecoverProfileTargets {
+		if strings.EqualFold(s, string(target)) {
+			return target, nil
+		}
+	}
+	return "", fmt.Errorf("illegal recoverProfile target state '%s', legal values are: %v", s, RecoverProfileTargets)
+}
+
+// IllegalTransitionError is returned when an invocation would take a
+// profile from its current state to a state it can't legally go to.
+// Nothing is sent to the SM-DP+ in that case.
+type IllegalTransitionError struct {
+	Function     string
+	Iccid        string
+	CurrentState ProfileState
+	TargetState  ProfileState
+	LegalStates  []ProfileState
+}
+
+func (err *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("es2+ %s of iccid '%s' refused: can't go from state %s to %s, legal current states are %v",
+		err.Function, err.Iccid, err.CurrentState, err.TargetState, err.LegalStates)
+}
+
+// checkTransition fetches the current state of a profile, and returns an
+// IllegalTransitionError if it isn't one of the legal source states.
+func (client *ClientState) checkTransition(ctx context.Context, function string, iccid string, target ProfileState, sources []ProfileState) error {
+	status, err := client.GetStatusContext(ctx, iccid)
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		return fmt.Errorf("no status returned for iccid '%s'", iccid)
+	}
+	current := ProfileState(status.State)
+	for _, source := range sources {
+		if current == source {
+			return nil
+		}
+	}
+	return &IllegalTransitionError{
+		Function:     function,
+		Iccid:        iccid,
+		CurrentState: current,
+		TargetState:  target,
+		LegalStates:  sources,
+	}
+}
+
+///
+///  Observing the states profiles are in
+///
+
+// ProfileObserver is told about the states of profiles, as reported by
+// getProfileStatus, and as changed by invocations that succeeded.  It
+// is called from the goroutines doing the invocations, so it must be
+// safe for concurrent use.
+type ProfileObserver interface {
+	// ProfileStatuses is called with the statuses returned by a
+	// single getProfileStatus request.
+	ProfileStatuses(statuses []ProfileStatus)
+
+	// ProfileStateChanged is called when an invocation has taken a
+	// profile to a new state.  The EID is empty if the invocation
+	// didn't tell.
+	ProfileStateChanged(iccid string, state ProfileState, eid string)
+}
+
+func (client *ClientState) observeStatuses(statuses []ProfileStatus) {
+	if client.observer != nil && len(statuses) > 0 {
+		client.observer.ProfileStatuses(statuses)
+	}
+}
+
+func (client *ClientState) observeStateChange(iccid string, state ProfileState, eid string) {
+	if client.observer != nil {
+		client.observer.ProfileStateChanged(iccid, state, eid)
+	}
+}
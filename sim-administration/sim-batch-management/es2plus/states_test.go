@@ -0,0 +1,166 @@
+package es2plus
+
+import (
+	"gotest.tools/assert"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// newStatefulTestClient returns a client talking to a server that reports
+// the profile as being in the given state, and a function returning the
+// number of invocations other than getProfileStatus it has received.
+func newStatefulTestClient(t *testing.T, state ProfileState) (*ClientState, func() int, func()) {
+	var mutex sync.Mutex
+	calls := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == es2plusPath("getProfileStatus") {
+			writeResponse(w, http.StatusOK, es2ProfileStatusResponse{
+				Header:            successHeader(),
+				ProfileStatusList: []ProfileStatus{{Iccid: "8947000000000000001", State: string(state)}},
+			})
+			return
+		}
+		mutex.Lock()
+		calls++
+		mutex.Unlock()
+		writeResponse(w, http.StatusOK, CancelOrderResponse{Header: successHeader()})
+	})
+	client, server := newTestClient(t, handler)
+	return client, func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return calls
+	}, server.Close
+}
+
+func TestIllegalTransitionsAreRefusedBeforeSending(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   ProfileState
+		invoke  func(client *ClientState) error
+		allowed bool
+	}{
+		{"release confirmed", ProfileStateConfirmed, func(c *ClientState) error { _, err := c.ReleaseProfile("8947000000000000001"); return err }, true},
+		{"release released", ProfileStateReleased, func(c *ClientState) error { _, err := c.ReleaseProfile("8947000000000000001"); return err }, false},
+		{"cancel allocated", ProfileStateAllocated, func(c *ClientState) error {
+			_, err := c.CancelOrder("8947000000000000001", CancelOrderToUnavailable)
+			return err
+		}, true},
+		{"cancel installed", ProfileStateInstalled, func(c *ClientState) error {
+			_, err := c.CancelOrder("8947000000000000001", CancelOrderToAvailable)
+			return err
+		}, false},
+		{"recover downloaded", ProfileStateDownloaded, func(c *ClientState) error {
+			_, err := c.RecoverProfile("8947000000000000001", RecoverProfileToReleased)
+			return err
+		}, true},
+		{"recover available", ProfileStateAvailable, func(c *ClientState) error {
+			_, err := c.RecoverProfile("8947000000000000001", RecoverProfileToReleased)
+			return err
+		}, false},
+	}
+
+	for _, test := range tests {
+		client, calls, cleanup := newStatefulTestClient(t, test.state)
+		err := test.invoke(client)
+		if test.allowed {
+			assert.NilError(t, err, test.name)
+			assert.Equal(t, 1, calls(), test.name)
+		} else {
+			transitionErr, ok := err.(*IllegalTransitionError)
+			assert.Assert(t, ok, "%s: expected *IllegalTransitionError, got %v", test.name, err)
+			assert.Equal(t, test.state, transitionErr.CurrentState)
+			assert.Equal(t, 0, calls(), test.name)
+		}
+		cleanup()
+	}
+}
+
+func TestUnknownTargetStatesAreRefused(t *testing.T) {
+	target, err := ParseCancelOrderTarget("unavailable")
+	assert.NilError(t, err)
+	assert.Equal(t, CancelOrderToUnavailable, target)
+
+	_, err = ParseCancelOrderTarget("RELEASED")
+	assert.Assert(t, err != nil)
+
+	recoverTarget, err := ParseRecoverProfileTarget("Released")
+	assert.NilError(t, err)
+	assert.Equal(t, RecoverProfileToReleased, recoverTarget)
+
+	_, err = ParseRecoverProfileTarget("INSTALLED")
+	assert.Assert(t, err != nil)
+
+	client, calls, cleanup := newStatefulTestClient(t, ProfileStateAllocated)
+	defer cleanup()
+	_, err = client.CancelOrder("8947000000000000001", CancelOrderTarget("RELEASED"))
+	assert.Assert(t, err != nil)
+	_, err = client.RecoverProfile("8947000000000000001", RecoverProfileTarget("INSTALLED"))
+	assert.Assert(t, err != nil)
+	assert.Equal(t, 0, calls())
+}
+
+type testObserver struct {
+	mutex    sync.Mutex
+	statuses []ProfileStatus
+	changes  []string
+}
+
+func (o *testObserver) ProfileStatuses(statuses []ProfileStatus) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.statuses = append(o.statuses, statuses...)
+}
+
+func (o *testObserver) ProfileStateChanged(iccid string, state ProfileState, eid string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.changes = append(o.changes, iccid+" "+string(state)+" "+eid)
+}
+
+func TestObserverIsToldAboutProfileStates(t *testing.T) {
+	client, _, cleanup := newStatefulTestClient(t, ProfileStateConfirmed)
+	defer cleanup()
+	observer := &testObserver{}
+	WithProfileObserver(observer)(client)
+
+	_, err := client.ReleaseProfile("8947000000000000001")
+	assert.NilError(t, err)
+	eid := "89049032123451234512345678901235"
+	_, err = client.ConfirmOrder("8947000000000000002", OrderParameters{Eid: eid, NoRelease: true})
+	assert.NilError(t, err)
+	_, err = client.DownloadOrder("8947000000000000003", OrderParameters{})
+	assert.NilError(t, err)
+
+	// The state checked before releasing, and the states the
+	// invocations left the profiles in.
+	assert.Equal(t, 1, len(observer.statuses))
+	assert.Equal(t, string(ProfileStateConfirmed), observer.statuses[0].State)
+	assert.DeepEqual(t, []string{
+		"8947000000000000001 RELEASED ",
+		"8947000000000000002 CONFIRMED " + eid,
+		"8947000000000000003 ALLOCATED ",
+	}, observer.changes)
+}
+
+func TestTargetStatesAreNormalizedBeforeBeingObserved(t *testing.T) {
+	observer := &testObserver{}
+
+	client, _, cleanup := newStatefulTestClient(t, ProfileStateDownloaded)
+	defer cleanup()
+	WithProfileObserver(observer)(client)
+	_, err := client.RecoverProfile("8947000000000000001", RecoverProfileTarget("released"))
+	assert.NilError(t, err)
+
+	client, _, cleanup = newStatefulTestClient(t, ProfileStateAllocated)
+	defer cleanup()
+	WithProfileObserver(observer)(client)
+	_, err = client.CancelOrder("8947000000000000002", CancelOrderTarget("Unavailable"))
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, []string{
+		"8947000000000000001 RELEASED ",
+		"8947000000000000002 UNAVAILABLE ",
+	}, observer.changes)
+}
@@ -0,0 +1,225 @@
+package es2plus
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+)
+
+///
+///  Verifying the identity of the SM-DP+
+///
+
+// ServerTrust describes how the certificate presented by an SM-DP+
+// is verified.
+type ServerTrust struct {
+	// Path to a PEM file containing the CA certificates the SM-DP+
+	// certificate chain must be signed by.  If empty, the system
+	// trust store is used.
+	CABundlePath string
+
+	// Base64 encoded SHA-256 hash of the SubjectPublicKeyInfo of a
+	// certificate, optionally prefixed by "sha256/".  If set without a
+	// CA bundle, the pin alone is verified, and must be that of the
+	// SM-DP+ certificate itself, which is useful when it is privately
+	// signed.  If set with a CA bundle, both are verified, and the pin
+	// may be that of any certificate in the verified chain.
+	PinnedSpkiSha256 string
+
+	// The name the SM-DP+ certificate must be valid for.  If empty,
+	// the host name used to connect is used.
+	ServerName string
+
+	// Turns off all verification of the SM-DP+ certificate.  Anyone
+	// able to intercept the traffic can then impersonate the SM-DP+,
+	// so don't.
+	InsecureSkipVerify bool
+}
+
+var serverNameRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+
+// ValidateServerTrust checks that a server trust description is
+// complete and consistent, and that the files it refers to contain
+// what they should.
+func ValidateServerTrust(trust ServerTrust) error {
+	if trust.InsecureSkipVerify {
+		if trust.CABundlePath != "" || trust.PinnedSpkiSha256 != "" {
+			return fmt.Errorf("can't both skip TLS verification and verify using a CA bundle or pinned key")
+		}
+		return nil
+	}
+
+	if trust.CABundlePath != "" {
+		if _, err := loadCertPool(trust.CABundlePath); err != nil {
+			return err
+		}
+	}
+
+	if trust.PinnedSpkiSha256 != "" {
+		if _, err := decodePin(trust.PinnedSpkiSha256); err != nil {
+			return err
+		}
+	}
+
+	if trust.ServerName != "" && !serverNameRegexp.MatchString(trust.ServerName) {
+		return fmt.Errorf("not a valid server name: '%s'", trust.ServerName)
+	}
+	return nil
+}
+
+// SpkiSha256 returns the base64 encoded SHA-256 hash of the
+// SubjectPublicKeyInfo of a certificate, in the format used
+// for pinning.
+func SpkiSha256(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func loadCertPool(caBundlePath string) (*x509.CertPool, error) {
+	caBytes, err := ioutil.ReadFile(caBundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read CA bundle '%s': %s", caBundlePath, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("no certificates found in CA bundle '%s'", caBundlePath)
+	}
+	return pool, nil
+}
+
+func decodePin(pin string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+	if err != nil || len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("pinned SPKI hash '%s' is not a base64 encoded SHA-256 hash", pin)
+	}
+	return decoded, nil
+}
+
+func matchesPin(cert *x509.Certificate, pin []byte) bool {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return string(hash[:]) == string(pin)
+}
+
+// ServerTLSConfig returns a TLS configuration verifying a server, such
+// as the ES9+ interface of an SM-DP+, according to the trust description.
+func ServerTLSConfig(trust ServerTrust) (*tls.Config, error) {
+	return newTLSConfig(trust, "")
+}
+
+// newTLSConfig returns a TLS configuration verifying the SM-DP+
+// according to the server trust description.
+func newTLSConfig(trust ServerTrust, vendor string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: trust.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if trust.InsecureSkipVerify {
+		logging.With(logging.FieldVendor, vendor).Warnf("TLS verification of the SM-DP+ is DISABLED.  Anyone able to intercept the traffic can impersonate it.")
+		config.InsecureSkipVerify = true
+		return config, nil
+	}
+
+	if trust.CABundlePath != "" {
+		pool, err := loadCertPool(trust.CABundlePath)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if trust.PinnedSpkiSha256 != "" {
+		pin, err := decodePin(trust.PinnedSpkiSha256)
+		if err != nil {
+			return nil, err
+		}
+
+		// With a pin and no CA bundle the pin is all we verify, since
+		// the chain is most likely privately signed.  Anyone can send
+		// any certificate along with their own, so only the leaf, whose
+		// key the handshake proves the SM-DP+ has, is looked at.
+		if trust.CABundlePath == "" {
+			config.InsecureSkipVerify = true
+			config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) > 0 {
+					leaf, err := x509.ParseCertificate(rawCerts[0])
+					if err != nil {
+						return err
+					}
+					if matchesPin(leaf, pin) {
+						return nil
+					}
+				}
+				return fmt.Errorf("the certificate presented by the SM-DP+ of profile vendor '%s' doesn't match the pinned key", vendor)
+			}
+			return config, nil
+		}
+
+		// With a CA bundle, the pin must be in a chain it verified.
+		config.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					if matchesPin(cert, pin) {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("no certificate in the verified chain of the SM-DP+ of profile vendor '%s' matches the pinned key", vendor)
+		}
+	}
+	return config, nil
+}
+
+///
+///  The certificate we present to the SM-DP+
+///
+
+// ClientCertificate describes the certificate a client authenticates
+// itself to the SM-DP+ with.
+type ClientCertificate struct {
+	Subject   string
+	Issuer    string
+	Serial    string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// LoadClientCertificate reads a client certificate and its private key,
+// checking that the key belongs to the certificate.  Whether the
+// certificate is currently valid is checked by Validate.
+func LoadClientCertificate(certFilePath string, keyFilePath string) (*ClientCertificate, error) {
+	pair, err := tls.LoadX509KeyPair(certFilePath, keyFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load certificate '%s' with key '%s': %s", certFilePath, keyFilePath, err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse certificate '%s': %s", certFilePath, err)
+	}
+	return &ClientCertificate{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		Serial:    fmt.Sprintf("%X", cert.SerialNumber),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}, nil
+}
+
+// Validate returns an error if the certificate isn't valid at the
+// given time.
+func (cert *ClientCertificate) Validate(now time.Time) error {
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate '%s' (serial %s) is not valid until %s", cert.Subject, cert.Serial, cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate '%s' (serial %s) expired %s", cert.Subject, cert.Serial, cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package es2plus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// connectWithTrust does a single request to the server, verifying it
+// according to the server trust description.
+func connectWithTrust(t *testing.T, server *httptest.Server, trust ServerTrust) error {
+	config, err := newTLSConfig(trust, "Durian")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// writeCABundle writes the server's certificate to a PEM file, and
+// returns the path to it.
+func writeCABundle(t *testing.T, server *httptest.Server) string {
+	dir, err := ioutil.TempDir("", "es2plus-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(path, pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestServerVerification(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	caBundle := writeCABundle(t, server)
+	defer os.RemoveAll(filepath.Dir(caBundle))
+
+	pin := SpkiSha256(server.Certificate())
+	otherPin := "sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+	tests := []struct {
+		name     string
+		trust    ServerTrust
+		accepted bool
+	}{
+		{"system trust store", ServerTrust{}, false},
+		{"CA bundle", ServerTrust{CABundlePath: caBundle}, true},
+		{"CA bundle and pin", ServerTrust{CABundlePath: caBundle, PinnedSpkiSha256: pin}, true},
+		{"CA bundle and wrong pin", ServerTrust{CABundlePath: caBundle, PinnedSpkiSha256: otherPin}, false},
+		{"CA bundle and server name", ServerTrust{CABundlePath: caBundle, ServerName: "example.com"}, true},
+		{"CA bundle and wrong server name", ServerTrust{CABundlePath: caBundle, ServerName: "smdp.example.org"}, false},
+		{"pin", ServerTrust{PinnedSpkiSha256: pin}, true},
+		{"prefixed pin", ServerTrust{PinnedSpkiSha256: "sha256/" + pin}, true},
+		{"wrong pin", ServerTrust{PinnedSpkiSha256: otherPin}, false},
+		{"insecure", ServerTrust{InsecureSkipVerify: true}, true},
+	}
+
+	for _, test := range tests {
+		err := connectWithTrust(t, server, test.trust)
+		assert.Equal(t, test.accepted, err == nil, "%s: %v", test.name, err)
+	}
+}
+
+// newImpostor returns a server presenting a certificate of its own,
+// followed by the certificate of the server it impersonates, and the
+// impostor's certificate.
+func newImpostor(t *testing.T, impersonated *httptest.Server) (*httptest.Server, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(666),
+		Subject:               pkix.Name{CommonName: "impostor"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"example.com"},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	impostor := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	impostor.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{der, impersonated.Certificate().Raw},
+		PrivateKey:  key,
+	}}}
+	impostor.StartTLS()
+	return impostor, cert
+}
+
+func TestPinIsNotSatisfiedByAppendedCertificates(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	impostor, impostorCert := newImpostor(t, server)
+	defer impostor.Close()
+
+	pin := SpkiSha256(server.Certificate())
+	err := connectWithTrust(t, impostor, ServerTrust{PinnedSpkiSha256: pin})
+	assert.ErrorContains(t, err, "pinned key")
+
+	// A CA bundle trusting the impostor doesn't help it either, since the
+	// appended certificate isn't in the chain that was verified.
+	dir, err := ioutil.TempDir("", "es2plus-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caBundle := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: impostorCert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.NilError(t, connectWithTrust(t, impostor, ServerTrust{CABundlePath: caBundle}))
+	err = connectWithTrust(t, impostor, ServerTrust{CABundlePath: caBundle, PinnedSpkiSha256: pin})
+	assert.ErrorContains(t, err, "pinned key")
+}
+
+func TestValidateServerTrust(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	caBundle := writeCABundle(t, server)
+	defer os.RemoveAll(filepath.Dir(caBundle))
+
+	notPem := filepath.Join(filepath.Dir(caBundle), "not.pem")
+	if err := ioutil.WriteFile(notPem, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pin := SpkiSha256(server.Certificate())
+
+	assert.NilError(t, ValidateServerTrust(ServerTrust{}))
+	assert.NilError(t, ValidateServerTrust(ServerTrust{CABundlePath: caBundle, PinnedSpkiSha256: pin, ServerName: "smdp.example.com"}))
+	assert.NilError(t, ValidateServerTrust(ServerTrust{InsecureSkipVerify: true}))
+
+	assert.Assert(t, ValidateServerTrust(ServerTrust{CABundlePath: "/no/such/file.pem"}) != nil)
+	assert.Assert(t, ValidateServerTrust(ServerTrust{CABundlePath: notPem}) != nil)
+	assert.Assert(t, ValidateServerTrust(ServerTrust{PinnedSpkiSha256: "not base64!"}) != nil)
+	assert.Assert(t, ValidateServerTrust(ServerTrust{PinnedSpkiSha256: "AAAA"}) != nil)
+	assert.Assert(t, ValidateServerTrust(ServerTrust{ServerName: "smdp example com"}) != nil)
+	assert.Assert(t, ValidateServerTrust(ServerTrust{InsecureSkipVerify: true, PinnedSpkiSha256: pin}) != nil)
+	assert.Assert(t, ValidateServerTrust(ServerTrust{InsecureSkipVerify: true, CABundlePath: caBundle}) != nil)
+}
+
+// writeClientCertificate writes a self-signed certificate, valid until
+// notAfter, and its key to PEM files, and returns the paths to them.
+func writeClientCertificate(t *testing.T, dir string, name string, serial int64, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"Test"}},
+		NotBefore:    notAfter.AddDate(-1, 0, 0),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestClientCertificateIsLoadedAndValidated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "es2plus-client-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	certPath, keyPath := writeClientCertificate(t, dir, "durian", 4711, notAfter)
+	cert, err := LoadClientCertificate(certPath, keyPath)
+	assert.NilError(t, err)
+	assert.Equal(t, "CN=durian,O=Test", cert.Subject)
+	assert.Equal(t, "CN=durian,O=Test", cert.Issuer)
+	assert.Equal(t, "1267", cert.Serial)
+	assert.Assert(t, cert.NotAfter.Equal(notAfter))
+
+	assert.NilError(t, cert.Validate(notAfter.AddDate(0, -1, 0)))
+	assert.ErrorContains(t, cert.Validate(notAfter.AddDate(0, 0, 1)), "expired 2030-01-01T00:00:00Z")
+	assert.ErrorContains(t, cert.Validate(notAfter.AddDate(-2, 0, 0)), "not valid until")
+
+	// A key that doesn't belong to the certificate is refused.
+	_, otherKeyPath := writeClientCertificate(t, dir, "other", 1, notAfter)
+	_, err = LoadClientCertificate(certPath, otherKeyPath)
+	assert.ErrorContains(t, err, "private key does not match public key")
+}
@@ -2,8 +2,8 @@ package fieldsyntaxchecks
 
 import (
 	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/loltelutils"
-	"log"
 	"net/url"
 	"regexp"
 	"strconv"
@@ -66,14 +66,14 @@ func IsICCID(s string) bool {
 // Does  check luhn checksum.
 func CheckICCIDSyntax(name string, potentialIccid string) {
 	if !IsICCID(potentialIccid) {
-		log.Fatalf("Not a valid '%s' ICCID: '%s'.  Must be 18 or 19 (or 20) digits (_including_ luhn checksum).", name, potentialIccid)
+		logging.Fatalf("Not a valid '%s' ICCID: '%s'.  Must be 18 or 19 (or 20) digits (_including_ luhn checksum).", name, potentialIccid)
 	}
 
 	stringWithoutLuhnChecksum := IccidWithoutLuhnChecksum(potentialIccid)
 	controlDigit := generateControlDigit(stringWithoutLuhnChecksum)
 	checksummedCandidate := fmt.Sprintf("%s%d", stringWithoutLuhnChecksum, controlDigit)
 	if checksummedCandidate != potentialIccid {
-		log.Fatalf("Not a valid '%s'  ICCID: '%s'. Expected luhn checksom '%d'", name, potentialIccid, controlDigit)
+		logging.Fatalf("Not a valid '%s'  ICCID: '%s'. Expected luhn checksom '%d'", name, potentialIccid, controlDigit)
 	}
 }
 
@@ -91,7 +91,7 @@ func IsIMSI(s string) bool {
 func CheckIMSISyntax(name string, potentialIMSI string) {
 	if !IsIMSI(potentialIMSI) {
 		// TODO: Modify.  Return error value instead.
-		log.Fatalf("Not a valid %s IMSI: '%s'.  Must be 15 digits.", name, potentialIMSI)
+		logging.Fatalf("Not a valid %s IMSI: '%s'.  Must be 15 digits.", name, potentialIMSI)
 	}
 }
 
@@ -108,7 +108,7 @@ func IsMSISDN(s string) bool {
 func CheckMSISDNSyntax(name string, potentialMSISDN string) {
 	if !IsMSISDN(potentialMSISDN) {
 		// TODO: Fix this to return error value instead.
-		log.Fatalf("Not a valid %s MSISDN: '%s'.  Must be non-empty sequence of digits.", name, potentialMSISDN)
+		logging.Fatalf("Not a valid %s MSISDN: '%s'.  Must be non-empty sequence of digits.", name, potentialMSISDN)
 	}
 }
 
@@ -120,7 +120,7 @@ func CheckMSISDNSyntax(name string, potentialMSISDN string) {
 func CheckURLSyntax(name string, theURL string) {
 	if _, err := url.ParseRequestURI(theURL);  err != nil {
 		// TODO: Fix this to return error value instead.
-		log.Fatalf("Not a valid %s URL: '%s'.", name, theURL)
+		logging.Fatalf("Not a valid %s URL: '%s'.", name, theURL)
 	}
 }
 
@@ -139,11 +139,26 @@ func IsProfileName(s string) bool {
 func CheckProfileType(name string, potentialProfileName string) {
 	if !IsProfileName(potentialProfileName) {
 		// TODO: Fix this to return error value instead.
-		log.Fatalf("Not a valid %s MSISDN: '%s'. Must be uppercase characters, numbers and underscores. ", name, potentialProfileName)
+		logging.Fatalf("Not a valid %s MSISDN: '%s'. Must be uppercase characters, numbers and underscores. ", name, potentialProfileName)
 	}
 }
 
 
+// IsEID is true iff the parameter string is a 32 digit number,
+// indicating that it could be a valid eUICC identifier.
+func IsEID(s string) bool {
+	match, _ := regexp.MatchString("^\\d{32}$", s)
+	return match
+}
+
+// IsMatchingID is true iff the parameter string could be used as
+// the matching ID of an activation code:  Uppercase characters,
+// numbers and dashes.
+func IsMatchingID(s string) bool {
+	match, _ := regexp.MatchString("^[0-9A-Z-]{1,255}$", s)
+	return match
+}
+
 // IccidWithoutLuhnChecksum takes an ICCID with a trailing Luhn
 // checksum, and returns the value without the trailing checksum.
 func IccidWithoutLuhnChecksum(s string) string {
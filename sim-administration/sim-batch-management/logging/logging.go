@@ -0,0 +1,323 @@
+// Package logging is a small levelled, structured logger.  Messages
+// carry fields, such as the batch, ICCID or profile vendor they concern,
+// and are written as logfmt or JSON, one per line, to stderr unless
+// configured otherwise.  Data meant for other programs goes to stdout,
+// never through here.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Names of fields used across packages.
+const (
+	FieldBatch                  = "batch"
+	FieldIccid                  = "iccid"
+	FieldVendor                 = "vendor"
+	FieldFunction               = "function"
+	FieldFunctionCallIdentifier = "functionCallIdentifier"
+	FieldJob                    = "job"
+	FieldError                  = "error"
+)
+
+// Level is the severity of a message.
+type Level int
+
+// The levels, from least to most severe.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Levels are the names of all levels, from least to most severe.
+var Levels = []string{"debug", "info", "warn", "error"}
+
+func (level Level) String() string {
+	if level >= LevelDebug && level <= LevelError {
+		return Levels[level]
+	}
+	return fmt.Sprintf("level(%d)", int(level))
+}
+
+// ParseLevel returns the level with the given name.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range Levels {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s', legal values are: %v", s, Levels)
+}
+
+// Format is the way messages are written.
+type Format int
+
+// The formats.
+const (
+	FormatLogfmt Format = iota
+	FormatJSON
+)
+
+// Formats are the names of all formats.
+var Formats = []string{"logfmt", "json"}
+
+// ParseFormat returns the format with the given name.
+func ParseFormat(s string) (Format, error) {
+	for i, name := range Formats {
+		if strings.EqualFold(s, name) {
+			return Format(i), nil
+		}
+	}
+	return FormatLogfmt, fmt.Errorf("unknown log format '%s', legal values are: %v", s, Formats)
+}
+
+// sink is where messages end up, shared by a logger and all the
+// loggers derived from it.
+type sink struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	level  Level
+	format Format
+	now    func() time.Time
+}
+
+// Logger writes messages with a fixed set of fields.  It is safe for
+// concurrent use.
+type Logger struct {
+	sink   *sink
+	fields []interface{}
+}
+
+// New creates a logger writing messages of at least the given level.
+func New(out io.Writer, level Level, format Format) *Logger {
+	return &Logger{sink: &sink{out: out, level: level, format: format, now: time.Now}}
+}
+
+// With returns a logger adding the fields, given as alternating names
+// and values, to every message.
+func (logger *Logger) With(keyvals ...interface{}) *Logger {
+	if len(keyvals)%2 != 0 {
+		keyvals = append(keyvals, "")
+	}
+	fields := make([]interface{}, 0, len(logger.fields)+len(keyvals))
+	fields = append(fields, logger.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{sink: logger.sink, fields: fields}
+}
+
+// Enabled is true if messages of the level are written.
+func (logger *Logger) Enabled(level Level) bool {
+	logger.sink.mutex.Lock()
+	defer logger.sink.mutex.Unlock()
+	return level >= logger.sink.level
+}
+
+// Debugf writes a debug message.
+func (logger *Logger) Debugf(format string, args ...interface{}) {
+	logger.write(LevelDebug, fmt.Sprintf(format, args...))
+}
+
+// Infof writes an informational message.
+func (logger *Logger) Infof(format string, args ...interface{}) {
+	logger.write(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+// Warnf writes a warning.
+func (logger *Logger) Warnf(format string, args ...interface{}) {
+	logger.write(LevelWarn, fmt.Sprintf(format, args...))
+}
+
+// Errorf writes an error message.
+func (logger *Logger) Errorf(format string, args ...interface{}) {
+	logger.write(LevelError, fmt.Sprintf(format, args...))
+}
+
+// Fatalf writes an error message, and terminates the program.
+func (logger *Logger) Fatalf(format string, args ...interface{}) {
+	logger.write(LevelError, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+func (logger *Logger) write(level Level, message string) {
+	s := logger.sink
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if level < s.level {
+		return
+	}
+
+	message = strings.TrimRightFunc(message, unicode.IsSpace)
+	now := s.now().Format("2006-01-02T15:04:05.000Z07:00")
+	buffer := new(bytes.Buffer)
+	if s.format == FormatJSON {
+		buffer.WriteString("{")
+		writeJSONField(buffer, "time", now)
+		buffer.WriteString(",")
+		writeJSONField(buffer, "level", level.String())
+		buffer.WriteString(",")
+		writeJSONField(buffer, "msg", message)
+		for i := 0; i+1 < len(logger.fields); i += 2 {
+			buffer.WriteString(",")
+			writeJSONField(buffer, fmt.Sprint(logger.fields[i]), logger.fields[i+1])
+		}
+		buffer.WriteString("}\n")
+	} else {
+		fmt.Fprintf(buffer, "time=%s level=%s msg=%s", now, level, logfmtValue(message))
+		for i := 0; i+1 < len(logger.fields); i += 2 {
+			fmt.Fprintf(buffer, " %s=%s", logfmtKey(fmt.Sprint(logger.fields[i])), logfmtValue(stringValue(logger.fields[i+1])))
+		}
+		buffer.WriteString("\n")
+	}
+	_, _ = s.out.Write(buffer.Bytes())
+}
+
+func stringValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
+
+func logfmtKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\\") || strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func writeJSONField(buffer *bytes.Buffer, key string, value interface{}) {
+	encodedKey, _ := json.Marshal(key)
+	buffer.Write(encodedKey)
+	buffer.WriteString(":")
+	switch value.(type) {
+	case error, fmt.Stringer:
+		value = stringValue(value)
+	}
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		encodedValue, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buffer.Write(encodedValue)
+}
+
+// Writer returns a writer turning every line written to it into a
+// message of the given level.
+func (logger *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{logger: logger, level: level}
+}
+
+type lineWriter struct {
+	mutex   sync.Mutex
+	logger  *Logger
+	level   Level
+	pending []byte
+}
+
+func (writer *lineWriter) Write(p []byte) (int, error) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.pending = append(writer.pending, p...)
+	for {
+		end := bytes.IndexByte(writer.pending, '\n')
+		if end < 0 {
+			break
+		}
+		line := string(writer.pending[:end])
+		writer.pending = writer.pending[end+1:]
+		writer.logger.write(writer.level, line)
+	}
+	return len(p), nil
+}
+
+///
+///  The standard logger
+///
+
+var std = New(os.Stderr, LevelInfo, FormatLogfmt)
+
+// Configure sets where the standard logger writes, the least severe
+// level it writes, and the format.  Messages written with the log
+// package of the standard library are passed on to it as well.
+func Configure(out io.Writer, level Level, format Format) {
+	std.sink.mutex.Lock()
+	std.sink.out = out
+	std.sink.level = level
+	std.sink.format = format
+	std.sink.mutex.Unlock()
+
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(std.Writer(LevelInfo))
+}
+
+// With returns a logger adding the fields, given as alternating names
+// and values, to every message written to the standard logger.
+func With(keyvals ...interface{}) *Logger {
+	return std.With(keyvals...)
+}
+
+// Enabled is true if messages of the level are written by the standard
+// logger.
+func Enabled(level Level) bool {
+	return std.Enabled(level)
+}
+
+// Debugf writes a debug message to the standard logger.
+func Debugf(format string, args ...interface{}) {
+	std.Debugf(format, args...)
+}
+
+// Infof writes an informational message to the standard logger.
+func Infof(format string, args ...interface{}) {
+	std.Infof(format, args...)
+}
+
+// Warnf writes a warning to the standard logger.
+func Warnf(format string, args ...interface{}) {
+	std.Warnf(format, args...)
+}
+
+// Errorf writes an error message to the standard logger.
+func Errorf(format string, args ...interface{}) {
+	std.Errorf(format, args...)
+}
+
+// Fatalf writes an error message to the standard logger, and
+// terminates the program.
+func Fatalf(format string, args ...interface{}) {
+	std.Fatalf(format, args...)
+}
+
+// Writer returns a writer turning every line written to it into a
+// message of the given level, written to the standard logger.
+func Writer(level Level) io.Writer {
+	return std.Writer(level)
+}
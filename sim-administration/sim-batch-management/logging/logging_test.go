@@ -0,0 +1,65 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gotest.tools/assert"
+	"testing"
+	"time"
+)
+
+func newTestLogger(level Level, format Format) (*Logger, *bytes.Buffer) {
+	output := new(bytes.Buffer)
+	logger := New(output, level, format)
+	logger.sink.now = func() time.Time {
+		return time.Date(2019, 12, 1, 10, 11, 12, 0, time.UTC)
+	}
+	return logger, output
+}
+
+func TestMessagesAreWrittenAsLogfmtWithFields(t *testing.T) {
+	logger, output := newTestLogger(LevelInfo, FormatLogfmt)
+	logger = logger.With(FieldVendor, "Durian", FieldBatch, "TestBatch")
+
+	logger.With(FieldIccid, "8947000000000000001").Infof("Activated profile\n")
+	logger.With(FieldError, errors.New("connection reset")).Errorf("Couldn't activate")
+	logger.Debugf("Not written")
+
+	assert.Equal(t, `time=2019-12-01T10:11:12.000Z level=info msg="Activated profile" vendor=Durian batch=TestBatch iccid=8947000000000000001
+time=2019-12-01T10:11:12.000Z level=error msg="Couldn't activate" vendor=Durian batch=TestBatch error="connection reset"
+`, output.String())
+}
+
+func TestMessagesAreWrittenAsJSONWithFields(t *testing.T) {
+	logger, output := newTestLogger(LevelDebug, FormatJSON)
+	logger.With(FieldJob, 42, FieldFunctionCallIdentifier, "urn:uuid:1").Debugf("Sending %s", "downloadOrder")
+
+	assert.Equal(t, `{"time":"2019-12-01T10:11:12.000Z","level":"debug","msg":"Sending downloadOrder","job":42,"functionCallIdentifier":"urn:uuid:1"}
+`, output.String())
+}
+
+func TestWriterTurnsLinesIntoMessages(t *testing.T) {
+	logger, output := newTestLogger(LevelInfo, FormatLogfmt)
+	writer := logger.Writer(LevelWarn)
+
+	fmt.Fprint(writer, "Couldn't parse 8947000000000000001: bro")
+	fmt.Fprint(writer, "ken\nERROR: slow\n")
+	fmt.Fprint(logger.Writer(LevelDebug), "Not written\n")
+
+	assert.Equal(t, `time=2019-12-01T10:11:12.000Z level=warn msg="Couldn't parse 8947000000000000001: broken"
+time=2019-12-01T10:11:12.000Z level=warn msg="ERROR: slow"
+`, output.String())
+}
+
+func TestLevelsAndFormatsAreParsed(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	assert.NilError(t, err)
+	assert.Equal(t, LevelWarn, level)
+	_, err = ParseLevel("verbose")
+	assert.ErrorContains(t, err, "unknown log level")
+
+	format, err := ParseFormat("json")
+	assert.NilError(t, err)
+	assert.Equal(t, FormatJSON, format)
+}
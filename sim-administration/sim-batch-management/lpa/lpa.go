@@ -0,0 +1,593 @@
+// Package lpa simulates the Local Profile Assistant (LPA) and eUICC of
+// a device, downloading a profile from an SM-DP+ using an activation
+// code the way a phone would, over SGP.22 ES9+.  It is used to check
+// that the activation codes we hand out actually lead to a profile.
+//
+// The eUICC identity is simulated:  A made up EID, and a key pair with
+// a self-signed certificate rather than one issued by a GSMA CI.  The
+// signed data elements, ASN.1 encoded in SGP.22, are base64 encoded
+// JSON here, as spoken by the SM-DP+ stand-in in the es2plustest
+// package.
+package lpa
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/es2plus"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+///
+///  Activation codes
+///
+
+// ActivationCode is the information a user scans or types into their
+// phone to download a profile, as defined by SGP.22 section 4.1.
+type ActivationCode struct {
+	SmdpAddress              string
+	MatchingID               string
+	SmdpOid                  string
+	ConfirmationCodeRequired bool
+}
+
+// ParseActivationCode parses an activation code such as
+// "LPA:1$smdp.example.com$04386-AGYFT-A74Y8-3F815".
+func ParseActivationCode(code string) (*ActivationCode, error) {
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(code), "LPA:"), "$")
+	if len(parts) < 3 || parts[0] != "1" {
+		return nil, fmt.Errorf("not an activation code: '%s'.  Must be 1$<SM-DP+ address>$<matching ID>, optionally prefixed by LPA:", code)
+	}
+	if parts[1] == "" {
+		return nil, fmt.Errorf("activation code '%s' has no SM-DP+ address", code)
+	}
+	result := &ActivationCode{SmdpAddress: parts[1], MatchingID: parts[2]}
+	if len(parts) > 3 {
+		result.SmdpOid = parts[3]
+	}
+	if len(parts) > 4 {
+		result.ConfirmationCodeRequired = parts[4] == "1"
+	}
+	return result, nil
+}
+
+func (code ActivationCode) String() string {
+	result := fmt.Sprintf("LPA:1$%s$%s", code.SmdpAddress, code.MatchingID)
+	if code.SmdpOid != "" || code.ConfirmationCodeRequired {
+		result += "$" + code.SmdpOid
+	}
+	if code.ConfirmationCodeRequired {
+		result += "$1"
+	}
+	return result
+}
+
+///
+///  The simulated eUICC
+///
+
+// EUICC is the simulated identity of a device's eUICC.
+type EUICC struct {
+	Eid         string
+	key         *ecdsa.PrivateKey
+	certificate []byte
+}
+
+// NewEUICC creates an eUICC with the given EID, and a fresh key pair.
+func NewEUICC(eid string) (*EUICC, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: eid, Organization: []string{"Simulated eUICC"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &EUICC{Eid: eid, key: key, certificate: certificate}, nil
+}
+
+// SimulatedEid returns a random 32 digit EID, so that simulated eUICCs
+// can be told apart.
+func SimulatedEid() (string, error) {
+	digits := make([]byte, 24)
+	if _, err := rand.Read(digits); err != nil {
+		return "", err
+	}
+	eid := "89049032"
+	for _, digit := range digits {
+		eid += fmt.Sprintf("%d", digit%10)
+	}
+	return eid, nil
+}
+
+// Certificate returns the base64 encoded DER certificate of the eUICC.
+func (euicc *EUICC) Certificate() string {
+	return base64.StdEncoding.EncodeToString(euicc.certificate)
+}
+
+// sign returns the base64 encoded signature of the data.
+func (euicc *EUICC) sign(data string) (string, error) {
+	hash := sha256.Sum256([]byte(data))
+	signature, err := ecdsa.SignASN1(rand.Reader, euicc.key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// VerifySignature checks that data was signed by the eUICC with the
+// given base64 encoded certificate.
+func VerifySignature(certificate string, data string, signature string) error {
+	der, err := base64.StdEncoding.DecodeString(certificate)
+	if err != nil {
+		return fmt.Errorf("eUICC certificate is not base64 encoded: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("couldn't parse eUICC certificate: %s", err)
+	}
+	key, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("eUICC certificate doesn't have an ECDSA key")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not base64 encoded: %s", err)
+	}
+	hash := sha256.Sum256([]byte(data))
+	if !ecdsa.VerifyASN1(key, hash[:], decoded) {
+		return fmt.Errorf("signature doesn't match eUICC certificate '%s'", cert.Subject.CommonName)
+	}
+	return nil
+}
+
+// HashConfirmationCode returns the hash of a confirmation code sent to
+// the SM-DP+ in the download, bound to the transaction.
+func HashConfirmationCode(confirmationCode string, transactionID string) string {
+	first := sha256.Sum256([]byte(confirmationCode))
+	second := sha256.Sum256(append(first[:], []byte(transactionID)...))
+	return base64.StdEncoding.EncodeToString(second[:])
+}
+
+///
+///  ES9+ messages
+///
+
+// The ES9+ functions, in the order they are invoked, which are also
+// the steps a download can fail at.
+const (
+	StepInitiateAuthentication = "initiateAuthentication"
+	StepAuthenticateClient     = "authenticateClient"
+	StepGetBoundProfilePackage = "getBoundProfilePackage"
+	StepHandleNotification     = "handleNotification"
+)
+
+// The final result of a profile installation.
+const (
+	InstallationSucceeded = "SUCCESS"
+	InstallationFailed    = "ERROR"
+)
+
+// InitiateAuthenticationRequest starts a download.
+type InitiateAuthenticationRequest struct {
+	EuiccChallenge string `json:"euiccChallenge"`
+	EuiccInfo1     string `json:"euiccInfo1"`
+	SmdpAddress    string `json:"smdpAddress"`
+}
+
+// InitiateAuthenticationResponse carries the SM-DP+'s challenge.
+// ServerSigned1 is a base64 encoded ServerSigned1.
+type InitiateAuthenticationResponse struct {
+	Header        es2plus.ResponseHeader `json:"header"`
+	TransactionID string                 `json:"transactionId"`
+	ServerSigned1 string                 `json:"serverSigned1"`
+}
+
+// ServerSigned1 echoes the eUICC's challenge, and adds the server's.
+type ServerSigned1 struct {
+	TransactionID   string `json:"transactionId"`
+	EuiccChallenge  string `json:"euiccChallenge"`
+	ServerAddress   string `json:"serverAddress"`
+	ServerChallenge string `json:"serverChallenge"`
+}
+
+// AuthenticateClientRequest carries the eUICC's response to the
+// SM-DP+'s challenge.  EuiccSigned1 is a base64 encoded EuiccSigned1.
+type AuthenticateClientRequest struct {
+	TransactionID    string `json:"transactionId"`
+	EuiccSigned1     string `json:"euiccSigned1"`
+	EuiccSignature1  string `json:"euiccSignature1"`
+	EuiccCertificate string `json:"euiccCertificate"`
+}
+
+// EuiccSigned1 identifies the eUICC and the profile it asks for.
+type EuiccSigned1 struct {
+	TransactionID   string `json:"transactionId"`
+	ServerAddress   string `json:"serverAddress"`
+	ServerChallenge string `json:"serverChallenge"`
+	Eid             string `json:"eid"`
+	MatchingID      string `json:"matchingId"`
+}
+
+// AuthenticateClientResponse describes the profile to be downloaded.
+// ProfileMetadata and SmdpSigned2 are base64 encoded.
+type AuthenticateClientResponse struct {
+	Header          es2plus.ResponseHeader `json:"header"`
+	TransactionID   string                 `json:"transactionId"`
+	ProfileMetadata string                 `json:"profileMetadata"`
+	SmdpSigned2     string                 `json:"smdpSigned2"`
+}
+
+// ProfileMetadata is what the user is shown before accepting a profile.
+type ProfileMetadata struct {
+	Iccid               string `json:"iccid"`
+	ServiceProviderName string `json:"serviceProviderName,omitempty"`
+	ProfileName         string `json:"profileName,omitempty"`
+}
+
+// SmdpSigned2 says whether the user must enter a confirmation code.
+type SmdpSigned2 struct {
+	TransactionID  string `json:"transactionId"`
+	CcRequiredFlag bool   `json:"ccRequiredFlag"`
+}
+
+// GetBoundProfilePackageRequest asks for the profile, once the user
+// has accepted it.  EuiccSigned2 is a base64 encoded EuiccSigned2.
+type GetBoundProfilePackageRequest struct {
+	TransactionID   string `json:"transactionId"`
+	EuiccSigned2    string `json:"euiccSigned2"`
+	EuiccSignature2 string `json:"euiccSignature2"`
+}
+
+// EuiccSigned2 carries the eUICC's one time key, and the hashed
+// confirmation code, if required.
+type EuiccSigned2 struct {
+	TransactionID string `json:"transactionId"`
+	EuiccOtpk     string `json:"euiccOtpk"`
+	HashCc        string `json:"hashCc,omitempty"`
+}
+
+// GetBoundProfilePackageResponse carries the profile, bound to the
+// eUICC.  BoundProfilePackage is a base64 encoded BoundProfilePackage.
+type GetBoundProfilePackageResponse struct {
+	Header              es2plus.ResponseHeader `json:"header"`
+	TransactionID       string                 `json:"transactionId"`
+	BoundProfilePackage string                 `json:"boundProfilePackage"`
+}
+
+// BoundProfilePackage is the profile, as installed by the eUICC.
+type BoundProfilePackage struct {
+	TransactionID   string `json:"transactionId"`
+	Iccid           string `json:"iccid"`
+	ProfileElements string `json:"profileElements"`
+}
+
+// HandleNotificationRequest tells the SM-DP+ how the installation went.
+// ProfileInstallationResult is a base64 encoded ProfileInstallationResult.
+type HandleNotificationRequest struct {
+	ProfileInstallationResult string `json:"profileInstallationResult"`
+	EuiccSignPIR              string `json:"euiccSignPIR"`
+}
+
+// ProfileInstallationResult is the outcome of installing a profile.
+type ProfileInstallationResult struct {
+	TransactionID       string `json:"transactionId"`
+	Eid                 string `json:"eid"`
+	Iccid               string `json:"iccid"`
+	NotificationAddress string `json:"notificationAddress"`
+	SeqNumber           int    `json:"seqNumber"`
+	FinalResult         string `json:"finalResult"`
+}
+
+// Encode returns a data element as base64 encoded JSON.
+func Encode(element interface{}) (string, error) {
+	encoded, err := json.Marshal(element)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(encoded), nil
+}
+
+// Decode parses a data element from base64 encoded JSON.
+func Decode(encoded string, element interface{}) error {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("not base64 encoded: %s", err)
+	}
+	return json.Unmarshal(decoded, element)
+}
+
+///
+///  Downloading a profile
+///
+
+// StepError is returned when a download fails, naming the step it
+// failed at.
+type StepError struct {
+	Step string
+	Err  error
+}
+
+func (err *StepError) Error() string {
+	return fmt.Sprintf("%s failed: %s", err.Step, err.Err)
+}
+
+// Result describes a successfully downloaded and installed profile.
+type Result struct {
+	Eid           string
+	Iccid         string
+	ProfileName   string
+	TransactionID string
+}
+
+// Simulator downloads profiles like an LPA would.
+type Simulator struct {
+	// The http client used to talk to the SM-DP+.  The default
+	// client is used if nil.
+	HTTPClient *http.Client
+
+	EUICC *EUICC
+
+	// If not empty, the SM-DP+ is contacted at this address instead of
+	// the one in the activation code, e.g. to reach a stand-in.
+	SmdpAddress string
+
+	// The SGP.22 version claimed in the X-Admin-Protocol header, e.g.
+	// "2.2.0".  es2plus.DefaultProtocolVersion if empty.
+	ProtocolVersion string
+}
+
+// Download downloads, installs and reports the installation of the
+// profile the activation code refers to.  The confirmation code is
+// only sent if the SM-DP+ asks for it.  If a step fails, a *StepError
+// is returned.
+func (simulator *Simulator) Download(ctx context.Context, code ActivationCode, confirmationCode string) (*Result, error) {
+	address := code.SmdpAddress
+	if simulator.SmdpAddress != "" {
+		address = simulator.SmdpAddress
+	}
+	logger := logging.With(logging.FieldFunction, "lpa", "eid", simulator.EUICC.Eid)
+
+	// The eUICC challenges the SM-DP+ ...
+	challenge, err := randomBase64(16)
+	if err != nil {
+		return nil, err
+	}
+	initiated := new(InitiateAuthenticationResponse)
+	err = simulator.invoke(ctx, address, StepInitiateAuthentication, &InitiateAuthenticationRequest{
+		EuiccChallenge: challenge,
+		EuiccInfo1:     base64.StdEncoding.EncodeToString([]byte("simulated")),
+		SmdpAddress:    code.SmdpAddress,
+	}, initiated)
+	if err != nil {
+		return nil, err
+	}
+	serverSigned1 := new(ServerSigned1)
+	if err := Decode(initiated.ServerSigned1, serverSigned1); err != nil {
+		return nil, stepError(StepInitiateAuthentication, "couldn't decode serverSigned1: %s", err)
+	}
+	transactionID := initiated.TransactionID
+	switch {
+	case serverSigned1.TransactionID != transactionID:
+		return nil, stepError(StepInitiateAuthentication, "serverSigned1 is for transaction '%s', not '%s'", serverSigned1.TransactionID, transactionID)
+	case serverSigned1.EuiccChallenge != challenge:
+		return nil, stepError(StepInitiateAuthentication, "serverSigned1 doesn't echo the eUICC challenge")
+	case serverSigned1.ServerAddress != code.SmdpAddress:
+		return nil, stepError(StepInitiateAuthentication, "SM-DP+ claims to be '%s', not '%s'", serverSigned1.ServerAddress, code.SmdpAddress)
+	}
+	logger.Debugf("Authentication initiated, transaction %s", transactionID)
+
+	// ... and responds to its challenge, asking for the profile.
+	euiccSigned1, err := Encode(&EuiccSigned1{
+		TransactionID:   transactionID,
+		ServerAddress:   serverSigned1.ServerAddress,
+		ServerChallenge: serverSigned1.ServerChallenge,
+		Eid:             simulator.EUICC.Eid,
+		MatchingID:      code.MatchingID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	euiccSignature1, err := simulator.EUICC.sign(euiccSigned1)
+	if err != nil {
+		return nil, err
+	}
+	authenticated := new(AuthenticateClientResponse)
+	err = simulator.invoke(ctx, address, StepAuthenticateClient, &AuthenticateClientRequest{
+		TransactionID:    transactionID,
+		EuiccSigned1:     euiccSigned1,
+		EuiccSignature1:  euiccSignature1,
+		EuiccCertificate: simulator.EUICC.Certificate(),
+	}, authenticated)
+	if err != nil {
+		return nil, err
+	}
+	metadata := new(ProfileMetadata)
+	if err := Decode(authenticated.ProfileMetadata, metadata); err != nil {
+		return nil, stepError(StepAuthenticateClient, "couldn't decode profileMetadata: %s", err)
+	}
+	smdpSigned2 := new(SmdpSigned2)
+	if err := Decode(authenticated.SmdpSigned2, smdpSigned2); err != nil {
+		return nil, stepError(StepAuthenticateClient, "couldn't decode smdpSigned2: %s", err)
+	}
+	if smdpSigned2.TransactionID != transactionID {
+		return nil, stepError(StepAuthenticateClient, "smdpSigned2 is for transaction '%s', not '%s'", smdpSigned2.TransactionID, transactionID)
+	}
+	logger.With(logging.FieldIccid, metadata.Iccid).Debugf("Client authenticated, profile '%s'", metadata.ProfileName)
+
+	// The user accepts the profile, entering the confirmation code
+	// if asked to.
+	otpk, err := randomBase64(32)
+	if err != nil {
+		return nil, err
+	}
+	signed2 := &EuiccSigned2{TransactionID: transactionID, EuiccOtpk: otpk}
+	if smdpSigned2.CcRequiredFlag {
+		if confirmationCode == "" {
+			return nil, stepError(StepGetBoundProfilePackage, "the SM-DP+ requires a confirmation code, and there is none")
+		}
+		signed2.HashCc = HashConfirmationCode(confirmationCode, transactionID)
+	}
+	euiccSigned2, err := Encode(signed2)
+	if err != nil {
+		return nil, err
+	}
+	euiccSignature2, err := simulator.EUICC.sign(euiccSigned2)
+	if err != nil {
+		return nil, err
+	}
+	bound := new(GetBoundProfilePackageResponse)
+	err = simulator.invoke(ctx, address, StepGetBoundProfilePackage, &GetBoundProfilePackageRequest{
+		TransactionID:   transactionID,
+		EuiccSigned2:    euiccSigned2,
+		EuiccSignature2: euiccSignature2,
+	}, bound)
+	if err != nil {
+		return nil, err
+	}
+
+	// The eUICC installs the profile ...
+	bpp := new(BoundProfilePackage)
+	if err := Decode(bound.BoundProfilePackage, bpp); err != nil {
+		return nil, stepError(StepGetBoundProfilePackage, "couldn't decode the bound profile package: %s", err)
+	}
+	switch {
+	case bpp.TransactionID != transactionID:
+		return nil, stepError(StepGetBoundProfilePackage, "bound profile package is for transaction '%s', not '%s'", bpp.TransactionID, transactionID)
+	case bpp.Iccid != metadata.Iccid:
+		return nil, stepError(StepGetBoundProfilePackage, "bound profile package is for ICCID '%s', not '%s' as announced", bpp.Iccid, metadata.Iccid)
+	}
+	logger.With(logging.FieldIccid, bpp.Iccid).Debugf("Profile installed")
+
+	// ... and the LPA tells the SM-DP+.
+	result, err := Encode(&ProfileInstallationResult{
+		TransactionID:       transactionID,
+		Eid:                 simulator.EUICC.Eid,
+		Iccid:               bpp.Iccid,
+		NotificationAddress: code.SmdpAddress,
+		SeqNumber:           1,
+		FinalResult:         InstallationSucceeded,
+	})
+	if err != nil {
+		return nil, err
+	}
+	signature, err := simulator.EUICC.sign(result)
+	if err != nil {
+		return nil, err
+	}
+	err = simulator.invoke(ctx, address, StepHandleNotification, &HandleNotificationRequest{
+		ProfileInstallationResult: result,
+		EuiccSignPIR:              signature,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Eid:           simulator.EUICC.Eid,
+		Iccid:         bpp.Iccid,
+		ProfileName:   metadata.ProfileName,
+		TransactionID: transactionID,
+	}, nil
+}
+
+func stepError(step string, format string, args ...interface{}) *StepError {
+	return &StepError{Step: step, Err: fmt.Errorf(format, args...)}
+}
+
+func randomBase64(length int) (string, error) {
+	random := make([]byte, length)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(random), nil
+}
+
+// invoke sends an ES9+ request, and unmarshals the response into the
+// result object, if any.  A function execution status other than
+// success is returned as an *es2plus.Error wrapped in a *StepError.
+func (simulator *Simulator) invoke(ctx context.Context, address string, function string, request interface{}, result interface{}) error {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("https://%s/gsma/rsp2/es9plus/%s", address, function)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return &StepError{Step: function, Err: err}
+	}
+	protocolVersion := simulator.ProtocolVersion
+	if protocolVersion == "" {
+		protocolVersion = es2plus.DefaultProtocolVersion
+	}
+	req.Header.Set("X-Admin-Protocol", es2plus.AdminProtocolHeader(protocolVersion))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gsma-rsp-lpad")
+
+	httpClient := simulator.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return &StepError{Step: function, Err: err}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &StepError{Step: function, Err: err}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StepError{Step: function, Err: &es2plus.Error{
+			Function:       function,
+			HTTPStatusCode: resp.StatusCode,
+			Message:        strings.TrimSpace(string(body)),
+		}}
+	}
+	if result == nil {
+		return nil
+	}
+
+	header := new(struct {
+		Header es2plus.ResponseHeader `json:"header"`
+	})
+	if err := json.Unmarshal(body, header); err != nil {
+		return stepError(function, "couldn't parse response: %s", err)
+	}
+	status := header.Header.FunctionExecutionStatus
+	if status.FunctionExecutionStatusType != es2plus.StatusExecutedSuccess {
+		return &StepError{Step: function, Err: &es2plus.Error{
+			Function:          function,
+			HTTPStatusCode:    resp.StatusCode,
+			Status:            status.FunctionExecutionStatusType,
+			SubjectCode:       status.StatusCodeData.SubjectCode,
+			ReasonCode:        status.StatusCodeData.ReasonCode,
+			SubjectIdentifier: status.StatusCodeData.SubjectIdentifier,
+			Message:           status.StatusCodeData.Message,
+		}}
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return stepError(function, "couldn't parse response: %s", err)
+	}
+	return nil
+}
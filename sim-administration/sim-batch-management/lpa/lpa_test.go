@@ -0,0 +1,43 @@
+package lpa
+
+import (
+	"gotest.tools/assert"
+	"testing"
+)
+
+func TestParseActivationCode(t *testing.T) {
+	code, err := ParseActivationCode("LPA:1$smdp.example.com$04386-AGYFT-A74Y8-3F815")
+	assert.NilError(t, err)
+	assert.Equal(t, "smdp.example.com", code.SmdpAddress)
+	assert.Equal(t, "04386-AGYFT-A74Y8-3F815", code.MatchingID)
+	assert.Assert(t, !code.ConfirmationCodeRequired)
+	assert.Equal(t, "LPA:1$smdp.example.com$04386-AGYFT-A74Y8-3F815", code.String())
+
+	code, err = ParseActivationCode("1$smdp.example.com$ABC-123$1.3.6.1.4.1.31746$1")
+	assert.NilError(t, err)
+	assert.Equal(t, "1.3.6.1.4.1.31746", code.SmdpOid)
+	assert.Assert(t, code.ConfirmationCodeRequired)
+	assert.Equal(t, "LPA:1$smdp.example.com$ABC-123$1.3.6.1.4.1.31746$1", code.String())
+
+	_, err = ParseActivationCode("ABC-123")
+	assert.ErrorContains(t, err, "not an activation code")
+	_, err = ParseActivationCode("LPA:1$$ABC-123")
+	assert.ErrorContains(t, err, "no SM-DP+ address")
+}
+
+func TestSignaturesAreVerified(t *testing.T) {
+	euicc, err := NewEUICC("89049032123451234512345678901235")
+	assert.NilError(t, err)
+	other, err := NewEUICC("89049032123451234512345678901236")
+	assert.NilError(t, err)
+
+	signature, err := euicc.sign("data")
+	assert.NilError(t, err)
+	assert.NilError(t, VerifySignature(euicc.Certificate(), "data", signature))
+	assert.ErrorContains(t, VerifySignature(euicc.Certificate(), "other data", signature), "doesn't match")
+	assert.ErrorContains(t, VerifySignature(other.Certificate(), "data", signature), "doesn't match")
+
+	eid, err := SimulatedEid()
+	assert.NilError(t, err)
+	assert.Equal(t, 32, len(eid))
+}
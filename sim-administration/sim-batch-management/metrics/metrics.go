@@ -0,0 +1,350 @@
+// Package metrics collects counters and histograms, and exposes them
+// in the Prometheus text format, either over HTTP while a command
+// runs, or as a file for the node exporter's textfile collector.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the histogram
+// buckets used for latencies unless told otherwise.  SM-DP+ invocations
+// can take a long time, so they go a bit higher than usual.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Registry is a set of metrics that are exposed together.  It is safe
+// for concurrent use.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// Default is the registry the metrics of the sim batch management
+// packages are registered in.
+var Default = NewRegistry()
+
+func (registry *Registry) register(name string, m metric) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if registry.names[name] {
+		panic(fmt.Sprintf("metric '%s' registered twice", name))
+	}
+	registry.names[name] = true
+	registry.metrics = append(registry.metrics, m)
+}
+
+// Write writes all the metrics in the registry in the Prometheus text
+// format, in the order they were registered.
+func (registry *Registry) Write(w io.Writer) error {
+	registry.mutex.Lock()
+	metrics := append([]metric(nil), registry.metrics...)
+	registry.mutex.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, m := range metrics {
+		if err := m.write(buffered); err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+// Handler returns an http.Handler serving the metrics in the registry.
+func (registry *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := registry.Write(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// WriteTextfile writes the metrics in the registry to a file.  The file
+// is written under a temporary name and then renamed, so that the
+// textfile collector never sees a half written file.
+func (registry *Registry) WriteTextfile(path string) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := registry.Write(file); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// labelled is the part common to all metrics: a name, a help text and
+// a fixed set of label names.  The values are kept per combination of
+// label values.
+type labelled struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+func (l *labelled) key(labelValues []string) string {
+	if len(labelValues) != len(l.labelNames) {
+		panic(fmt.Sprintf("metric '%s' takes %d label values, got %d", l.name, len(l.labelNames), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\x00")
+}
+
+// labels formats the labels of a sample, with any extra label
+// (e.g. the upper bound of a histogram bucket) added last.
+func (l *labelled) labels(key string, extra ...string) string {
+	var pairs []string
+	if len(l.labelNames) > 0 {
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", l.labelNames[i], escape(value)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[i], escape(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (l *labelled) writeHeader(w io.Writer, metricType string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", l.name, strings.Replace(l.help, "\n", " ", -1), l.name, metricType)
+	return err
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(value string) string {
+	return escaper.Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+///
+///  Counters
+///
+
+// Counter is a value that only goes up, per combination of label values.
+type Counter struct {
+	labelled
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter creates a counter with the given label names, and
+// registers it in the default registry.
+func NewCounter(name string, help string, labelNames ...string) *Counter {
+	return Default.NewCounter(name, help, labelNames...)
+}
+
+// NewCounter creates a counter with the given label names, and
+// registers it in the registry.
+func (registry *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	counter := &Counter{
+		labelled: labelled{name: name, help: help, labelNames: labelNames},
+		values:   make(map[string]float64),
+	}
+	registry.register(name, counter)
+	return counter
+}
+
+// Inc adds one to the counter for the label values.
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Add adds a value, which must not be negative, to the counter for the
+// label values.
+func (counter *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("counter '%s' can't go down", counter.name))
+	}
+	key := counter.key(labelValues)
+	counter.mutex.Lock()
+	counter.values[key] += value
+	counter.mutex.Unlock()
+}
+
+// Value returns the value of the counter for the label values.
+func (counter *Counter) Value(labelValues ...string) float64 {
+	key := counter.key(labelValues)
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	return counter.values[key]
+}
+
+func (counter *Counter) write(w io.Writer) error {
+	if err := counter.writeHeader(w, "counter"); err != nil {
+		return err
+	}
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	for _, key := range sortedKeys(counter.values) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", counter.name, counter.labels(key), formatValue(counter.values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+///
+///  Histograms
+///
+
+// Histogram counts observations, e.g. latencies, in buckets, per
+// combination of label values.
+type Histogram struct {
+	labelled
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds
+// and label names, and registers it in the default registry.  Nil
+// buckets means DefaultBuckets.
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labelNames...)
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds
+// and label names, and registers it in the registry.  Nil buckets means
+// DefaultBuckets.
+func (registry *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	histogram := &Histogram{
+		labelled: labelled{name: name, help: help, labelNames: labelNames},
+		buckets:  buckets,
+		series:   make(map[string]*histogramSeries),
+	}
+	registry.register(name, histogram)
+	return histogram
+}
+
+// Observe adds an observation to the histogram for the label values.
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	key := histogram.key(labelValues)
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	series, ok := histogram.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(histogram.buckets))}
+		histogram.series[key] = series
+	}
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+// ObserveDuration adds the time since started, in seconds, to the
+// histogram for the label values.
+func (histogram *Histogram) ObserveDuration(started time.Time, labelValues ...string) {
+	histogram.Observe(time.Since(started).Seconds(), labelValues...)
+}
+
+// Count returns the number of observations for the label values.
+func (histogram *Histogram) Count(labelValues ...string) uint64 {
+	key := histogram.key(labelValues)
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	if series, ok := histogram.series[key]; ok {
+		return series.count
+	}
+	return 0
+}
+
+func (histogram *Histogram) write(w io.Writer) error {
+	if err := histogram.writeHeader(w, "histogram"); err != nil {
+		return err
+	}
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	keys := make([]string, 0, len(histogram.series))
+	for key := range histogram.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := histogram.series[key]
+		for i, bound := range histogram.buckets {
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, histogram.labels(key, "le", formatValue(bound)), series.counts[i]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, histogram.labels(key, "le", "+Inf"), series.count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", histogram.name, histogram.labels(key), formatValue(series.sum)); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, histogram.labels(key), series.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
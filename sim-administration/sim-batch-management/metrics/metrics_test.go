@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"bytes"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMetricsAreWrittenInPrometheusTextFormat(t *testing.T) {
+	registry := NewRegistry()
+	calls := registry.NewCounter("test_calls_total", "Calls made.", "function", "outcome")
+	latency := registry.NewHistogram("test_latency_seconds", "Latency of calls.", []float64{0.1, 1}, "function")
+
+	calls.Inc("downloadOrder", "success")
+	calls.Inc("downloadOrder", "success")
+	calls.Inc("confirmOrder", "failed \"badly\"")
+	latency.Observe(0.05, "downloadOrder")
+	latency.Observe(0.5, "downloadOrder")
+	latency.Observe(5, "downloadOrder")
+
+	output := new(bytes.Buffer)
+	assert.NilError(t, registry.Write(output))
+	assert.Equal(t, `# HELP test_calls_total Calls made.
+# TYPE test_calls_total counter
+test_calls_total{function="confirmOrder",outcome="failed \"badly\""} 1
+test_calls_total{function="downloadOrder",outcome="success"} 2
+# HELP test_latency_seconds Latency of calls.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{function="downloadOrder",le="0.1"} 1
+test_latency_seconds_bucket{function="downloadOrder",le="1"} 2
+test_latency_seconds_bucket{function="downloadOrder",le="+Inf"} 3
+test_latency_seconds_sum{function="downloadOrder"} 5.55
+test_latency_seconds_count{function="downloadOrder"} 3
+`, output.String())
+
+	assert.Equal(t, 2.0, calls.Value("downloadOrder", "success"))
+	assert.Equal(t, uint64(3), latency.Count("downloadOrder"))
+}
+
+func TestMetricsAreServedAndWrittenToTextfile(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("test_items_total", "Items processed.").Add(42)
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, recorder.Code)
+	assert.Assert(t, bytes.Contains(recorder.Body.Bytes(), []byte("test_items_total 42\n")))
+
+	dir, err := ioutil.TempDir("", "metrics-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sbm.prom")
+	assert.NilError(t, registry.WriteTextfile(path))
+	written, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, recorder.Body.String(), string(written))
+
+	// Nothing but the file itself is left behind.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(files))
+}
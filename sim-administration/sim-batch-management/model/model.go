@@ -18,8 +18,34 @@ type SimEntry struct {
 	Msisdn               string `db:"msisdn" json:"msisdn"`
 	Ki                   string `db:"ki" json:"ki"`
 	ActivationCode       string `db:"activationCode" json:"activationCode"`
+	MatchingID           string `db:"matchingId" json:"matchingId"`
+	ConfirmationCode     string `db:"confirmationCode" json:"confirmationCode"`
+
+	// The state of the profile at the SM-DP+, the eUICC it is bound
+	// to and its lock flag, as last reported by or changed through
+	// ES2+.  When the SM-DP+ last reported the status, by its clock,
+	// and when sbm last changed the state, by the local clock (RFC3339).
+	SmdpState       string `db:"smdpState" json:"smdpState"`
+	Eid             string `db:"eid" json:"eid"`
+	LockFlag        bool   `db:"lockFlag" json:"lockFlag"`
+	StatusUpdatedAt string `db:"statusUpdatedAt" json:"statusUpdatedAt"`
+	StateChangedAt  string `db:"stateChangedAt" json:"stateChangedAt"`
+
+	// Whether the file provisioning the profile in the HSS, and the
+	// script uploading it to Prime, have been generated.  Not whether
+	// they have been run.
+	HssState         string `db:"hssState" json:"hssState"`
+	PrimeUploadState string `db:"primeUploadState" json:"primeUploadState"`
 }
 
+// The HSS and Prime upload states of a sim profile.  sbm writes the
+// files and scripts that provision profiles in the HSS and upload them
+// to Prime, and records that it has, but doesn't run them itself.
+const (
+	HssStateFileWritten             = "FILE_WRITTEN"
+	PrimeUploadStateScriptGenerated = "SCRIPT_GENERATED"
+)
+
 // Batch represents batches of sim profiles.  Instances can be
 // subject to JSON serialisation/deserialisation, and can be stored
 // in persistent storage.
@@ -60,4 +86,132 @@ type ProfileVendor struct {
 	Es2PlusHost        string `db:"es2PlusHostPath" json:"es2plusHostPath"`
 	Es2PlusPort        int    `db:"es2PlusPort" json:"es2plusPort"`
 	Es2PlusRequesterID string `db:"es2PlusRequesterId" json:"es2PlusRequesterId"`
+
+	// What the client certificate says about itself, recorded when it
+	// was declared or rotated.  Expiry is in RFC3339 format.
+	Es2PlusCertSubject  string `db:"es2PlusCertSubject" json:"es2PlusCertSubject"`
+	Es2PlusCertIssuer   string `db:"es2PlusCertIssuer" json:"es2PlusCertIssuer"`
+	Es2PlusCertSerial   string `db:"es2PlusCertSerial" json:"es2PlusCertSerial"`
+	Es2PlusCertNotAfter string `db:"es2PlusCertNotAfter" json:"es2PlusCertNotAfter"`
+
+	// Maximum number of ICCIDs to put in a single getProfileStatus
+	// request.  Zero means "use the client default".
+	Es2PlusMaxIccidsPerRequest int `db:"es2PlusMaxIccidsPerRequest" json:"es2PlusMaxIccidsPerRequest"`
+
+	// Default deadline for ES2+ invocations.  Zero means "use the
+	// client default".
+	Es2PlusTimeoutSeconds int `db:"es2PlusTimeoutSeconds" json:"es2PlusTimeoutSeconds"`
+
+	// How the SM-DP+ certificate is verified: A CA bundle the chain
+	// must be signed by, a pinned SPKI hash, and the name the certificate
+	// must be valid for.  Skipping verification altogether requires
+	// explicitly setting Es2PlusInsecureSkipVerify.
+	Es2PlusCABundle           string `db:"es2PlusCaBundlePath" json:"es2PlusCaBundlePath"`
+	Es2PlusPinnedSpkiSha256   string `db:"es2PlusPinnedSpkiSha256" json:"es2PlusPinnedSpkiSha256"`
+	Es2PlusServerName         string `db:"es2PlusServerName" json:"es2PlusServerName"`
+	Es2PlusInsecureSkipVerify bool   `db:"es2PlusInsecureSkipVerify" json:"es2PlusInsecureSkipVerify"`
+
+	// The SGP.22 version, e.g. "2.2.0", claimed in requests to the
+	// SM-DP+, and the dialect translating our field names to the ones
+	// it uses: The name of a built-in dialect, or a JSON object.
+	Es2PlusProtocolVersion string `db:"es2PlusProtocolVersion" json:"es2PlusProtocolVersion"`
+	Es2PlusDialect         string `db:"es2PlusDialect" json:"es2PlusDialect"`
+
+	// Limits on the ES2+ traffic sent to the SM-DP+.  Zero means
+	// no limit.
+	Es2PlusRequestsPerSecond float64 `db:"es2PlusRequestsPerSecond" json:"es2PlusRequestsPerSecond"`
+	Es2PlusMaxInFlight       int     `db:"es2PlusMaxInFlight" json:"es2PlusMaxInFlight"`
+}
+
+// ProfileVendorEndpoint is one of the SM-DP+ sites of a profile vendor,
+// such as a primary and a disaster recovery site.  Requests go to the
+// endpoint with the lowest position that hasn't failed recently.
+type ProfileVendorEndpoint struct {
+	ID              int64  `db:"id" json:"id"`
+	ProfileVendorID int64  `db:"profileVendorID" json:"profileVendorID"`
+	Position        int    `db:"position" json:"position"`
+	Host            string `db:"host" json:"host"`
+	Port            int    `db:"port" json:"port"`
+
+	// When the endpoint last failed (RFC3339), and how.  Empty if it
+	// has responded since.
+	FailedAt  string `db:"failedAt" json:"failedAt"`
+	LastError string `db:"lastError" json:"lastError"`
+}
+
+// DownloadProgressEvent represents a single handleDownloadProgressInfo
+// notification received from an SM-DP+, recorded against the
+// sim profile it refers to.
+type DownloadProgressEvent struct {
+	ID                     int64  `db:"id" json:"id"`
+	SimProfileID           int64  `db:"simProfileID" json:"simProfileID"`
+	Iccid                  string `db:"iccid" json:"iccid"`
+	Eid                    string `db:"eid" json:"eid"`
+	NotificationPointID    int    `db:"notificationPointId" json:"notificationPointId"`
+	Status                 string `db:"status" json:"status"`
+	Timestamp              string `db:"timestamp" json:"timestamp"`
+	FunctionCallIdentifier string `db:"functionCallIdentifier" json:"functionCallIdentifier"`
+}
+
+// The states of a job.  A job that is RUNNING when nobody is running
+// it was cut short by a crash.
+const (
+	JobRunning     = "RUNNING"
+	JobDone        = "DONE"
+	JobFailed      = "FAILED"
+	JobInterrupted = "INTERRUPTED"
+)
+
+// The states of the individual items of a job.  Items that are
+// SUCCEEDED or SKIPPED are done, the others are retried when the job
+// is resumed.
+const (
+	JobItemPending   = "PENDING"
+	JobItemSucceeded = "SUCCEEDED"
+	JobItemFailed    = "FAILED"
+	JobItemSkipped   = "SKIPPED"
+)
+
+// Job is a bulk operation, such as activating all the profiles in a
+// batch, recorded so that it can be followed up, and resumed if it
+// didn't finish.
+type Job struct {
+	ID            int64  `db:"id" json:"id"`
+	Type          string `db:"type" json:"type"`
+	BatchName     string `db:"batchName" json:"batchName"`
+	ProfileVendor string `db:"profileVendor" json:"profileVendor"`
+	Parameters    string `db:"parameters" json:"parameters"`
+	Operator      string `db:"operator" json:"operator"`
+	State         string `db:"state" json:"state"`
+	StartedAt     string `db:"startedAt" json:"startedAt"`
+	EndedAt       string `db:"endedAt" json:"endedAt"`
+}
+
+// JobItem is the outcome of a job for a single ICCID.
+type JobItem struct {
+	ID        int64  `db:"id" json:"id"`
+	JobID     int64  `db:"jobID" json:"jobID"`
+	Iccid     string `db:"iccid" json:"iccid"`
+	State     string `db:"state" json:"state"`
+	Output    string `db:"output" json:"output"`
+	Error     string `db:"error" json:"error"`
+	UpdatedAt string `db:"updatedAt" json:"updatedAt"`
+}
+
+// AuditEntry records a change to a field of a batch, sim profile,
+// profile vendor or profile vendor endpoint, who made it, and when
+// (RFC3339).  Creating or deleting one is recorded with an empty
+// field.  Secrets are only recorded as having been set.
+type AuditEntry struct {
+	ID          int64  `db:"id" json:"id"`
+	Entity      string `db:"entity" json:"entity"`
+	EntityID    int64  `db:"entityID" json:"entityID"`
+	BatchID     int64  `db:"batchID" json:"batchID"`
+	Iccid       string `db:"iccid" json:"iccid"`
+	Field       string `db:"field" json:"field"`
+	OldValue    string `db:"oldValue" json:"oldValue"`
+	NewValue    string `db:"newValue" json:"newValue"`
+	CommandLine string `db:"commandLine" json:"commandLine"`
+	Operator    string `db:"operator" json:"operator"`
+	Timestamp   string `db:"timestamp" json:"timestamp"`
 }
@@ -3,11 +3,11 @@ package outfileparser
 import (
 	"bufio"
 	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/loltelutils"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/store"
 
-	"log"
 	"os"
 	"regexp"
 	"strconv"
@@ -36,7 +36,7 @@ type OutputFileRecord struct {
 func parseLineIntoKeyValueMap(line string, theMap map[string]string) {
 	var splitString = strings.Split(line, ":")
 	if len(splitString) != 2 {
-		log.Fatalf("Unparsable colon separated key/value pair: '%s'\n", line)
+		logging.Fatalf("Unparsable colon separated key/value pair: '%s'", line)
 	}
 	key := strings.TrimSpace(splitString[0])
 	value := strings.TrimSpace(splitString[1])
@@ -84,7 +84,7 @@ func ParseOutputFile(filePath string) (*OutputFileRecord, error) {
 
 	file, err := os.Open(filePath) // For read access.
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatalf("Couldn't open '%s': %s", filePath, err)
 	}
 
 	defer file.Close()
@@ -182,7 +182,7 @@ func ParseOutputFile(filePath string) (*OutputFileRecord, error) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		logging.Fatalf("Couldn't read '%s': %s", filePath, err)
 	}
 
 	countedNoOfEntries := len(state.entries)
@@ -306,6 +306,6 @@ func WriteHssCsvFile(filepath string, sdb *store.SimBatchDB, batch *model.Batch)
 		}
 		max = i + 1
 	}
-	fmt.Println("Successfully written ", max, " sim card records.")
+	logging.With(logging.FieldBatch, batch.Name).Infof("Successfully wrote %d sim card records to '%s'", max, filepath)
 	return f.Close()
 }
@@ -3,28 +3,59 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/bulk"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/es2plus"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/fieldsyntaxchecks"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/lpa"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/metrics"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/outfileparser"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/store"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/uploadtoprime"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 	"io"
-	"log"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 //  "gopkg.in/alecthomas/kingpin.v2"
 var (
-	// TODO: Global flags can be added to Kingpin, but also make it have an effect.
-	// debug    = kingpin.Flag("debug", "enable debug mode").Default("false").Bool()
+	debug     = kingpin.Flag("debug", "Log debug messages, including the payloads and HTTP headers of ES2+ requests and responses.").Bool()
+	logLevel  = kingpin.Flag("log-level", "Least severe level of messages logged to stderr.").Default("info").Enum(logging.Levels...)
+	logFormat = kingpin.Flag("log-format", "Format of messages logged to stderr.").Default("logfmt").Enum(logging.Formats...)
+
+	bulkConcurrency = kingpin.Flag("concurrency", "Max number of profiles processed in parallel by bulk commands.").Default(strconv.Itoa(bulk.DefaultConcurrency)).Int()
+
+	es2MaxAttempts    = kingpin.Flag("es2-max-attempts", "Max number of attempts for each ES2+ invocation, transient failures are retried with exponential backoff where re-sending is safe.").Default("5").Int()
+	es2AttemptTimeout = kingpin.Flag("es2-attempt-timeout", "Time a single ES2+ request may take.  A request that takes longer is given up on, and counts as a failure of the SM-DP+ endpoint.").Default(es2plus.DefaultAttemptTimeout.String()).Duration()
+	es2LogPayload     = kingpin.Flag("es2-log-payload", "Log the payloads of ES2+ requests and responses.").Bool()
+	es2LogHeaders     = kingpin.Flag("es2-log-headers", "Log the HTTP headers of ES2+ requests and responses.").Bool()
+	es2Record         = kingpin.Flag("es2-record", "Append all ES2+ requests and responses, with secrets redacted, to this JSONL traffic log.").String()
+	es2Replay         = kingpin.Flag("es2-replay", "Don't talk to any SM-DP+, serve ES2+ responses from this traffic log instead.").String()
+
+	breakerFailureRatio = kingpin.Flag("breaker-failure-ratio", "Stop sending ES2+ requests to a vendor for a while when this fraction of its recent requests failed for transient reasons.  Zero disables the circuit breaker.").Default("0.5").Float64()
+	breakerMinRequests  = kingpin.Flag("breaker-min-requests", "Number of recent requests to a vendor the failure ratio is computed over.").Default("10").Int()
+	breakerOpenDuration = kingpin.Flag("breaker-open-duration", "Time to stop sending ES2+ requests to a failing vendor, before probing whether it is back.").Default("30s").Duration()
+
+	endpointFailBackAfter = kingpin.Flag("endpoint-fail-back-after", "Time to avoid an SM-DP+ endpoint that failed, sending ES2+ requests to the vendor's next endpoint instead.").Default(es2plus.DefaultFailBackAfter.String()).Duration()
+
+	metricsListen   = kingpin.Flag("metrics-listen", "Serve metrics in Prometheus text format on http://<address>/metrics while the command runs, e.g. localhost:9099.").String()
+	metricsTextfile = kingpin.Flag("metrics-textfile", "Write metrics in Prometheus text format to this file when the command exits, for the node exporter's textfile collector.").String()
 
 	///
 	///   Profile-vendor - centric commands
@@ -40,6 +71,50 @@ var (
 	dpvHost         = dpv.Flag("host", "Host of ES2+ endpoint.").Required().String()
 	dpvPort         = dpv.Flag("port", "Port of ES2+ endpoint").Required().Int()
 	dpvRequesterID  = dpv.Flag("requester-id", "ES2+ requester ID.").Required().String()
+	dpvMaxIccids    = dpv.Flag("max-iccids-per-request", "Max number of ICCIDs in a single getProfileStatus request").Default("50").Int()
+	dpvTimeout      = dpv.Flag("timeout", "Default deadline for each ES2+ invocation, including retries").Default("60s").Duration()
+	dpvCABundle     = dpv.Flag("ca-bundle", "PEM file with the CA certificates the SM-DP+ certificate must be signed by.  Default is the system trust store.").String()
+	dpvPinnedSpki   = dpv.Flag("pinned-spki-sha256", "Base64 encoded SHA-256 hash of the public key (SPKI) of the SM-DP+ certificate, or with --ca-bundle, of a certificate in the verified chain.").String()
+	dpvServerName   = dpv.Flag("server-name", "Name the SM-DP+ certificate must be valid for, if different from the host.").String()
+	dpvInsecure     = dpv.Flag("insecure-skip-tls-verify", "Don't verify the SM-DP+ certificate at all.  Dangerous, only for testing.").Bool()
+	dpvRps          = dpv.Flag("requests-per-second", "Max number of ES2+ requests per second sent to the SM-DP+, zero means no limit").Default("0").Float64()
+	dpvMaxInFlight  = dpv.Flag("max-in-flight", "Max number of concurrent ES2+ requests sent to the SM-DP+, zero means no limit").Default("0").Int()
+	dpvProtocol     = dpv.Flag("protocol-version", "SGP.22 version spoken by the SM-DP+, e.g. 2.2.0").Default(es2plus.DefaultProtocolVersion).String()
+	dpvDialect      = dpv.Flag("dialect", "Field names used by the SM-DP+: 'default', 'sgp22', or a JSON object such as {\"fields\": {\"matchingId\": \"matchingID\"}, \"omit\": [\"smdsAddress\"]}").Default(es2plus.DialectDefault).String()
+
+	pvLimits            = kingpin.Command("profile-vendor-set-rate-limits", "Set the limits on ES2+ traffic sent to the SM-DP+ of a profile vendor")
+	pvLimitsName        = pvLimits.Flag("name", "Name of profile-vendor").Required().String()
+	pvLimitsRps         = pvLimits.Flag("requests-per-second", "Max number of ES2+ requests per second, zero means no limit").Required().Float64()
+	pvLimitsMaxInFlight = pvLimits.Flag("max-in-flight", "Max number of concurrent ES2+ requests, zero means no limit").Required().Int()
+
+	pvProtocol        = kingpin.Command("profile-vendor-set-protocol", "Set the ES2+ protocol version and dialect spoken by the SM-DP+ of a profile vendor")
+	pvProtocolName    = pvProtocol.Flag("name", "Name of profile-vendor").Required().String()
+	pvProtocolVersion = pvProtocol.Flag("protocol-version", "SGP.22 version spoken by the SM-DP+, e.g. 2.2.0").Required().String()
+	pvProtocolDialect = pvProtocol.Flag("dialect", "Field names used by the SM-DP+: 'default', 'sgp22', or a JSON object").Default(es2plus.DialectDefault).String()
+
+	pvCheck     = kingpin.Command("profile-vendor-check", "Check the client certificates of profile vendors, warning about those that expire soon")
+	pvCheckName = pvCheck.Flag("name", "Name of profile-vendor.  Default is all of them.").String()
+	pvCheckDays = pvCheck.Flag("days", "Warn about certificates expiring within this many days").Default("30").Int()
+
+	pvRotate          = kingpin.Command("profile-vendor-rotate-cert", "Replace the client certificate and key of a profile vendor, after checking that the SM-DP+ accepts them")
+	pvRotateName      = pvRotate.Flag("name", "Name of profile-vendor").Required().String()
+	pvRotateCert      = pvRotate.Flag("cert", "New certificate pem file.").Required().String()
+	pvRotateKey       = pvRotate.Flag("key", "New certificate key file.").Required().String()
+	pvRotateTestIccid = pvRotate.Flag("test-iccid", "ICCID to get the status of using the new certificate, to check that the SM-DP+ accepts it").Required().String()
+
+	pvEndpointAdd         = kingpin.Command("profile-vendor-endpoint-add", "Add an SM-DP+ endpoint, e.g. a disaster recovery site, to a profile vendor")
+	pvEndpointAddName     = pvEndpointAdd.Flag("name", "Name of profile-vendor").Required().String()
+	pvEndpointAddHost     = pvEndpointAdd.Flag("host", "Host of ES2+ endpoint.").Required().String()
+	pvEndpointAddPort     = pvEndpointAdd.Flag("port", "Port of ES2+ endpoint").Required().Int()
+	pvEndpointAddPosition = pvEndpointAdd.Flag("position", "Position in the vendor's list of endpoints, zero being the preferred one.  Default is last.").Default("-1").Int()
+
+	pvEndpointRemove     = kingpin.Command("profile-vendor-endpoint-remove", "Remove an SM-DP+ endpoint from a profile vendor")
+	pvEndpointRemoveName = pvEndpointRemove.Flag("name", "Name of profile-vendor").Required().String()
+	pvEndpointRemoveHost = pvEndpointRemove.Flag("host", "Host of ES2+ endpoint.").Required().String()
+	pvEndpointRemovePort = pvEndpointRemove.Flag("port", "Port of ES2+ endpoint").Required().Int()
+
+	pvEndpointList     = kingpin.Command("profile-vendor-endpoint-list", "List the SM-DP+ endpoints of a profile vendor, their health, and which one is active")
+	pvEndpointListName = pvEndpointList.Flag("name", "Name of profile-vendor").Required().String()
 
 	///
 	///    ICCID - centric commands
@@ -52,16 +127,30 @@ var (
 	downloadOrder       = kingpin.Command("iccid-download-order", "Execute es2p download-order.")
 	downloadOrderVendor = downloadOrder.Flag("profile-vendor", "Name of profile vendor").Required().String()
 	downloadOrderIccid  = downloadOrder.Flag("iccid", "Iccid to recover profile  for").Required().String()
+	downloadOrderEid    = downloadOrder.Flag("eid", "EID of the eUICC to bind the profile to").String()
+	downloadOrderType   = downloadOrder.Flag("profile-type", "Profile type to allocate a profile of").String()
+
+	lpaSimulate               = kingpin.Command("lpa-simulate", "Download and install a profile like a phone would, using a simulated eUICC, reporting the step that failed if any.  Only works against the SM-DP+ stand-in of the es2plustest package:  Real SM-DP+s expect ASN.1 and an eUICC certified by a GSMA CI.")
+	lpaSimulateIccid          = lpaSimulate.Flag("iccid", "Iccid of the profile, whose activation and confirmation codes are read from the database").String()
+	lpaSimulateActivationCode = lpaSimulate.Flag("activation-code", "Activation code to use, e.g. LPA:1$smdp.example.com$04386-AGYFT-A74Y8-3F815, instead of the one in the database").String()
+	lpaSimulateConfirmation   = lpaSimulate.Flag("confirmation-code", "Confirmation code to enter if the SM-DP+ asks for one, instead of the one in the database").String()
+	lpaSimulateEid            = lpaSimulate.Flag("eid", "EID of the simulated eUICC.  Default is a random one.").String()
+	lpaSimulateSmdpAddress    = lpaSimulate.Flag("smdp-address", "host:port to reach the SM-DP+ at, e.g. an emulator, instead of the address in the activation code").String()
+	lpaSimulateCABundle       = lpaSimulate.Flag("ca-bundle", "PEM file with the CA certificates the SM-DP+ certificate must be signed by.  Default is the system trust store.").String()
+	lpaSimulateInsecure       = lpaSimulate.Flag("insecure-skip-tls-verify", "Don't verify the SM-DP+ certificate.  For emulators only.").Bool()
+	lpaSimulateTimeout        = lpaSimulate.Flag("timeout", "Time allowed for the whole download").Default("1m").Duration()
+	lpaSimulateProtocol       = lpaSimulate.Flag("protocol-version", "SGP.22 version to claim in the X-Admin-Protocol header.  Default is the one configured for the vendor of the profile given by --iccid, or "+es2plus.DefaultProtocolVersion+".").String()
+	lpaSimulateAnySmdp        = lpaSimulate.Flag("allow-any-smdp", "Contact the SM-DP+ even if it isn't on this machine, and so can't be the stand-in.").Bool()
 
 	recoverProfile       = kingpin.Command("iccid-recover-profile", "Change state of profile.")
 	recoverProfileVendor = recoverProfile.Flag("profile-vendor", "Name of profile vendor").Required().String()
 	recoverProfileIccid  = recoverProfile.Flag("iccid", "Iccid to recover profile  for").Required().String()
-	recoverProfileTarget = recoverProfile.Flag("target-state", "Desired target state").Required().String()
+	recoverProfileTarget = recoverProfile.Flag("target-state", "Desired target state: AVAILABLE, RELEASED or UNAVAILABLE").Required().String()
 
 	cancelIccid       = kingpin.Command("iccid-cancel", "Execute es2p iccid-confirm-order.")
 	cancelIccidIccid  = cancelIccid.Flag("iccid", "The iccid to cancel").Required().String()
 	cancelIccidVendor = cancelIccid.Flag("profile-vendor", "Name of profile vendor").Required().String()
-	cancelIccidTarget = cancelIccid.Flag("target", "Tarfget t set profile to").Required().String()
+	cancelIccidTarget = cancelIccid.Flag("target", "Final state to set profile to: AVAILABLE or UNAVAILABLE").Required().String()
 
 	activateIccidFile       = kingpin.Command("iccids-activate-from-file", "Execute es2p iccid-confirm-order.")
 	activateIccidFileVendor = activateIccidFile.Flag("profile-vendor", "Name of profile vendor").Required().String()
@@ -71,13 +160,66 @@ var (
 	bulkActivateIccidsVendor = bulkActivateIccids.Flag("profile-vendor", "Name of profile vendor").Required().String()
 	bulkActivateIccidsIccids = bulkActivateIccids.Flag("iccid-file", "Iccid to confirm profile  for").Required().String()
 
-	activateIccid       = kingpin.Command("iccid-activate", "Execute es2p iccid-confirm-order.")
-	activateIccidVendor = activateIccid.Flag("profile-vendor", "Name of profile vendor").Required().String()
-	activateIccidIccid  = activateIccid.Flag("iccid", "Iccid to confirm profile  for").Required().String()
+	activateIccid        = kingpin.Command("iccid-activate", "Execute es2p iccid-confirm-order.")
+	activateIccidVendor  = activateIccid.Flag("profile-vendor", "Name of profile vendor").Required().String()
+	activateIccidIccid   = activateIccid.Flag("iccid", "Iccid to confirm profile  for").Required().String()
+	activateIccidEid     = activateIccid.Flag("eid", "EID of the eUICC to bind the profile to").String()
+	activateIccidType    = activateIccid.Flag("profile-type", "Profile type to allocate a profile of").String()
+	activateIccidMatch   = activateIccid.Flag("matching-id", "Matching ID to use in the activation code, instead of one chosen by the SM-DP+").String()
+	activateIccidCode    = activateIccid.Flag("confirmation-code", "Confirmation code the end user must enter when downloading the profile").String()
+	activateIccidSmds    = activateIccid.Flag("smds-address", "Address of the SM-DS to register the order at").String()
+	activateIccidRelease = activateIccid.Flag("release", "Release the profile, making it downloadable.  Use --no-release to stage the order.").Default("true").Bool()
+
+	confirmOrder        = kingpin.Command("iccid-confirm-order", "Execute es2p iccid-confirm-order.")
+	confirmOrderVendor  = confirmOrder.Flag("profile-vendor", "Name of profile vendor").Required().String()
+	confirmOrderIccid   = confirmOrder.Flag("iccid", "Iccid to confirm profile  for").Required().String()
+	confirmOrderEid     = confirmOrder.Flag("eid", "EID of the eUICC to bind the profile to").String()
+	confirmOrderMatch   = confirmOrder.Flag("matching-id", "Matching ID to use in the activation code, instead of one chosen by the SM-DP+").String()
+	confirmOrderCode    = confirmOrder.Flag("confirmation-code", "Confirmation code the end user must enter when downloading the profile").String()
+	confirmOrderSmds    = confirmOrder.Flag("smds-address", "Address of the SM-DS to register the order at").String()
+	confirmOrderRelease = confirmOrder.Flag("release", "Release the profile, making it downloadable.  Use --no-release to stage the order.").Default("true").Bool()
+
+	releaseProfile       = kingpin.Command("iccid-release", "Execute es2p release-profile, making a profile confirmed with --no-release downloadable.")
+	releaseProfileVendor = releaseProfile.Flag("profile-vendor", "Name of profile vendor").Required().String()
+	releaseProfileIccid  = releaseProfile.Flag("iccid", "Iccid to release profile for").Required().String()
+
+	///
+	///   Notifications from the SM-DP+
+	///
+
+	es2plusListen         = kingpin.Command("es2plus-listen", "Receive ES2+ handleDownloadProgressInfo notifications from SM-DP+ instances and record them.")
+	es2plusListenHost     = es2plusListen.Flag("host", "Host/interface to listen on.").Default("0.0.0.0").String()
+	es2plusListenPort     = es2plusListen.Flag("port", "Port to listen on.").Default("8443").Int()
+	es2plusListenCert     = es2plusListen.Flag("cert", "Server certificate pem file.").Required().ExistingFile()
+	es2plusListenKey      = es2plusListen.Flag("key", "Server certificate key file.").Required().ExistingFile()
+	es2plusListenClientCA = es2plusListen.Flag("client-ca", "Pem file containing the CA certificates used to verify SM-DP+ client certificates.").Required().ExistingFile()
+
+	///
+	///   The database
+	///
+
+	dbMigrate       = kingpin.Command("db-migrate", "Migrate the schema of the database.  Migrations not yet applied are also applied whenever sbm opens the database.")
+	dbMigrateStatus = dbMigrate.Flag("status", "List the schema migrations and when they were applied, instead of migrating").Bool()
+	dbMigrateTo     = dbMigrate.Flag("to", "Schema version to migrate to.  Default is the latest.").Default("-1").Int()
+
+	audit      = kingpin.Command("audit", "List the changes made to batches, sim profiles and profile vendors, oldest first.  Secrets are only listed as having been set.")
+	auditIccid = audit.Flag("iccid", "Only list changes to the sim profile with this ICCID.").String()
+	auditBatch = audit.Flag("batch", "Only list changes to the batch with this name and its sim profiles.").String()
+	auditSince = audit.Flag("since", "Only list changes made at or after this time (RFC3339).").String()
+	auditUntil = audit.Flag("until", "Only list changes made at or before this time (RFC3339).").String()
+
+	///
+	///   Bulk jobs
+	///
+
+	jobList = kingpin.Command("job-list", "List bulk jobs, most recent first.")
 
-	confirmOrder       = kingpin.Command("iccid-confirm-order", "Execute es2p iccid-confirm-order.")
-	confirmOrderVendor = confirmOrder.Flag("profile-vendor", "Name of profile vendor").Required().String()
-	confirmOrderIccid  = confirmOrder.Flag("iccid", "Iccid to confirm profile  for").Required().String()
+	jobStatus      = kingpin.Command("job-status", "Describe a bulk job, and list the items that are not done.")
+	jobStatusJobID = jobStatus.Arg("job-id", "The job to describe").Required().Int64()
+
+	jobResume      = kingpin.Command("job-resume", "Resume a bulk job, retrying only the items that are not done.")
+	jobResumeJobID = jobResume.Arg("job-id", "The job to resume").Required().Int64()
+	jobResumeForce = jobResume.Flag("force", "Resume the job even if it is still marked as running.  Make sure it isn't.").Bool()
 
 	///
 	///   Batch - centric commands
@@ -89,6 +231,10 @@ var (
 	getProfActActStatusesForBatch      = kingpin.Command("batch-get-activation-statuses", "Get current activation statuses from SM-DP+ for named batch.")
 	getProfActActStatusesForBatchBatch = getProfActActStatusesForBatch.Arg("batch-name", "The batch to get activation statuses for.").Required().String()
 
+	batchStatus        = kingpin.Command("batch-status", "Count the profiles in a batch by SM-DP+ state, as recorded in the local database, and by whether their HSS file and Prime upload script have been generated.  sbm doesn't know if those were ever run.")
+	batchStatusBatch   = batchStatus.Arg("batch-name", "The batch to count the profiles of.").Required().String()
+	batchStatusRefresh = batchStatus.Flag("refresh", "Get the current statuses of the profiles from the SM-DP+ first.").Bool()
+
 	describeBatch      = kingpin.Command("batch-describe", "Describe a batch with a particular name.")
 	describeBatchBatch = describeBatch.Arg("batch-name", "The batch to describe").String()
 
@@ -152,21 +298,79 @@ func main() {
 	kingpin.Command("batches-list", "List all known batches.")
 
 	if err := parseCommandLine(); err != nil {
+		// Bulk operations that partially failed have already
+		// reported the details, so just exit with the right code.
+		if exitErr, ok := err.(*bulk.Error); ok {
+			logging.Errorf("%s", exitErr)
+			os.Exit(exitErr.ExitCode())
+		}
 		panic(err)
 	}
 }
 
 func parseCommandLine() error {
 
-	db, err := store.OpenFileSqliteDatabaseFromPathInEnvironmentVariable("SIM_BATCH_DATABASE")
+	cmd := kingpin.Parse()
+
+	if err := configureLogging(); err != nil {
+		return err
+	}
+
+	// Migrating is done before the database is opened, since
+	// opening it applies all the migrations.
+	if cmd == "db-migrate" {
+		return migrateDatabase()
+	}
+
+	db, err := store.OpenFromEnvironmentVariable("SIM_BATCH_DATABASE")
 
 	if err != nil {
-		return fmt.Errorf("couldn't open sqlite database.  '%s'", err)
+		return fmt.Errorf("couldn't open database.  '%s'", err)
 	}
 
-	db.GenerateTables()
+	// Bulk commands stop dispatching new work when this context is
+	// cancelled.
+	ctx := interruptibleContext()
+
+	if *es2Record != "" {
+		recorder, err := es2plus.OpenTrafficRecorder(*es2Record)
+		if err != nil {
+			return err
+		}
+		defer recorder.Close()
+		es2Options = append(es2Options, es2plus.WithTrafficRecorder(recorder))
+	}
+
+	if *es2Replay != "" {
+		replay, err := es2plus.OpenReplayTransport(*es2Replay)
+		if err != nil {
+			return err
+		}
+		logging.Infof("Replaying ES2+ responses from '%s', no SM-DP+ will be contacted", *es2Replay)
+		es2Options = append(es2Options, es2plus.WithHTTPClient(&http.Client{Transport: replay}))
+	}
+
+	if *metricsListen != "" {
+		listener, err := net.Listen("tcp", *metricsListen)
+		if err != nil {
+			return fmt.Errorf("couldn't serve metrics on '%s': %s", *metricsListen, err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Default.Handler())
+		server := &http.Server{Handler: mux}
+		go server.Serve(listener)
+		defer server.Close()
+		logging.Infof("Serving metrics on http://%s/metrics", listener.Addr())
+	}
+
+	if *metricsTextfile != "" {
+		defer func() {
+			if err := metrics.Default.WriteTextfile(*metricsTextfile); err != nil {
+				logging.With(logging.FieldError, err).Errorf("Couldn't write metrics to '%s'", *metricsTextfile)
+			}
+		}()
+	}
 
-	cmd := kingpin.Parse()
 	switch cmd {
 
 	case "profile-vendor-declare":
@@ -180,12 +384,12 @@ func parseCommandLine() error {
 			return fmt.Errorf("already declared profile vendor '%s'", *dpvName)
 		}
 
-		if _, err := os.Stat(*dpvCertFilePath); os.IsNotExist(err) {
-			return fmt.Errorf("can't find certificate file '%s'", *dpvCertFilePath)
+		cert, err := es2plus.LoadClientCertificate(*dpvCertFilePath, *dpvKeyFilePath)
+		if err != nil {
+			return err
 		}
-
-		if _, err := os.Stat(*dpvKeyFilePath); os.IsNotExist(err) {
-			return fmt.Errorf("can't find key file '%s'", *dpvKeyFilePath)
+		if err := cert.Validate(time.Now()); err != nil {
+			return err
 		}
 
 		if *dpvPort <= 0 {
@@ -196,6 +400,40 @@ func parseCommandLine() error {
 			return fmt.Errorf("port must be smaller than or equal to 65535, was '%d'", *dpvPort)
 		}
 
+		if *dpvMaxIccids <= 0 {
+			return fmt.Errorf("max number of ICCIDs per request must be positive, was '%d'", *dpvMaxIccids)
+		}
+
+		if *dpvTimeout < time.Second {
+			return fmt.Errorf("timeout must be at least one second, was '%v'", *dpvTimeout)
+		}
+
+		if err := checkRateLimits(*dpvRps, *dpvMaxInFlight); err != nil {
+			return err
+		}
+
+		if err := es2plus.ValidateProtocolVersion(*dpvProtocol); err != nil {
+			return err
+		}
+
+		if _, err := es2plus.ParseDialect(*dpvDialect); err != nil {
+			return err
+		}
+
+		serverTrust := es2plus.ServerTrust{
+			CABundlePath:       *dpvCABundle,
+			PinnedSpkiSha256:   *dpvPinnedSpki,
+			ServerName:         *dpvServerName,
+			InsecureSkipVerify: *dpvInsecure,
+		}
+		if err := es2plus.ValidateServerTrust(serverTrust); err != nil {
+			return err
+		}
+
+		if *dpvInsecure {
+			logging.With(logging.FieldVendor, *dpvName).Warnf("The SM-DP+ certificate of the profile vendor will NOT be verified.")
+		}
+
 		// Modify the paths to absolute  paths.
 
 		absDpvCertFilePath, err := filepath.Abs(*dpvCertFilePath)
@@ -206,6 +444,13 @@ func parseCommandLine() error {
 		if err != nil {
 			return err
 		}
+		absDpvCABundle := ""
+		if *dpvCABundle != "" {
+			absDpvCABundle, err = filepath.Abs(*dpvCABundle)
+			if err != nil {
+				return err
+			}
+		}
 		v := &model.ProfileVendor{
 			Name:               *dpvName,
 			Es2PlusCert:        absDpvCertFilePath,
@@ -213,18 +458,244 @@ func parseCommandLine() error {
 			Es2PlusHost:        *dpvHost,
 			Es2PlusPort:        *dpvPort,
 			Es2PlusRequesterID: *dpvRequesterID,
+
+			Es2PlusCertSubject:  cert.Subject,
+			Es2PlusCertIssuer:   cert.Issuer,
+			Es2PlusCertSerial:   cert.Serial,
+			Es2PlusCertNotAfter: cert.NotAfter.UTC().Format(time.RFC3339),
+
+			Es2PlusMaxIccidsPerRequest: *dpvMaxIccids,
+			Es2PlusTimeoutSeconds:      int(dpvTimeout.Seconds()),
+
+			Es2PlusCABundle:           absDpvCABundle,
+			Es2PlusPinnedSpkiSha256:   *dpvPinnedSpki,
+			Es2PlusServerName:         *dpvServerName,
+			Es2PlusInsecureSkipVerify: *dpvInsecure,
+
+			Es2PlusRequestsPerSecond: *dpvRps,
+			Es2PlusMaxInFlight:       *dpvMaxInFlight,
+
+			Es2PlusProtocolVersion: *dpvProtocol,
+			Es2PlusDialect:         *dpvDialect,
 		}
 
 		if err := db.CreateProfileVendor(v); err != nil {
 			return err
 		}
 
-		fmt.Println("Declared a new vendor named ", *dpvName)
+		logging.With(logging.FieldVendor, *dpvName).Infof("Declared a new profile vendor")
+
+	case "profile-vendor-set-rate-limits":
+		vendor, err := db.GetProfileVendorByName(*pvLimitsName)
+		if err != nil {
+			return err
+		}
+		if vendor == nil {
+			return fmt.Errorf("unknown profile vendor '%s'", *pvLimitsName)
+		}
+		if err := checkRateLimits(*pvLimitsRps, *pvLimitsMaxInFlight); err != nil {
+			return err
+		}
+		if err := db.UpdateProfileVendorRateLimits(vendor.ID, *pvLimitsRps, *pvLimitsMaxInFlight); err != nil {
+			return err
+		}
+		logging.With(logging.FieldVendor, vendor.Name).Infof("Profile vendor now limited to %v requests per second and %d requests in flight (zero means no limit)",
+			*pvLimitsRps, *pvLimitsMaxInFlight)
+
+	case "profile-vendor-set-protocol":
+		vendor, err := getProfileVendor(db, *pvProtocolName)
+		if err != nil {
+			return err
+		}
+		if err := es2plus.ValidateProtocolVersion(*pvProtocolVersion); err != nil {
+			return err
+		}
+		if _, err := es2plus.ParseDialect(*pvProtocolDialect); err != nil {
+			return err
+		}
+		if err := db.UpdateProfileVendorProtocol(vendor.ID, *pvProtocolVersion, *pvProtocolDialect); err != nil {
+			return err
+		}
+		logging.With(logging.FieldVendor, vendor.Name).Infof("Profile vendor now spoken to using ES2+ version %s and dialect %s", *pvProtocolVersion, *pvProtocolDialect)
+
+	case "profile-vendor-check":
+		vendors, err := db.GetAllProfileVendors()
+		if err != nil {
+			return err
+		}
+		checked, problems := 0, 0
+		fmt.Printf("%s, %s, %s, %s, %s\n", "VENDOR", "SERIAL", "NOT AFTER", "DAYS LEFT", "STATUS")
+		for _, vendor := range vendors {
+			if *pvCheckName != "" && vendor.Name != *pvCheckName {
+				continue
+			}
+			checked++
+			serial, notAfter, daysLeft, status := checkVendorCertificate(vendor, *pvCheckDays)
+			if status != "OK" {
+				problems++
+			}
+			fmt.Printf("%s, %s, %s, %s, %s\n", vendor.Name, serial, notAfter, daysLeft, status)
+		}
+		if *pvCheckName != "" && checked == 0 {
+			return fmt.Errorf("unknown profile vendor '%s'", *pvCheckName)
+		}
+		if problems > 0 {
+			return fmt.Errorf("%d of %d profile vendor certificates need attention", problems, checked)
+		}
+
+	case "profile-vendor-rotate-cert":
+		vendor, err := getProfileVendor(db, *pvRotateName)
+		if err != nil {
+			return err
+		}
+		cert, err := es2plus.LoadClientCertificate(*pvRotateCert, *pvRotateKey)
+		if err != nil {
+			return err
+		}
+		if err := cert.Validate(time.Now()); err != nil {
+			return err
+		}
+
+		rotated := *vendor
+		if rotated.Es2PlusCert, err = filepath.Abs(*pvRotateCert); err != nil {
+			return err
+		}
+		if rotated.Es2PlusKey, err = filepath.Abs(*pvRotateKey); err != nil {
+			return err
+		}
+		rotated.Es2PlusCertSubject = cert.Subject
+		rotated.Es2PlusCertIssuer = cert.Issuer
+		rotated.Es2PlusCertSerial = cert.Serial
+		rotated.Es2PlusCertNotAfter = cert.NotAfter.UTC().Format(time.RFC3339)
+
+		client, err := clientForProfileVendor(db, &rotated)
+		if err != nil {
+			return err
+		}
+		if err := rotateVendorCertificate(ctx, db, client, &rotated, *pvRotateTestIccid); err != nil {
+			return err
+		}
+		logging.With(logging.FieldVendor, vendor.Name).Infof("Rotated client certificate from serial %s (expiring %s) to serial %s (expiring %s)",
+			vendor.Es2PlusCertSerial, vendor.Es2PlusCertNotAfter, rotated.Es2PlusCertSerial, rotated.Es2PlusCertNotAfter)
+
+	case "profile-vendor-endpoint-add":
+		vendor, err := getProfileVendor(db, *pvEndpointAddName)
+		if err != nil {
+			return err
+		}
+		endpoint := &model.ProfileVendorEndpoint{
+			ProfileVendorID: vendor.ID,
+			Position:        *pvEndpointAddPosition,
+			Host:            *pvEndpointAddHost,
+			Port:            *pvEndpointAddPort,
+		}
+		if err := db.CreateProfileVendorEndpoint(endpoint); err != nil {
+			return err
+		}
+		logging.With(logging.FieldVendor, vendor.Name).Infof("Added endpoint %s:%d at position %d", endpoint.Host, endpoint.Port, endpoint.Position)
+
+	case "profile-vendor-endpoint-remove":
+		vendor, err := getProfileVendor(db, *pvEndpointRemoveName)
+		if err != nil {
+			return err
+		}
+		endpoints, err := db.GetProfileVendorEndpoints(vendor.ID)
+		if err != nil {
+			return err
+		}
+		var found *model.ProfileVendorEndpoint
+		for i := range endpoints {
+			if endpoints[i].Host == *pvEndpointRemoveHost && endpoints[i].Port == *pvEndpointRemovePort {
+				found = &endpoints[i]
+			}
+		}
+		if found == nil {
+			return fmt.Errorf("profile vendor '%s' has no endpoint %s:%d", vendor.Name, *pvEndpointRemoveHost, *pvEndpointRemovePort)
+		}
+		if len(endpoints) == 1 {
+			return fmt.Errorf("can't remove %s:%d, it is the only endpoint of profile vendor '%s'", found.Host, found.Port, vendor.Name)
+		}
+		if err := db.DeleteProfileVendorEndpoint(found.ID); err != nil {
+			return err
+		}
+		logging.With(logging.FieldVendor, vendor.Name).Infof("Removed endpoint %s:%d", found.Host, found.Port)
+
+	case "profile-vendor-endpoint-list":
+		vendor, err := getProfileVendor(db, *pvEndpointListName)
+		if err != nil {
+			return err
+		}
+		endpoints, err := endpointSetForVendor(db, vendor)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s, %s, %s, %s, %s\n", "ENDPOINT", "ACTIVE", "HEALTH", "FAILED AT", "LAST ERROR")
+		for _, status := range endpoints.Status() {
+			active := ""
+			if status.Active {
+				active = "active"
+			}
+			health := "healthy"
+			if !status.Healthy {
+				health = "failed"
+			}
+			failedAt := ""
+			if !status.FailedAt.IsZero() {
+				failedAt = status.FailedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%s, %s, %s, %s, %s\n", status.Hostport, active, health, failedAt, status.LastError)
+		}
+
+	case "es2plus-listen":
+		addr := fmt.Sprintf("%s:%d", *es2plusListenHost, *es2plusListenPort)
+
+		// The database isn't happy about concurrent writers, so
+		// notifications are recorded one at a time.
+		var mutex = &sync.Mutex{}
+
+		handler := func(notification *es2plus.HandleDownloadProgressInfoRequest) (*es2plus.StatusCodeData, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			simProfile, err := db.GetSimProfileByIccid(notification.Iccid)
+			if err != nil {
+				return nil, err
+			}
+			if simProfile == nil {
+				logging.With(logging.FieldIccid, notification.Iccid).Warnf("Received notification for unknown iccid")
+				return &es2plus.StatusCodeUnknownIccid, nil
+			}
+
+			event := &model.DownloadProgressEvent{
+				SimProfileID:           simProfile.ID,
+				Iccid:                  notification.Iccid,
+				Eid:                    notification.Eid,
+				NotificationPointID:    notification.NotificationPointID,
+				Status:                 notification.NotificationPointStatus.Status,
+				Timestamp:              notification.Timestamp,
+				FunctionCallIdentifier: notification.Header.FunctionCallIdentifier,
+			}
+			state, _ := notification.ProfileState()
+			recorded, err := db.RecordDownloadProgress(event, string(state))
+			if err != nil {
+				return nil, err
+			}
+			if !recorded {
+				logging.With(logging.FieldIccid, event.Iccid, logging.FieldFunctionCallIdentifier, event.FunctionCallIdentifier).Infof("Ignoring notification already received")
+				return nil, nil
+			}
+
+			fmt.Printf("%s, %s, %d, %s, %s\n", event.Iccid, event.Eid, event.NotificationPointID, event.Status, event.Timestamp)
+			return nil, nil
+		}
+
+		logging.Infof("Listening for ES2+ notifications on %s", addr)
+		return es2plus.ListenAndServeNotifications(addr, *es2plusListenCert, *es2plusListenKey, *es2plusListenClientCA, handler)
 
 	case "batch-get-activation-statuses":
 		batchName := *getProfActActStatusesForBatchBatch
 
-		log.Printf("Getting statuses for all profiles in batch  named %s\n", batchName)
+		logging.With(logging.FieldBatch, batchName).Infof("Getting statuses for all profiles in batch")
 
 		batch, err := db.GetBatchByName(batchName)
 		if err != nil {
@@ -245,74 +716,84 @@ func parseCommandLine() error {
 			return fmt.Errorf("batch quantity retrieved from database (%d) different from batch quantity (%d)", len(entries), batch.Quantity)
 		}
 
-		log.Printf("Found %d profiles\n", len(entries))
-
-		// XXX Is this really necessary? I don't think so
-		var mutex = &sync.Mutex{}
+		logging.With(logging.FieldBatch, batchName).Infof("Found %d profiles", len(entries))
 
-		var waitgroup sync.WaitGroup
+		iccids := make([]string, len(entries))
+		for i, entry := range entries {
+			iccids[i] = entry.Iccid
+		}
 
-		// Limit concurrency of the for-loop below
-		// to 160 goroutines.  The reason is that if we get too
-		// many we run out of file descriptors, and we don't seem to
-		// get much speedup after hundred or so.
+		// The statuses that could be had are listed even if some
+		// of the requests failed.
+		statuses, missing, err := client.GetStatusesContext(ctx, iccids)
 
-		concurrency := 160
-		sem := make(chan bool, concurrency)
 		for _, entry := range entries {
+			if result, found := statuses[entry.Iccid]; found {
+				fmt.Printf("%s, %s\n", entry.Iccid, result.State)
+			}
+		}
 
-			//
-			// Only apply activation if not already noted in the
-			// database.
-			//
-
-			sem <- true
+		for _, iccid := range missing {
+			logging.With(logging.FieldIccid, iccid).Errorf("Couldn't find any status")
+		}
+		logClientStats(client, batch.ProfileVendor)
+		if err != nil {
+			return err
+		}
 
-			waitgroup.Add(1)
-			go func(entry model.SimEntry) {
+	case "batch-status":
+		batch, err := db.GetBatchByName(*batchStatusBatch)
+		if err != nil {
+			return err
+		}
+		if batch == nil {
+			return fmt.Errorf("no batch found with name '%s'", *batchStatusBatch)
+		}
 
-				defer func() { <-sem }()
+		entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
+		if err != nil {
+			return err
+		}
 
-				result, err := client.GetStatus(entry.Iccid)
-				if err != nil {
-					panic(err)
-				}
+		var refreshErr error
+		if *batchStatusRefresh {
+			client, err := clientForVendor(db, batch.ProfileVendor)
+			if err != nil {
+				return err
+			}
+			iccids := make([]string, len(entries))
+			for i, entry := range entries {
+				iccids[i] = entry.Iccid
+			}
 
-				if result == nil {
-					log.Printf("ERROR: Couldn't find any status for Iccid='%s'\n", entry.Iccid)
-				}
+			// The statuses are recorded as they are received, so
+			// those that could be had are counted even if some of
+			// the requests failed.
+			var missing []string
+			_, missing, refreshErr = client.GetStatusesContext(ctx, iccids)
+			for _, iccid := range missing {
+				logging.With(logging.FieldIccid, iccid).Errorf("Couldn't find any status")
+			}
+			logClientStats(client, batch.ProfileVendor)
 
-				mutex.Lock()
-				fmt.Printf("%s, %s\n", entry.Iccid, result.State)
-				mutex.Unlock()
-				waitgroup.Done()
-			}(entry)
+			if entries, err = db.GetAllSimEntriesForBatch(batch.BatchID); err != nil {
+				return err
+			}
 		}
 
-		waitgroup.Wait()
-		for i := 0; i < cap(sem); i++ {
-			sem <- true
+		fmt.Printf("Batch '%s', %d profiles\n", batch.Name, len(entries))
+		printStateCounts("SM-DP+ STATE", entries, func(entry model.SimEntry) string { return entry.SmdpState })
+		printStateCounts("HSS FILE (GENERATED, NOT NECESSARILY LOADED)", entries, func(entry model.SimEntry) string { return entry.HssState })
+		printStateCounts("PRIME UPLOAD SCRIPT (GENERATED, NOT NECESSARILY RUN)", entries, func(entry model.SimEntry) string { return entry.PrimeUploadState })
+		if refreshErr != nil {
+			return fmt.Errorf("couldn't refresh all the statuses, the counts are of those recorded: %s", refreshErr)
 		}
 
 	case "batch-read-out-file":
 
-		tx := db.Begin()
-
-		// By default we're not cool to commit.  Need to prove something first.
-		weCool := false
-
-		defer func() {
-			if weCool {
-				tx.Commit()
-			} else {
-				tx.Rollback()
-			}
-		}()
-
 		batch, err := db.GetBatchByName(*spBatchName)
 
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
 
@@ -330,6 +811,9 @@ func parseCommandLine() error {
 				outRecord.NoOfEntries, batch.Quantity, batch.Name)
 		}
 
+		// Every record is checked before any Ki is updated, and then
+		// they are all updated, or none of them are.
+		var updates []model.SimEntry
 		for _, e := range outRecord.Entries {
 			simProfile, err := db.GetSimProfileByIccid(e.IccidWithChecksum)
 			if err != nil {
@@ -341,12 +825,11 @@ func parseCommandLine() error {
 			if simProfile.Imsi != e.Imsi {
 				return fmt.Errorf("profile enty for ICCID=%s has IMSI (%s), but we expected (%s)", e.Iccid, e.Imsi, simProfile.Imsi)
 			}
-			db.UpdateSimEntryKi(simProfile.ID, e.Ki)
+			updates = append(updates, model.SimEntry{ID: simProfile.ID, Ki: e.Ki})
+		}
+		if err := db.UpdateSimEntryKis(updates); err != nil {
+			return err
 		}
-
-		// Signal to defered transaction cleanup that we're cool
-		// with a commit.
-		weCool = true
 
 	case "batch-write-hss":
 
@@ -361,11 +844,14 @@ func parseCommandLine() error {
 		}
 
 		outputFile := fmt.Sprintf("%s/%s.csv", *bwOutputDirName, batch.Name)
-		log.Println("outputFile = ", outputFile)
+		logging.With(logging.FieldBatch, batch.Name).Debugf("Writing HSS output file '%s'", outputFile)
 
 		if err := outfileparser.WriteHssCsvFile(outputFile, db, batch); err != nil {
 			return fmt.Errorf("couldn't write hss output to file  '%s', .  Error = '%v'", outputFile, err)
 		}
+		if err := db.UpdateHssStateForBatch(batch.BatchID, model.HssStateFileWritten); err != nil {
+			return err
+		}
 
 	case "batches-list":
 		allBatches, err := db.GetAllBatches()
@@ -427,6 +913,9 @@ func parseCommandLine() error {
 
 		var csvPayload = uploadtoprime.GenerateCsvPayload(db, *batch)
 		uploadtoprime.GeneratePostingCurlscript(batch.URL, csvPayload)
+		if err := db.UpdatePrimeUploadStateForBatch(batch.BatchID, model.PrimeUploadStateScriptGenerated); err != nil {
+			return err
+		}
 
 	case "batch-generate-input-file":
 		batch, err := db.GetBatchByName(*generateInputFileBatchname)
@@ -496,7 +985,7 @@ func parseCommandLine() error {
 			if err == io.EOF {
 				break
 			} else if err != nil {
-				log.Fatal(err)
+				logging.Fatalf("%s", err)
 			}
 
 			iccid := line[columnMap["Iccid"]]
@@ -523,41 +1012,34 @@ func parseCommandLine() error {
 			return err
 		}
 
-		// Check for compatibility
-		tx := db.Begin()
-		noOfRecordsUpdated := 0
+		// Check for compatibility of every record before updating
+		// any, and then update them all, or none of them.
+		var updates []model.SimEntry
 		for _, entry := range simEntries {
 			record, iccidRecordIsPresent := recordMap[entry.Iccid]
 			if !iccidRecordIsPresent {
-				tx.Rollback()
 				return fmt.Errorf("ICCID not in batch: %s", entry.Iccid)
 			}
 
 			if entry.Imsi != record.imsi {
-				tx.Rollback()
 				return fmt.Errorf("IMSI mismatch for ICCID=%s.  Batch has %s, csv file has %s", entry.Iccid, entry.Imsi, record.iccid)
 			}
 
 			if entry.Msisdn != "" && record.msisdn != "" && record.msisdn != entry.Msisdn {
-				tx.Rollback()
 				return fmt.Errorf("MSISDN mismatch for ICCID=%s.  Batch has %s, csv file has %s", entry.Iccid, entry.Msisdn, record.msisdn)
 			}
 
 			if entry.Msisdn == "" && record.msisdn != "" {
-				err = db.UpdateSimEntryMsisdn(entry.ID, record.msisdn)
-				if err != nil {
-					tx.Rollback()
-					return err
-				}
-				noOfRecordsUpdated++
+				updates = append(updates, model.SimEntry{ID: entry.ID, Msisdn: record.msisdn})
 			}
 		}
-		tx.Commit()
+		if err := db.UpdateSimEntryMsisdns(updates); err != nil {
+			return err
+		}
 
-		log.Printf("Updated %d of a total of %d records in batch '%s'\n", noOfRecordsUpdated, len(simEntries), batchName)
+		logging.With(logging.FieldBatch, batchName).Infof("Updated %d of a total of %d records in batch", len(updates), len(simEntries))
 
 	case "batch-declare":
-		log.Println("Declare batch")
 		batch, err := db.DeclareBatch(
 			*dbName,
 			*dbAddLuhn,
@@ -581,7 +1063,7 @@ func parseCommandLine() error {
 		if err != nil {
 			return err
 		}
-		log.Printf("Declared batch '%s'", batch.Name)
+		logging.With(logging.FieldBatch, batch.Name).Infof("Declared batch")
 		return nil
 
 	case "iccid-get-status":
@@ -594,74 +1076,169 @@ func parseCommandLine() error {
 		if err != nil {
 			return err
 		}
-		log.Printf("Iccid='%s', state='%s', acToken='%s'\n", *getStatusProfileIccid, (*result).State, (*result).ACToken)
+		fmt.Printf("Iccid='%s', state='%s', acToken='%s'\n", *getStatusProfileIccid, (*result).State, (*result).ACToken)
 
-	case "iccid-recover-profile":
-		client, err := clientForVendor(db, *recoverProfileVendor)
+	case "lpa-simulate":
+		code, confirmationCode, err := activationCodeToSimulate(db)
 		if err != nil {
 			return err
 		}
-
-		err = checkEs2TargetState(*recoverProfileTarget)
-		if err != nil {
+		address := code.SmdpAddress
+		if *lpaSimulateSmdpAddress != "" {
+			address = *lpaSimulateSmdpAddress
+		}
+		if err := checkSimulatedSmdp(address, *lpaSimulateAnySmdp); err != nil {
 			return err
 		}
-		result, err := client.RecoverProfile(*recoverProfileIccid, *recoverProfileTarget)
+		protocolVersion, err := protocolVersionToSimulate(db)
 		if err != nil {
 			return err
 		}
-		log.Println("result -> ", result)
-
-	case "iccid-download-order":
-		client, err := clientForVendor(db, *downloadOrderVendor)
+		eid := *lpaSimulateEid
+		if eid == "" {
+			if eid, err = lpa.SimulatedEid(); err != nil {
+				return err
+			}
+		}
+		euicc, err := lpa.NewEUICC(eid)
 		if err != nil {
 			return err
 		}
-		result, err := client.DownloadOrder(*downloadOrderIccid)
+		tlsConfig, err := es2plus.ServerTLSConfig(es2plus.ServerTrust{
+			CABundlePath:       *lpaSimulateCABundle,
+			InsecureSkipVerify: *lpaSimulateInsecure,
+		})
 		if err != nil {
 			return err
 		}
-		log.Println("result -> ", result)
+		simulator := &lpa.Simulator{
+			HTTPClient:      &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+			EUICC:           euicc,
+			SmdpAddress:     *lpaSimulateSmdpAddress,
+			ProtocolVersion: protocolVersion,
+		}
 
-	case "iccid-confirm-order":
-		client, err := clientForVendor(db, *confirmOrderVendor)
+		simulateCtx, cancel := context.WithTimeout(ctx, *lpaSimulateTimeout)
+		defer cancel()
+		result, err := simulator.Download(simulateCtx, *code, confirmationCode)
 		if err != nil {
+			if stepErr, ok := err.(*lpa.StepError); ok {
+				fmt.Printf("Activation code '%s', eid='%s': FAILED at %s\n", code, eid, stepErr.Step)
+			}
 			return err
 		}
-		result, err := client.ConfirmOrder(*confirmOrderIccid)
+		fmt.Printf("Activation code '%s', eid='%s': installed iccid='%s', transaction='%s'\n", code, eid, result.Iccid, result.TransactionID)
+
+	case "iccid-recover-profile":
+		client, err := clientForVendor(db, *recoverProfileVendor)
 		if err != nil {
 			return err
 		}
-		fmt.Println("result -> ", result)
 
-	case "iccid-activate":
-		client, err := clientForVendor(db, *activateIccidVendor)
+		target, err := es2plus.ParseRecoverProfileTarget(*recoverProfileTarget)
 		if err != nil {
 			return err
 		}
-
-		result, err := client.ActivateIccid(*activateIccidIccid)
-
+		result, err := client.RecoverProfile(*recoverProfileIccid, target)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("%s, %s\n", *activateIccidIccid, result.ACToken)
+		fmt.Println("result -> ", result)
 
-	case "iccid-cancel":
-		client, err := clientForVendor(db, *cancelIccidVendor)
+	case "iccid-download-order":
+		client, err := clientForVendor(db, *downloadOrderVendor)
 		if err != nil {
 			return err
 		}
-		err = checkEs2TargetState(*cancelIccidTarget)
+		params, err := orderParameters(*downloadOrderEid, *downloadOrderType, "", "", "", true)
 		if err != nil {
 			return err
 		}
-		_, err = client.CancelOrder(*cancelIccidIccid, *cancelIccidTarget)
+		result, err := client.DownloadOrder(*downloadOrderIccid, params)
 		if err != nil {
 			return err
 		}
+		fmt.Println("result -> ", result)
 
-	case "iccids-activate-from-file":
+	case "iccid-confirm-order":
+		client, err := clientForVendor(db, *confirmOrderVendor)
+		if err != nil {
+			return err
+		}
+		params, err := orderParameters(*confirmOrderEid, "", *confirmOrderMatch, *confirmOrderCode, *confirmOrderSmds, *confirmOrderRelease)
+		if err != nil {
+			return err
+		}
+		result, err := client.ConfirmOrder(*confirmOrderIccid, params)
+		if err != nil {
+			return err
+		}
+		fmt.Println("result -> ", result)
+
+		matchingID := result.MatchingID
+		if matchingID == "" {
+			matchingID = params.MatchingID
+		}
+		if err := storeOrderParameters(db, *confirmOrderIccid, matchingID, params.ConfirmationCode); err != nil {
+			return err
+		}
+
+	case "iccid-release":
+		client, err := clientForVendor(db, *releaseProfileVendor)
+		if err != nil {
+			return err
+		}
+		result, err := client.ReleaseProfile(*releaseProfileIccid)
+		if err != nil {
+			return err
+		}
+		fmt.Println("result -> ", result)
+
+	case "iccid-activate":
+		client, err := clientForVendor(db, *activateIccidVendor)
+		if err != nil {
+			return err
+		}
+
+		params, err := orderParameters(*activateIccidEid, *activateIccidType, *activateIccidMatch, *activateIccidCode, *activateIccidSmds, *activateIccidRelease)
+		if err != nil {
+			return err
+		}
+
+		activation, err := client.Activate(ctx, *activateIccidIccid, params)
+
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s, %s\n", *activateIccidIccid, activation.Status.ACToken)
+
+		// The order parameters are only used if the profile was
+		// ordered now, rather than found ready.
+		if activation.Confirmed != nil {
+			matchingID := activation.Confirmed.MatchingID
+			if matchingID == "" {
+				matchingID = params.MatchingID
+			}
+			if err := storeOrderParameters(db, *activateIccidIccid, matchingID, params.ConfirmationCode); err != nil {
+				return err
+			}
+		}
+
+	case "iccid-cancel":
+		client, err := clientForVendor(db, *cancelIccidVendor)
+		if err != nil {
+			return err
+		}
+		target, err := es2plus.ParseCancelOrderTarget(*cancelIccidTarget)
+		if err != nil {
+			return err
+		}
+		_, err = client.CancelOrder(*cancelIccidIccid, target)
+		if err != nil {
+			return err
+		}
+
+	case "iccids-activate-from-file":
 		client, err := clientForVendor(db, *activateIccidFileVendor)
 		if err != nil {
 			return err
@@ -678,7 +1255,7 @@ func parseCommandLine() error {
 		if error == io.EOF {
 			break
 		} else if error != nil {
-			log.Fatal(error)
+			logging.Fatalf("%s", error)
 		}
 
 		var columnMap map[string]int
@@ -692,14 +1269,10 @@ func parseCommandLine() error {
 			return fmt.Errorf("no ICCID  column in CSV file")
 		}
 
-		type csvRecord struct {
-			Iccid string
-		}
-
-		var recordMap map[string]csvRecord
-		recordMap = make(map[string]csvRecord)
+		var iccids []string
+		seen := make(map[string]bool)
 
-		// Read all the lines into the record map.
+		// Read all the lines into the ICCID list.
 		for {
 			line, err := reader.Read()
 			if err == io.EOF {
@@ -708,184 +1281,610 @@ func parseCommandLine() error {
 				return err
 			}
 
-			iccid := line[columnMap["Iccid"]]
+			iccid := line[columnMap["iccid"]]
 			iccid = strings.TrimSpace(iccid)
 
-			record := csvRecord{
-				Iccid: iccid,
+			if seen[iccid] {
+				return fmt.Errorf("duplicate ICCID record in map: %s", iccid)
 			}
+			seen[iccid] = true
+			iccids = append(iccids, iccid)
+		}
 
-			if _, duplicateRecordExists := recordMap[record.Iccid]; duplicateRecordExists {
-				return fmt.Errorf("duplicate ICCID record in map: %s", record.Iccid)
+		statuses, missing, err := client.GetStatusesContext(ctx, iccids)
+		logClientStats(client, *activateIccidFileVendor)
+
+		fmt.Printf("%s, %s\n", "ICCID", "STATE")
+		for _, iccid := range iccids {
+			if result, found := statuses[iccid]; found {
+				fmt.Printf("%s, %s\n", iccid, result.State)
 			}
+		}
+		if err != nil {
+			for _, iccid := range missing {
+				logging.With(logging.FieldIccid, iccid).Errorf("Couldn't find any status")
+			}
+			return err
+		}
 
-			recordMap[record.Iccid] = record
+		if len(missing) > 0 {
+			for _, iccid := range missing {
+				logging.With(logging.FieldIccid, iccid).Errorf("Couldn't find any status")
+			}
+			return fmt.Errorf("couldn't find any status for %d of %d ICCIDs", len(missing), len(iccids))
 		}
 
-		// XXX Is this really necessary? I don't think so
-		var mutex = &sync.Mutex{}
+	case "batch-activate-all-profiles":
 
-		var waitgroup sync.WaitGroup
+		client, batch, err := clientForBatch(db, *setBatchActivationCodesBatch)
+		if err != nil {
+			return err
+		}
 
-		// Limit concurrency of the for-loop below
-		// to 160 goroutines.  The reason is that if we get too
-		// many we run out of file descriptors, and we don't seem to
-		// get much speedup after hundred or so.
+		err = activateAllProfilesInBatch(ctx, db, client, batch)
+		logClientStats(client, batch.ProfileVendor)
+		if err != nil {
+			return err
+		}
 
-		concurrency := 160
-		sem := make(chan bool, concurrency)
-		fmt.Printf("%s, %s\n", "ICCID", "STATE")
-		for _, entry := range recordMap {
+	case "iccids-bulk-activate":
+		client, err := clientForVendor(db, *bulkActivateIccidsVendor)
+		if err != nil {
+			return err
+		}
 
-			//
-			// Only apply activation if not already noted in the
-			// database.
-			//
+		file, err := os.Open(*bulkActivateIccidsIccids)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
 
-			sem <- true
+		var iccids []string
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			iccids = append(iccids, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
 
-			waitgroup.Add(1)
-			go func(entry csvRecord) {
+		job, err := startJob(db, jobActivateIccids, "", *bulkActivateIccidsVendor, jobParameters{IccidFile: *bulkActivateIccidsIccids}, iccids)
+		if err != nil {
+			return err
+		}
+		summary, err := runJob(ctx, db, client, job)
+		logClientStats(client, *bulkActivateIccidsVendor)
+		if err != nil {
+			return err
+		}
 
-				defer func() { <-sem }()
+		if remaining := summary.Items(bulk.Failed, bulk.NotAttempted); len(remaining) > 0 {
+			remainingFile := *bulkActivateIccidsIccids + ".remaining"
+			if err := ioutil.WriteFile(remainingFile, []byte(strings.Join(remaining, "\n")+"\n"), 0644); err != nil {
+				return err
+			}
+			logging.With(logging.FieldJob, job.ID).Warnf("%d of %d ICCIDs were not activated, they are listed in '%s'.", len(remaining), len(iccids), remainingFile)
+		}
+		return summary.Err()
 
-				result, err := client.GetStatus(entry.Iccid)
-				if err != nil {
-					panic(err)
-				}
+	case "job-list":
+		jobs, err := db.GetAllJobs()
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			items, err := db.GetJobItems(job.ID)
+			if err != nil {
+				return err
+			}
+			counts := countJobItems(items)
+			fmt.Printf("%d, %s, %s, %s, %s, %s, %s, %s, %d of %d done\n",
+				job.ID, job.Type, job.BatchName, job.ProfileVendor, job.State, job.Operator, job.StartedAt, job.EndedAt,
+				counts[model.JobItemSucceeded]+counts[model.JobItemSkipped], len(items))
+		}
 
-				if result == nil {
-					panic(fmt.Sprintf("Couldn't find any status for Iccid='%s'\n", entry.Iccid))
-				}
+	case "job-status":
+		job, err := db.GetJobByID(*jobStatusJobID)
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			return fmt.Errorf("no job found with id %d", *jobStatusJobID)
+		}
 
-				mutex.Lock()
-				fmt.Printf("%s, %s\n", entry.Iccid, result.State)
-				mutex.Unlock()
-				waitgroup.Done()
-			}(entry)
+		bytes, err := json.MarshalIndent(job, "    ", "     ")
+		if err != nil {
+			return fmt.Errorf("can't serialize job '%v'", job)
 		}
+		fmt.Printf("%v\n", string(bytes))
 
-		waitgroup.Wait()
-		for i := 0; i < cap(sem); i++ {
-			sem <- true
+		items, err := db.GetJobItems(job.ID)
+		if err != nil {
+			return err
+		}
+		counts := countJobItems(items)
+		fmt.Printf("%d items: %d succeeded, %d failed, %d skipped, %d pending\n",
+			len(items), counts[model.JobItemSucceeded], counts[model.JobItemFailed], counts[model.JobItemSkipped], counts[model.JobItemPending])
+		for _, item := range items {
+			if !jobItemDone(item) {
+				fmt.Printf("%s, %s, %s\n", item.Iccid, item.State, item.Error)
+			}
 		}
 
-	case "batch-activate-all-profiles":
+	case "job-resume":
+		job, err := db.GetJobByID(*jobResumeJobID)
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			return fmt.Errorf("no job found with id %d", *jobResumeJobID)
+		}
+		if job.State == model.JobDone {
+			logging.With(logging.FieldJob, job.ID).Infof("Job is done, nothing to resume.")
+			return nil
+		}
+		if err := checkResumable(job, *jobResumeForce); err != nil {
+			return err
+		}
 
-		client, batch, err := clientForBatch(db, *setBatchActivationCodesBatch)
+		client, err := clientForVendor(db, job.ProfileVendor)
+		if err != nil {
+			return err
+		}
+		summary, err := runJob(ctx, db, client, job)
+		logClientStats(client, job.ProfileVendor)
 		if err != nil {
 			return err
 		}
+		return summary.Err()
 
-		entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
+	case "audit":
+		var batchID int64
+		if *auditBatch != "" {
+			batch, err := db.GetBatchByName(*auditBatch)
+			if err != nil {
+				return err
+			}
+			if batch == nil {
+				return fmt.Errorf("no batch found with name '%s'", *auditBatch)
+			}
+			batchID = batch.BatchID
+		}
+		since, err := auditTime("since", *auditSince)
+		if err != nil {
+			return err
+		}
+		until, err := auditTime("until", *auditUntil)
 		if err != nil {
 			return err
 		}
 
-		if len(entries) != batch.Quantity {
-			return fmt.Errorf("batch quantity retrieved from database (%d) different from batch quantity (%d)", len(entries), batch.Quantity)
+		entries, err := db.GetAuditEntries(*auditIccid, batchID, since, until)
+		if err != nil {
+			return err
 		}
+		printAuditEntries(entries)
 
-		// XXX Is this really necessary? I don't think so
-		var mutex = &sync.Mutex{}
+	default:
+		return fmt.Errorf("unknown command: '%s'", cmd)
+	}
 
-		var waitgroup sync.WaitGroup
+	return nil
+}
 
-		// Limit concurrency of the for-loop below
-		// to 160 goroutines.  The reason is that if we get too
-		// many we run out of file descriptors, and we don't seem to
-		// get much speedup after hundred or so.
+// The types of bulk jobs, named after the commands starting them.
+const (
+	jobActivateBatch  = "batch-activate-all-profiles"
+	jobActivateIccids = "iccids-bulk-activate"
+)
 
-		concurrency := 160
-		sem := make(chan bool, concurrency)
-		tx := db.Begin()
-		for _, entry := range entries {
+// jobParameters are the parameters of a job, other than its batch and
+// profile vendor.  They are persisted as JSON.
+type jobParameters struct {
+	IccidFile string `json:"iccidFile,omitempty"`
+}
 
-			//
-			// Only apply activation if not already noted in the
-			// database.
+// activateAllProfilesInBatch activates all the profiles in a batch
+// that don't already have an activation code, and stores the
+// activation codes returned by the SM-DP+ in the database.  It is
+// run as a job, so that it can be resumed if it doesn't finish.
+func activateAllProfilesInBatch(ctx context.Context, db store.Store, client es2plus.Client, batch *model.Batch) error {
+	entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
+	if err != nil {
+		return err
+	}
 
-			if entry.ActivationCode == "" {
+	if len(entries) != batch.Quantity {
+		return fmt.Errorf("batch quantity retrieved from database (%d) different from batch quantity (%d)", len(entries), batch.Quantity)
+	}
 
-				sem <- true
+	iccids := make([]string, len(entries))
+	for i, entry := range entries {
+		iccids[i] = entry.Iccid
+	}
+	job, err := startJob(db, jobActivateBatch, batch.Name, batch.ProfileVendor, jobParameters{}, iccids)
+	if err != nil {
+		return err
+	}
+	summary, err := runJob(ctx, db, client, job)
+	if err != nil {
+		return err
+	}
+	return summary.Err()
+}
 
-				waitgroup.Add(1)
-				go func(entry model.SimEntry) {
+// startJob records a new job processing the ICCIDs, all of them pending.
+func startJob(db store.Store, jobType string, batchName string, vendorName string, parameters jobParameters, iccids []string) (*model.Job, error) {
+	params, err := json.Marshal(parameters)
+	if err != nil {
+		return nil, err
+	}
+	job := &model.Job{
+		Type:          jobType,
+		BatchName:     batchName,
+		ProfileVendor: vendorName,
+		Parameters:    string(params),
+		Operator:      store.AuditOperator,
+		State:         model.JobRunning,
+		StartedAt:     store.Timestamp(),
+	}
+	if err := db.CreateJob(job, iccids); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
 
-					defer func() { <-sem }()
+// runJob processes the items of a job that are not done, committing
+// the outcome of each item as soon as it is known, so that a job that
+// is interrupted, or crashes, can be resumed where it stopped.  If the
+// context is cancelled, no more items are started, but the ones in
+// flight are allowed to finish.
+func runJob(ctx context.Context, db store.Store, client es2plus.Client, job *model.Job) (*bulk.Summary, error) {
+	// Writes to the database are serialized.
+	var mutex sync.Mutex
 
-					result, err := client.ActivateIccid(entry.Iccid)
-					if err != nil {
-						panic(err)
-					}
+	task, err := jobTask(db, client, job, &mutex)
+	if err != nil {
+		return nil, err
+	}
 
-					mutex.Lock()
-					fmt.Printf("%s, %s\n", entry.Iccid, result.ACToken)
-					db.UpdateActivationCode(entry.ID, result.ACToken)
-					mutex.Unlock()
-					waitgroup.Done()
-				}(entry)
-			}
+	items, err := db.GetJobItems(job.ID)
+	if err != nil {
+		return nil, err
+	}
+	var todo []model.JobItem
+	var iccids []string
+	for _, item := range items {
+		if !jobItemDone(item) {
+			todo = append(todo, item)
+			iccids = append(iccids, item.Iccid)
 		}
+	}
 
-		waitgroup.Wait()
-		for i := 0; i < cap(sem); i++ {
-			sem <- true
+	if err := db.UpdateJobState(job.ID, model.JobRunning, ""); err != nil {
+		return nil, err
+	}
+	logging.With(logging.FieldJob, job.ID, logging.FieldVendor, job.ProfileVendor).Infof("Running %s job, %d of %d items to do.", job.Type, len(todo), len(items))
+
+	options := bulkOptions()
+	options.Name = job.Type
+
+	// While the vendor's SM-DP+ is down, pause instead of failing the
+	// rest of the job, and retry the items that were refused without
+	// anything being sent.  Items refused half way through activation
+	// are failed by the task instead, see activationError.
+	breaker := breakerForVendor(job.ProfileVendor)
+	options.Pause = breaker.Wait
+	options.Requeue = es2plus.IsCircuitOpen
+	options.OnResult = func(result bulk.Result) {
+		item := todo[result.Index]
+		item.State = jobItemState(result.Outcome)
+		item.Output = redactJobOutput(result.Output)
+		item.Error = ""
+		if result.Err != nil {
+			item.Error = result.Err.Error()
+		}
+		item.UpdatedAt = store.Timestamp()
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err := db.UpdateJobItem(&item); err != nil {
+			logging.With(logging.FieldJob, job.ID, logging.FieldIccid, item.Iccid, logging.FieldError, err).Errorf("Couldn't record outcome of job item")
 		}
-		tx.Commit()
+	}
+	summary := bulk.RunIccids(ctx, iccids, task, options)
 
-	case "iccids-bulk-activate":
-		client, err := clientForVendor(db, *bulkActivateIccidsVendor)
+	job.State = model.JobDone
+	if summary.NotAttempted > 0 {
+		job.State = model.JobInterrupted
+	} else if summary.Failed > 0 {
+		job.State = model.JobFailed
+	}
+	job.EndedAt = store.Timestamp()
+	if err := db.UpdateJobState(job.ID, job.State, job.EndedAt); err != nil {
+		return summary, err
+	}
+
+	if job.State != model.JobDone {
+		logging.With(logging.FieldJob, job.ID).Warnf("%d of %d items in job are not done.  Run 'sbm job-resume %d' to retry them.",
+			summary.NotAttempted+summary.Failed, len(items), job.ID)
+	}
+	return summary, nil
+}
+
+// jobTask returns the function processing a single item of a job.
+// Database writes are serialized by the mutex.
+func jobTask(db store.Store, client es2plus.Client, job *model.Job, mutex *sync.Mutex) (func(iccid string) (string, error), error) {
+	switch job.Type {
+	case jobActivateBatch:
+		batch, err := db.GetBatchByName(job.BatchName)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if batch == nil {
+			return nil, fmt.Errorf("no batch found with name '%s'", job.BatchName)
 		}
 
-		file, err := os.Open(*bulkActivateIccidsIccids)
+		// Read the entries afresh, since activation codes may have
+		// been stored since the job was started.
+		entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
+		}
+		entriesByIccid := make(map[string]model.SimEntry, len(entries))
+		for _, entry := range entries {
+			entriesByIccid[entry.Iccid] = entry
 		}
-		defer file.Close()
 
-		scanner := bufio.NewScanner(file)
-		var mutex = &sync.Mutex{}
-		var waitgroup sync.WaitGroup
-		for scanner.Scan() {
-			iccid := scanner.Text()
-			waitgroup.Add(1)
-			go func(i string) {
+		return func(iccid string) (string, error) {
+			entry, ok := entriesByIccid[iccid]
+			if !ok {
+				return "", fmt.Errorf("iccid '%s' is not in batch '%s'", iccid, batch.Name)
+			}
 
-				result, err := client.ActivateIccid(i)
-				if err != nil {
-					panic(err)
-				}
-				mutex.Lock()
-				fmt.Printf("%s, %s\n", i, result.ACToken)
-				mutex.Unlock()
-				waitgroup.Done()
-			}(iccid)
-		}
+			//
+			// Only apply activation if not already noted in the
+			// database.
 
-		waitgroup.Wait()
+			if entry.ActivationCode != "" {
+				return "", bulk.Skip("already has an activation code")
+			}
 
-		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
-		}
+			// Let invocations in flight finish (or time out) even
+			// if we're interrupted.
+			activation, err := client.Activate(context.Background(), iccid, es2plus.OrderParameters{})
+			if err != nil {
+				return "", activationError(activation, err)
+			}
+			result := activation.Status
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err := db.UpdateActivationCode(entry.ID, result.ACToken); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s, %s", iccid, result.ACToken), nil
+		}, nil
+
+	case jobActivateIccids:
+		return func(iccid string) (string, error) {
+			activation, err := client.Activate(context.Background(), iccid, es2plus.OrderParameters{})
+			if err != nil {
+				return "", activationError(activation, err)
+			}
+			return fmt.Sprintf("%s, %s", iccid, activation.Status.ACToken), nil
+		}, nil
 
 	default:
-		return fmt.Errorf("unknown command: '%s'", cmd)
+		return nil, fmt.Errorf("job %d is of unknown type '%s'", job.ID, job.Type)
 	}
+}
 
+// activationError returns the error a job item fails with when
+// activation fails.  A circuit breaker refusing a step after the
+// profile was changed on the SM-DP+ is reported as a plain error, so
+// that the item is failed instead of requeued:  Activation is only
+// requeued when nothing was done.  Resuming the job picks up where the
+// activation stopped.
+func activationError(activation *es2plus.Activation, err error) error {
+	if es2plus.IsCircuitOpen(err) && activation.Changed() {
+		return fmt.Errorf("activation stopped after changing the profile: %s", err)
+	}
+	return err
+}
+
+// checkResumable returns an error if a job is still marked as running,
+// unless forced:  It may still be processed by another worker, and two
+// workers must not process the same items.  A job that wasn't stopped
+// in an orderly fashion is also left marked as running.
+func checkResumable(job *model.Job, force bool) error {
+	if job.State != model.JobRunning {
+		return nil
+	}
+	if !force {
+		return fmt.Errorf("job %d is still marked as running.  If it isn't, resume it with --force", job.ID)
+	}
+	logging.With(logging.FieldJob, job.ID).Warnf("Job is still marked as running, resuming it anyway.")
 	return nil
 }
 
-func checkEs2TargetState(target string) error {
-	if target != "AVAILABLE" {
-		return fmt.Errorf("target ES2+ state unexpected, legal value(s) is(are): 'AVAILABLE'")
+// redactJobOutput returns the output of a job item as recorded with the
+// job.  The activation code, which lets anyone download the profile, is
+// redacted as in traffic logs, so it is only printed.
+func redactJobOutput(output string) string {
+	if i := strings.Index(output, ", "); i >= 0 {
+		return output[:i+2] + es2plus.Redacted
+	}
+	return output
+}
+
+// jobItemState returns the state a job item is left in by an outcome.
+func jobItemState(outcome bulk.Outcome) string {
+	switch outcome {
+	case bulk.Succeeded:
+		return model.JobItemSucceeded
+	case bulk.Skipped:
+		return model.JobItemSkipped
+	default:
+		return model.JobItemFailed
+	}
+}
+
+// jobItemDone returns true if there is nothing more to do for a job item.
+func jobItemDone(item model.JobItem) bool {
+	return item.State == model.JobItemSucceeded || item.State == model.JobItemSkipped
+}
+
+// countJobItems returns the number of job items in each state.
+func countJobItems(items []model.JobItem) map[string]int {
+	counts := make(map[string]int)
+	for _, item := range items {
+		counts[item.State]++
+	}
+	return counts
+}
+
+// printStateCounts prints the number of sim profiles in each state,
+// ordered by state.  Profiles nothing is known about are counted as
+// UNKNOWN.
+func printStateCounts(heading string, entries []model.SimEntry, stateOf func(entry model.SimEntry) string) {
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		state := stateOf(entry)
+		if state == "" {
+			state = "UNKNOWN"
+		}
+		counts[state]++
+	}
+	states := make([]string, 0, len(counts))
+	for state := range counts {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+
+	fmt.Printf("%s, %s\n", heading, "COUNT")
+	for _, state := range states {
+		fmt.Printf("%s, %d\n", state, counts[state])
 	}
+}
+
+// auditTime checks a time given to the audit command, and returns it
+// the way times are recorded in the audit log.
+func auditTime(flag string, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", fmt.Errorf("--%s must be an RFC3339 time, e.g. 2020-01-31T12:00:00Z, not '%s'", flag, value)
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
 
+// printAuditEntries prints entries of the audit log, one per line.  Empty
+// fields, e.g. the old value of a field that was just created, are
+// printed as '*'.
+func printAuditEntries(entries []model.AuditEntry) {
+	orStar := func(value string) string {
+		if value == "" {
+			return "*"
+		}
+		return value
+	}
+	fmt.Printf("%s, %s, %s, %s, %s, %s, %s, %s, %s\n",
+		"TIMESTAMP", "OPERATOR", "ENTITY", "ID", "ICCID", "FIELD", "OLD VALUE", "NEW VALUE", "COMMAND LINE")
+	for _, entry := range entries {
+		fmt.Printf("%s, %s, %s, %d, %s, %s, %s, %s, %s\n",
+			entry.Timestamp, entry.Operator, entry.Entity, entry.EntityID, orStar(entry.Iccid), orStar(entry.Field),
+			orStar(entry.OldValue), orStar(entry.NewValue), entry.CommandLine)
+	}
+}
+
+// profileStateRecorder records the states the SM-DP+ reports sim profiles
+// to be in, and the states ES2+ invocations take them to, in the database.
+// Profiles that aren't in the database are ignored, and failing to record
+// a state is logged, but doesn't fail the invocation.
+type profileStateRecorder struct {
+	db    store.Store
+	mutex sync.Mutex
+}
+
+func (recorder *profileStateRecorder) ProfileStatuses(statuses []es2plus.ProfileStatus) {
+	entries := make([]model.SimEntry, len(statuses))
+	for i, status := range statuses {
+		// Left empty if the SM-DP+ doesn't say when the status was
+		// updated, rather than stamped by a clock it doesn't share.
+		entries[i] = model.SimEntry{
+			Iccid:           status.Iccid,
+			SmdpState:       status.State,
+			Eid:             status.Eid,
+			LockFlag:        status.LockFlag,
+			StatusUpdatedAt: status.StatusLastUpdateTimestamp,
+		}
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if err := recorder.db.UpdateSmdpStatuses(entries); err != nil {
+		logging.With(logging.FieldError, err).Errorf("Couldn't record the states of %d profiles", len(entries))
+	}
+}
+
+func (recorder *profileStateRecorder) ProfileStateChanged(iccid string, state es2plus.ProfileState, eid string) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if err := recorder.db.UpdateSmdpState(iccid, string(state), eid, store.Timestamp()); err != nil {
+		logging.With(logging.FieldIccid, iccid, logging.FieldError, err).Errorf("Couldn't record the state of profile")
+	}
+}
+
+// bulkOptions returns the options used to run bulk operations:  Output
+// on stdout, progress and errors on stderr.
+func bulkOptions() bulk.Options {
+	return bulk.Options{
+		Concurrency: *bulkConcurrency,
+		Output:      os.Stdout,
+		Progress:    logging.With(),
+	}
+}
+
+// configureLogging makes diagnostics go to stderr at the level and in
+// the format asked for.  Payload and header logging imply --debug.
+func configureLogging() error {
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	if *debug || *es2LogPayload || *es2LogHeaders {
+		level = logging.LevelDebug
+	}
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		return err
+	}
+	logging.Configure(os.Stderr, level, format)
 	return nil
 }
 
+// interruptibleContext returns a context that is cancelled the first
+// time the program is interrupted (ctrl-c), so that bulk commands
+// can wind down in an orderly fashion.  A second interrupt terminates
+// the program immediately.
+func interruptibleContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logging.Warnf("Interrupted, waiting for ES2+ invocations in flight to finish.  Interrupt again to terminate immediately.")
+		cancel()
+		<-signals
+		logging.Warnf("Interrupted again, terminating.")
+		os.Exit(130)
+	}()
+	return ctx
+}
+
 ///
 ///    Input batch management
 ///
@@ -911,7 +1910,117 @@ func generateInputFileString(batch *model.Batch) string {
 	return result
 }
 
-func clientForVendor(db *store.SimBatchDB, vendorName string) (es2plus.Client, error) {
+// checkRateLimits checks the ES2+ traffic limits of a profile vendor.
+func checkRateLimits(requestsPerSecond float64, maxInFlight int) error {
+	if requestsPerSecond < 0 {
+		return fmt.Errorf("requests per second can't be negative, was '%v'", requestsPerSecond)
+	}
+	if maxInFlight < 0 {
+		return fmt.Errorf("max number of requests in flight can't be negative, was '%d'", maxInFlight)
+	}
+	return nil
+}
+
+// All the ES2+ traffic to a profile vendor goes through the same
+// circuit breaker, however many clients are talking to it.
+var (
+	breakersMutex sync.Mutex
+	breakers      = make(map[string]*es2plus.CircuitBreaker)
+)
+
+// breakerForVendor returns the circuit breaker for a profile vendor,
+// or nil if circuit breakers are disabled.
+func breakerForVendor(vendorName string) *es2plus.CircuitBreaker {
+	if *breakerFailureRatio <= 0 {
+		return nil
+	}
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	breaker, found := breakers[vendorName]
+	if !found {
+		breaker = es2plus.NewCircuitBreaker(vendorName, es2plus.BreakerPolicy{
+			FailureRatio: *breakerFailureRatio,
+			Window:       *breakerMinRequests,
+			MinRequests:  *breakerMinRequests,
+			OpenDuration: *breakerOpenDuration,
+		})
+		breakers[vendorName] = breaker
+	}
+	return breaker
+}
+
+// All the ES2+ traffic to a profile vendor is sent to the active one
+// of the same set of endpoints, however many clients are talking to it.
+var (
+	endpointSetsMutex sync.Mutex
+	endpointSets      = make(map[string]*es2plus.EndpointSet)
+)
+
+// endpointSetForVendor returns the endpoints of a profile vendor, with
+// the health they had the last time they were used.  Changes in their
+// health are remembered in the database.
+func endpointSetForVendor(db store.Store, vendor *model.ProfileVendor) (*es2plus.EndpointSet, error) {
+	endpointSetsMutex.Lock()
+	defer endpointSetsMutex.Unlock()
+	if set, found := endpointSets[vendor.Name]; found {
+		return set, nil
+	}
+
+	stored, err := db.GetProfileVendorEndpoints(vendor.ID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]int64)
+	endpoints := make([]es2plus.Endpoint, len(stored))
+	for i, endpoint := range stored {
+		endpoints[i].Hostport = fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)
+		endpoints[i].LastError = endpoint.LastError
+		if endpoint.FailedAt != "" {
+			if endpoints[i].FailedAt, err = time.Parse(time.RFC3339, endpoint.FailedAt); err != nil {
+				return nil, fmt.Errorf("endpoint %s of profile vendor '%s' has an unparseable failure time: %s", endpoints[i].Hostport, vendor.Name, err)
+			}
+		}
+		ids[endpoints[i].Hostport] = endpoint.ID
+	}
+
+	set := es2plus.NewEndpointSet(vendor.Name, endpoints, *endpointFailBackAfter, func(endpoint es2plus.Endpoint) {
+		failedAt := ""
+		if !endpoint.FailedAt.IsZero() {
+			failedAt = endpoint.FailedAt.UTC().Format(time.RFC3339)
+		}
+		if err := db.UpdateProfileVendorEndpointHealth(ids[endpoint.Hostport], failedAt, endpoint.LastError); err != nil {
+			logging.With(logging.FieldVendor, vendor.Name, logging.FieldError, err).Errorf("Couldn't record health of endpoint %s", endpoint.Hostport)
+		}
+	})
+	endpointSets[vendor.Name] = set
+	return set, nil
+}
+
+// All the ES2+ traffic to a profile vendor goes through the same
+// rate limiter, however many clients are talking to it.
+var (
+	rateLimitersMutex sync.Mutex
+	rateLimiters      = make(map[string]*es2plus.RateLimiter)
+)
+
+func rateLimiterForVendor(vendor *model.ProfileVendor) *es2plus.RateLimiter {
+	rateLimitersMutex.Lock()
+	defer rateLimitersMutex.Unlock()
+	limiter, found := rateLimiters[vendor.Name]
+	if !found {
+		limiter = es2plus.NewRateLimiter(vendor.Es2PlusRequestsPerSecond, vendor.Es2PlusMaxInFlight)
+		rateLimiters[vendor.Name] = limiter
+	}
+	return limiter
+}
+
+// es2Options are applied to every ES2+ client, after the options
+// given by the profile vendor.
+var es2Options []es2plus.ClientOption
+
+// getProfileVendor returns the named profile vendor, or an error if
+// there is no such vendor.
+func getProfileVendor(db store.Store, vendorName string) (*model.ProfileVendor, error) {
 	vendor, err := db.GetProfileVendorByName(vendorName)
 	if err != nil {
 		return nil, err
@@ -920,12 +2029,296 @@ func clientForVendor(db *store.SimBatchDB, vendorName string) (es2plus.Client, e
 	if vendor == nil {
 		return nil, fmt.Errorf("unknown profile vendor '%s'", vendorName)
 	}
+	return vendor, nil
+}
+
+func clientForVendor(db store.Store, vendorName string) (es2plus.Client, error) {
+	vendor, err := getProfileVendor(db, vendorName)
+	if err != nil {
+		return nil, err
+	}
+	return clientForProfileVendor(db, vendor)
+}
+
+func clientForProfileVendor(db store.Store, vendor *model.ProfileVendor) (es2plus.Client, error) {
+	endpoints, err := endpointSetForVendor(db, vendor)
+	if err != nil {
+		return nil, err
+	}
+
+	dialect, err := es2plus.ParseDialect(vendor.Es2PlusDialect)
+	if err != nil {
+		return nil, fmt.Errorf("profile vendor '%s' has an unusable dialect: %s", vendor.Name, err)
+	}
+
+	retryPolicy := es2plus.DefaultRetryPolicy()
+	retryPolicy.MaxAttempts = *es2MaxAttempts
 
 	hostport := fmt.Sprintf("%s:%d", vendor.Es2PlusHost, vendor.Es2PlusPort)
-	return es2plus.NewClient(vendor.Es2PlusCert, vendor.Es2PlusKey, hostport, vendor.Es2PlusRequesterID), nil
+	options := []es2plus.ClientOption{
+		es2plus.WithVendor(vendor.Name),
+		es2plus.WithMaxIccidsPerRequest(vendor.Es2PlusMaxIccidsPerRequest),
+		es2plus.WithDefaultTimeout(time.Duration(vendor.Es2PlusTimeoutSeconds) * time.Second),
+		es2plus.WithAttemptTimeout(*es2AttemptTimeout),
+		es2plus.WithRetryPolicy(retryPolicy),
+		es2plus.WithServerTrust(es2plus.ServerTrust{
+			CABundlePath:       vendor.Es2PlusCABundle,
+			PinnedSpkiSha256:   vendor.Es2PlusPinnedSpkiSha256,
+			ServerName:         vendor.Es2PlusServerName,
+			InsecureSkipVerify: vendor.Es2PlusInsecureSkipVerify,
+		}),
+		es2plus.WithRateLimiter(rateLimiterForVendor(vendor)),
+		es2plus.WithCircuitBreaker(breakerForVendor(vendor.Name)),
+		es2plus.WithEndpoints(endpoints),
+		es2plus.WithProtocolVersion(vendor.Es2PlusProtocolVersion),
+		es2plus.WithDialect(dialect),
+		es2plus.WithProfileObserver(&profileStateRecorder{db: db}),
+		es2plus.WithPayloadLogging(*es2LogPayload || *debug),
+		es2plus.WithHeaderLogging(*es2LogHeaders || *debug),
+	}
+	options = append(options, es2Options...)
+	return es2plus.NewClient(vendor.Es2PlusCert, vendor.Es2PlusKey, hostport, vendor.Es2PlusRequesterID, options...), nil
+}
+
+// migrateDatabase lists the schema migrations of the database, or
+// migrates it to the requested version.
+func migrateDatabase() error {
+	dsn, err := store.DSNFromEnvironmentVariable("SIM_BATCH_DATABASE")
+	if err != nil {
+		return err
+	}
+	db, err := store.OpenWithoutMigrating(dsn)
+	if err != nil {
+		return fmt.Errorf("couldn't open database.  '%s'", err)
+	}
+	defer db.Close()
+
+	if *dbMigrateStatus {
+		version, err := db.SchemaVersion()
+		if err != nil {
+			return err
+		}
+		statuses, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Schema version %d, latest known by sbm is %d\n", version, store.LatestSchemaVersion())
+		fmt.Printf("%s, %s, %s\n", "VERSION", "APPLIED AT", "DESCRIPTION")
+		for _, status := range statuses {
+			appliedAt := status.AppliedAt
+			if appliedAt == "" {
+				appliedAt = "PENDING"
+			}
+			fmt.Printf("%d, %s, %s\n", status.Version, appliedAt, status.Description)
+		}
+		return nil
+	}
+
+	version := *dbMigrateTo
+	if version < 0 {
+		version = store.LatestSchemaVersion()
+	}
+	if err := db.MigrateTo(version); err != nil {
+		return err
+	}
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Schema version %d\n", current)
+	return nil
+}
+
+// activationCodeToSimulate returns the activation code and the
+// confirmation code the lpa-simulate command should use, given on the
+// command line or read from the profile in the database.
+func activationCodeToSimulate(db store.Store) (*lpa.ActivationCode, string, error) {
+	activationCode := *lpaSimulateActivationCode
+	confirmationCode := *lpaSimulateConfirmation
+	if *lpaSimulateIccid != "" {
+		entry, err := db.GetSimProfileByIccid(*lpaSimulateIccid)
+		if err != nil {
+			return nil, "", err
+		}
+		if entry == nil {
+			return nil, "", fmt.Errorf("no sim profile with iccid '%s'", *lpaSimulateIccid)
+		}
+		if activationCode == "" {
+			activationCode = entry.ActivationCode
+		}
+		if confirmationCode == "" {
+			confirmationCode = entry.ConfirmationCode
+		}
+		if activationCode == "" {
+			return nil, "", fmt.Errorf("sim profile with iccid '%s' has no activation code, has its batch been activated?", *lpaSimulateIccid)
+		}
+	}
+	if activationCode == "" {
+		return nil, "", fmt.Errorf("either --iccid or --activation-code must be given")
+	}
+	code, err := lpa.ParseActivationCode(activationCode)
+	return code, confirmationCode, err
+}
+
+// checkSimulatedSmdp returns an error if the SM-DP+ the LPA simulator
+// is about to contact isn't on this machine, unless told to go ahead
+// anyway:  The simulator only works against the es2plustest stand-in.
+func checkSimulatedSmdp(address string, allowAny bool) error {
+	if allowAny {
+		return nil
+	}
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return nil
+	}
+	return fmt.Errorf("the LPA simulator only works against the es2plustest SM-DP+ stand-in, not '%s'.  Give --smdp-address to reach the stand-in, or --allow-any-smdp", address)
+}
+
+// protocolVersionToSimulate returns the SGP.22 version the lpa-simulate
+// command should claim: the one given on the command line, or the one
+// configured for the vendor of the profile given by --iccid.
+func protocolVersionToSimulate(db store.Store) (string, error) {
+	version := *lpaSimulateProtocol
+	if version == "" && *lpaSimulateIccid != "" {
+		entry, err := db.GetSimProfileByIccid(*lpaSimulateIccid)
+		if err != nil {
+			return "", err
+		}
+		if entry != nil {
+			batch, err := db.GetBatchByID(entry.BatchID)
+			if err != nil {
+				return "", err
+			}
+			if batch != nil {
+				vendor, err := db.GetProfileVendorByName(batch.ProfileVendor)
+				if err != nil {
+					return "", err
+				}
+				if vendor != nil {
+					version = vendor.Es2PlusProtocolVersion
+				}
+			}
+		}
+	}
+	if version == "" {
+		return es2plus.DefaultProtocolVersion, nil
+	}
+	return version, es2plus.ValidateProtocolVersion(version)
+}
+
+// checkVendorCertificate reads the client certificate of a profile
+// vendor, and returns its serial number, expiry, the number of days
+// left until it expires, and "OK" unless it expires within the given
+// number of days, or something else is wrong with it.
+func checkVendorCertificate(vendor model.ProfileVendor, days int) (string, string, string, string) {
+	logger := logging.With(logging.FieldVendor, vendor.Name)
+	cert, err := es2plus.LoadClientCertificate(vendor.Es2PlusCert, vendor.Es2PlusKey)
+	if err != nil {
+		logger.With(logging.FieldError, err).Errorf("Can't use client certificate")
+		return vendor.Es2PlusCertSerial, vendor.Es2PlusCertNotAfter, "", "UNREADABLE"
+	}
+
+	serial := cert.Serial
+	notAfter := cert.NotAfter.UTC().Format(time.RFC3339)
+	left := time.Until(cert.NotAfter)
+	daysLeft := strconv.Itoa(int(left.Hours() / 24))
+	validityErr := cert.Validate(time.Now())
+	switch {
+	case vendor.Es2PlusCertSerial != "" && vendor.Es2PlusCertSerial != cert.Serial:
+		logger.Warnf("Client certificate '%s' has serial %s, not %s as recorded.  Use profile-vendor-rotate-cert to replace certificates.",
+			vendor.Es2PlusCert, cert.Serial, vendor.Es2PlusCertSerial)
+		return serial, notAfter, daysLeft, "REPLACED"
+	case validityErr != nil:
+		logger.With(logging.FieldError, validityErr).Errorf("Client certificate is not valid")
+		return serial, notAfter, daysLeft, "INVALID"
+	case left < time.Duration(days)*24*time.Hour:
+		logger.Warnf("Client certificate (serial %s) expires in %s days, at %s", serial, daysLeft, notAfter)
+		return serial, notAfter, daysLeft, "EXPIRING"
+	}
+	return serial, notAfter, daysLeft, "OK"
+}
+
+// rotateVendorCertificate records the new certificate of a profile
+// vendor, but only if the SM-DP+ accepts it:  The client, which uses the
+// new certificate, must get an answer to a getProfileStatus request for
+// the test ICCID.
+func rotateVendorCertificate(ctx context.Context, db store.Store, client es2plus.Client, rotated *model.ProfileVendor, testIccid string) error {
+	if _, err := client.GetStatusContext(ctx, testIccid); err != nil && !isExecutedBySmdp(err) {
+		return fmt.Errorf("the new certificate didn't work with the SM-DP+ of profile vendor '%s', keeping the old one: %s", rotated.Name, err)
+	}
+	return db.UpdateProfileVendorCertificate(rotated)
+}
+
+// isExecutedBySmdp is true if an error is a function execution status
+// reported by the SM-DP+, meaning it accepted the request as coming from
+// us, if not what was asked for.  Refusing us as function requester is
+// how an SM-DP+ turns away a certificate it doesn't map to us, so that
+// doesn't count.
+func isExecutedBySmdp(err error) bool {
+	es2Err, ok := err.(*es2plus.Error)
+	return ok && es2Err.Status != "" && es2Err.HTTPStatusCode >= 200 && es2Err.HTTPStatusCode <= 299 && !es2Err.IsAuthFailure()
+}
+
+// orderParameters checks the syntax of the optional downloadOrder and
+// confirmOrder parameters given on the command line.
+func orderParameters(eid string, profileType string, matchingID string, confirmationCode string, smdsAddress string, release bool) (es2plus.OrderParameters, error) {
+	params := es2plus.OrderParameters{
+		Eid:              eid,
+		ProfileType:      profileType,
+		MatchingID:       matchingID,
+		ConfirmationCode: confirmationCode,
+		SmdsAddress:      smdsAddress,
+		NoRelease:        !release,
+	}
+	if eid != "" && !fieldsyntaxchecks.IsEID(eid) {
+		return params, fmt.Errorf("not a valid EID: '%s'.  Must be 32 digits", eid)
+	}
+	if profileType != "" && !fieldsyntaxchecks.IsProfileName(profileType) {
+		return params, fmt.Errorf("not a valid profile type: '%s'.  Must be uppercase characters, numbers and underscores", profileType)
+	}
+	if matchingID != "" && !fieldsyntaxchecks.IsMatchingID(matchingID) {
+		return params, fmt.Errorf("not a valid matching ID: '%s'.  Must be uppercase characters, numbers and dashes", matchingID)
+	}
+	if strings.ContainsAny(smdsAddress, " \t/:") {
+		return params, fmt.Errorf("not a valid SM-DS address: '%s'.  Must be a host name", smdsAddress)
+	}
+	return params, nil
+}
+
+// storeOrderParameters records the matching ID and confirmation code
+// a profile was ordered with, if the profile is in the database.
+func storeOrderParameters(db store.Store, iccid string, matchingID string, confirmationCode string) error {
+	entry, err := db.GetSimProfileByIccid(iccid)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		logging.With(logging.FieldIccid, iccid).Warnf("ICCID is not in the database, not storing its matching ID and confirmation code")
+		return nil
+	}
+	return db.UpdateOrderParameters(entry.ID, matchingID, confirmationCode)
+}
+
+// logClientStats reports the number of retried ES2+ invocations, the
+// effective throughput and the time spent throttled at the end of a
+// bulk command.
+func logClientStats(client es2plus.Client, vendorName string) {
+	logger := logging.With(logging.FieldVendor, vendorName)
+	logger.Infof("Retried %d ES2+ invocations", client.RetryCount())
+
+	rateLimitersMutex.Lock()
+	limiter := rateLimiters[vendorName]
+	rateLimitersMutex.Unlock()
+	if limiter != nil {
+		logger.Infof("Sent %d ES2+ requests, %.1f requests per second, throttled for %v in total",
+			limiter.Requests(), limiter.Throughput(), limiter.ThrottledTime().Round(time.Millisecond))
+	}
 }
 
-func clientForBatch(db *store.SimBatchDB, batchName string) (es2plus.Client, *model.Batch, error) {
+func clientForBatch(db store.Store, batchName string) (es2plus.Client, *model.Batch, error) {
 
 	batch, err := db.GetBatchByName(batchName)
 	if err != nil {
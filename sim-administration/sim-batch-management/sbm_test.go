@@ -0,0 +1,689 @@
+package main
+
+import (
+	"context"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/bulk"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/es2plus"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/es2plus/es2plustest"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/lpa"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/store"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDatabase returns a fresh database containing a profile vendor
+// and a batch of twenty profiles, and a function that cleans it up.
+func newTestDatabase(t *testing.T) (*store.SimBatchDB, *model.Batch, func()) {
+	dir, err := ioutil.TempDir("", "sbm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := store.OpenFileSqliteDatabase(filepath.Join(dir, "sbm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.GenerateTables(); err != nil {
+		t.Fatal(err)
+	}
+
+	vendor := &model.ProfileVendor{
+		Name:               "Durian",
+		Es2PlusCert:        "cert",
+		Es2PlusKey:         "key",
+		Es2PlusHost:        "host",
+		Es2PlusPort:        4711,
+		Es2PlusRequesterID: "1.2.3",
+	}
+	if err := db.CreateProfileVendor(vendor); err != nil {
+		t.Fatal(err)
+	}
+
+	batch, err := db.DeclareBatch(
+		"TestBatch",
+		true,
+		"Customer",
+		"1",
+		"20191201",
+		"894700000000001000",
+		"894700000000001019",
+		"242017100012000",
+		"242017100012019",
+		"4790010000",
+		"4790010019",
+		"BAR_FOOTEL_STD",
+		"20",
+		"M1",
+		"localhost",
+		"8080",
+		"Durian",
+		"ACTIVATED")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db, batch, func() {
+		_ = db.Db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestActivateAllProfilesInBatch(t *testing.T) {
+	db, batch, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	smdp := es2plustest.NewServer()
+	defer smdp.Close()
+	if err := smdp.SeedFromBatch(db, batch.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := activateAllProfilesInBatch(context.Background(), db, smdp.NewClient(), batch); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 20, len(entries))
+	for _, entry := range entries {
+		profile := smdp.Profile(entry.Iccid)
+		assert.Equal(t, es2plustest.StateReleased, profile.State)
+		assert.Equal(t, profile.ACToken, entry.ActivationCode)
+	}
+	assert.Equal(t, 20, smdp.Calls("downloadOrder"))
+	assert.Equal(t, 20, smdp.Calls("confirmOrder"))
+
+	// Running it again shouldn't touch the SM-DP+, since all the
+	// profiles already have activation codes.
+	if err := activateAllProfilesInBatch(context.Background(), db, smdp.NewClient(), batch); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 20, smdp.Calls("downloadOrder"))
+}
+
+func TestActivateAllProfilesInBatchSurvivesTransientFaults(t *testing.T) {
+	db, batch, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	smdp := es2plustest.NewServer()
+	defer smdp.Close()
+	if err := smdp.SeedFromBatch(db, batch.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only faults guaranteeing that nothing was done are retried, since
+	// neither downloadOrder nor confirmOrder is idempotent.
+	smdp.InjectFault(es2plustest.Fault{Function: "downloadOrder", HTTPStatus: 429, Times: 3})
+	smdp.InjectFault(es2plustest.Fault{Function: "confirmOrder", HTTPStatus: 429, Latency: 10 * time.Millisecond, Times: 3})
+
+	client := smdp.NewClient(es2plus.WithRetryPolicy(es2plus.RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+		Multiplier:     2.0,
+	}))
+	if err := activateAllProfilesInBatch(context.Background(), db, client, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		assert.Assert(t, entry.ActivationCode != "", "no activation code for %s", entry.Iccid)
+	}
+	assert.Equal(t, int64(6), client.RetryCount())
+}
+
+func TestActivateAllProfilesInBatchStopsWhenInterrupted(t *testing.T) {
+	db, batch, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	smdp := es2plustest.NewServer()
+	defer smdp.Close()
+	if err := smdp.SeedFromBatch(db, batch.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := activateAllProfilesInBatch(ctx, db, smdp.NewClient(), batch)
+	assert.Assert(t, err != nil)
+	assert.Equal(t, 0, smdp.Calls("downloadOrder"))
+}
+
+func TestActivationTellsWhetherTheProfileWasOrdered(t *testing.T) {
+	db, batch, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	smdp := es2plustest.NewServer()
+	defer smdp.Close()
+	if err := smdp.SeedFromBatch(db, batch.Name); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iccid := entries[0].Iccid
+	client := smdp.NewClient()
+
+	activation, err := client.Activate(context.Background(), iccid, es2plus.OrderParameters{MatchingID: "ABC-123"})
+	assert.NilError(t, err)
+	assert.Assert(t, activation.Ordered && activation.Changed())
+	assert.Assert(t, activation.Confirmed != nil)
+	assert.Equal(t, "LPA:1$smdp.example.com$ABC-123", activation.Status.ACToken)
+
+	// The profile is ready, so the order parameters of a second
+	// activation are never sent, and mustn't be recorded.
+	activation, err = client.Activate(context.Background(), iccid, es2plus.OrderParameters{MatchingID: "XYZ-999"})
+	assert.NilError(t, err)
+	assert.Assert(t, !activation.Changed())
+	assert.Assert(t, activation.Confirmed == nil)
+	assert.Equal(t, "LPA:1$smdp.example.com$ABC-123", activation.Status.ACToken)
+	assert.Equal(t, 1, smdp.Calls("confirmOrder"))
+}
+
+func TestActivateIccidWithOrderParameters(t *testing.T) {
+	db, batch, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	smdp := es2plustest.NewServer()
+	defer smdp.Close()
+	if err := smdp.SeedFromBatch(db, batch.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iccid := entries[0].Iccid
+
+	params, err := orderParameters("89049032123451234512345678901235", "BAR_FOOTEL_STD", "ABC-123", "4711", "smds.example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := smdp.NewClient().ActivateIccid(iccid, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "LPA:1$smdp.example.com$ABC-123", result.ACToken)
+
+	profile := smdp.Profile(iccid)
+	assert.Equal(t, es2plustest.StateConfirmed, profile.State)
+	assert.Equal(t, "89049032123451234512345678901235", profile.Eid)
+	assert.Equal(t, "BAR_FOOTEL_STD", profile.ProfileType)
+	assert.Equal(t, "4711", profile.ConfirmationCode)
+
+	if err := storeOrderParameters(db, iccid, params.MatchingID, params.ConfirmationCode); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := db.GetSimProfileByIccid(iccid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ABC-123", entry.MatchingID)
+	assert.Equal(t, "4711", entry.ConfirmationCode)
+
+	// Unknown ICCIDs are tolerated, there is just nothing to update.
+	assert.NilError(t, storeOrderParameters(db, "8947000000000009999", "ABC-124", ""))
+}
+
+func TestOrderParametersAreValidated(t *testing.T) {
+	_, err := orderParameters("", "", "", "", "", true)
+	assert.NilError(t, err)
+
+	_, err = orderParameters("8904903212345", "", "", "", "", true)
+	assert.Assert(t, err != nil)
+	_, err = orderParameters("", "bar footel", "", "", "", true)
+	assert.Assert(t, err != nil)
+	_, err = orderParameters("", "", "abc 123", "", "", true)
+	assert.Assert(t, err != nil)
+	_, err = orderParameters("", "", "", "", "https://smds.example.com/", true)
+	assert.Assert(t, err != nil)
+}
+
+func TestStagedOrderCanBeReleased(t *testing.T) {
+	db, batch, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	smdp := es2plustest.NewServer()
+	defer smdp.Close()
+	if err := smdp.SeedFromBatch(db, batch.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iccid := entries[0].Iccid
+
+	client := smdp.NewClient()
+	if _, err := client.ActivateIccid(iccid, es2plus.OrderParameters{NoRelease: true}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, es2plustest.StateConfirmed, smdp.Profile(iccid).State)
+
+	if _, err := client.ReleaseProfile(iccid); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, es2plustest.StateReleased, smdp.Profile(iccid).State)
+
+	// Releasing twice is refused without bothering the SM-DP+.
+	_, err = client.ReleaseProfile(iccid)
+	_, ok := err.(*es2plus.IllegalTransitionError)
+	assert.Assert(t, ok, "expected *es2plus.IllegalTransitionError, got %v", err)
+	assert.Equal(t, 1, smdp.Calls("releaseProfile"))
+}
+
+func TestProfileStatesAreRecorded(t *testing.T) {
+	db, batch, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	smdp := es2plustest.NewServer()
+	defer smdp.Close()
+	if err := smdp.SeedFromBatch(db, batch.Name); err != nil {
+		t.Fatal(err)
+	}
+	client := smdp.NewClient(es2plus.WithProfileObserver(&profileStateRecorder{db: db}))
+
+	entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iccid := entries[0].Iccid
+	if _, err := client.ActivateIccid(iccid, es2plus.OrderParameters{NoRelease: true}); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := db.GetSimProfileByIccid(iccid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(es2plustest.StateConfirmed), entry.SmdpState)
+	assert.Assert(t, entry.StateChangedAt != "")
+
+	if _, err := client.ReleaseProfile(iccid); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err = db.GetSimProfileByIccid(iccid); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(es2plustest.StateReleased), entry.SmdpState)
+
+	if err := activateAllProfilesInBatch(context.Background(), db, client, batch); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = db.GetAllSimEntriesForBatch(batch.BatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		assert.Equal(t, string(es2plustest.StateReleased), entry.SmdpState, entry.Iccid)
+	}
+}
+
+func TestActivateAllProfilesInBatchReportsPartialFailure(t *testing.T) {
+	db, batch, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	smdp := es2plustest.NewServer()
+	defer smdp.Close()
+	if err := smdp.SeedFromBatch(db, batch.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := entries[7].Iccid
+	smdp.InjectFault(es2plustest.Fault{
+		Function: "downloadOrder",
+		Iccid:    broken,
+		StatusCodeData: &es2plus.StatusCodeData{
+			SubjectCode: es2plus.SubjectProfileIccid,
+			ReasonCode:  es2plus.ReasonInvalidTransition,
+			Message:     "Profile is broken",
+		},
+	})
+
+	err = activateAllProfilesInBatch(context.Background(), db, smdp.NewClient(), batch)
+	bulkErr, ok := err.(*bulk.Error)
+	assert.Assert(t, ok, "expected *bulk.Error, got %v", err)
+	assert.Equal(t, bulk.ExitPartialFailure, bulkErr.ExitCode())
+	assert.Equal(t, 19, bulkErr.Summary.Succeeded)
+	assert.DeepEqual(t, []string{broken}, bulkErr.Summary.Items(bulk.Failed))
+
+	// The rest of the batch was activated anyway, and a second run
+	// only retries the one that failed.
+	smdp.ClearFaults()
+	if err := activateAllProfilesInBatch(context.Background(), db, smdp.NewClient(), batch); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 21, smdp.Calls("downloadOrder"))
+}
+
+func TestInterruptedJobCanBeResumed(t *testing.T) {
+	db, batch, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	smdp := es2plustest.NewServer()
+	defer smdp.Close()
+	if err := smdp.SeedFromBatch(db, batch.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := entries[3].Iccid
+	smdp.InjectFault(es2plustest.Fault{
+		Function: "downloadOrder",
+		Iccid:    broken,
+		StatusCodeData: &es2plus.StatusCodeData{
+			SubjectCode: es2plus.SubjectProfileIccid,
+			ReasonCode:  es2plus.ReasonInvalidTransition,
+			Message:     "Profile is broken",
+		},
+	})
+
+	err = activateAllProfilesInBatch(context.Background(), db, smdp.NewClient(), batch)
+	assert.Assert(t, err != nil)
+
+	// The outcome of every item was recorded with the job.
+	jobs, err := db.GetAllJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(jobs))
+	job := jobs[0]
+	assert.Equal(t, model.JobFailed, job.State)
+	assert.Equal(t, jobActivateBatch, job.Type)
+	assert.Equal(t, batch.Name, job.BatchName)
+	assert.Assert(t, job.EndedAt != "")
+
+	items, err := db.GetJobItems(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := countJobItems(items)
+	assert.Equal(t, 19, counts[model.JobItemSucceeded])
+	assert.Equal(t, 1, counts[model.JobItemFailed])
+
+	// Resuming only retries the item that failed.
+	smdp.ClearFaults()
+	summary, err := runJob(context.Background(), db, smdp.NewClient(), &job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NilError(t, summary.Err())
+	assert.Equal(t, 1, len(summary.Results))
+	assert.Equal(t, broken, summary.Results[0].Item)
+	assert.Equal(t, 21, smdp.Calls("downloadOrder"))
+
+	resumed, err := db.GetJobByID(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, model.JobDone, resumed.State)
+	items, err = db.GetJobItems(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 20, countJobItems(items)[model.JobItemSucceeded])
+
+	// Activation codes are only printed, not recorded with the job.
+	for _, item := range items {
+		assert.Equal(t, item.Iccid+", "+es2plus.Redacted, item.Output)
+	}
+}
+
+func TestOnlyActivationsThatChangedNothingAreRequeued(t *testing.T) {
+	refused := &es2plus.CircuitOpenError{}
+	assert.Assert(t, es2plus.IsCircuitOpen(activationError(&es2plus.Activation{}, refused)))
+	assert.Assert(t, !es2plus.IsCircuitOpen(activationError(&es2plus.Activation{Ordered: true}, refused)))
+	assert.Assert(t, !es2plus.IsCircuitOpen(activationError(&es2plus.Activation{Confirmed: &es2plus.ConfirmOrderResponse{}}, refused)))
+}
+
+func TestRunningJobIsOnlyResumedWhenForced(t *testing.T) {
+	job := &model.Job{ID: 42, State: model.JobRunning}
+	assert.ErrorContains(t, checkResumable(job, false), "--force")
+	assert.NilError(t, checkResumable(job, true))
+
+	job.State = model.JobInterrupted
+	assert.NilError(t, checkResumable(job, false))
+}
+
+func TestCertificateRefusedBySmdpIsNotRotatedIn(t *testing.T) {
+	db, _, cleanup := newTestDatabase(t)
+	defer cleanup()
+	smdp := es2plustest.NewServer()
+	defer smdp.Close()
+
+	vendor, err := db.GetProfileVendorByName("Durian")
+	assert.NilError(t, err)
+	rotated := *vendor
+	rotated.Es2PlusCert = "new-cert"
+	rotated.Es2PlusKey = "new-key"
+	rotated.Es2PlusCertSerial = "4711"
+
+	// The SM-DP+ doesn't map the certificate to us.
+	smdp.InjectFault(es2plustest.Fault{
+		Function:       "getProfileStatus",
+		StatusCodeData: &es2plus.StatusCodeData{SubjectCode: es2plus.SubjectFunctionRequester, ReasonCode: es2plus.ReasonNotAllowed},
+	})
+	err = rotateVendorCertificate(context.Background(), db, smdp.NewClient(), &rotated, "8947000000000000001")
+	assert.ErrorContains(t, err, "keeping the old one")
+	kept, err := db.GetProfileVendorByName("Durian")
+	assert.NilError(t, err)
+	assert.Equal(t, "cert", kept.Es2PlusCert)
+
+	// The SM-DP+ not knowing the test ICCID still means it accepted us.
+	smdp.ClearFaults()
+	assert.NilError(t, rotateVendorCertificate(context.Background(), db, smdp.NewClient(), &rotated, "8947000000000000001"))
+	changed, err := db.GetProfileVendorByName("Durian")
+	assert.NilError(t, err)
+	assert.Equal(t, "new-cert", changed.Es2PlusCert)
+	assert.Equal(t, "4711", changed.Es2PlusCertSerial)
+}
+
+func TestJobPausesWhileCircuitBreakerIsOpen(t *testing.T) {
+	db, batch, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	smdp := es2plustest.NewServer()
+	defer smdp.Close()
+	if err := smdp.SeedFromBatch(db, batch.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	// Process one item at a time, and let the breaker open after four
+	// failures in a row.
+	defer func(concurrency int, ratio float64, minRequests int, openDuration time.Duration) {
+		*bulkConcurrency, *breakerFailureRatio, *breakerMinRequests, *breakerOpenDuration = concurrency, ratio, minRequests, openDuration
+	}(*bulkConcurrency, *breakerFailureRatio, *breakerMinRequests, *breakerOpenDuration)
+	*bulkConcurrency, *breakerFailureRatio, *breakerMinRequests, *breakerOpenDuration = 1, 0.5, 4, 100*time.Millisecond
+	breaker := breakerForVendor(batch.ProfileVendor)
+	defer func() {
+		breakersMutex.Lock()
+		delete(breakers, batch.ProfileVendor)
+		breakersMutex.Unlock()
+	}()
+
+	// The SM-DP+ is down until the breaker opens.
+	smdp.InjectFault(es2plustest.Fault{Function: "getProfileStatus", HTTPStatus: http.StatusServiceUnavailable})
+	go func() {
+		for breaker.State() != "open" {
+			time.Sleep(time.Millisecond)
+		}
+		smdp.ClearFaults()
+	}()
+
+	err := activateAllProfilesInBatch(context.Background(), db, smdp.NewClient(es2plus.WithCircuitBreaker(breaker)), batch)
+	bulkErr, ok := err.(*bulk.Error)
+	assert.Assert(t, ok, "expected *bulk.Error, got %v", err)
+
+	// Only the items processed before the breaker opened failed, the
+	// rest of the job waited for the SM-DP+ to come back.
+	assert.Equal(t, 4, bulkErr.Summary.Failed)
+	assert.Equal(t, 16, bulkErr.Summary.Succeeded)
+	assert.Equal(t, "closed", breaker.State())
+}
+
+// newTestSimulator returns an LPA simulator talking to the fake SM-DP+,
+// which has been told its address.
+func newTestSimulator(t *testing.T, smdp *es2plustest.Server) *lpa.Simulator {
+	smdp.SmdpAddress = strings.TrimPrefix(smdp.URL, "https://")
+	euicc, err := lpa.NewEUICC("89049032123451234512345678901235")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &lpa.Simulator{HTTPClient: smdp.Client(), EUICC: euicc}
+}
+
+func TestLpaSimulatorInstallsActivatedProfile(t *testing.T) {
+	db, batch, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	smdp := es2plustest.NewServer()
+	defer smdp.Close()
+	simulator := newTestSimulator(t, smdp)
+	if err := smdp.SeedFromBatch(db, batch.Name); err != nil {
+		t.Fatal(err)
+	}
+	if err := activateAllProfilesInBatch(context.Background(), db, smdp.NewClient(), batch); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iccid := entries[0].Iccid
+	*lpaSimulateIccid = iccid
+	defer func() { *lpaSimulateIccid = "" }()
+	code, confirmationCode, err := activationCodeToSimulate(db)
+	assert.NilError(t, err)
+	assert.Equal(t, "", confirmationCode)
+
+	result, err := simulator.Download(context.Background(), *code, confirmationCode)
+	assert.NilError(t, err)
+	assert.Equal(t, iccid, result.Iccid)
+	profile := smdp.Profile(iccid)
+	assert.Equal(t, es2plustest.StateInstalled, profile.State)
+	assert.Equal(t, simulator.EUICC.Eid, profile.Eid)
+	assert.Equal(t, 1, smdp.Calls(lpa.StepHandleNotification))
+
+	// The profile can't be downloaded twice.
+	_, err = simulator.Download(context.Background(), *code, confirmationCode)
+	stepErr, ok := err.(*lpa.StepError)
+	assert.Assert(t, ok, "%v is not a step error", err)
+	assert.Equal(t, lpa.StepAuthenticateClient, stepErr.Step)
+	assert.ErrorContains(t, err, "3.5")
+}
+
+// roundTripperFunc lets a function be used as an http.RoundTripper.
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestLpaSimulatorClaimsTheConfiguredProtocolVersion(t *testing.T) {
+	smdp := es2plustest.NewServer()
+	defer smdp.Close()
+	simulator := newTestSimulator(t, smdp)
+	var claimed []string
+	transport := simulator.HTTPClient.Transport
+	simulator.HTTPClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		claimed = append(claimed, req.Header.Get("X-Admin-Protocol"))
+		return transport.RoundTrip(req)
+	})}
+
+	defer func() { *lpaSimulateProtocol = "" }()
+	*lpaSimulateProtocol = "2.1.0"
+	version, err := protocolVersionToSimulate(nil)
+	assert.NilError(t, err)
+	simulator.ProtocolVersion = version
+	_, _ = simulator.Download(context.Background(), lpa.ActivationCode{SmdpAddress: smdp.SmdpAddress, MatchingID: "NO-SUCH-PROFILE"}, "")
+	assert.Assert(t, len(claimed) > 0)
+	assert.Equal(t, "gsma/rsp/v2.1.0", claimed[0])
+
+	*lpaSimulateProtocol = "3.0"
+	_, err = protocolVersionToSimulate(nil)
+	assert.ErrorContains(t, err, "not a supported ES2+ protocol version")
+}
+
+func TestLpaSimulatorOnlyContactsTheStandIn(t *testing.T) {
+	assert.NilError(t, checkSimulatedSmdp("localhost:8443", false))
+	assert.NilError(t, checkSimulatedSmdp("127.0.0.1:8443", false))
+	assert.NilError(t, checkSimulatedSmdp("[::1]:8443", false))
+	assert.ErrorContains(t, checkSimulatedSmdp("smdp.example.com", false), "--allow-any-smdp")
+	assert.NilError(t, checkSimulatedSmdp("smdp.example.com", true))
+}
+
+func TestLpaSimulatorReportsFailingStep(t *testing.T) {
+	db, batch, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	smdp := es2plustest.NewServer()
+	defer smdp.Close()
+	simulator := newTestSimulator(t, smdp)
+	if err := smdp.SeedFromBatch(db, batch.Name); err != nil {
+		t.Fatal(err)
+	}
+	iccid := "8947000000000010003"
+	params, err := orderParameters("", "BAR_FOOTEL_STD", "ABC-123", "4711", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := smdp.NewClient().ActivateIccid(iccid, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := lpa.ParseActivationCode(result.ACToken)
+	assert.NilError(t, err)
+
+	stepOf := func(err error) string {
+		stepErr, ok := err.(*lpa.StepError)
+		assert.Assert(t, ok, "%v is not a step error", err)
+		return stepErr.Step
+	}
+
+	unknown := *code
+	unknown.MatchingID = "ABC-999"
+	_, err = simulator.Download(context.Background(), unknown, "4711")
+	assert.Equal(t, lpa.StepAuthenticateClient, stepOf(err))
+	assert.ErrorContains(t, err, "Unknown matching ID")
+
+	_, err = simulator.Download(context.Background(), *code, "")
+	assert.Equal(t, lpa.StepGetBoundProfilePackage, stepOf(err))
+	assert.ErrorContains(t, err, "requires a confirmation code")
+
+	_, err = simulator.Download(context.Background(), *code, "1234")
+	assert.Equal(t, lpa.StepGetBoundProfilePackage, stepOf(err))
+	assert.ErrorContains(t, err, "Wrong confirmation code")
+
+	smdp.InjectFault(es2plustest.Fault{Function: lpa.StepHandleNotification, HTTPStatus: http.StatusInternalServerError, Times: 1})
+	_, err = simulator.Download(context.Background(), *code, "4711")
+	assert.Equal(t, lpa.StepHandleNotification, stepOf(err))
+	assert.Equal(t, es2plustest.StateDownloaded, smdp.Profile(iccid).State)
+
+	wrongAddress := *code
+	wrongAddress.SmdpAddress = "smdp.example.org"
+	simulator.SmdpAddress = smdp.SmdpAddress
+	_, err = simulator.Download(context.Background(), wrongAddress, "4711")
+	assert.Equal(t, lpa.StepInitiateAuthentication, stepOf(err))
+}
@@ -0,0 +1,265 @@
+package store
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"os"
+	"os/user"
+	"reflect"
+	"strings"
+	"time"
+)
+
+///
+///  The audit log
+///
+
+// The entities whose changes are recorded in the audit log.
+const (
+	AuditEntityBatch                 = "BATCH"
+	AuditEntitySimProfile            = "SIM_PROFILE"
+	AuditEntityProfileVendor         = "PROFILE_VENDOR"
+	AuditEntityProfileVendorEndpoint = "PROFILE_VENDOR_ENDPOINT"
+)
+
+// Fields holding secrets.  Only whether they were set is recorded, so
+// that the audit log tells when a secret changed without revealing it.
+// Not even hashes are recorded, as matching IDs and confirmation codes
+// are short enough to be guessed from theirs.
+var auditSecretFields = map[string]bool{
+	"ki":               true,
+	"activationCode":   true,
+	"matchingId":       true,
+	"confirmationCode": true,
+}
+
+// Fields that change along with others, and would only add noise to the
+// audit log.
+var auditIgnoredFields = map[string]bool{
+	"id":              true,
+	"statusUpdatedAt": true,
+	"stateChangedAt":  true,
+}
+
+// Flags whose values are secrets, and are left out of the command lines
+// recorded in the audit log.
+var auditSecretFlags = []string{"--activation-code", "--matching-id", "--confirmation-code"}
+
+// AuditCommandLine is the command line recorded with the changes made
+// by this process.
+var AuditCommandLine = redactedCommandLine(os.Args)
+
+// AuditOperator is the user recorded as having made the changes made by
+// this process.
+var AuditOperator = currentUser()
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// Timestamp returns the current time the way timestamps are stored in
+// the database:  RFC3339, in UTC.
+func Timestamp() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+func redactedCommandLine(args []string) string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i, arg := range redacted {
+		for _, flag := range auditSecretFlags {
+			if arg == flag && i+1 < len(redacted) {
+				redacted[i+1] = auditRedacted
+			} else if strings.HasPrefix(arg, flag+"=") {
+				redacted[i] = flag + "=" + auditRedacted
+			}
+		}
+	}
+	return strings.Join(redacted, " ")
+}
+
+// auditRedacted is recorded in place of secrets.
+const auditRedacted = "***"
+
+// auditValue is what is recorded about the value of a field.
+func auditValue(field string, value string) string {
+	if !auditSecretFields[field] || value == "" {
+		return value
+	}
+	return auditRedacted
+}
+
+// writeAuditLog appends entries to the audit log, stamped with the
+// command line, the operator and the current time.
+func writeAuditLog(ext sqlx.Ext, entries ...model.AuditEntry) error {
+	now := Timestamp()
+	for _, entry := range entries {
+		entry.CommandLine = AuditCommandLine
+		entry.Operator = AuditOperator
+		entry.Timestamp = now
+		_, err := namedExec(ext, `
+       INSERT INTO AUDIT_LOG (entity,  entityID,  batchID,  iccid,  field,  oldValue,  newValue,  commandLine,  operator,  timestamp)
+                      VALUES (:entity, :entityID, :batchID, :iccid, :field, :oldValue, :newValue, :commandLine, :operator, :timestamp)`,
+			entry)
+		if err != nil {
+			return fmt.Errorf("failed to write audit log '%s'", err)
+		}
+	}
+	return nil
+}
+
+// auditCreation records the creation of an entity, described by what it
+// is known as, e.g. its name or ICCID.
+func auditCreation(ext sqlx.Ext, entity string, row interface{}, description string) error {
+	entry := auditSubject(entity, row)
+	entry.NewValue = description
+	return writeAuditLog(ext, entry)
+}
+
+// auditDeletion records the deletion of an entity, described by what it
+// was known as.
+func auditDeletion(ext sqlx.Ext, entity string, row interface{}, description string) error {
+	entry := auditSubject(entity, row)
+	entry.OldValue = description
+	return writeAuditLog(ext, entry)
+}
+
+// auditSubject returns an audit entry naming the row of an entity, and
+// the batch and ICCID it belongs to, if any.
+func auditSubject(entity string, row interface{}) model.AuditEntry {
+	fields := auditFields(row)
+	entry := model.AuditEntry{Entity: entity, Iccid: fields["iccid"]}
+	fmt.Sscan(fields["id"], &entry.EntityID)
+	switch entity {
+	case AuditEntityBatch:
+		entry.BatchID = entry.EntityID
+	case AuditEntitySimProfile:
+		fmt.Sscan(fields["batchID"], &entry.BatchID)
+	}
+	return entry
+}
+
+// auditFields returns the values of the columns of a row read into a
+// struct, by column name.
+func auditFields(row interface{}) map[string]string {
+	value := reflect.Indirect(reflect.ValueOf(row))
+	fields := map[string]string{}
+	for i := 0; i < value.NumField(); i++ {
+		column := value.Type().Field(i).Tag.Get("db")
+		if column != "" {
+			fields[column] = fmt.Sprint(value.Field(i).Interface())
+		}
+	}
+	return fields
+}
+
+// auditChanges returns an audit entry for every column that differs
+// between two versions of a row.
+func auditChanges(entity string, before interface{}, after interface{}) []model.AuditEntry {
+	var entries []model.AuditEntry
+	oldFields := auditFields(before)
+	value := reflect.Indirect(reflect.ValueOf(after))
+	for i := 0; i < value.NumField(); i++ {
+		column := value.Type().Field(i).Tag.Get("db")
+		if column == "" || auditIgnoredFields[column] {
+			continue
+		}
+		newValue := fmt.Sprint(value.Field(i).Interface())
+		if newValue == oldFields[column] {
+			continue
+		}
+		entry := auditSubject(entity, after)
+		entry.Field = column
+		entry.OldValue = auditValue(column, oldFields[column])
+		entry.NewValue = auditValue(column, newValue)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// auditedRows returns a pointer to an empty slice of the structs the rows
+// of an entity's table are read into.
+func auditedRows(entity string) interface{} {
+	switch entity {
+	case AuditEntityBatch:
+		return &[]model.Batch{}
+	case AuditEntitySimProfile:
+		return &[]model.SimEntry{}
+	case AuditEntityProfileVendor:
+		return &[]model.ProfileVendor{}
+	case AuditEntityProfileVendorEndpoint:
+		return &[]model.ProfileVendorEndpoint{}
+	}
+	panic(fmt.Sprintf("no audited table for entity '%s'", entity))
+}
+
+// auditedUpdate runs an update of the rows of an entity's table matching
+// a condition within a transaction, and records every field it changes
+// in the audit log.  The update must not change which rows match.
+func auditedUpdate(tx *sqlx.Tx, entity string, update func() error, where string, args ...interface{}) error {
+	query := fmt.Sprintf("SELECT * FROM %s WHERE %s ORDER BY id", entity, where)
+	before := auditedRows(entity)
+	if err := selectQuery(tx, before, query, args...); err != nil {
+		return err
+	}
+	if err := update(); err != nil {
+		return err
+	}
+	after := auditedRows(entity)
+	if err := selectQuery(tx, after, query, args...); err != nil {
+		return err
+	}
+
+	beforeRows := reflect.ValueOf(before).Elem()
+	afterRows := reflect.ValueOf(after).Elem()
+	if beforeRows.Len() != afterRows.Len() {
+		return fmt.Errorf("the rows of %s where %s changed while updating them", entity, where)
+	}
+	var entries []model.AuditEntry
+	for i := 0; i < afterRows.Len(); i++ {
+		entries = append(entries, auditChanges(entity, beforeRows.Index(i).Interface(), afterRows.Index(i).Interface())...)
+	}
+	return writeAuditLog(tx, entries...)
+}
+
+// updateAudited runs an audited update, see auditedUpdate, in a
+// transaction of its own.
+func (sdb SimBatchDB) updateAudited(entity string, update func(tx *sqlx.Tx) error, where string, args ...interface{}) error {
+	return sdb.withTx(func(tx *sqlx.Tx) error {
+		return auditedUpdate(tx, entity, func() error { return update(tx) }, where, args...)
+	})
+}
+
+// GetAuditEntries returns the entries of the audit log about the sim
+// profile with an ICCID, the batch with an ID and its profiles, made at
+// or after since and at or before until (RFC3339, UTC), in the order
+// they were made.  Empty or zero values don't restrict the entries
+// returned.
+func (sdb SimBatchDB) GetAuditEntries(iccid string, batchID int64, since string, until string) ([]model.AuditEntry, error) {
+	query := "SELECT * FROM AUDIT_LOG WHERE 1 = 1"
+	var args []interface{}
+	if iccid != "" {
+		query += " AND iccid = ?"
+		args = append(args, iccid)
+	}
+	if batchID != 0 {
+		query += " AND batchID = ?"
+		args = append(args, batchID)
+	}
+	if since != "" {
+		query += " AND timestamp >= ?"
+		args = append(args, since)
+	}
+	if until != "" {
+		query += " AND timestamp <= ?"
+		args = append(args, until)
+	}
+
+	//noinspection GoPreferNilSlice
+	result := []model.AuditEntry{}
+	return result, selectQuery(sdb.Db, &result, query+" ORDER BY id", args...)
+}
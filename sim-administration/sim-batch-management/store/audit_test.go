@@ -0,0 +1,144 @@
+package store
+
+import (
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"gotest.tools/assert"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	cleanTables()
+	injectTestprofileVendor(t)
+
+	// The audit log outlives cleanTables, so only what is added to it
+	// by this test is looked at.
+	earlier, err := sdb.GetAuditEntries("", 0, "", "")
+	assert.NilError(t, err)
+
+	theBatch := declareTestBatch(t)
+	entries, err := sdb.GetAllSimEntriesForBatch(theBatch.BatchID)
+	assert.NilError(t, err)
+	entry := entries[0]
+
+	assert.NilError(t, sdb.UpdateSimEntryMsisdn(entry.ID, "4790099"))
+	assert.NilError(t, sdb.UpdateSimEntryKi(entry.ID, "A1B2C3"))
+	// Nothing changes, so nothing is recorded.
+	assert.NilError(t, sdb.UpdateSimEntryKi(entry.ID, "A1B2C3"))
+
+	all, err := sdb.GetAuditEntries("", 0, "", "")
+	assert.NilError(t, err)
+	log := all[len(earlier):]
+	assert.Equal(t, 4, len(log))
+
+	assert.Equal(t, AuditEntityBatch, log[0].Entity)
+	assert.Equal(t, theBatch.BatchID, log[0].EntityID)
+	assert.Equal(t, "", log[0].Field)
+	assert.Equal(t, theBatch.Name, log[0].NewValue)
+
+	assert.Equal(t, AuditEntitySimProfile, log[1].Entity)
+	assert.Equal(t, entry.ID, log[1].EntityID)
+	assert.Equal(t, entry.Iccid, log[1].NewValue)
+
+	assert.Equal(t, model.AuditEntry{
+		ID:          log[2].ID,
+		Entity:      AuditEntitySimProfile,
+		EntityID:    entry.ID,
+		BatchID:     theBatch.BatchID,
+		Iccid:       entry.Iccid,
+		Field:       "msisdn",
+		OldValue:    entry.Msisdn,
+		NewValue:    "4790099",
+		CommandLine: AuditCommandLine,
+		Operator:    AuditOperator,
+		Timestamp:   log[2].Timestamp,
+	}, log[2])
+	assert.Assert(t, log[2].Timestamp != "")
+
+	// Secrets are only recorded as having been set.
+	assert.Equal(t, "ki", log[3].Field)
+	assert.Equal(t, "", log[3].OldValue)
+	assert.Equal(t, "***", log[3].NewValue)
+
+	byIccid, err := sdb.GetAuditEntries(entry.Iccid, 0, "", "")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, log[1:], byIccid[len(byIccid)-3:])
+
+	byBatch, err := sdb.GetAuditEntries("", theBatch.BatchID, "", "")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, log, byBatch[len(byBatch)-4:])
+
+	inWindow, err := sdb.GetAuditEntries(entry.Iccid, 0, log[2].Timestamp, log[3].Timestamp)
+	assert.NilError(t, err)
+	assert.Assert(t, len(inWindow) >= 2)
+	future, err := sdb.GetAuditEntries("", 0, "2999-01-01T00:00:00Z", "")
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(future))
+	past, err := sdb.GetAuditEntries("", 0, "", "2000-01-01T00:00:00Z")
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(past))
+
+	// The audit log can't be rewritten.
+	_, err = sdb.Db.Exec("UPDATE AUDIT_LOG SET newValue = 'forged'")
+	assert.ErrorContains(t, err, "append-only")
+	_, err = sdb.Db.Exec("DELETE FROM AUDIT_LOG")
+	assert.ErrorContains(t, err, "append-only")
+}
+
+func TestAuditedProfileVendorChanges(t *testing.T) {
+	cleanTables()
+	earlier, err := sdb.GetAuditEntries("", 0, "", "")
+	assert.NilError(t, err)
+
+	v := injectTestprofileVendor(t)
+	assert.NilError(t, sdb.UpdateProfileVendorRateLimits(v.ID, 5, v.Es2PlusMaxInFlight))
+	endpoint := model.ProfileVendorEndpoint{ProfileVendorID: v.ID, Position: -1, Host: "backup.example.com", Port: 4711}
+	assert.NilError(t, sdb.CreateProfileVendorEndpoint(&endpoint))
+	assert.NilError(t, sdb.UpdateProfileVendorEndpointHealth(endpoint.ID, "2020-01-01T00:00:00Z", "timeout"))
+	assert.NilError(t, sdb.DeleteProfileVendorEndpoint(endpoint.ID))
+
+	all, err := sdb.GetAuditEntries("", 0, "", "")
+	assert.NilError(t, err)
+	log := all[len(earlier):]
+	assert.Equal(t, 4, len(log))
+
+	assert.Equal(t, AuditEntityProfileVendor, log[0].Entity)
+	assert.Equal(t, v.Name, log[0].NewValue)
+	assert.Equal(t, "es2PlusRequestsPerSecond", log[1].Field)
+	assert.Equal(t, "2.5", log[1].OldValue)
+	assert.Equal(t, "5", log[1].NewValue)
+	assert.Equal(t, AuditEntityProfileVendorEndpoint, log[2].Entity)
+	assert.Equal(t, "backup.example.com:4711", log[2].NewValue)
+	assert.Equal(t, endpoint.ID, log[3].EntityID)
+	assert.Equal(t, "backup.example.com:4711", log[3].OldValue)
+	assert.Equal(t, "", log[3].NewValue)
+}
+
+func TestRedactedCommandLine(t *testing.T) {
+	assert.Equal(t,
+		"sbm confirm-order --iccid 8947000000000000038 --confirmation-code *** --activation-code=***",
+		redactedCommandLine([]string{"sbm", "confirm-order", "--iccid", "8947000000000000038", "--confirmation-code", "1234", "--activation-code=LPA:1$smdp.example.com$ABC"}))
+	assert.Equal(t,
+		"sbm iccid-activate --iccid 8947000000000000038 --matching-id *** --matching-id=***",
+		redactedCommandLine([]string{"sbm", "iccid-activate", "--iccid", "8947000000000000038", "--matching-id", "ABC-123", "--matching-id=ABC-123"}))
+}
+
+func TestOrderParametersAreRecordedAsSecrets(t *testing.T) {
+	cleanTables()
+	injectTestprofileVendor(t)
+	theBatch := declareTestBatch(t)
+	entries, err := sdb.GetAllSimEntriesForBatch(theBatch.BatchID)
+	assert.NilError(t, err)
+
+	earlier, err := sdb.GetAuditEntries("", 0, "", "")
+	assert.NilError(t, err)
+	assert.NilError(t, sdb.UpdateOrderParameters(entries[0].ID, "ABC-123", "1234"))
+	all, err := sdb.GetAuditEntries("", 0, "", "")
+	assert.NilError(t, err)
+	log := all[len(earlier):]
+
+	assert.Equal(t, 2, len(log))
+	for _, entry := range log {
+		assert.Equal(t, "", entry.OldValue, entry.Field)
+		assert.Equal(t, "***", entry.NewValue, entry.Field)
+	}
+}
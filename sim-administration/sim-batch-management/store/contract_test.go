@@ -0,0 +1,196 @@
+package store
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// The tests in store_test.go and audit_test.go exercise the store
+// through the global sdb, which is an SQLite database.  They are the
+// contract every database behind the Store interface must satisfy, and
+// are run again here against PostgreSQL, see postgresForTest.
+// TestStoreContractIsComplete sees to it that none are left out.
+var storeContract = []struct {
+	name string
+	test func(t *testing.T)
+}{
+	{"Ping", TestMemoryDbPing},
+	{"GetBatchByID", TestGetBatchByID},
+	{"GetAllBatches", TestGetAllBatches},
+	{"DeclareBatch", TestDeclareBatch},
+	{"DeclareBatchReportsConstraintViolations", TestDeclareBatchReportsConstraintViolations},
+	{"DeclareAndRetrieveProfileVendorEntry", TestDeclareAndRetrieveProfileVendorEntry},
+	{"UpdateProfileVendorRateLimits", TestUpdateProfileVendorRateLimits},
+	{"UpdateProfileVendorProtocol", TestUpdateProfileVendorProtocol},
+	{"UpdateProfileVendorCertificate", TestUpdateProfileVendorCertificate},
+	{"ProfileVendorEndpoints", TestProfileVendorEndpoints},
+	{"DeclareAndRetrieveSimEntries", TestDeclareAndRetrieveSimEntries},
+	{"UpdateSimEntryKi", TestSimBatchDB_UpdateSimEntryKi},
+	{"UpdateSimEntriesInOneGo", TestUpdateSimEntriesInOneGo},
+	{"SimProfileLifecycleState", TestSimProfileLifecycleState},
+	{"DownloadProgressEvents", TestDownloadProgressEvents},
+	{"RecordingDownloadProgress", TestRecordingDownloadProgress},
+	{"JobsAndTheirItems", TestJobsAndTheirItems},
+	{"AuditLog", TestAuditLog},
+	{"AuditedProfileVendorChanges", TestAuditedProfileVendorChanges},
+	{"OrderParametersAreRecordedAsSecrets", TestOrderParametersAreRecordedAsSecrets},
+
+	// Drops the tables and puts them back, so it goes last.
+	{"DropTablesOfPopulatedDatabase", TestDropTablesOfPopulatedDatabase},
+}
+
+// The tests of the store package that aren't part of storeContract,
+// because they don't go through sdb.
+var notInStoreContract = map[string]string{
+	"TestMain":                  "sets up sdb",
+	"TestPostgresStoreContract": "runs the contract",
+	"TestParseDSN":              "doesn't touch a database",
+	"TestRedactedCommandLine":   "doesn't touch a database",
+
+	// Migrations are run against SQLite databases of their own, made
+	// to look like they were created by older versions.
+	"TestDatabaseCreatedBeforeMigrationsIsMigrated": "migrates a database of its own",
+	"TestMigratingStepwiseAndRefusingNewerSchemas":  "migrates a database of its own",
+	"TestFailingMigrationIsRolledBack":              "migrates a database of its own",
+	"TestProfilesThatCantBeMigratedAreListed":       "migrates a database of its own",
+}
+
+// A test added to the package without being added to storeContract
+// would otherwise only ever be run against SQLite.
+func TestStoreContractIsComplete(t *testing.T) {
+	inContract := map[string]bool{}
+	for _, c := range storeContract {
+		name := runtime.FuncForPC(reflect.ValueOf(c.test).Pointer()).Name()
+		inContract[name[strings.LastIndex(name, ".")+1:]] = true
+	}
+
+	files, err := filepath.Glob("*_test.go")
+	assert.NilError(t, err)
+	fset := token.NewFileSet()
+	for _, file := range files {
+		parsed, err := parser.ParseFile(fset, file, nil, 0)
+		assert.NilError(t, err)
+		for _, decl := range parsed.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || !strings.HasPrefix(fn.Name.Name, "Test") {
+				continue
+			}
+			name := fn.Name.Name
+			if name == "TestStoreContractIsComplete" {
+				continue
+			}
+			_, excluded := notInStoreContract[name]
+			assert.Assert(t, inContract[name] || excluded,
+				"%s (%s) is neither in storeContract nor in notInStoreContract", name, file)
+		}
+	}
+}
+
+// postgresForTest returns the DSN of a PostgreSQL database that can be
+// thrown away, and a function disposing of it:  The one named by
+// SIM_BATCH_TEST_POSTGRES_DSN, e.g.
+// "postgres://sbm@localhost/sbm_test?sslmode=disable", or else a cluster
+// of its own, started with the initdb and pg_ctl found on the PATH.  If
+// neither is possible the test is skipped, unless
+// SIM_BATCH_TEST_REQUIRE_POSTGRES is set, as it is in CI.
+func postgresForTest(t *testing.T) (string, func()) {
+	if dsn := os.Getenv("SIM_BATCH_TEST_POSTGRES_DSN"); dsn != "" {
+		return dsn, func() {}
+	}
+	unavailable := func(format string, args ...interface{}) {
+		message := fmt.Sprintf(format, args...)
+		if os.Getenv("SIM_BATCH_TEST_REQUIRE_POSTGRES") != "" {
+			t.Fatal(message)
+		}
+		t.Skip(message)
+	}
+
+	initdb, err := exec.LookPath("initdb")
+	if err != nil {
+		unavailable("SIM_BATCH_TEST_POSTGRES_DSN not set, and no initdb to create a PostgreSQL cluster with")
+	}
+	pgCtl, err := exec.LookPath("pg_ctl")
+	if err != nil {
+		unavailable("SIM_BATCH_TEST_POSTGRES_DSN not set, and no pg_ctl to start a PostgreSQL cluster with")
+	}
+	dir, err := ioutil.TempDir("", "sbm-postgres")
+	assert.NilError(t, err)
+	data := filepath.Join(dir, "data")
+	run := func(name string, args ...string) {
+		if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+			_ = os.RemoveAll(dir)
+			unavailable("couldn't run %s: %s\n%s", filepath.Base(name), err, output)
+		}
+	}
+
+	// Find a free port, and hope it stays free until the server is up.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	assert.NilError(t, listener.Close())
+
+	run(initdb, "--pgdata", data, "--username", "sbm", "--auth", "trust", "--no-sync")
+	run(pgCtl, "start", "--wait", "--pgdata", data, "--log", filepath.Join(dir, "postgres.log"),
+		"-o", fmt.Sprintf("-h 127.0.0.1 -p %d -k %s", port, dir))
+	return fmt.Sprintf("postgres://sbm@127.0.0.1:%d/postgres?sslmode=disable", port), func() {
+		_ = exec.Command(pgCtl, "stop", "--pgdata", data, "--mode", "immediate").Run()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestPostgresStoreContract(t *testing.T) {
+	dsn, dispose := postgresForTest(t)
+	defer dispose()
+
+	db, err := OpenWithoutMigrating(dsn)
+	assert.NilError(t, err)
+	defer db.Close()
+	assert.Assert(t, db.isPostgres(), "'%s' is not a PostgreSQL DSN", dsn)
+
+	// Start from an empty database, whatever an earlier run left behind.
+	for _, table := range tablesInDropOrder {
+		_, err := db.Db.Exec("DROP TABLE IF EXISTS " + table)
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, db.Migrate())
+	version, err := db.SchemaVersion()
+	assert.NilError(t, err)
+	assert.Equal(t, LatestSchemaVersion(), version)
+
+	defer func(original *SimBatchDB) { sdb = original }(sdb)
+	sdb = db
+	defer func() { assert.NilError(t, db.DropTables()) }()
+
+	for _, c := range storeContract {
+		cleanTables()
+		t.Run(c.name, c.test)
+	}
+}
+
+func TestParseDSN(t *testing.T) {
+	for dsn, driver := range map[string]string{
+		"sbm.db":                          DriverSqlite,
+		"sqlite:/var/lib/sbm/sbm.db":      DriverSqlite,
+		"postgres://sbm@localhost/sbm":    DriverPostgres,
+		"postgresql://sbm@db.example/sbm": DriverPostgres,
+		"host=localhost dbname=sbm":       DriverPostgres,
+		"  dbname=sbm sslmode=disable   ": DriverPostgres,
+	} {
+		actual, _ := ParseDSN(dsn)
+		assert.Equal(t, driver, actual, "driver for '%s'", dsn)
+	}
+	_, source := ParseDSN("sqlite:/var/lib/sbm/sbm.db")
+	assert.Equal(t, "/var/lib/sbm/sbm.db", source)
+}
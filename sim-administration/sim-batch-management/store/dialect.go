@@ -0,0 +1,216 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
+	"os"
+	"regexp"
+	"strings"
+)
+
+///
+///  SQLite and PostgreSQL
+///
+
+// The database drivers the store can use.
+const (
+	DriverSqlite   = "sqlite3"
+	DriverPostgres = "postgres"
+)
+
+// ParseDSN returns the driver and data source name to use for a DSN.
+// PostgreSQL DSNs are URLs such as "postgres://user@host/sbm" or
+// key/value strings such as "host=localhost dbname=sbm".  Anything
+// else is the path of an SQLite database file, optionally prefixed
+// with "sqlite:".
+func ParseDSN(dsn string) (string, string) {
+	dsn = strings.TrimSpace(dsn)
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return DriverPostgres, dsn
+	case strings.Contains(dsn, "dbname=") || strings.Contains(dsn, "host="):
+		return DriverPostgres, dsn
+	default:
+		return DriverSqlite, strings.TrimPrefix(dsn, "sqlite:")
+	}
+}
+
+// Open opens the database a DSN refers to, see ParseDSN, and applies the
+// schema migrations not yet applied to it.  A database with a newer
+// schema than this binary knows about is refused.
+func Open(dsn string) (*SimBatchDB, error) {
+	db, err := OpenWithoutMigrating(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Migrate(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// OpenWithoutMigrating opens a database like Open does, but leaves its
+// schema alone.
+func OpenWithoutMigrating(dsn string) (*SimBatchDB, error) {
+	driver, source := ParseDSN(dsn)
+	if driver == DriverSqlite {
+		if _, err := os.Stat(source); err == nil {
+			logging.Debugf("Using database file at '%s'", source)
+		} else {
+			logging.Debugf("No database file found at '%s', will create one", source)
+		}
+	}
+
+	if driver == DriverSqlite {
+		source = withForeignKeys(source)
+	}
+	db, err := sqlx.Open(driver, source)
+	if err != nil {
+		return nil, err
+	}
+	if driver == DriverPostgres {
+		if err := db.Ping(); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("couldn't connect to PostgreSQL database: %s", err)
+		}
+		// PostgreSQL folds unquoted names to lower case, so that is
+		// what the columns are called in results.
+		db.Mapper = reflectx.NewMapperTagFunc("db", strings.ToLower, strings.ToLower)
+	}
+	return &SimBatchDB{Db: db}, nil
+}
+
+// withForeignKeys makes SQLite enforce foreign keys, which it otherwise
+// only does when asked to, on every connection it opens.
+func withForeignKeys(source string) string {
+	if strings.Contains(source, "?") {
+		return source + "&_foreign_keys=1"
+	}
+	return source + "?_foreign_keys=1"
+}
+
+// Close closes the database.
+func (sdb *SimBatchDB) Close() error {
+	return sdb.Db.Close()
+}
+
+func (sdb *SimBatchDB) isPostgres() bool {
+	return sdb.Db.DriverName() == DriverPostgres
+}
+
+// The queries of the store are written for SQLite, with ? placeholders
+// and mixed case names.  These functions run them on either database,
+// in or out of a transaction.
+
+func execQuery(ext sqlx.Ext, query string, args ...interface{}) (sql.Result, error) {
+	return ext.Exec(ext.Rebind(query), args...)
+}
+
+func selectQuery(ext sqlx.Ext, dest interface{}, query string, args ...interface{}) error {
+	return sqlx.Select(ext, dest, ext.Rebind(query), args...)
+}
+
+func getQuery(ext sqlx.Ext, dest interface{}, query string, args ...interface{}) error {
+	return sqlx.Get(ext, dest, ext.Rebind(query), args...)
+}
+
+var namedParameterRegexp = regexp.MustCompile(`:[A-Za-z_]\w*`)
+
+// lowerNames makes the names of parameters match the lower case names
+// used to look up struct fields on PostgreSQL.
+func lowerNames(ext sqlx.Ext, query string, arg interface{}) (string, interface{}) {
+	if ext.DriverName() != DriverPostgres {
+		return query, arg
+	}
+	query = namedParameterRegexp.ReplaceAllStringFunc(query, strings.ToLower)
+	if values, ok := arg.(map[string]interface{}); ok {
+		lowered := make(map[string]interface{}, len(values))
+		for name, value := range values {
+			lowered[strings.ToLower(name)] = value
+		}
+		arg = lowered
+	}
+	return query, arg
+}
+
+func namedExec(ext sqlx.Ext, query string, arg interface{}) (sql.Result, error) {
+	query, arg = lowerNames(ext, query, arg)
+	return sqlx.NamedExec(ext, query, arg)
+}
+
+// namedInsert runs an INSERT with named parameters, and returns the id
+// of the inserted row.
+func namedInsert(ext sqlx.Ext, query string, arg interface{}) (int64, error) {
+	if ext.DriverName() != DriverPostgres {
+		res, err := sqlx.NamedExec(ext, query, arg)
+		if err != nil {
+			return 0, err
+		}
+		return res.LastInsertId()
+	}
+
+	query, arg = lowerNames(ext, query, arg)
+	bound, args, err := ext.BindNamed(query+" RETURNING id", arg)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	return id, ext.QueryRowx(bound, args...).Scan(&id)
+}
+
+// insert runs an INSERT with ? placeholders, and returns the id of the
+// inserted row.
+func insert(ext sqlx.Ext, query string, args ...interface{}) (int64, error) {
+	if ext.DriverName() != DriverPostgres {
+		res, err := ext.Exec(query, args...)
+		if err != nil {
+			return 0, err
+		}
+		return res.LastInsertId()
+	}
+
+	var id int64
+	return id, ext.QueryRowx(ext.Rebind(query+" RETURNING id"), args...).Scan(&id)
+}
+
+var uniqueKeyRegexp = regexp.MustCompile(`Key \((\w+)\)`)
+
+// uniqueViolation tells if an error is caused by a unique constraint,
+// and if so, on which column.
+func uniqueViolation(err error) (string, bool) {
+	switch e := err.(type) {
+	case sqlite3.Error:
+		// "UNIQUE constraint failed: SIM_PROFILE.iccid"
+		if e.ExtendedCode == sqlite3.ErrConstraintUnique {
+			message := e.Error()
+			return strings.ToLower(message[strings.LastIndex(message, ".")+1:]), true
+		}
+	case *pq.Error:
+		// "Key (iccid)=(8947000000000000038) already exists."
+		if e.Code == "23505" {
+			if match := uniqueKeyRegexp.FindStringSubmatch(e.Detail); match != nil {
+				return strings.ToLower(match[1]), true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// foreignKeyViolation tells if an error is caused by a foreign key
+// constraint.
+func foreignKeyViolation(err error) bool {
+	switch e := err.(type) {
+	case sqlite3.Error:
+		return e.ExtendedCode == sqlite3.ErrConstraintForeignKey
+	case *pq.Error:
+		return e.Code == "23503"
+	}
+	return false
+}
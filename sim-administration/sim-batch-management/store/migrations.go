@@ -0,0 +1,627 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
+	"regexp"
+	"strings"
+)
+
+///
+///  Versioned schema migrations
+///
+
+// Migration is a change to the schema of the database.  Migrations are
+// applied in order of version, each in its own transaction, and the
+// versions applied are recorded in the SCHEMA_VERSION table.
+// Statements are run on SQLite, PostgresStatements on PostgreSQL.
+// Check, if set, is run first, and fails the migration if the data
+// can't be migrated as it is.
+type Migration struct {
+	Version            int
+	Description        string
+	Statements         []string
+	PostgresStatements []string
+	Check              func(tx *sqlx.Tx) error
+}
+
+// MigrationStatus is a migration, and when it was applied to the
+// database.  AppliedAt is empty if it hasn't been.
+type MigrationStatus struct {
+	Migration
+	AppliedAt string
+}
+
+// The migrations, in order.  Never change a migration that has been
+// released, add a new one instead.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Initial schema",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS BATCH (
+         id integer primary key autoincrement,
+         name VARCHAR NOT NULL UNIQUE,
+         profileVendor VARCHAR NOT NULL,
+         filenameBase VARCHAR,
+         customer VARCHAR,
+         profileType VARCHAR,
+         orderDate VARCHAR,
+         batchNo VARCHAR,
+         quantity INTEGER,
+         firstIccid VARCHAR,
+         firstImsi VARCHAR,
+         firstMsisdn VARCHAR,
+         msisdnIncrement INTEGER,
+         imsiIncrement INTEGER,
+         iccidIncrement INTEGER,
+         url VARCHAR)`,
+			`CREATE TABLE IF NOT EXISTS SIM_PROFILE (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         batchID INTEGER NOT NULL,
+         activationCode VARCHAR NOT NULL,
+         imsi VARCHAR NOT NULL,
+         rawIccid VARCHAR NOT NULL,
+         iccidWithChecksum VARCHAR NOT NULL,
+         iccidWithoutChecksum VARCHAR NOT NULL,
+         iccid VARCHAR NOT NULL,
+         ki VARCHAR NOT NULL,
+         msisdn VARCHAR NOT NULL)`,
+			`CREATE TABLE IF NOT EXISTS PROFILE_VENDOR (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         name VARCHAR NOT NULL UNIQUE,
+         es2PlusCertPath  VARCHAR,
+         es2PlusKeyPath VARCHAR,
+         es2PlusHostPath VARCHAR,
+         es2PlusPort VARCHAR,
+         es2PlusRequesterId VARCHAR)`,
+		},
+		// There were no PostgreSQL databases before there were
+		// migrations, so they start out with the schema SQLite
+		// databases have after migration 3.
+		PostgresStatements: []string{
+			`CREATE TABLE BATCH (
+         id BIGSERIAL PRIMARY KEY,
+         name VARCHAR NOT NULL UNIQUE,
+         profileVendor VARCHAR NOT NULL,
+         filenameBase VARCHAR,
+         customer VARCHAR,
+         profileType VARCHAR,
+         orderDate VARCHAR,
+         batchNo VARCHAR,
+         quantity INTEGER,
+         firstIccid VARCHAR,
+         firstImsi VARCHAR,
+         firstMsisdn VARCHAR,
+         msisdnIncrement INTEGER,
+         imsiIncrement INTEGER,
+         iccidIncrement INTEGER,
+         url VARCHAR)`,
+			`CREATE TABLE SIM_PROFILE (
+         id BIGSERIAL PRIMARY KEY,
+         batchID BIGINT NOT NULL,
+         activationCode VARCHAR NOT NULL,
+         imsi VARCHAR NOT NULL,
+         rawIccid VARCHAR NOT NULL,
+         iccidWithChecksum VARCHAR NOT NULL,
+         iccidWithoutChecksum VARCHAR NOT NULL,
+         iccid VARCHAR NOT NULL,
+         ki VARCHAR NOT NULL,
+         msisdn VARCHAR NOT NULL,
+         matchingId VARCHAR NOT NULL DEFAULT '',
+         confirmationCode VARCHAR NOT NULL DEFAULT '')`,
+			`CREATE TABLE PROFILE_VENDOR (
+         id BIGSERIAL PRIMARY KEY,
+         name VARCHAR NOT NULL UNIQUE,
+         es2PlusCertPath  VARCHAR,
+         es2PlusKeyPath VARCHAR,
+         es2PlusHostPath VARCHAR,
+         es2PlusPort INTEGER,
+         es2PlusRequesterId VARCHAR,
+         es2PlusCertSubject VARCHAR NOT NULL DEFAULT '',
+         es2PlusCertIssuer VARCHAR NOT NULL DEFAULT '',
+         es2PlusCertSerial VARCHAR NOT NULL DEFAULT '',
+         es2PlusCertNotAfter VARCHAR NOT NULL DEFAULT '',
+         es2PlusMaxIccidsPerRequest INTEGER NOT NULL DEFAULT 0,
+         es2PlusTimeoutSeconds INTEGER NOT NULL DEFAULT 0,
+         es2PlusCaBundlePath VARCHAR NOT NULL DEFAULT '',
+         es2PlusPinnedSpkiSha256 VARCHAR NOT NULL DEFAULT '',
+         es2PlusServerName VARCHAR NOT NULL DEFAULT '',
+         es2PlusInsecureSkipVerify BOOLEAN NOT NULL DEFAULT FALSE,
+         es2PlusRequestsPerSecond DOUBLE PRECISION NOT NULL DEFAULT 0,
+         es2PlusMaxInFlight INTEGER NOT NULL DEFAULT 0,
+         es2PlusProtocolVersion VARCHAR NOT NULL DEFAULT '2.0.0',
+         es2PlusDialect VARCHAR NOT NULL DEFAULT '')`,
+			`CREATE TABLE PROFILE_VENDOR_ENDPOINT (
+         id BIGSERIAL PRIMARY KEY,
+         profileVendorID BIGINT NOT NULL,
+         position INTEGER NOT NULL,
+         host VARCHAR NOT NULL,
+         port INTEGER NOT NULL,
+         failedAt VARCHAR NOT NULL DEFAULT '',
+         lastError VARCHAR NOT NULL DEFAULT '',
+         UNIQUE (profileVendorID, host, port))`,
+			`CREATE TABLE DOWNLOAD_PROGRESS_EVENT (
+         id BIGSERIAL PRIMARY KEY,
+         simProfileID BIGINT NOT NULL,
+         iccid VARCHAR NOT NULL,
+         eid VARCHAR NOT NULL,
+         notificationPointId INTEGER NOT NULL,
+         status VARCHAR NOT NULL,
+         timestamp VARCHAR NOT NULL,
+         functionCallIdentifier VARCHAR NOT NULL)`,
+			`CREATE TABLE JOB (
+         id BIGSERIAL PRIMARY KEY,
+         type VARCHAR NOT NULL,
+         batchName VARCHAR NOT NULL DEFAULT '',
+         profileVendor VARCHAR NOT NULL,
+         parameters VARCHAR NOT NULL DEFAULT '{}',
+         operator VARCHAR NOT NULL DEFAULT '',
+         state VARCHAR NOT NULL,
+         startedAt VARCHAR NOT NULL,
+         endedAt VARCHAR NOT NULL DEFAULT '')`,
+			`CREATE TABLE JOB_ITEM (
+         id BIGSERIAL PRIMARY KEY,
+         jobID BIGINT NOT NULL,
+         iccid VARCHAR NOT NULL,
+         state VARCHAR NOT NULL,
+         output VARCHAR NOT NULL DEFAULT '',
+         error VARCHAR NOT NULL DEFAULT '',
+         updatedAt VARCHAR NOT NULL DEFAULT '')`,
+		},
+	},
+	{
+		// Databases created before there were migrations may
+		// already have any of these, see addColumnRegexp.
+		Version:     2,
+		Description: "Tables and columns added before there were migrations",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS DOWNLOAD_PROGRESS_EVENT (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         simProfileID INTEGER NOT NULL,
+         iccid VARCHAR NOT NULL,
+         eid VARCHAR NOT NULL,
+         notificationPointId INTEGER NOT NULL,
+         status VARCHAR NOT NULL,
+         timestamp VARCHAR NOT NULL,
+         functionCallIdentifier VARCHAR NOT NULL)`,
+			`ALTER TABLE SIM_PROFILE ADD COLUMN matchingId VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE SIM_PROFILE ADD COLUMN confirmationCode VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE PROFILE_VENDOR ADD COLUMN es2PlusCertSubject VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE PROFILE_VENDOR ADD COLUMN es2PlusCertIssuer VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE PROFILE_VENDOR ADD COLUMN es2PlusCertSerial VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE PROFILE_VENDOR ADD COLUMN es2PlusCertNotAfter VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE PROFILE_VENDOR ADD COLUMN es2PlusMaxIccidsPerRequest INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE PROFILE_VENDOR ADD COLUMN es2PlusTimeoutSeconds INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE PROFILE_VENDOR ADD COLUMN es2PlusCaBundlePath VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE PROFILE_VENDOR ADD COLUMN es2PlusPinnedSpkiSha256 VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE PROFILE_VENDOR ADD COLUMN es2PlusServerName VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE PROFILE_VENDOR ADD COLUMN es2PlusInsecureSkipVerify BOOLEAN NOT NULL DEFAULT 0`,
+			`ALTER TABLE PROFILE_VENDOR ADD COLUMN es2PlusRequestsPerSecond REAL NOT NULL DEFAULT 0`,
+			`ALTER TABLE PROFILE_VENDOR ADD COLUMN es2PlusMaxInFlight INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE PROFILE_VENDOR ADD COLUMN es2PlusProtocolVersion VARCHAR NOT NULL DEFAULT '2.0.0'`,
+			`ALTER TABLE PROFILE_VENDOR ADD COLUMN es2PlusDialect VARCHAR NOT NULL DEFAULT ''`,
+			`CREATE TABLE IF NOT EXISTS PROFILE_VENDOR_ENDPOINT (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         profileVendorID INTEGER NOT NULL,
+         position INTEGER NOT NULL,
+         host VARCHAR NOT NULL,
+         port INTEGER NOT NULL,
+         failedAt VARCHAR NOT NULL DEFAULT '',
+         lastError VARCHAR NOT NULL DEFAULT '',
+         UNIQUE (profileVendorID, host, port))`,
+			// Profile vendors declared before they could have several
+			// endpoints get theirs from the host and port they were
+			// declared with.
+			`INSERT INTO PROFILE_VENDOR_ENDPOINT (profileVendorID, position, host, port)
+         SELECT id, 0, es2PlusHostPath, es2PlusPort FROM PROFILE_VENDOR
+         WHERE id NOT IN (SELECT profileVendorID FROM PROFILE_VENDOR_ENDPOINT)`,
+			`CREATE TABLE IF NOT EXISTS JOB (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         type VARCHAR NOT NULL,
+         batchName VARCHAR NOT NULL DEFAULT '',
+         profileVendor VARCHAR NOT NULL,
+         parameters VARCHAR NOT NULL DEFAULT '{}',
+         operator VARCHAR NOT NULL DEFAULT '',
+         state VARCHAR NOT NULL,
+         startedAt VARCHAR NOT NULL,
+         endedAt VARCHAR NOT NULL DEFAULT '')`,
+			`CREATE TABLE IF NOT EXISTS JOB_ITEM (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         jobID INTEGER NOT NULL,
+         iccid VARCHAR NOT NULL,
+         state VARCHAR NOT NULL,
+         output VARCHAR NOT NULL DEFAULT '',
+         error VARCHAR NOT NULL DEFAULT '',
+         updatedAt VARCHAR NOT NULL DEFAULT '')`,
+		},
+	},
+	{
+		// SQLite can't change the type of a column, so the table
+		// is copied.
+		Version:     3,
+		Description: "Make PROFILE_VENDOR.es2PlusPort an INTEGER, as in the model",
+		Statements: []string{
+			`CREATE TABLE PROFILE_VENDOR_NEW (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         name VARCHAR NOT NULL UNIQUE,
+         es2PlusCertPath  VARCHAR,
+         es2PlusKeyPath VARCHAR,
+         es2PlusHostPath VARCHAR,
+         es2PlusPort INTEGER,
+         es2PlusRequesterId VARCHAR,
+         es2PlusCertSubject VARCHAR NOT NULL DEFAULT '',
+         es2PlusCertIssuer VARCHAR NOT NULL DEFAULT '',
+         es2PlusCertSerial VARCHAR NOT NULL DEFAULT '',
+         es2PlusCertNotAfter VARCHAR NOT NULL DEFAULT '',
+         es2PlusMaxIccidsPerRequest INTEGER NOT NULL DEFAULT 0,
+         es2PlusTimeoutSeconds INTEGER NOT NULL DEFAULT 0,
+         es2PlusCaBundlePath VARCHAR NOT NULL DEFAULT '',
+         es2PlusPinnedSpkiSha256 VARCHAR NOT NULL DEFAULT '',
+         es2PlusServerName VARCHAR NOT NULL DEFAULT '',
+         es2PlusInsecureSkipVerify BOOLEAN NOT NULL DEFAULT 0,
+         es2PlusRequestsPerSecond REAL NOT NULL DEFAULT 0,
+         es2PlusMaxInFlight INTEGER NOT NULL DEFAULT 0,
+         es2PlusProtocolVersion VARCHAR NOT NULL DEFAULT '2.0.0',
+         es2PlusDialect VARCHAR NOT NULL DEFAULT '')`,
+			`INSERT INTO PROFILE_VENDOR_NEW
+         SELECT id, name, es2PlusCertPath, es2PlusKeyPath, es2PlusHostPath, CAST(es2PlusPort AS INTEGER),
+                es2PlusRequesterId, es2PlusCertSubject, es2PlusCertIssuer, es2PlusCertSerial, es2PlusCertNotAfter,
+                es2PlusMaxIccidsPerRequest, es2PlusTimeoutSeconds, es2PlusCaBundlePath, es2PlusPinnedSpkiSha256,
+                es2PlusServerName, es2PlusInsecureSkipVerify, es2PlusRequestsPerSecond, es2PlusMaxInFlight,
+                es2PlusProtocolVersion, es2PlusDialect
+         FROM PROFILE_VENDOR`,
+			`DROP TABLE PROFILE_VENDOR`,
+			`ALTER TABLE PROFILE_VENDOR_NEW RENAME TO PROFILE_VENDOR`,
+		},
+	},
+	{
+		// SQLite can't add constraints to a table, so BATCH and
+		// SIM_PROFILE are copied.  Batches may name profile vendors
+		// that were never declared, those are declared with just a
+		// name.  Duplicate ICCIDs or IMSIs, and SIM profiles of batches
+		// that are gone, make the migration fail, and must be cleaned
+		// up by hand.  They are listed before anything is copied.
+		Version:     4,
+		Description: "Foreign keys, unique ICCIDs and IMSIs, and indices",
+		Check:       checkProfilesMigratable,
+		Statements: []string{
+			undeclaredProfileVendors,
+			`CREATE TABLE BATCH_NEW (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         name VARCHAR NOT NULL UNIQUE,
+         profileVendor VARCHAR NOT NULL REFERENCES PROFILE_VENDOR (name),
+         filenameBase VARCHAR,
+         customer VARCHAR,
+         profileType VARCHAR,
+         orderDate VARCHAR,
+         batchNo VARCHAR,
+         quantity INTEGER,
+         firstIccid VARCHAR,
+         firstImsi VARCHAR,
+         firstMsisdn VARCHAR,
+         msisdnIncrement INTEGER,
+         imsiIncrement INTEGER,
+         iccidIncrement INTEGER,
+         url VARCHAR)`,
+			`INSERT INTO BATCH_NEW (id, name, profileVendor, filenameBase, customer, profileType, orderDate, batchNo, quantity,
+                                firstIccid, firstImsi, firstMsisdn, msisdnIncrement, imsiIncrement, iccidIncrement, url)
+         SELECT id, name, profileVendor, filenameBase, customer, profileType, orderDate, batchNo, quantity,
+                firstIccid, firstImsi, firstMsisdn, msisdnIncrement, imsiIncrement, iccidIncrement, url
+         FROM BATCH`,
+			`DROP TABLE BATCH`,
+			`ALTER TABLE BATCH_NEW RENAME TO BATCH`,
+			`CREATE TABLE SIM_PROFILE_NEW (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         batchID INTEGER NOT NULL REFERENCES BATCH (id),
+         activationCode VARCHAR NOT NULL,
+         imsi VARCHAR NOT NULL,
+         rawIccid VARCHAR NOT NULL,
+         iccidWithChecksum VARCHAR NOT NULL,
+         iccidWithoutChecksum VARCHAR NOT NULL,
+         iccid VARCHAR NOT NULL,
+         ki VARCHAR NOT NULL,
+         msisdn VARCHAR NOT NULL,
+         matchingId VARCHAR NOT NULL DEFAULT '',
+         confirmationCode VARCHAR NOT NULL DEFAULT '')`,
+			`INSERT INTO SIM_PROFILE_NEW (id, batchID, activationCode, imsi, rawIccid, iccidWithChecksum, iccidWithoutChecksum,
+                                      iccid, ki, msisdn, matchingId, confirmationCode)
+         SELECT id, batchID, activationCode, imsi, rawIccid, iccidWithChecksum, iccidWithoutChecksum,
+                iccid, ki, msisdn, matchingId, confirmationCode
+         FROM SIM_PROFILE`,
+			`DROP TABLE SIM_PROFILE`,
+			`ALTER TABLE SIM_PROFILE_NEW RENAME TO SIM_PROFILE`,
+			createSimProfileIccidIndex,
+			createSimProfileImsiIndex,
+			createSimProfileBatchIndex,
+			createDownloadProgressEventIndex,
+			createJobItemIndex,
+		},
+		PostgresStatements: []string{
+			undeclaredProfileVendors,
+			`ALTER TABLE BATCH ADD CONSTRAINT BATCH_PROFILE_VENDOR
+         FOREIGN KEY (profileVendor) REFERENCES PROFILE_VENDOR (name)`,
+			`ALTER TABLE SIM_PROFILE ADD CONSTRAINT SIM_PROFILE_BATCH
+         FOREIGN KEY (batchID) REFERENCES BATCH (id)`,
+			createSimProfileIccidIndex,
+			createSimProfileImsiIndex,
+			createSimProfileBatchIndex,
+			createDownloadProgressEventIndex,
+			createJobItemIndex,
+		},
+	},
+	{
+		Version:     5,
+		Description: "Lifecycle state of SIM profiles",
+		Statements: []string{
+			`ALTER TABLE SIM_PROFILE ADD COLUMN smdpState VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE SIM_PROFILE ADD COLUMN eid VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE SIM_PROFILE ADD COLUMN lockFlag BOOLEAN NOT NULL DEFAULT 0`,
+			`ALTER TABLE SIM_PROFILE ADD COLUMN statusUpdatedAt VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE SIM_PROFILE ADD COLUMN hssState VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE SIM_PROFILE ADD COLUMN primeUploadState VARCHAR NOT NULL DEFAULT ''`,
+		},
+		PostgresStatements: []string{
+			`ALTER TABLE SIM_PROFILE ADD COLUMN smdpState VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE SIM_PROFILE ADD COLUMN eid VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE SIM_PROFILE ADD COLUMN lockFlag BOOLEAN NOT NULL DEFAULT FALSE`,
+			`ALTER TABLE SIM_PROFILE ADD COLUMN statusUpdatedAt VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE SIM_PROFILE ADD COLUMN hssState VARCHAR NOT NULL DEFAULT ''`,
+			`ALTER TABLE SIM_PROFILE ADD COLUMN primeUploadState VARCHAR NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		// Rows in the audit log can't be changed or deleted, only
+		// dropped along with the table.
+		Version:     6,
+		Description: "Audit log",
+		Statements: []string{
+			`CREATE TABLE AUDIT_LOG (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         entity VARCHAR NOT NULL,
+         entityID INTEGER NOT NULL,
+         batchID INTEGER NOT NULL DEFAULT 0,
+         iccid VARCHAR NOT NULL DEFAULT '',
+         field VARCHAR NOT NULL,
+         oldValue VARCHAR NOT NULL,
+         newValue VARCHAR NOT NULL,
+         commandLine VARCHAR NOT NULL,
+         operator VARCHAR NOT NULL,
+         timestamp VARCHAR NOT NULL)`,
+			`CREATE TRIGGER AUDIT_LOG_NO_UPDATE BEFORE UPDATE ON AUDIT_LOG
+         BEGIN SELECT RAISE(ABORT, 'AUDIT_LOG is append-only'); END`,
+			`CREATE TRIGGER AUDIT_LOG_NO_DELETE BEFORE DELETE ON AUDIT_LOG
+         BEGIN SELECT RAISE(ABORT, 'AUDIT_LOG is append-only'); END`,
+			createAuditLogIccidIndex,
+			createAuditLogBatchIndex,
+			createAuditLogTimestampIndex,
+		},
+		PostgresStatements: []string{
+			`CREATE TABLE AUDIT_LOG (
+         id BIGSERIAL PRIMARY KEY,
+         entity VARCHAR NOT NULL,
+         entityID BIGINT NOT NULL,
+         batchID BIGINT NOT NULL DEFAULT 0,
+         iccid VARCHAR NOT NULL DEFAULT '',
+         field VARCHAR NOT NULL,
+         oldValue VARCHAR NOT NULL,
+         newValue VARCHAR NOT NULL,
+         commandLine VARCHAR NOT NULL,
+         operator VARCHAR NOT NULL,
+         timestamp VARCHAR NOT NULL)`,
+			`CREATE OR REPLACE FUNCTION AUDIT_LOG_APPEND_ONLY() RETURNS TRIGGER AS $$
+         BEGIN RAISE EXCEPTION 'AUDIT_LOG is append-only'; END
+         $$ LANGUAGE plpgsql`,
+			`CREATE TRIGGER AUDIT_LOG_APPEND_ONLY BEFORE UPDATE OR DELETE ON AUDIT_LOG
+         FOR EACH ROW EXECUTE PROCEDURE AUDIT_LOG_APPEND_ONLY()`,
+			createAuditLogIccidIndex,
+			createAuditLogBatchIndex,
+			createAuditLogTimestampIndex,
+		},
+	},
+	{
+		// statusUpdatedAt is by the clock of the SM-DP+, and the
+		// state changes sbm makes through ES2+ are stamped by the local
+		// clock, which needn't agree with it.
+		Version:     7,
+		Description: "Separate timestamp of SM-DP+ state changes made through ES2+",
+		Statements: []string{
+			`ALTER TABLE SIM_PROFILE ADD COLUMN stateChangedAt VARCHAR NOT NULL DEFAULT ''`,
+		},
+		PostgresStatements: []string{
+			`ALTER TABLE SIM_PROFILE ADD COLUMN stateChangedAt VARCHAR NOT NULL DEFAULT ''`,
+		},
+	},
+}
+
+// Statements shared by both databases in migration 4.
+const (
+	undeclaredProfileVendors = `INSERT INTO PROFILE_VENDOR (name, es2PlusCertPath, es2PlusKeyPath, es2PlusHostPath, es2PlusPort, es2PlusRequesterId)
+         SELECT DISTINCT profileVendor, '', '', '', 0, '' FROM BATCH
+         WHERE profileVendor NOT IN (SELECT name FROM PROFILE_VENDOR)`
+	createSimProfileIccidIndex       = `CREATE UNIQUE INDEX SIM_PROFILE_ICCID ON SIM_PROFILE (iccid)`
+	createSimProfileImsiIndex        = `CREATE UNIQUE INDEX SIM_PROFILE_IMSI ON SIM_PROFILE (imsi)`
+	createSimProfileBatchIndex       = `CREATE INDEX SIM_PROFILE_BATCH_ID ON SIM_PROFILE (batchID)`
+	createDownloadProgressEventIndex = `CREATE INDEX DOWNLOAD_PROGRESS_EVENT_SIM_PROFILE_ID ON DOWNLOAD_PROGRESS_EVENT (simProfileID)`
+	createJobItemIndex               = `CREATE INDEX JOB_ITEM_JOB_ID ON JOB_ITEM (jobID)`
+)
+
+// Statements shared by both databases in migration 6.
+const (
+	createAuditLogIccidIndex     = `CREATE INDEX AUDIT_LOG_ICCID ON AUDIT_LOG (iccid)`
+	createAuditLogBatchIndex     = `CREATE INDEX AUDIT_LOG_BATCH_ID ON AUDIT_LOG (batchID)`
+	createAuditLogTimestampIndex = `CREATE INDEX AUDIT_LOG_TIMESTAMP ON AUDIT_LOG (timestamp)`
+)
+
+// LatestSchemaVersion is the schema version this binary expects.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// addColumnRegexp matches statements adding a column.  These are
+// skipped if the column is already there, since before there were
+// migrations, columns were added by creating the tables with them.
+var addColumnRegexp = regexp.MustCompile(`(?i)^\s*ALTER\s+TABLE\s+(\w+)\s+ADD\s+COLUMN\s+(\w+)`)
+
+func (sdb *SimBatchDB) createSchemaVersionTable() error {
+	_, err := execQuery(sdb.Db, `CREATE TABLE IF NOT EXISTS SCHEMA_VERSION (
+         version INTEGER PRIMARY KEY,
+         description VARCHAR NOT NULL,
+         appliedAt VARCHAR NOT NULL)`)
+	return err
+}
+
+// SchemaVersion returns the version of the schema of the database, zero
+// if no migrations have been applied.
+func (sdb *SimBatchDB) SchemaVersion() (int, error) {
+	if err := sdb.createSchemaVersionTable(); err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	if err := getQuery(sdb.Db, &version, "SELECT MAX(version) FROM SCHEMA_VERSION"); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// MigrationStatus returns all the migrations this binary knows about,
+// and when they were applied.
+func (sdb *SimBatchDB) MigrationStatus() ([]MigrationStatus, error) {
+	if err := sdb.createSchemaVersionTable(); err != nil {
+		return nil, err
+	}
+	applied := []struct {
+		Version   int    `db:"version"`
+		AppliedAt string `db:"appliedAt"`
+	}{}
+	if err := selectQuery(sdb.Db, &applied, "SELECT version, appliedAt FROM SCHEMA_VERSION"); err != nil {
+		return nil, err
+	}
+	appliedAt := make(map[int]string)
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+	result := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		result[i] = MigrationStatus{Migration: migration, AppliedAt: appliedAt[migration.Version]}
+	}
+	return result, nil
+}
+
+// Migrate applies all the migrations not yet applied to the database.
+func (sdb *SimBatchDB) Migrate() error {
+	return sdb.MigrateTo(LatestSchemaVersion())
+}
+
+// MigrateTo applies the migrations not yet applied to the database, up
+// to and including the given version.  The schema can't be downgraded,
+// and a database with a newer schema than this binary knows about is
+// refused.
+func (sdb *SimBatchDB) MigrateTo(version int) error {
+	current, err := sdb.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > LatestSchemaVersion() {
+		return fmt.Errorf("the database has schema version %d, newer than version %d known by this binary.  Upgrade sbm", current, LatestSchemaVersion())
+	}
+	if version > LatestSchemaVersion() || version < 0 {
+		return fmt.Errorf("no schema version %d, the latest is %d", version, LatestSchemaVersion())
+	}
+	if version < current {
+		return fmt.Errorf("the database has schema version %d, migrating down to %d is not supported", current, version)
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= current || migration.Version > version {
+			continue
+		}
+		if err := sdb.applyMigration(migration); err != nil {
+			return fmt.Errorf("couldn't migrate the database to schema version %d (%s): %s", migration.Version, migration.Description, err)
+		}
+		logging.Infof("Migrated the database to schema version %d: %s", migration.Version, migration.Description)
+	}
+	return nil
+}
+
+func (sdb *SimBatchDB) applyMigration(migration Migration) error {
+	return sdb.withTx(func(tx *sqlx.Tx) error {
+		if migration.Check != nil {
+			if err := migration.Check(tx); err != nil {
+				return err
+			}
+		}
+
+		statements := migration.Statements
+		if sdb.isPostgres() {
+			statements = migration.PostgresStatements
+		}
+		for _, statement := range statements {
+			if match := addColumnRegexp.FindStringSubmatch(statement); match != nil && !sdb.isPostgres() {
+				found, err := hasColumn(tx, match[1], match[2])
+				if err != nil {
+					return err
+				}
+				if found {
+					continue
+				}
+			}
+			if _, err := execQuery(tx, statement); err != nil {
+				return err
+			}
+		}
+		_, err := execQuery(tx, "INSERT INTO SCHEMA_VERSION (version, description, appliedAt) VALUES (?, ?, ?)",
+			migration.Version, migration.Description, Timestamp())
+		return err
+	})
+}
+
+// checkProfilesMigratable lists the SIM profiles that migration 4 can't
+// migrate:  Those sharing an ICCID or an IMSI, and those of batches that
+// are gone.
+func checkProfilesMigratable(tx *sqlx.Tx) error {
+	var problems []string
+	for _, column := range []string{"iccid", "imsi"} {
+		duplicates := []string{}
+		err := selectQuery(tx, &duplicates,
+			"SELECT "+column+" FROM SIM_PROFILE GROUP BY "+column+" HAVING COUNT(*) > 1 ORDER BY "+column)
+		if err != nil {
+			return err
+		}
+		if len(duplicates) > 0 {
+			problems = append(problems, fmt.Sprintf("duplicate %ss %s", strings.ToUpper(column), strings.Join(duplicates, ", ")))
+		}
+	}
+
+	orphans := []string{}
+	err := selectQuery(tx, &orphans,
+		"SELECT DISTINCT CAST(batchID AS VARCHAR) FROM SIM_PROFILE WHERE batchID NOT IN (SELECT id FROM BATCH) ORDER BY 1")
+	if err != nil {
+		return err
+	}
+	if len(orphans) > 0 {
+		problems = append(problems, fmt.Sprintf("SIM profiles of missing batches %s", strings.Join(orphans, ", ")))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("clean up the SIM profiles first: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func hasColumn(tx *sqlx.Tx, table string, column string) (bool, error) {
+	columns := []struct {
+		Name string `db:"name"`
+	}{}
+	if err := tx.Select(&columns, "SELECT name FROM pragma_table_info(?)", table); err != nil {
+		return false, err
+	}
+	for _, c := range columns {
+		if strings.EqualFold(c.Name, column) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
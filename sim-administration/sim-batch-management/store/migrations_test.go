@@ -0,0 +1,177 @@
+package store
+
+import (
+	"gotest.tools/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDatabaseCreatedBeforeMigrationsIsMigrated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbm-migrations")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "old.db")
+
+	// A database as created by a version that created the tables
+	// with some, but not all, of the columns added since.
+	old, err := OpenFileSqliteDatabaseWithoutMigrating(path)
+	assert.NilError(t, err)
+	for _, statement := range []string{
+		migrations[0].Statements[0],
+		`CREATE TABLE SIM_PROFILE (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         batchID INTEGER NOT NULL,
+         activationCode VARCHAR NOT NULL,
+         imsi VARCHAR NOT NULL,
+         rawIccid VARCHAR NOT NULL,
+         iccidWithChecksum VARCHAR NOT NULL,
+         iccidWithoutChecksum VARCHAR NOT NULL,
+         iccid VARCHAR NOT NULL,
+         ki VARCHAR NOT NULL,
+         msisdn VARCHAR NOT NULL,
+         matchingId VARCHAR NOT NULL DEFAULT '',
+         confirmationCode VARCHAR NOT NULL DEFAULT '')`,
+		migrations[0].Statements[2],
+		`INSERT INTO PROFILE_VENDOR (name, es2PlusCertPath, es2PlusKeyPath, es2PlusHostPath, es2PlusPort, es2PlusRequesterId)
+         VALUES ('Durian', 'cert', 'key', 'host', '4711', '1.2.3')`,
+		`INSERT INTO BATCH (name, profileVendor) VALUES ('Old', 'Jackfruit')`,
+		`INSERT INTO SIM_PROFILE (batchID, activationCode, imsi, rawIccid, iccidWithChecksum, iccidWithoutChecksum, iccid, ki, msisdn)
+         SELECT id, '', '242017100012213', '', '', '', '89148000000745809013', '', '' FROM BATCH`,
+	} {
+		_, err := old.Db.Exec(statement)
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, old.Db.Close())
+
+	db, err := OpenFileSqliteDatabase(path)
+	assert.NilError(t, err)
+	defer db.Db.Close()
+
+	version, err := db.SchemaVersion()
+	assert.NilError(t, err)
+	assert.Equal(t, LatestSchemaVersion(), version)
+
+	var portType string
+	assert.NilError(t, db.Db.Get(&portType, "SELECT typeof(es2PlusPort) FROM PROFILE_VENDOR"))
+	assert.Equal(t, "integer", portType)
+
+	vendor, err := db.GetProfileVendorByName("Durian")
+	assert.NilError(t, err)
+	assert.Equal(t, 4711, vendor.Es2PlusPort)
+	assert.Equal(t, "2.0.0", vendor.Es2PlusProtocolVersion)
+	endpoints, err := db.GetProfileVendorEndpoints(vendor.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(endpoints))
+	assert.Equal(t, 4711, endpoints[0].Port)
+
+	// Batches referring to profile vendors that were never declared
+	// get them declared.
+	undeclared, err := db.GetProfileVendorByName("Jackfruit")
+	assert.NilError(t, err)
+	assert.Assert(t, undeclared != nil)
+	entry, err := db.GetSimProfileByIccid("89148000000745809013")
+	assert.NilError(t, err)
+	assert.Equal(t, "242017100012213", entry.Imsi)
+
+	var foreignKeys int
+	assert.NilError(t, db.Db.Get(&foreignKeys, "PRAGMA foreign_keys"))
+	assert.Equal(t, 1, foreignKeys)
+
+	statuses, err := db.MigrationStatus()
+	assert.NilError(t, err)
+	for _, status := range statuses {
+		assert.Assert(t, status.AppliedAt != "", "migration %d not applied", status.Version)
+	}
+}
+
+func TestMigratingStepwiseAndRefusingNewerSchemas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbm-migrations")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "new.db")
+
+	db, err := OpenFileSqliteDatabaseWithoutMigrating(path)
+	assert.NilError(t, err)
+	defer db.Db.Close()
+
+	assert.NilError(t, db.MigrateTo(1))
+	version, err := db.SchemaVersion()
+	assert.NilError(t, err)
+	assert.Equal(t, 1, version)
+	statuses, err := db.MigrationStatus()
+	assert.NilError(t, err)
+	assert.Assert(t, statuses[0].AppliedAt != "")
+	assert.Equal(t, "", statuses[1].AppliedAt)
+
+	assert.NilError(t, db.Migrate())
+	assert.ErrorContains(t, db.MigrateTo(1), "not supported")
+	assert.ErrorContains(t, db.MigrateTo(LatestSchemaVersion()+1), "no schema version")
+
+	// A database migrated by a newer binary is refused.
+	_, err = db.Db.Exec("INSERT INTO SCHEMA_VERSION (version, description, appliedAt) VALUES (?, 'From the future', '')", LatestSchemaVersion()+1)
+	assert.NilError(t, err)
+	_, err = OpenFileSqliteDatabase(path)
+	assert.ErrorContains(t, err, "newer than version")
+}
+
+func TestFailingMigrationIsRolledBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbm-migrations")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := OpenFileSqliteDatabase(filepath.Join(dir, "failing.db"))
+	assert.NilError(t, err)
+	defer db.Db.Close()
+
+	defer func(original []Migration) { migrations = original }(migrations)
+	migrations = append(migrations[:len(migrations):len(migrations)], Migration{
+		Version:     LatestSchemaVersion() + 1,
+		Description: "Broken",
+		Statements:  []string{`CREATE TABLE BROKEN (id INTEGER)`, `INSERT INTO NO_SUCH_TABLE VALUES (1)`},
+	})
+	assert.ErrorContains(t, db.Migrate(), "Broken")
+
+	version, err := db.SchemaVersion()
+	assert.NilError(t, err)
+	assert.Equal(t, LatestSchemaVersion()-1, version)
+	var tables int
+	assert.NilError(t, db.Db.Get(&tables, "SELECT COUNT(*) FROM sqlite_master WHERE name = 'BROKEN'"))
+	assert.Equal(t, 0, tables)
+}
+
+func TestProfilesThatCantBeMigratedAreListed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbm-migrations")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "unclean.db")
+
+	old, err := OpenFileSqliteDatabaseWithoutMigrating(path)
+	assert.NilError(t, err)
+	defer old.Db.Close()
+	assert.NilError(t, old.MigrateTo(3))
+	for _, statement := range []string{
+		`INSERT INTO BATCH (id, name, profileVendor) VALUES (1, 'Unclean', 'Durian')`,
+		`INSERT INTO SIM_PROFILE (batchID, activationCode, imsi, rawIccid, iccidWithChecksum, iccidWithoutChecksum, iccid, ki, msisdn)
+         VALUES (1, '', '242017100012213', '', '', '', '89148000000745809013', '', ''),
+                (1, '', '242017100012214', '', '', '', '89148000000745809013', '', ''),
+                (1, '', '242017100012214', '', '', '', '89148000000745809021', '', ''),
+                (47, '', '242017100012215', '', '', '', '89148000000745809039', '', '')`,
+	} {
+		_, err := old.Db.Exec(statement)
+		assert.NilError(t, err)
+	}
+
+	err = old.Migrate()
+	assert.ErrorContains(t, err, "duplicate ICCIDs 89148000000745809013")
+	assert.ErrorContains(t, err, "duplicate IMSIs 242017100012214")
+	assert.ErrorContains(t, err, "SIM profiles of missing batches 47")
+
+	version, err := old.SchemaVersion()
+	assert.NilError(t, err)
+	assert.Equal(t, 3, version)
+	var profiles int
+	assert.NilError(t, old.Db.Get(&profiles, "SELECT COUNT(*) FROM SIM_PROFILE"))
+	assert.Equal(t, 4, profiles)
+}
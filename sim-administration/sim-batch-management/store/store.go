@@ -1,65 +1,97 @@
 package store
 
 import (
-	"database/sql"
 	"flag"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3" // We need this
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/fieldsyntaxchecks"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/logging"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/loltelutils"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
-	"log"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // SimBatchDB Holding database abstraction for the sim batch management system.
+// It is backed by either SQLite or PostgreSQL, see Open.
 type SimBatchDB struct {
 	Db *sqlx.DB
 }
 
 // Store is an interface used to abstract the CRUD operations on the
-// various entities in the sim batch management database.
+// various entities in the sim batch management database.  Changes to
+// batches, sim profiles and profile vendors are recorded in the audit
+// log in the same transaction, see GetAuditEntries.
 type Store interface {
 	GenerateTables() error
 	DropTables() error
+	Close() error
+
+	SchemaVersion() (int, error)
+	MigrationStatus() ([]MigrationStatus, error)
+	Migrate() error
+	MigrateTo(version int) error
 
 	CreateBatch(theBatch *model.Batch) error
-	GetAllBatches(id string) ([]model.Batch, error)
+	DeclareBatch(name string, addLuhn bool, customer string, batchNo string, orderDate string,
+		firstIccid string, lastIccid string, firstIMSI string, lastIMSI string, firstMsisdn string, lastMsisdn string,
+		profileType string, batchLengthString string, hssVendor string, uploadHostname string, uploadPortnumber string,
+		profileVendor string, initialHlrActivationStatusOfProfiles string) (*model.Batch, error)
+	GetAllBatches() ([]model.Batch, error)
 	GetBatchByID(id int64) (*model.Batch, error)
-	GetBatchByName(id string) (*model.Batch, error)
+	GetBatchByName(name string) (*model.Batch, error)
 
 	CreateSimEntry(simEntry *model.SimEntry) error
-	UpdateSimEntryMsisdn(simID int64, msisdn string)
+	UpdateSimEntryMsisdn(simID int64, msisdn string) error
+	UpdateSimEntryMsisdns(entries []model.SimEntry) error
 	UpdateActivationCode(simID int64, activationCode string) error
 	UpdateSimEntryKi(simID int64, ki string) error
+	UpdateSimEntryKis(entries []model.SimEntry) error
+	UpdateOrderParameters(simID int64, matchingID string, confirmationCode string) error
+	UpdateSmdpStatuses(entries []model.SimEntry) error
+	UpdateSmdpState(iccid string, state string, eid string, changedAt string) error
+	UpdateHssStateForBatch(batchID int64, state string) error
+	UpdatePrimeUploadStateForBatch(batchID int64, state string) error
+	GetSimEntryByID(simID int64) (*model.SimEntry, error)
 	GetAllSimEntriesForBatch(batchID int64) ([]model.SimEntry, error)
-	GetSimProfileByIccid(msisdn string) (*model.SimEntry, error)
+	GetSimProfileByIccid(iccid string) (*model.SimEntry, error)
+	GetSimProfileByImsi(imsi string) (*model.SimEntry, error)
 
 	CreateProfileVendor(*model.ProfileVendor) error
 	GetProfileVendorByID(id int64) (*model.ProfileVendor, error)
 	GetProfileVendorByName(name string) (*model.ProfileVendor, error)
-
-	Begin()
+	GetAllProfileVendors() ([]model.ProfileVendor, error)
+	UpdateProfileVendorCertificate(vendor *model.ProfileVendor) error
+	UpdateProfileVendorProtocol(id int64, protocolVersion string, dialect string) error
+	UpdateProfileVendorRateLimits(id int64, requestsPerSecond float64, maxInFlight int) error
+
+	CreateProfileVendorEndpoint(endpoint *model.ProfileVendorEndpoint) error
+	GetProfileVendorEndpoints(profileVendorID int64) ([]model.ProfileVendorEndpoint, error)
+	DeleteProfileVendorEndpoint(id int64) error
+	UpdateProfileVendorEndpointHealth(id int64, failedAt string, lastError string) error
+
+	CreateDownloadProgressEvent(event *model.DownloadProgressEvent) error
+	RecordDownloadProgress(event *model.DownloadProgressEvent, state string) (bool, error)
+	GetDownloadProgressEventsForSimProfile(simID int64) ([]model.DownloadProgressEvent, error)
+
+	CreateJob(job *model.Job, iccids []string) error
+	GetAllJobs() ([]model.Job, error)
+	GetJobByID(id int64) (*model.Job, error)
+	UpdateJobState(id int64, state string, endedAt string) error
+	GetJobItems(jobID int64) ([]model.JobItem, error)
+	UpdateJobItem(item *model.JobItem) error
+
+	GetAuditEntries(iccid string, batchID int64, since string, until string) ([]model.AuditEntry, error)
 }
 
-// Begin starts a transaction, returns the
-// transaction objects. If for some reason the transaction
-// can't be started, the functioni will terminate the program
-// via panic.
-func (sdb *SimBatchDB) Begin() *sql.Tx {
-	tx, err := sdb.Db.Begin()
-	if err != nil {
-		panic(err)
-	}
-	return tx
-}
+var _ Store = &SimBatchDB{}
 
 // NewInMemoryDatabase creates a new in-memory instance of an SQLIte database
 func NewInMemoryDatabase() (*SimBatchDB, error) {
-	db, err := sqlx.Connect("sqlite3", ":memory:")
+	db, err := sqlx.Connect(DriverSqlite, withForeignKeys(":memory:"))
 	if err != nil {
 		return nil, err
 	}
@@ -72,44 +104,47 @@ func NewInMemoryDatabase() (*SimBatchDB, error) {
 	return &SimBatchDB{Db: db}, nil
 }
 
-// OpenFileSqliteDatabaseFromPathInEnvironmentVariable creates
-// a new  instance of an SQLIte database backed by a file whose path
-// is found in the named environment variable. If the
-// file doesn't exist, then it is created.  If the environment variable is not
+// OpenFromEnvironmentVariable opens the database whose DSN is found in
+// the named environment variable, see Open.  If the environment
+// variable is not defined or empty, an error is returned.
+func OpenFromEnvironmentVariable(variablename string) (*SimBatchDB, error) {
+	dsn, err := DSNFromEnvironmentVariable(variablename)
+	if err != nil {
+		return nil, err
+	}
+	return Open(dsn)
+}
+
+// DSNFromEnvironmentVariable returns the DSN of the database found in
+// the named environment variable.  If the environment variable is not
 // defined or empty, an error is returned.
-func OpenFileSqliteDatabaseFromPathInEnvironmentVariable(variablename string) (*SimBatchDB, error) {
+func DSNFromEnvironmentVariable(variablename string) (string, error) {
 	variableValue := strings.TrimSpace(os.Getenv(variablename))
 	if variableValue == "" {
-		return nil, fmt.Errorf("environment variable '%s' is empty, is should contain the path to a sqlite database used by this program.  The file will be created if it's not there, but the path can't be empty", variablename)
+		return "", fmt.Errorf("environment variable '%s' is empty, is should contain the path to a sqlite database used by this program, or the DSN of a PostgreSQL database.  A sqlite file will be created if it's not there, but the path can't be empty", variablename)
 	}
-	db, err := OpenFileSqliteDatabase(variableValue)
-	return db, err
+	return variableValue, nil
 }
 
 // OpenFileSqliteDatabase creates a new  instance of an SQLIte database backed by a file. If the
-// file doesn't exist, then it is created.
+// file doesn't exist, then it is created.  The schema migrations not yet
+// applied to the database are applied, and a database with a newer
+// schema than this binary knows about is refused.
 func OpenFileSqliteDatabase(path string) (*SimBatchDB, error) {
+	return Open("sqlite:" + path)
+}
 
-	/*  TODO: Introduce 'debug' flag, and let that flag light up this code.
-	if _, err := os.Stat(path); err == nil {
-		log.Printf("Using database file  at '%s'", path)
-	} else  {
-		log.Printf("No databasefile found at '%s', will create one", path)
-	}
-	*/
-
-	db, err := sqlx.Open("sqlite3", path)
-	if err != nil {
-		return nil, err
-	}
-	return &SimBatchDB{Db: db}, nil
+// OpenFileSqliteDatabaseWithoutMigrating opens a database like
+// OpenFileSqliteDatabase does, but leaves its schema alone.
+func OpenFileSqliteDatabaseWithoutMigrating(path string) (*SimBatchDB, error) {
+	return OpenWithoutMigrating("sqlite:" + path)
 }
 
 // GetAllBatches gets a slice containing all the batches in the database
 func (sdb SimBatchDB) GetAllBatches() ([]model.Batch, error) {
 	//noinspection GoPreferNilSlice
 	result := []model.Batch{}
-	return result, sdb.Db.Select(&result, "SELECT * from BATCH")
+	return result, selectQuery(sdb.Db, &result, "SELECT * from BATCH")
 }
 
 // GetBatchByID gets a batch identified by its datbase ID number.   If nothing is found
@@ -117,10 +152,9 @@ func (sdb SimBatchDB) GetAllBatches() ([]model.Batch, error) {
 func (sdb SimBatchDB) GetBatchByID(id int64) (*model.Batch, error) {
 	//noinspection GoPreferNilSlice
 	result := []model.Batch{}
-	if err := sdb.Db.Select(&result, "SELECT * FROM BATCH WHERE id = ?", id); err != nil {
+	if err := selectQuery(sdb.Db, &result, "SELECT * FROM BATCH WHERE id = ?", id); err != nil {
 		return nil, err
 	} else if len(result) == 0 {
-		fmt.Println("returning null")
 		return nil, nil
 	} else {
 		return &(result[0]), nil
@@ -132,7 +166,7 @@ func (sdb SimBatchDB) GetBatchByID(id int64) (*model.Batch, error) {
 func (sdb SimBatchDB) GetBatchByName(name string) (*model.Batch, error) {
 	//noinspection GoPreferNilSlice
 	result := []model.Batch{}
-	if err := sdb.Db.Select(&result, "select * from BATCH where name = ?", name); err != nil {
+	if err := selectQuery(sdb.Db, &result, "select * from BATCH where name = ?", name); err != nil {
 		return nil, err
 	} else if len(result) == 0 {
 		return nil, nil
@@ -147,79 +181,67 @@ func (sdb SimBatchDB) GetBatchByName(name string) (*model.Batch, error) {
 // "theBatch" parameter.
 func (sdb SimBatchDB) CreateBatch(theBatch *model.Batch) error {
 	// TODO: mutex?
+	return sdb.withTx(func(tx *sqlx.Tx) error {
+		if err := createBatch(tx, theBatch); err != nil {
+			return batchConstraintError(theBatch, err)
+		}
+		return nil
+	})
+}
 
-	res, err := sdb.Db.NamedExec("INSERT INTO BATCH (name, filenameBase, orderDate, customer, profileType, batchNo, quantity, profileVendor) values (:name, :filenameBase, :orderDate, :customer, :profileType, :batchNo, :quantity, :profileVendor)",
-		theBatch,
-	)
-
+// withTx runs a function in a transaction, which is committed if the
+// function succeeds, and rolled back if it fails or panics.  It is
+// rolled back before withTx returns, so that the error can be explained
+// by looking up what is already in the database, e.g. the sim profile
+// that a new one clashes with, without waiting for the transaction.
+func (sdb SimBatchDB) withTx(f func(tx *sqlx.Tx) error) error {
+	tx, err := sdb.Db.Beginx()
 	if err != nil {
-		return fmt.Errorf("failed to insert new batch '%s'", err)
+		return err
 	}
+	// Rolling back is a no-op after a successful commit.
+	defer tx.Rollback()
 
-	id, err := res.LastInsertId()
-	if err != nil {
-		return fmt.Errorf("getting last inserted id failed '%s'", err)
+	if err := f(tx); err != nil {
+		return err
 	}
-	theBatch.BatchID = id
-
-	_, err = sdb.Db.NamedExec("UPDATE BATCH  SET firstIccid = :firstIccid, firstImsi = :firstImsi, firstMsisdn = :firstMsisdn, msisdnIncrement = :msisdnIncrement, iccidIncrement = :iccidIncrement, imsiIncrement = :imsiIncrement, url=:url WHERE id = :id",
-		theBatch)
-
-	return err
+	return tx.Commit()
 }
 
-// GenerateTables will, if they don't already exist, then generate the tables used by the
-// store package.
-func (sdb *SimBatchDB) GenerateTables() error {
-	s := `CREATE TABLE IF NOT EXISTS BATCH (
-     id integer primary key autoincrement,
-	 name VARCHAR NOT NULL UNIQUE,
-	 profileVendor VARCHAR NOT NULL,
-	 filenameBase VARCHAR,
-	 customer VARCHAR,
-	 profileType VARCHAR,
-	 orderDate VARCHAR,
-	 batchNo VARCHAR,
-	 quantity INTEGER,
-	 firstIccid VARCHAR,
-	 firstImsi VARCHAR,
-	 firstMsisdn VARCHAR,
-	 msisdnIncrement INTEGER,
-	 imsiIncrement INTEGER,
-	 iccidIncrement INTEGER,
-	 url VARCHAR)`
-	_, err := sdb.Db.Exec(s)
+func createBatch(ext sqlx.Ext, theBatch *model.Batch) error {
+	id, err := namedInsert(ext, "INSERT INTO BATCH (name, filenameBase, orderDate, customer, profileType, batchNo, quantity, profileVendor) values (:name, :filenameBase, :orderDate, :customer, :profileType, :batchNo, :quantity, :profileVendor)",
+		theBatch,
+	)
+
 	if err != nil {
 		return err
 	}
+	theBatch.BatchID = id
 
-	s = `CREATE TABLE IF NOT EXISTS SIM_PROFILE (
-         id INTEGER PRIMARY KEY AUTOINCREMENT,
-         batchID INTEGER NOT NULL,
-         activationCode VARCHAR NOT NULL,
-         imsi VARCHAR NOT NULL,
-         rawIccid VARCHAR NOT NULL,
-         iccidWithChecksum VARCHAR NOT NULL,
-         iccidWithoutChecksum VARCHAR NOT NULL,
-         iccid VARCHAR NOT NULL,
-         ki VARCHAR NOT NULL,
-         msisdn VARCHAR NOT NULL)`
-	_, err = sdb.Db.Exec(s)
+	_, err = namedExec(ext, "UPDATE BATCH  SET firstIccid = :firstIccid, firstImsi = :firstImsi, firstMsisdn = :firstMsisdn, msisdnIncrement = :msisdnIncrement, iccidIncrement = :iccidIncrement, imsiIncrement = :imsiIncrement, url=:url WHERE id = :id",
+		theBatch)
 	if err != nil {
 		return err
 	}
 
-	s = `CREATE TABLE IF NOT EXISTS PROFILE_VENDOR (
-         id INTEGER PRIMARY KEY AUTOINCREMENT,
-         name VARCHAR NOT NULL UNIQUE,
-         es2PlusCertPath  VARCHAR,
-         es2PlusKeyPath VARCHAR,
-         es2PlusHostPath VARCHAR,
-         es2PlusPort VARCHAR,
-         es2PlusRequesterId VARCHAR)`
-	_, err = sdb.Db.Exec(s)
+	return auditCreation(ext, AuditEntityBatch, theBatch, theBatch.Name)
+}
 
-	return err
+// batchConstraintError explains why a batch couldn't be inserted.
+func batchConstraintError(theBatch *model.Batch, err error) error {
+	if column, ok := uniqueViolation(err); ok && column == "name" {
+		return fmt.Errorf("a batch named '%s' already exists", theBatch.Name)
+	}
+	if foreignKeyViolation(err) {
+		return fmt.Errorf("unknown profile vendor: '%s'", theBatch.ProfileVendor)
+	}
+	return fmt.Errorf("failed to insert new batch '%s'", err)
+}
+
+// GenerateTables brings the tables used by the store package up to
+// date, by applying the schema migrations not yet applied.
+func (sdb *SimBatchDB) GenerateTables() error {
+	return sdb.Migrate()
 }
 
 //CreateProfileVendor inject a new profile vendor instance into the database.
@@ -231,27 +253,148 @@ func (sdb SimBatchDB) CreateProfileVendor(theEntry *model.ProfileVendor) error {
 		return fmt.Errorf("duplicate profile vendor named %s,  %v", theEntry.Name, vendor)
 	}
 
-	res, err := sdb.Db.NamedExec(`
-       INSERT INTO PROFILE_VENDOR (name,   es2PlusCertPath,  es2PlusKeyPath,  es2PlusHostPath,  es2PlusPort, es2PlusRequesterId)
-                           VALUES (:name, :es2PlusCertPath, :es2PlusKeyPath, :es2PlusHostPath, :es2PlusPort, :es2PlusRequesterId)`,
-		theEntry)
+	err := sdb.withTx(func(tx *sqlx.Tx) error {
+		id, err := namedInsert(tx, `
+       INSERT INTO PROFILE_VENDOR (name,   es2PlusCertPath,  es2PlusKeyPath,  es2PlusHostPath,  es2PlusPort, es2PlusRequesterId,  es2PlusCertSubject,  es2PlusCertIssuer,  es2PlusCertSerial,  es2PlusCertNotAfter,  es2PlusMaxIccidsPerRequest,  es2PlusTimeoutSeconds,  es2PlusCaBundlePath,  es2PlusPinnedSpkiSha256,  es2PlusServerName,  es2PlusInsecureSkipVerify,  es2PlusRequestsPerSecond,  es2PlusMaxInFlight,  es2PlusProtocolVersion,  es2PlusDialect)
+                           VALUES (:name, :es2PlusCertPath, :es2PlusKeyPath, :es2PlusHostPath, :es2PlusPort, :es2PlusRequesterId, :es2PlusCertSubject, :es2PlusCertIssuer, :es2PlusCertSerial, :es2PlusCertNotAfter, :es2PlusMaxIccidsPerRequest, :es2PlusTimeoutSeconds, :es2PlusCaBundlePath, :es2PlusPinnedSpkiSha256, :es2PlusServerName, :es2PlusInsecureSkipVerify, :es2PlusRequestsPerSecond, :es2PlusMaxInFlight, :es2PlusProtocolVersion, :es2PlusDialect)`,
+			theEntry)
+		if err != nil {
+			return err
+		}
+
+		// The host and port the vendor is declared with is its first endpoint.
+		_, err = execQuery(tx, "INSERT INTO PROFILE_VENDOR_ENDPOINT (profileVendorID, position, host, port) VALUES (?, 0, ?, ?)",
+			id, theEntry.Es2PlusHost, theEntry.Es2PlusPort)
+		if err != nil {
+			return fmt.Errorf("failed to insert endpoint of profile vendor '%s'", err)
+		}
+
+		theEntry.ID = id
+		return auditCreation(tx, AuditEntityProfileVendor, theEntry, theEntry.Name)
+	})
 	if err != nil {
-		return err
+		theEntry.ID = 0
 	}
+	return err
+}
+
+// CreateProfileVendorEndpoint adds an endpoint to a profile vendor.  The
+// endpoint goes before those at the same or later positions, or last
+// if its position is negative.
+func (sdb SimBatchDB) CreateProfileVendorEndpoint(theEntry *model.ProfileVendorEndpoint) error {
+	err := sdb.withTx(func(tx *sqlx.Tx) error {
+		var err error
+		if theEntry.Position < 0 {
+			err = getQuery(tx, &theEntry.Position, "SELECT COALESCE(MAX(position) + 1, 0) FROM PROFILE_VENDOR_ENDPOINT WHERE profileVendorID = ?", theEntry.ProfileVendorID)
+		} else {
+			_, err = execQuery(tx, "UPDATE PROFILE_VENDOR_ENDPOINT SET position = position + 1 WHERE profileVendorID = ? AND position >= ?", theEntry.ProfileVendorID, theEntry.Position)
+		}
+		if err != nil {
+			return err
+		}
 
-	id, err := res.LastInsertId()
+		id, err := namedInsert(tx, `
+       INSERT INTO PROFILE_VENDOR_ENDPOINT (profileVendorID,  position,  host,  port,  failedAt,  lastError)
+                                    VALUES (:profileVendorID, :position, :host, :port, :failedAt, :lastError)`,
+			theEntry)
+		if err != nil {
+			return fmt.Errorf("failed to insert endpoint %s:%d '%s'", theEntry.Host, theEntry.Port, err)
+		}
+
+		theEntry.ID = id
+		return auditCreation(tx, AuditEntityProfileVendorEndpoint, theEntry, fmt.Sprintf("%s:%d", theEntry.Host, theEntry.Port))
+	})
 	if err != nil {
-		return fmt.Errorf("getting last inserted id failed '%s'", err)
+		theEntry.ID = 0
 	}
-	theEntry.ID = id
-	return nil
+	return err
+}
+
+// GetProfileVendorEndpoints returns the endpoints of a profile vendor,
+// in order of preference.
+func (sdb SimBatchDB) GetProfileVendorEndpoints(profileVendorID int64) ([]model.ProfileVendorEndpoint, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.ProfileVendorEndpoint{}
+	return result, selectQuery(sdb.Db, &result, "SELECT * FROM PROFILE_VENDOR_ENDPOINT WHERE profileVendorID = ? ORDER BY position, id", profileVendorID)
+}
+
+// DeleteProfileVendorEndpoint removes an endpoint from its profile vendor.
+func (sdb SimBatchDB) DeleteProfileVendorEndpoint(id int64) error {
+	return sdb.withTx(func(tx *sqlx.Tx) error {
+		//noinspection GoPreferNilSlice
+		endpoints := []model.ProfileVendorEndpoint{}
+		if err := selectQuery(tx, &endpoints, "SELECT * FROM PROFILE_VENDOR_ENDPOINT WHERE id = ?", id); err != nil {
+			return err
+		}
+		if _, err := execQuery(tx, "DELETE FROM PROFILE_VENDOR_ENDPOINT WHERE id = ?", id); err != nil {
+			return err
+		}
+		for _, endpoint := range endpoints {
+			if err := auditDeletion(tx, AuditEntityProfileVendorEndpoint, endpoint, fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateProfileVendorEndpointHealth records when an endpoint last failed,
+// and how.  Empty values mean it has responded since.  This is
+// operational state, not configuration, so it isn't audited.
+func (sdb SimBatchDB) UpdateProfileVendorEndpointHealth(id int64, failedAt string, lastError string) error {
+	_, err := execQuery(sdb.Db, "UPDATE PROFILE_VENDOR_ENDPOINT SET failedAt = ?, lastError = ? WHERE id = ?", failedAt, lastError, id)
+	return err
+}
+
+// UpdateProfileVendorRateLimits sets the limits on the ES2+ traffic sent to the
+// SM-DP+ of a persisted profile vendor.
+func (sdb SimBatchDB) UpdateProfileVendorRateLimits(id int64, requestsPerSecond float64, maxInFlight int) error {
+	return sdb.updateAudited(AuditEntityProfileVendor, func(tx *sqlx.Tx) error {
+		_, err := namedExec(tx, "UPDATE PROFILE_VENDOR SET es2PlusRequestsPerSecond=:requestsPerSecond, es2PlusMaxInFlight=:maxInFlight WHERE id = :id",
+			map[string]interface{}{
+				"id":                id,
+				"requestsPerSecond": requestsPerSecond,
+				"maxInFlight":       maxInFlight,
+			})
+		return err
+	}, "id = ?", id)
+}
+
+// UpdateProfileVendorCertificate replaces the client certificate and key of a
+// persisted profile vendor, and what is recorded about the certificate.
+func (sdb SimBatchDB) UpdateProfileVendorCertificate(vendor *model.ProfileVendor) error {
+	return sdb.updateAudited(AuditEntityProfileVendor, func(tx *sqlx.Tx) error {
+		_, err := namedExec(tx, `
+       UPDATE PROFILE_VENDOR SET es2PlusCertPath=:es2PlusCertPath, es2PlusKeyPath=:es2PlusKeyPath,
+              es2PlusCertSubject=:es2PlusCertSubject, es2PlusCertIssuer=:es2PlusCertIssuer,
+              es2PlusCertSerial=:es2PlusCertSerial, es2PlusCertNotAfter=:es2PlusCertNotAfter
+       WHERE id = :id`,
+			vendor)
+		return err
+	}, "id = ?", vendor.ID)
+}
+
+// UpdateProfileVendorProtocol sets the ES2+ protocol version and dialect
+// spoken by the SM-DP+ of a persisted profile vendor.
+func (sdb SimBatchDB) UpdateProfileVendorProtocol(id int64, protocolVersion string, dialect string) error {
+	return sdb.updateAudited(AuditEntityProfileVendor, func(tx *sqlx.Tx) error {
+		_, err := execQuery(tx, "UPDATE PROFILE_VENDOR SET es2PlusProtocolVersion=?, es2PlusDialect=? WHERE id = ?", protocolVersion, dialect, id)
+		return err
+	}, "id = ?", id)
+}
+
+// GetAllProfileVendors returns all the profile vendors, ordered by name.
+func (sdb SimBatchDB) GetAllProfileVendors() ([]model.ProfileVendor, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.ProfileVendor{}
+	return result, selectQuery(sdb.Db, &result, "SELECT * FROM PROFILE_VENDOR ORDER BY name")
 }
 
 // GetProfileVendorByID find a profile vendor in the database by looking it up by name.
 func (sdb SimBatchDB) GetProfileVendorByID(id int64) (*model.ProfileVendor, error) {
 	//noinspection GoPreferNilSlice
 	result := []model.ProfileVendor{}
-	if err := sdb.Db.Select(&result, "select * from PROFILE_VENDOR where id = ?", id); err != nil {
+	if err := selectQuery(sdb.Db, &result, "select * from PROFILE_VENDOR where id = ?", id); err != nil {
 		return nil, err
 	}
 
@@ -266,7 +409,7 @@ func (sdb SimBatchDB) GetProfileVendorByID(id int64) (*model.ProfileVendor, erro
 func (sdb SimBatchDB) GetProfileVendorByName(name string) (*model.ProfileVendor, error) {
 	//noinspection GoPreferNilSlice
 	result := []model.ProfileVendor{}
-	if err := sdb.Db.Select(&result, "select * from PROFILE_VENDOR where name = ?", name); err != nil {
+	if err := selectQuery(sdb.Db, &result, "select * from PROFILE_VENDOR where name = ?", name); err != nil {
 		return nil, err
 	}
 
@@ -279,8 +422,17 @@ func (sdb SimBatchDB) GetProfileVendorByName(name string) (*model.ProfileVendor,
 
 // CreateSimEntry persists a SimEntry instance in the database.
 func (sdb SimBatchDB) CreateSimEntry(theEntry *model.SimEntry) error {
+	err := sdb.withTx(func(tx *sqlx.Tx) error {
+		return createSimEntry(tx, theEntry)
+	})
+	if err != nil {
+		return sdb.simEntryConstraintError(theEntry, err)
+	}
+	return nil
+}
 
-	res := sdb.Db.MustExec("INSERT INTO SIM_PROFILE (batchID, activationCode, rawIccid, iccidWithChecksum, iccidWithoutChecksum, iccid, imsi, msisdn, ki) values (?,?,?,?,?,?,?,?,?)",
+func createSimEntry(ext sqlx.Ext, theEntry *model.SimEntry) error {
+	id, err := insert(ext, "INSERT INTO SIM_PROFILE (batchID, activationCode, rawIccid, iccidWithChecksum, iccidWithoutChecksum, iccid, imsi, msisdn, ki) values (?,?,?,?,?,?,?,?,?)",
 		theEntry.BatchID,
 		theEntry.ActivationCode,
 		theEntry.RawIccid,
@@ -291,13 +443,38 @@ func (sdb SimBatchDB) CreateSimEntry(theEntry *model.SimEntry) error {
 		theEntry.Msisdn,
 		theEntry.Ki,
 	)
-
-	id, err := res.LastInsertId()
 	if err != nil {
-		return fmt.Errorf("getting last inserted id failed '%s'", err)
+		return err
 	}
 	theEntry.ID = id
-	return err
+	return auditCreation(ext, AuditEntitySimProfile, theEntry, theEntry.Iccid)
+}
+
+// simEntryConstraintError explains why a sim profile couldn't be
+// inserted, naming the batch already holding its ICCID or IMSI.
+func (sdb SimBatchDB) simEntryConstraintError(theEntry *model.SimEntry, err error) error {
+	column, unique := uniqueViolation(err)
+	var existing *model.SimEntry
+	switch {
+	case unique && column == "iccid":
+		existing, _ = sdb.GetSimProfileByIccid(theEntry.Iccid)
+	case unique && column == "imsi":
+		existing, _ = sdb.GetSimProfileByImsi(theEntry.Imsi)
+	case foreignKeyViolation(err):
+		return fmt.Errorf("failed to insert sim profile '%s': there is no batch with id %d", theEntry.Iccid, theEntry.BatchID)
+	}
+	if existing == nil {
+		return fmt.Errorf("failed to insert sim profile '%s': %s", theEntry.Iccid, err)
+	}
+
+	batchName := fmt.Sprintf("with id %d", existing.BatchID)
+	if batch, _ := sdb.GetBatchByID(existing.BatchID); batch != nil {
+		batchName = fmt.Sprintf("'%s'", batch.Name)
+	}
+	if column == "iccid" {
+		return fmt.Errorf("failed to insert sim profile '%s': ICCID '%s' is already used by batch %s", theEntry.Iccid, theEntry.Iccid, batchName)
+	}
+	return fmt.Errorf("failed to insert sim profile '%s': IMSI '%s' is already used by ICCID '%s' in batch %s", theEntry.Iccid, theEntry.Imsi, existing.Iccid, batchName)
 }
 
 // GetSimEntryByID retrieves a sim entryh instance stored in the database.  If no
@@ -305,7 +482,7 @@ func (sdb SimBatchDB) CreateSimEntry(theEntry *model.SimEntry) error {
 func (sdb SimBatchDB) GetSimEntryByID(simID int64) (*model.SimEntry, error) {
 	//noinspection GoPreferNilSlice
 	result := []model.SimEntry{}
-	if err := sdb.Db.Select(&result, "select * from SIM_PROFILE where id = ?", simID); err != nil {
+	if err := selectQuery(sdb.Db, &result, "select * from SIM_PROFILE where id = ?", simID); err != nil {
 		return nil, err
 	}
 
@@ -321,7 +498,7 @@ func (sdb SimBatchDB) GetSimEntryByID(simID int64) (*model.SimEntry, error) {
 func (sdb SimBatchDB) GetAllSimEntriesForBatch(batchID int64) ([]model.SimEntry, error) {
 	//noinspection GoPreferNilSlice
 	result := []model.SimEntry{}
-	if err := sdb.Db.Select(&result, "SELECT * from SIM_PROFILE WHERE batchID = ?", batchID); err != nil {
+	if err := selectQuery(sdb.Db, &result, "SELECT * from SIM_PROFILE WHERE batchID = ?", batchID); err != nil {
 		return nil, err
 	}
 
@@ -336,7 +513,7 @@ func (sdb SimBatchDB) GetAllSimEntriesForBatch(batchID int64) ([]model.SimEntry,
 func (sdb SimBatchDB) GetSimProfileByIccid(iccid string) (*model.SimEntry, error) {
 	//noinspection GoPreferNilSlice
 	result := []model.SimEntry{}
-	if err := sdb.Db.Select(&result, "select * from SIM_PROFILE where iccid = ?", iccid); err != nil {
+	if err := selectQuery(sdb.Db, &result, "select * from SIM_PROFILE where iccid = ?", iccid); err != nil {
 		return nil, err
 	}
 
@@ -352,7 +529,7 @@ func (sdb SimBatchDB) GetSimProfileByIccid(iccid string) (*model.SimEntry, error
 func (sdb SimBatchDB) GetSimProfileByImsi(imsi string) (*model.SimEntry, error) {
 	//noinspection GoPreferNilSlice
 	result := []model.SimEntry{}
-	if err := sdb.Db.Select(&result, "select * from SIM_PROFILE where imsi = ?", imsi); err != nil {
+	if err := selectQuery(sdb.Db, &result, "select * from SIM_PROFILE where imsi = ?", imsi); err != nil {
 		return nil, err
 	}
 
@@ -364,46 +541,339 @@ func (sdb SimBatchDB) GetSimProfileByImsi(imsi string) (*model.SimEntry, error)
 
 // UpdateSimEntryMsisdn Sets the MSISDN field of a persisted instance of a sim entry.
 func (sdb SimBatchDB) UpdateSimEntryMsisdn(simID int64, msisdn string) error {
-	_, err := sdb.Db.NamedExec("UPDATE SIM_PROFILE SET msisdn=:msisdn WHERE id = :simID",
-		map[string]interface{}{
-			"simID":  simID,
-			"msisdn": msisdn,
-		})
-	return err
+	return sdb.UpdateSimEntryMsisdns([]model.SimEntry{{ID: simID, Msisdn: msisdn}})
+}
+
+// UpdateSimEntryMsisdns Sets the MSISDN fields of the persisted sim entries
+// with the IDs of the entries, all in one transaction.
+func (sdb SimBatchDB) UpdateSimEntryMsisdns(entries []model.SimEntry) error {
+	return sdb.withTx(func(tx *sqlx.Tx) error {
+		for _, entry := range entries {
+			err := auditedUpdate(tx, AuditEntitySimProfile, func() error {
+				_, err := namedExec(tx, "UPDATE SIM_PROFILE SET msisdn=:msisdn WHERE id = :simID",
+					map[string]interface{}{
+						"simID":  entry.ID,
+						"msisdn": entry.Msisdn,
+					})
+				return err
+			}, "id = ?", entry.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // UpdateSimEntryKi Sets the Ki field of a persisted instance of a sim entry.
 func (sdb SimBatchDB) UpdateSimEntryKi(simID int64, ki string) error {
-	_, err := sdb.Db.NamedExec("UPDATE SIM_PROFILE SET ki=:ki WHERE id = :simID",
-		map[string]interface{}{
-			"simID": simID,
-			"ki":    ki,
-		})
-	return err
+	return sdb.UpdateSimEntryKis([]model.SimEntry{{ID: simID, Ki: ki}})
+}
+
+// UpdateSimEntryKis Sets the Ki fields of the persisted sim entries with
+// the IDs of the entries, all in one transaction.
+func (sdb SimBatchDB) UpdateSimEntryKis(entries []model.SimEntry) error {
+	return sdb.withTx(func(tx *sqlx.Tx) error {
+		for _, entry := range entries {
+			err := auditedUpdate(tx, AuditEntitySimProfile, func() error {
+				_, err := namedExec(tx, "UPDATE SIM_PROFILE SET ki=:ki WHERE id = :simID",
+					map[string]interface{}{
+						"simID": entry.ID,
+						"ki":    entry.Ki,
+					})
+				return err
+			}, "id = ?", entry.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // UpdateActivationCode Sets the activation code field of a persisted instance of a sim entry.
 func (sdb SimBatchDB) UpdateActivationCode(simID int64, activationCode string) error {
-	_, err := sdb.Db.NamedExec("UPDATE SIM_PROFILE SET activationCode=:activationCode WHERE id = :simID",
-		map[string]interface{}{
-			"simID":          simID,
-			"activationCode": activationCode,
-		})
+	return sdb.updateAudited(AuditEntitySimProfile, func(tx *sqlx.Tx) error {
+		_, err := namedExec(tx, "UPDATE SIM_PROFILE SET activationCode=:activationCode WHERE id = :simID",
+			map[string]interface{}{
+				"simID":          simID,
+				"activationCode": activationCode,
+			})
+		return err
+	}, "id = ?", simID)
+}
+
+// UpdateOrderParameters Sets the matching ID and confirmation code chosen when
+// ordering the profile of a persisted instance of a sim entry.
+func (sdb SimBatchDB) UpdateOrderParameters(simID int64, matchingID string, confirmationCode string) error {
+	return sdb.updateAudited(AuditEntitySimProfile, func(tx *sqlx.Tx) error {
+		_, err := namedExec(tx, "UPDATE SIM_PROFILE SET matchingId=:matchingId, confirmationCode=:confirmationCode WHERE id = :simID",
+			map[string]interface{}{
+				"simID":            simID,
+				"matchingId":       matchingID,
+				"confirmationCode": confirmationCode,
+			})
+		return err
+	}, "id = ?", simID)
+}
+
+// UpdateSmdpStatuses records the SM-DP+ state, EID, lock flag and status
+// timestamp of the sim profiles with the ICCIDs of the entries, all in
+// one transaction.  Entries with ICCIDs that aren't in the database are
+// ignored, and so are entries older than the status already reported by
+// the SM-DP+, so that responses arriving out of order don't set a profile
+// back.
+func (sdb SimBatchDB) UpdateSmdpStatuses(entries []model.SimEntry) error {
+	return sdb.withTx(func(tx *sqlx.Tx) error {
+		for _, entry := range entries {
+			err := auditedUpdate(tx, AuditEntitySimProfile, func() error {
+				if stale, err := staleStatus(tx, "statusUpdatedAt", entry.Iccid, entry.StatusUpdatedAt); err != nil || stale {
+					return err
+				}
+				_, err := execQuery(tx, "UPDATE SIM_PROFILE SET smdpState = ?, eid = ?, lockFlag = ?, statusUpdatedAt = ? WHERE iccid = ?",
+					entry.SmdpState, entry.Eid, entry.LockFlag, entry.StatusUpdatedAt, entry.Iccid)
+				return err
+			}, "iccid = ?", entry.Iccid)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateSmdpState records the SM-DP+ state an ES2+ invocation took the
+// sim profile with an ICCID to, at changedAt by the local clock.  The EID
+// is only changed if one is given, and nothing is changed if the state
+// was changed later than changedAt.
+func (sdb SimBatchDB) UpdateSmdpState(iccid string, state string, eid string, changedAt string) error {
+	return sdb.updateAudited(AuditEntitySimProfile, func(tx *sqlx.Tx) error {
+		return updateSmdpState(tx, "stateChangedAt", iccid, state, eid, changedAt)
+	}, "iccid = ?", iccid)
+}
+
+// updateSmdpState records the SM-DP+ state of a sim profile, unless it is
+// older than the timestamp in column, which is statusUpdatedAt for states
+// reported by the SM-DP+ and stateChangedAt for changes made through ES2+.
+// The SM-DP+ and the local clock needn't agree, so timestamps from the one
+// are never compared with timestamps from the other.
+func updateSmdpState(tx *sqlx.Tx, column string, iccid string, state string, eid string, at string) error {
+	if stale, err := staleStatus(tx, column, iccid, at); err != nil || stale {
+		return err
+	}
+	if eid == "" {
+		_, err := execQuery(tx, "UPDATE SIM_PROFILE SET smdpState = ?, "+column+" = ? WHERE iccid = ?", state, at, iccid)
+		return err
+	}
+	_, err := execQuery(tx, "UPDATE SIM_PROFILE SET smdpState = ?, eid = ?, "+column+" = ? WHERE iccid = ?", state, eid, at, iccid)
 	return err
 }
 
-// DropTables Drop all tables used by the store package.
-func (sdb *SimBatchDB) DropTables() error {
-	foo := `DROP  TABLE BATCH`
-	_, err := sdb.Db.Exec(foo)
+// staleStatus is true if the timestamp in column of the sim profile with
+// an ICCID is later than at.  The timestamps are compared as times, since
+// they needn't be in the same time zone, and a timestamp that can't be
+// parsed is never considered stale.
+func staleStatus(tx *sqlx.Tx, column string, iccid string, at string) (bool, error) {
+	//noinspection GoPreferNilSlice
+	recorded := []string{}
+	if err := selectQuery(tx, &recorded, "SELECT "+column+" FROM SIM_PROFILE WHERE iccid = ?", iccid); err != nil {
+		return false, err
+	}
+	if len(recorded) == 0 {
+		return false, nil
+	}
+	recordedAt, err := time.Parse(time.RFC3339, recorded[0])
+	if err != nil {
+		return false, nil
+	}
+	atTime, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return false, nil
+	}
+	return atTime.Before(recordedAt), nil
+}
+
+// UpdateHssStateForBatch sets the HSS state of all the sim profiles in a batch.
+func (sdb SimBatchDB) UpdateHssStateForBatch(batchID int64, state string) error {
+	return sdb.updateAudited(AuditEntitySimProfile, func(tx *sqlx.Tx) error {
+		_, err := execQuery(tx, "UPDATE SIM_PROFILE SET hssState = ? WHERE batchID = ?", state, batchID)
+		return err
+	}, "batchID = ?", batchID)
+}
+
+// UpdatePrimeUploadStateForBatch sets the Prime upload state of all the sim
+// profiles in a batch.
+func (sdb SimBatchDB) UpdatePrimeUploadStateForBatch(batchID int64, state string) error {
+	return sdb.updateAudited(AuditEntitySimProfile, func(tx *sqlx.Tx) error {
+		_, err := execQuery(tx, "UPDATE SIM_PROFILE SET primeUploadState = ? WHERE batchID = ?", state, batchID)
+		return err
+	}, "batchID = ?", batchID)
+}
+
+// CreateDownloadProgressEvent persists a download progress event
+// received from an SM-DP+.
+func (sdb SimBatchDB) CreateDownloadProgressEvent(theEvent *model.DownloadProgressEvent) error {
+	return createDownloadProgressEvent(sdb.Db, theEvent)
+}
+
+func createDownloadProgressEvent(ext sqlx.Ext, theEvent *model.DownloadProgressEvent) error {
+	id, err := namedInsert(ext, `
+       INSERT INTO DOWNLOAD_PROGRESS_EVENT (simProfileID,  iccid,  eid,  notificationPointId,  status,  timestamp,  functionCallIdentifier)
+                                    VALUES (:simProfileID, :iccid, :eid, :notificationPointId, :status, :timestamp, :functionCallIdentifier)`,
+		theEvent)
+	if err != nil {
+		return err
+	}
+	theEvent.ID = id
+	return nil
+}
+
+// RecordDownloadProgress persists a download progress event and, unless it
+// is empty, the SM-DP+ state the event tells the sim profile has reached,
+// in one transaction.  The SM-DP+ resends a notification with the same
+// function call identifier until it gets an answer, so an event with the
+// identifier of one already recorded for the profile is ignored.  The
+// return value tells if the event was recorded.
+func (sdb SimBatchDB) RecordDownloadProgress(theEvent *model.DownloadProgressEvent, state string) (bool, error) {
+	recorded := false
+	err := sdb.withTx(func(tx *sqlx.Tx) error {
+		var seen int
+		err := getQuery(tx, &seen, "SELECT COUNT(*) FROM DOWNLOAD_PROGRESS_EVENT WHERE iccid = ? AND functionCallIdentifier = ?",
+			theEvent.Iccid, theEvent.FunctionCallIdentifier)
+		if err != nil || seen > 0 {
+			return err
+		}
+		if err := createDownloadProgressEvent(tx, theEvent); err != nil {
+			return err
+		}
+		if state != "" {
+			err := auditedUpdate(tx, AuditEntitySimProfile, func() error {
+				return updateSmdpState(tx, "statusUpdatedAt", theEvent.Iccid, state, theEvent.Eid, theEvent.Timestamp)
+			}, "iccid = ?", theEvent.Iccid)
+			if err != nil {
+				return err
+			}
+		}
+		recorded = true
+		return nil
+	})
+	if err != nil {
+		theEvent.ID = 0
+		return false, err
+	}
+	return recorded, nil
+}
+
+// GetDownloadProgressEventsForSimProfile retrieves all the download progress
+// events recorded for a sim profile, in the order they were received.
+func (sdb SimBatchDB) GetDownloadProgressEventsForSimProfile(simID int64) ([]model.DownloadProgressEvent, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.DownloadProgressEvent{}
+	return result, selectQuery(sdb.Db, &result, "SELECT * FROM DOWNLOAD_PROGRESS_EVENT WHERE simProfileID = ? ORDER BY id", simID)
+}
+
+// CreateJob persists a job, along with a pending item for each of the
+// ICCIDs it is to process, in a single transaction.
+func (sdb SimBatchDB) CreateJob(theJob *model.Job, iccids []string) error {
+	var id int64
+	err := sdb.withTx(func(tx *sqlx.Tx) error {
+		var err error
+		id, err = namedInsert(tx, `
+       INSERT INTO JOB (type,  batchName,  profileVendor,  parameters,  operator,  state,  startedAt,  endedAt)
+                VALUES (:type, :batchName, :profileVendor, :parameters, :operator, :state, :startedAt, :endedAt)`,
+			theJob)
+		if err != nil {
+			return fmt.Errorf("failed to insert new job '%s'", err)
+		}
+
+		for _, iccid := range iccids {
+			_, err := execQuery(tx, "INSERT INTO JOB_ITEM (jobID, iccid, state) VALUES (?, ?, ?)", id, iccid, model.JobItemPending)
+			if err != nil {
+				return fmt.Errorf("failed to insert item '%s' of job %d '%s'", iccid, id, err)
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	foo = `DROP  TABLE SIM_PROFILE`
-	_, err = sdb.Db.Exec(foo)
+	theJob.ID = id
+	return nil
+}
+
+// GetAllJobs returns all the jobs, most recent first.
+func (sdb SimBatchDB) GetAllJobs() ([]model.Job, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.Job{}
+	return result, selectQuery(sdb.Db, &result, "SELECT * FROM JOB ORDER BY id DESC")
+}
+
+// GetJobByID returns the job with the given id, or nil if there is
+// no such job.
+func (sdb SimBatchDB) GetJobByID(id int64) (*model.Job, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.Job{}
+	if err := selectQuery(sdb.Db, &result, "SELECT * FROM JOB WHERE id = ?", id); err != nil {
+		return nil, err
+	} else if len(result) == 0 {
+		return nil, nil
+	} else {
+		return &(result[0]), nil
+	}
+}
+
+// UpdateJobState sets the state of a job, and the time it ended, which
+// is empty while it is running.
+func (sdb SimBatchDB) UpdateJobState(id int64, state string, endedAt string) error {
+	_, err := namedExec(sdb.Db, "UPDATE JOB SET state = :state, endedAt = :endedAt WHERE id = :id",
+		map[string]interface{}{
+			"id":      id,
+			"state":   state,
+			"endedAt": endedAt,
+		})
+	return err
+}
+
+// GetJobItems returns the items of a job, in the order they were created.
+func (sdb SimBatchDB) GetJobItems(jobID int64) ([]model.JobItem, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.JobItem{}
+	return result, selectQuery(sdb.Db, &result, "SELECT * FROM JOB_ITEM WHERE jobID = ? ORDER BY id", jobID)
+}
+
+// UpdateJobItem records the outcome of a job for a single item.  It is
+// committed at once, so that the outcome survives if the job doesn't.
+func (sdb SimBatchDB) UpdateJobItem(item *model.JobItem) error {
+	_, err := namedExec(sdb.Db, "UPDATE JOB_ITEM SET state = :state, output = :output, error = :error, updatedAt = :updatedAt WHERE id = :id",
+		item)
 	return err
 }
 
+// The tables used by the store package, each before the tables its
+// foreign keys refer to.
+var tablesInDropOrder = []string{
+	"DOWNLOAD_PROGRESS_EVENT",
+	"JOB_ITEM",
+	"JOB",
+	"SIM_PROFILE",
+	"BATCH",
+	"PROFILE_VENDOR_ENDPOINT",
+	"PROFILE_VENDOR",
+	"AUDIT_LOG",
+	"SCHEMA_VERSION",
+}
+
+// DropTables Drop all tables used by the store package, referring
+// tables first, so that foreign keys don't get in the way.
+func (sdb *SimBatchDB) DropTables() error {
+	for _, table := range tablesInDropOrder {
+		if _, err := execQuery(sdb.Db, "DROP TABLE "+table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // DeclareBatch generates a batch instance  by first checking all of its
 // parameters, and then storing it, and finally returning it from the function.
 func (sdb SimBatchDB) DeclareBatch(
@@ -426,7 +896,7 @@ func (sdb SimBatchDB) DeclareBatch(
 	profileVendor string,
 	initialHlrActivationStatusOfProfiles string) (*model.Batch, error) {
 
-	log.Println("Declaring batch ...")
+	logging.With(logging.FieldBatch, name, logging.FieldVendor, profileVendor).Infof("Declaring batch")
 
 	vendor, err := sdb.GetProfileVendorByName(profileVendor)
 	if err != nil {
@@ -498,11 +968,8 @@ func (sdb SimBatchDB) DeclareBatch(
 	// values.
 	// TODO: Perhaps use some varargs trick of some sort here?
 	if loltelutils.Abs(msisdnLen) != loltelutils.Abs(iccidlen) || loltelutils.Abs(msisdnLen) != loltelutils.Abs(imsiLen) || batchLength != loltelutils.Abs(imsiLen) {
-		log.Printf("msisdnLen   = %10d\n", msisdnLen)
-		log.Printf("iccidLen    = %10d\n", iccidlen)
-		log.Printf("imsiLen     = %10d\n", imsiLen)
-		log.Printf("batchLength = %10d\n", batchLength)
-		log.Fatal("FATAL: msisdnLen, iccidLen and imsiLen are not identical.")
+		logging.With(logging.FieldBatch, name).Fatalf("msisdnLen (%d), iccidLen (%d), imsiLen (%d) and batchLength (%d) are not identical.",
+			msisdnLen, iccidlen, imsiLen, batchLength)
 	}
 
 	tail := flag.Args()
@@ -530,74 +997,65 @@ func (sdb SimBatchDB) DeclareBatch(
 		ProfileVendor:   profileVendor,
 	}
 
-	tx := sdb.Begin()
-
-	// This variable should be se to "true" if all transactions
-	// were successful, otherwise it will be rolled back.
-	weCool := false
-
-	defer func() {
-		if weCool {
-			err := tx.Commit()
-			if err != nil {
-				panic(err)
-			}
-		} else {
-			err := tx.Rollback()
-			if err != nil {
-				panic(err)
-			}
+	// The batch and all its sim profiles are created, or none of them
+	// are.  The profile that couldn't be created, if any, is explained
+	// after the transaction has been rolled back.
+	var failedEntry *model.SimEntry
+	err = sdb.withTx(func(tx *sqlx.Tx) error {
+		// Persist the newly created batch,
+		if err := createBatch(tx, &batch); err != nil {
+			return batchConstraintError(&batch, err)
 		}
-	}()
 
-	// Persist the newly created batch,
-	if err = sdb.CreateBatch(&batch); err != nil {
-		return nil, err
-	}
+		imsi, err := strconv.Atoi(batch.FirstImsi)
+		if err != nil {
+			return err
+		}
 
-	imsi, err := strconv.Atoi(batch.FirstImsi)
-	if err != nil {
-		return nil, err
-	}
+		// Now create all the sim profiles
 
-	// Now create all the sim profiles
+		iccidWithoutLuhnChecksum := firstIccidInt
 
-	iccidWithoutLuhnChecksum := firstIccidInt
+		// XXX !!! TODO THis is wrong, but I'm doing it now, just to get started!
+		var msisdn, err2 = strconv.Atoi(batch.FirstMsisdn)
+		if err2 != nil {
+			return err2
+		}
 
-	// XXX !!! TODO THis is wrong, but I'm doing it now, just to get started!
-	var msisdn, err2 = strconv.Atoi(batch.FirstMsisdn)
-	if err2 != nil {
-		return nil, err
-	}
+		for i := 0; i < batch.Quantity; i++ {
 
-	for i := 0; i < batch.Quantity; i++ {
+			iccidWithLuhnChecksum := fmt.Sprintf("%d%d", iccidWithoutLuhnChecksum, fieldsyntaxchecks.LuhnChecksum(iccidWithoutLuhnChecksum))
 
-		iccidWithLuhnChecksum := fmt.Sprintf("%d%d", iccidWithoutLuhnChecksum, fieldsyntaxchecks.LuhnChecksum(iccidWithoutLuhnChecksum))
+			simEntry := &model.SimEntry{
+				BatchID:              batch.BatchID,
+				ActivationCode:       "",
+				RawIccid:             fmt.Sprintf("%d", iccidWithoutLuhnChecksum),
+				IccidWithChecksum:    iccidWithLuhnChecksum,
+				IccidWithoutChecksum: fmt.Sprintf("%d", iccidWithoutLuhnChecksum),
+				Iccid:                iccidWithLuhnChecksum,
+				Imsi:                 fmt.Sprintf("%d", imsi),
+				Msisdn:               fmt.Sprintf("%d", msisdn),
+				Ki:                   "", // Should be null
+			}
 
-		simEntry := &model.SimEntry{
-			BatchID:              batch.BatchID,
-			ActivationCode:       "",
-			RawIccid:             fmt.Sprintf("%d", iccidWithoutLuhnChecksum),
-			IccidWithChecksum:    iccidWithLuhnChecksum,
-			IccidWithoutChecksum: fmt.Sprintf("%d", iccidWithoutLuhnChecksum),
-			Iccid:                iccidWithLuhnChecksum,
-			Imsi:                 fmt.Sprintf("%d", imsi),
-			Msisdn:               fmt.Sprintf("%d", msisdn),
-			Ki:                   "", // Should be null
-		}
+			if err = createSimEntry(tx, simEntry); err != nil {
+				failedEntry = simEntry
+				return err
+			}
 
-		if err = sdb.CreateSimEntry(simEntry); err != nil {
-			return nil, err
+			iccidWithoutLuhnChecksum += batch.IccidIncrement
+			imsi += batch.ImsiIncrement
+			msisdn += batch.MsisdnIncrement
 		}
-
-		iccidWithoutLuhnChecksum += batch.IccidIncrement
-		imsi += batch.ImsiIncrement
-		msisdn += batch.MsisdnIncrement
+		return nil
+	})
+	if failedEntry != nil {
+		return nil, sdb.simEntryConstraintError(failedEntry, err)
+	}
+	if err != nil {
+		return nil, err
 	}
-
-	// Signal to deferred function that we're ready to commit.
-	weCool = true
 
 	//  Return the newly created batch
-	return &batch, err
+	return &batch, nil
 }
@@ -51,7 +51,22 @@ func setup() {
 
 func cleanTables() {
 	fmt.Println("Cleaning tables ...")
-	_, err := sdb.Db.Exec("DELETE FROM SIM_PROFILE")
+	_, err := sdb.Db.Exec("DELETE FROM DOWNLOAD_PROGRESS_EVENT")
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't delete DOWNLOAD_PROGRESS_EVENT  '%s'", err))
+	}
+
+	_, err = sdb.Db.Exec("DELETE FROM JOB_ITEM")
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't delete JOB_ITEM  '%s'", err))
+	}
+
+	_, err = sdb.Db.Exec("DELETE FROM JOB")
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't delete JOB  '%s'", err))
+	}
+
+	_, err = sdb.Db.Exec("DELETE FROM SIM_PROFILE")
 	if err != nil {
 		panic(fmt.Sprintf("Couldn't delete SIM_PROFILE  '%s'", err))
 	}
@@ -61,6 +76,11 @@ func cleanTables() {
 		panic(fmt.Sprintf("Couldn't delete BATCH  '%s'", err))
 	}
 
+	_, err = sdb.Db.Exec("DELETE FROM PROFILE_VENDOR_ENDPOINT")
+	if err != nil {
+		panic(fmt.Sprintf("Couldn't delete PROFILE_VENDOR_ENDPOINT  '%s'", err))
+	}
+
 	_, err = sdb.Db.Exec("DELETE FROM PROFILE_VENDOR")
 	if err != nil {
 		panic(fmt.Sprintf("Couldn't delete PROFILE_VENDOR  '%s'", err))
@@ -149,6 +169,7 @@ func TestGetAllBatches(t *testing.T) {
 
 	assert.Equal(t, len(allBatches), 0)
 
+	injectTestprofileVendor(t)
 	theBatch := injectTestBatch()
 
 	allBatches, err = sdb.GetAllBatches()
@@ -194,6 +215,7 @@ func declareTestBatch(t *testing.T) *model.Batch {
 }
 
 func TestDeclareBatch(t *testing.T) {
+	cleanTables()
 	injectTestprofileVendor(t)
 	theBatch := declareTestBatch(t)
 
@@ -214,6 +236,37 @@ func TestDeclareBatch(t *testing.T) {
 	// TODO: Add check for content of retrieved entity
 }
 
+func TestDeclareBatchReportsConstraintViolations(t *testing.T) {
+	cleanTables()
+	injectTestprofileVendor(t)
+	declareTestBatch(t)
+
+	declare := func(name string, iccid string, imsi string) error {
+		_, err := sdb.DeclareBatch(name, false, "Customer", "8778fsda", "20200101",
+			iccid, iccid, imsi, imsi, "47900185", "47900185",
+			"BAR_FOOTEL_STD", "1", "LOL", "localhost", "8088", "Durian", "ACTIVE")
+		return err
+	}
+
+	assert.ErrorContains(t, declare("Name", "89148000000745809021", "242017100012214"),
+		"a batch named 'Name' already exists")
+	assert.ErrorContains(t, declare("Other", "89148000000745809013", "242017100012214"),
+		"ICCID '89148000000745809013' is already used by batch 'Name'")
+	assert.ErrorContains(t, declare("Other", "89148000000745809021", "242017100012213"),
+		"IMSI '242017100012213' is already used by ICCID '89148000000745809013' in batch 'Name'")
+
+	// Nothing is left of a batch that couldn't be declared.
+	other, err := sdb.GetBatchByName("Other")
+	assert.NilError(t, err)
+	assert.Assert(t, other == nil)
+	assert.NilError(t, declare("Other", "89148000000745809021", "242017100012214"))
+
+	err = sdb.CreateBatch(&model.Batch{Name: "Orphan", ProfileVendor: "Jackfruit"})
+	assert.ErrorContains(t, err, "unknown profile vendor: 'Jackfruit'")
+	err = sdb.CreateSimEntry(&model.SimEntry{BatchID: 4711, Iccid: "89148000000745809039", Imsi: "242017100012215"})
+	assert.ErrorContains(t, err, "there is no batch with id 4711")
+}
+
 //noinspection GoUnusedParameter
 func injectTestprofileVendor(t *testing.T) *model.ProfileVendor {
 	v := &model.ProfileVendor{
@@ -223,6 +276,14 @@ func injectTestprofileVendor(t *testing.T) *model.ProfileVendor {
 		Es2PlusHost:        "host",
 		Es2PlusPort:        4711,
 		Es2PlusRequesterID: "1.2.3",
+
+		Es2PlusMaxIccidsPerRequest: 100,
+		Es2PlusTimeoutSeconds:      30,
+		Es2PlusPinnedSpkiSha256:    "sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+		Es2PlusServerName:          "smdp.example.com",
+		Es2PlusRequestsPerSecond:   2.5,
+		Es2PlusMaxInFlight:         8,
+		Es2PlusProtocolVersion:     "2.0.0",
 	}
 
 	if err := sdb.CreateProfileVendor(v); err != nil {
@@ -256,6 +317,81 @@ func TestDeclareAndRetrieveProfileVendorEntry(t *testing.T) {
 	}
 }
 
+func TestUpdateProfileVendorRateLimits(t *testing.T) {
+	cleanTables()
+
+	v := injectTestprofileVendor(t)
+	if err := sdb.UpdateProfileVendorRateLimits(v.ID, 10, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	retrievedVendor, err := sdb.GetProfileVendorByID(v.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 10.0, retrievedVendor.Es2PlusRequestsPerSecond)
+	assert.Equal(t, 4, retrievedVendor.Es2PlusMaxInFlight)
+}
+
+func TestUpdateProfileVendorProtocol(t *testing.T) {
+	cleanTables()
+
+	v := injectTestprofileVendor(t)
+	assert.NilError(t, sdb.UpdateProfileVendorProtocol(v.ID, "2.2.0", "sgp22"))
+
+	retrievedVendor, err := sdb.GetProfileVendorByID(v.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, "2.2.0", retrievedVendor.Es2PlusProtocolVersion)
+	assert.Equal(t, "sgp22", retrievedVendor.Es2PlusDialect)
+}
+
+func TestUpdateProfileVendorCertificate(t *testing.T) {
+	cleanTables()
+
+	v := injectTestprofileVendor(t)
+	v.Es2PlusCert = "new-cert"
+	v.Es2PlusKey = "new-key"
+	v.Es2PlusCertSubject = "CN=durian"
+	v.Es2PlusCertIssuer = "CN=durian-ca"
+	v.Es2PlusCertSerial = "1267"
+	v.Es2PlusCertNotAfter = "2030-01-01T00:00:00Z"
+	assert.NilError(t, sdb.UpdateProfileVendorCertificate(v))
+
+	vendors, err := sdb.GetAllProfileVendors()
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(vendors))
+	assert.DeepEqual(t, *v, vendors[0])
+}
+
+func TestProfileVendorEndpoints(t *testing.T) {
+	cleanTables()
+
+	v := injectTestprofileVendor(t)
+	dr := &model.ProfileVendorEndpoint{ProfileVendorID: v.ID, Position: -1, Host: "dr-host", Port: 4711}
+	assert.NilError(t, sdb.CreateProfileVendorEndpoint(dr))
+	first := &model.ProfileVendorEndpoint{ProfileVendorID: v.ID, Position: 0, Host: "first-host", Port: 4711}
+	assert.NilError(t, sdb.CreateProfileVendorEndpoint(first))
+
+	// The same endpoint can't be added twice.
+	assert.Assert(t, sdb.CreateProfileVendorEndpoint(&model.ProfileVendorEndpoint{ProfileVendorID: v.ID, Position: -1, Host: "dr-host", Port: 4711}) != nil)
+
+	assert.NilError(t, sdb.UpdateProfileVendorEndpointHealth(dr.ID, "2019-12-01T10:11:12Z", "connection refused"))
+
+	endpoints, err := sdb.GetProfileVendorEndpoints(v.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, len(endpoints))
+	assert.Equal(t, "first-host", endpoints[0].Host)
+	assert.Equal(t, "host", endpoints[1].Host)
+	assert.Equal(t, "dr-host", endpoints[2].Host)
+	assert.Equal(t, "connection refused", endpoints[2].LastError)
+
+	assert.NilError(t, sdb.DeleteProfileVendorEndpoint(first.ID))
+	endpoints, err = sdb.GetProfileVendorEndpoints(v.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(endpoints))
+	assert.Equal(t, "host", endpoints[0].Host)
+}
+
 func TestDeclareAndRetrieveSimEntries(t *testing.T) {
 	cleanTables()
 	injectTestprofileVendor(t)
@@ -331,3 +467,240 @@ func TestSimBatchDB_UpdateSimEntryKi(t *testing.T) {
 		t.Fatalf("Retrieved (%s) and stored  (%s) ki values are different", retrivedEntry.Ki, newKi)
 	}
 }
+
+func TestUpdateSimEntriesInOneGo(t *testing.T) {
+	cleanTables()
+	injectTestprofileVendor(t)
+	theBatch := declareTestBatch(t)
+	entries, err := sdb.GetAllSimEntriesForBatch(theBatch.BatchID)
+	assert.NilError(t, err)
+	entry := entries[0]
+
+	assert.NilError(t, sdb.UpdateSimEntryMsisdns([]model.SimEntry{{ID: entry.ID, Msisdn: "4790099"}}))
+	assert.NilError(t, sdb.UpdateSimEntryKis([]model.SimEntry{{ID: entry.ID, Ki: "A1B2C3"}}))
+	assert.NilError(t, sdb.UpdateSimEntryMsisdns(nil))
+
+	updated, err := sdb.GetSimEntryByID(entry.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, "4790099", updated.Msisdn)
+	assert.Equal(t, "A1B2C3", updated.Ki)
+}
+
+func TestSimProfileLifecycleState(t *testing.T) {
+	cleanTables()
+	injectTestprofileVendor(t)
+	theBatch := declareTestBatch(t)
+	iccid := "89148000000745809013"
+	eid := "89049032123451234512345678901235"
+
+	assert.NilError(t, sdb.UpdateSmdpStatuses([]model.SimEntry{
+		{Iccid: iccid, SmdpState: "DOWNLOADED", Eid: eid, LockFlag: true, StatusUpdatedAt: "2020-01-01T10:11:12Z"},
+		{Iccid: "89148000000745809021", SmdpState: "RELEASED"},
+	}))
+	entry, err := sdb.GetSimProfileByIccid(iccid)
+	assert.NilError(t, err)
+	assert.Equal(t, "DOWNLOADED", entry.SmdpState)
+	assert.Equal(t, eid, entry.Eid)
+	assert.Equal(t, true, entry.LockFlag)
+	assert.Equal(t, "2020-01-01T10:11:12Z", entry.StatusUpdatedAt)
+
+	// A state change that doesn't tell the EID keeps the one known.
+	assert.NilError(t, sdb.UpdateSmdpState(iccid, "INSTALLED", "", "2020-01-01T10:12:00Z"))
+	assert.NilError(t, sdb.UpdateHssStateForBatch(theBatch.BatchID, model.HssStateFileWritten))
+	assert.NilError(t, sdb.UpdatePrimeUploadStateForBatch(theBatch.BatchID, model.PrimeUploadStateScriptGenerated))
+	entry, err = sdb.GetSimProfileByIccid(iccid)
+	assert.NilError(t, err)
+	assert.Equal(t, "INSTALLED", entry.SmdpState)
+	assert.Equal(t, eid, entry.Eid)
+	assert.Equal(t, true, entry.LockFlag)
+	assert.Equal(t, "2020-01-01T10:11:12Z", entry.StatusUpdatedAt)
+	assert.Equal(t, "2020-01-01T10:12:00Z", entry.StateChangedAt)
+	assert.Equal(t, model.HssStateFileWritten, entry.HssState)
+	assert.Equal(t, model.PrimeUploadStateScriptGenerated, entry.PrimeUploadState)
+
+	// Statuses older than the one the SM-DP+ last reported, e.g. from a
+	// getProfileStatus response overtaken by a notification, and changes
+	// older than the last one made, don't set the profile back.
+	assert.NilError(t, sdb.UpdateSmdpStatuses([]model.SimEntry{
+		{Iccid: iccid, SmdpState: "AVAILABLE", StatusUpdatedAt: "2020-01-01T10:11:00Z"},
+	}))
+	assert.NilError(t, sdb.UpdateSmdpState(iccid, "DOWNLOADED", "", "2020-01-01T11:11:59+01:00"))
+	entry, err = sdb.GetSimProfileByIccid(iccid)
+	assert.NilError(t, err)
+	assert.Equal(t, "INSTALLED", entry.SmdpState)
+	assert.Equal(t, eid, entry.Eid)
+	assert.Equal(t, "2020-01-01T10:11:12Z", entry.StatusUpdatedAt)
+	assert.Equal(t, "2020-01-01T10:12:00Z", entry.StateChangedAt)
+
+	// The clock of the SM-DP+ needn't agree with the local one, so what
+	// it reports isn't compared with the changes made through ES2+.
+	assert.NilError(t, sdb.UpdateSmdpStatuses([]model.SimEntry{
+		{Iccid: iccid, SmdpState: "RELEASED", Eid: eid, StatusUpdatedAt: "2020-01-01T10:11:30Z"},
+	}))
+	entry, err = sdb.GetSimProfileByIccid(iccid)
+	assert.NilError(t, err)
+	assert.Equal(t, "RELEASED", entry.SmdpState)
+	assert.Equal(t, "2020-01-01T10:11:30Z", entry.StatusUpdatedAt)
+	assert.Equal(t, "2020-01-01T10:12:00Z", entry.StateChangedAt)
+}
+
+func TestDownloadProgressEvents(t *testing.T) {
+	cleanTables()
+	injectTestprofileVendor(t)
+	theBatch := declareTestBatch(t)
+
+	entries, err := sdb.GetAllSimEntriesForBatch(theBatch.BatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(entries))
+	simProfile := entries[0]
+
+	for _, notificationPointID := range []int{3, 4} {
+		event := model.DownloadProgressEvent{
+			SimProfileID:           simProfile.ID,
+			Iccid:                  simProfile.Iccid,
+			Eid:                    "89049032123451234512345678901235",
+			NotificationPointID:    notificationPointID,
+			Status:                 "Executed-Success",
+			Timestamp:              "2019-11-29T10:12:13Z",
+			FunctionCallIdentifier: fmt.Sprintf("call-%d", notificationPointID),
+		}
+		if err := sdb.CreateDownloadProgressEvent(&event); err != nil {
+			t.Fatal(err)
+		}
+		assert.Assert(t, event.ID != 0)
+	}
+
+	events, err := sdb.GetDownloadProgressEventsForSimProfile(simProfile.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, 3, events[0].NotificationPointID)
+	assert.Equal(t, 4, events[1].NotificationPointID)
+	assert.Equal(t, simProfile.Iccid, events[1].Iccid)
+}
+
+func TestRecordingDownloadProgress(t *testing.T) {
+	cleanTables()
+	injectTestprofileVendor(t)
+	theBatch := declareTestBatch(t)
+	entries, err := sdb.GetAllSimEntriesForBatch(theBatch.BatchID)
+	assert.NilError(t, err)
+	simProfile := entries[0]
+
+	event := model.DownloadProgressEvent{
+		SimProfileID:           simProfile.ID,
+		Iccid:                  simProfile.Iccid,
+		Eid:                    "89049032123451234512345678901235",
+		NotificationPointID:    4,
+		Status:                 "Executed-Success",
+		Timestamp:              "2019-11-29T10:12:13Z",
+		FunctionCallIdentifier: "call-4",
+	}
+
+	// A change made through ES2+ by a local clock that is ahead doesn't
+	// keep the notification from being recorded.
+	assert.NilError(t, sdb.UpdateSmdpState(simProfile.Iccid, "RELEASED", "", "2019-11-29T12:00:00Z"))
+	recorded, err := sdb.RecordDownloadProgress(&event, "INSTALLED")
+	assert.NilError(t, err)
+	assert.Assert(t, recorded)
+	assert.Assert(t, event.ID != 0)
+
+	// The SM-DP+ resending the notification changes nothing.
+	again := event
+	again.ID = 0
+	recorded, err = sdb.RecordDownloadProgress(&again, "INSTALLED")
+	assert.NilError(t, err)
+	assert.Assert(t, !recorded)
+
+	events, err := sdb.GetDownloadProgressEventsForSimProfile(simProfile.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(events))
+	entry, err := sdb.GetSimProfileByIccid(simProfile.Iccid)
+	assert.NilError(t, err)
+	assert.Equal(t, "INSTALLED", entry.SmdpState)
+	assert.Equal(t, event.Eid, entry.Eid)
+	assert.Equal(t, event.Timestamp, entry.StatusUpdatedAt)
+}
+
+func TestDropTablesOfPopulatedDatabase(t *testing.T) {
+	cleanTables()
+	vendor := injectTestprofileVendor(t)
+	theBatch := declareTestBatch(t)
+	entries, err := sdb.GetAllSimEntriesForBatch(theBatch.BatchID)
+	assert.NilError(t, err)
+	assert.NilError(t, sdb.CreateDownloadProgressEvent(&model.DownloadProgressEvent{SimProfileID: entries[0].ID, Iccid: entries[0].Iccid}))
+	assert.NilError(t, sdb.CreateProfileVendorEndpoint(&model.ProfileVendorEndpoint{ProfileVendorID: vendor.ID, Position: -1, Host: "backup.example.com", Port: 4711}))
+	assert.NilError(t, sdb.CreateJob(&model.Job{Type: "batch-activate-all-profiles", ProfileVendor: vendor.Name, State: model.JobRunning}, []string{entries[0].Iccid}))
+
+	// Put the tables back for the tests that come after.
+	defer func() { assert.NilError(t, sdb.GenerateTables()) }()
+	assert.NilError(t, sdb.DropTables())
+	for _, table := range tablesInDropOrder {
+		var rows int
+		assert.Assert(t, sdb.Db.Get(&rows, "SELECT COUNT(*) FROM "+table) != nil, "%s wasn't dropped", table)
+	}
+}
+
+func TestJobsAndTheirItems(t *testing.T) {
+	cleanTables()
+
+	job := model.Job{
+		Type:          "iccids-bulk-activate",
+		ProfileVendor: "Durian",
+		Parameters:    `{"iccidFile":"iccids.txt"}`,
+		Operator:      "ops",
+		State:         model.JobRunning,
+		StartedAt:     "2019-12-01T10:00:00Z",
+	}
+	iccids := []string{"8947000000000010003", "8947000000000010011"}
+	if err := sdb.CreateJob(&job, iccids); err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, job.ID != 0)
+
+	items, err := sdb.GetJobItems(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(items))
+	assert.Equal(t, iccids[0], items[0].Iccid)
+	assert.Equal(t, model.JobItemPending, items[1].State)
+
+	items[0].State = model.JobItemSucceeded
+	items[0].Output = "8947000000000010003, LPA:1$smdp.example.com$ABC"
+	items[0].UpdatedAt = "2019-12-01T10:00:01Z"
+	if err := sdb.UpdateJobItem(&items[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sdb.UpdateJobState(job.ID, model.JobInterrupted, "2019-12-01T10:00:02Z"); err != nil {
+		t.Fatal(err)
+	}
+
+	retrieved, err := sdb.GetJobByID(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, model.JobInterrupted, retrieved.State)
+	assert.Equal(t, "2019-12-01T10:00:02Z", retrieved.EndedAt)
+	assert.Equal(t, job.Parameters, retrieved.Parameters)
+
+	items, err = sdb.GetJobItems(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, model.JobItemSucceeded, items[0].State)
+	assert.Equal(t, model.JobItemPending, items[1].State)
+
+	jobs, err := sdb.GetAllJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(jobs))
+
+	missing, err := sdb.GetJobByID(job.ID + 1)
+	assert.NilError(t, err)
+	assert.Assert(t, missing == nil)
+}